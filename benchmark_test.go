@@ -4,11 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"crypto/rand"
 	_ "embed"
 	"encoding/binary"
+	"encoding/json"
 	"io"
 	"net"
+	"runtime"
 	"testing"
+	"time"
 
 	klauspost "github.com/klauspost/compress/flate"
 	"github.com/marifcelik/gws/internal"
@@ -55,6 +59,30 @@ func BenchmarkConn_WriteMessage(b *testing.B) {
 			_ = conn.WriteMessage(OpcodeText, githubData)
 		}
 	})
+
+	b.Run("compress adaptive", func(b *testing.B) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, &ServerOption{
+			PermessageDeflate: PermessageDeflate{
+				Enabled:         true,
+				PoolSize:        64,
+				AdaptiveEnabled: true,
+			},
+		})
+		var config = upgrader.option.getConfig()
+		var pd = upgrader.option.PermessageDeflate
+		var conn = &Conn{
+			conn:     &benchConn{},
+			pd:       pd,
+			config:   config,
+			deflater: upgrader.deflaterPool.Select(),
+			sampler:  newCompressSampler(pd),
+		}
+		var payload = make([]byte, len(githubData))
+		_, _ = rand.Read(payload)
+		for i := 0; i < b.N; i++ {
+			_ = conn.WriteMessage(OpcodeBinary, payload)
+		}
+	})
 }
 
 func BenchmarkConn_ReadMessage(b *testing.B) {
@@ -68,7 +96,7 @@ func BenchmarkConn_ReadMessage(b *testing.B) {
 			conn:     &benchConn{},
 			config:   upgrader.option.getConfig(),
 		}
-		var buf, _ = conn1.genFrame(OpcodeText, internal.Bytes(githubData), false)
+		var buf, _ = conn1.genFrame(OpcodeText, internal.Bytes(githubData), WriteOptions{}, false)
 
 		var reader = bytes.NewBuffer(buf.Bytes())
 		var conn2 = &Conn{
@@ -98,7 +126,7 @@ func BenchmarkConn_ReadMessage(b *testing.B) {
 			deflater: new(deflater),
 		}
 		conn1.deflater.initialize(false, conn1.pd, config.ReadMaxPayloadSize)
-		var buf, _ = conn1.genFrame(OpcodeText, internal.Bytes(githubData), false)
+		var buf, _ = conn1.genFrame(OpcodeText, internal.Bytes(githubData), WriteOptions{}, false)
 
 		var reader = bytes.NewBuffer(buf.Bytes())
 		var conn2 = &Conn{
@@ -118,6 +146,153 @@ func BenchmarkConn_ReadMessage(b *testing.B) {
 	})
 }
 
+func BenchmarkConn_WriteJSON(b *testing.B) {
+	var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+	var conn = &Conn{
+		conn:   &benchConn{},
+		config: upgrader.option.getConfig(),
+	}
+	var value = map[string]any{"id": 1, "name": "caster", "tags": []string{"gws", "websocket"}}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p, _ := json.Marshal(value)
+			_ = conn.WriteMessage(OpcodeText, p)
+		}
+	})
+
+	b.Run("codec", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = WriteJSON(conn, value)
+		}
+	})
+}
+
+// 上下文接管模式下每个连接的滑动窗口内存
+func BenchmarkConn_CompressionMemory(b *testing.B) {
+	var upgrader = NewUpgrader(&BuiltinEventHandler{}, &ServerOption{
+		PermessageDeflate: PermessageDeflate{
+			Enabled:               true,
+			ServerContextTakeover: true,
+			ClientContextTakeover: true,
+		},
+	})
+	var config = upgrader.option.getConfig()
+	var pd = upgrader.option.PermessageDeflate
+	var newConn = func() *Conn {
+		var conn = &Conn{
+			isServer: true,
+			conn:     &benchConn{},
+			pd:       pd,
+			config:   config,
+			deflater: upgrader.deflaterPool.Select(),
+		}
+		conn.cpsWindow.initialize(config.cswPool, pd.ServerMaxWindowBits)
+		conn.dpsWindow.initialize(config.dswPool, pd.ClientMaxWindowBits)
+		return conn
+	}
+	var run = func(b *testing.B, active bool, shrink bool) {
+		var total = 0
+		for i := 0; i < b.N; i++ {
+			var conn = newConn()
+			if active {
+				_ = conn.WriteMessage(OpcodeText, githubData)
+			}
+			if shrink {
+				conn.ShrinkWindow()
+			}
+			total += conn.CompressionMemory()
+		}
+		b.ReportMetric(float64(total)/float64(b.N), "window-B/conn")
+	}
+
+	b.Run("idle", func(b *testing.B) { run(b, false, false) })
+	b.Run("active", func(b *testing.B) { run(b, true, false) })
+	b.Run("shrink", func(b *testing.B) { run(b, true, true) })
+}
+
+// 空闲连接的堆内存, 对比空闲模式归还读缓冲区和滑动窗口前后的差异
+func BenchmarkConn_IdleMemory(b *testing.B) {
+	const count = 100000
+	var pd = PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+	var heap = func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapInuse
+	}
+	var run = func(b *testing.B, timeout time.Duration) {
+		var option = initServerOption(&ServerOption{PermessageDeflate: pd, IdleReleaseTimeout: timeout})
+		var config = option.getConfig()
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, option)
+		var total uint64
+		for i := 0; i < b.N; i++ {
+			var before = heap()
+			var clients = make([]net.Conn, 0, count)
+			for j := 0; j < count; j++ {
+				s, c := net.Pipe()
+				var br = config.brPool.Get()
+				br.Reset(s)
+				var socket = serveWebSocket(true, config, newSmap(), s, br, &BuiltinEventHandler{}, false, "", option.PermessageDeflate)
+				socket.deflater = upgrader.deflaterPool.Select()
+				socket.cpsWindow.initialize(config.cswPool, pd.ServerMaxWindowBits)
+				socket.dpsWindow.initialize(config.dswPool, pd.ClientMaxWindowBits)
+				socket.cpsWindow.alloc()
+				go socket.ReadLoop()
+				clients = append(clients, c)
+			}
+			time.Sleep(timeout + time.Second)
+			total += heap() - before
+			for _, c := range clients {
+				_ = c.Close()
+			}
+		}
+		b.ReportMetric(float64(total)/float64(b.N*count), "heap-B/conn")
+	}
+
+	b.Run("baseline", func(b *testing.B) { run(b, 0) })
+	b.Run("idle release", func(b *testing.B) { run(b, 100*time.Millisecond) })
+}
+
+// 高频小消息的异步写入, 对比合并写入前后的吞吐
+func BenchmarkConn_WriteAsync(b *testing.B) {
+	var run = func(b *testing.B, coalesce bool) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				_, _ = io.Copy(io.Discard, conn)
+			}
+		}()
+		netConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		var option = initServerOption(&ServerOption{WriteCoalesceEnabled: coalesce})
+		var conn = serveWebSocket(true, option.getConfig(), newSmap(), netConn, nil, &BuiltinEventHandler{}, false, "", option.PermessageDeflate)
+		var payload = []byte("hello, world!")
+		var done = make(chan struct{})
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			conn.WriteAsync(OpcodeText, payload, nil)
+		}
+		conn.WriteAsync(OpcodeText, payload, func(err error) { close(done) })
+		<-done
+		b.StopTimer()
+		_ = netConn.Close()
+	}
+
+	b.Run("default", func(b *testing.B) { run(b, false) })
+	b.Run("coalesce", func(b *testing.B) { run(b, true) })
+}
+
 func BenchmarkStdCompress(b *testing.B) {
 	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
 	contents := githubData
@@ -24,6 +24,8 @@ type connector struct {
 	conn            net.Conn
 	eventHandler    Event
 	secWebsocketKey string
+	extensions      []Extension
+	zstd            *zstdExtension // 这次握手独占的zstd拓展
 }
 
 // NewClient 创建客户端
@@ -96,8 +98,8 @@ func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	r.Header.Set(internal.Connection.Key, internal.Connection.Val)
 	r.Header.Set(internal.Upgrade.Key, internal.Upgrade.Val)
 	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
-	if c.option.PermessageDeflate.Enabled {
-		r.Header.Set(internal.SecWebSocketExtensions.Key, c.option.PermessageDeflate.genRequestHeader())
+	if offers := c.getOffers(); len(offers) > 0 {
+		r.Header.Set(internal.SecWebSocketExtensions.Key, joinExtensions(offers))
 	}
 	if c.secWebsocketKey == "" {
 		var key [16]byte
@@ -128,24 +130,43 @@ func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	return resp, br, err
 }
 
-func (c *connector) getPermessageDeflate(extensions string) PermessageDeflate {
-	serverPD := permessageNegotiation(extensions)
-	clientPD := c.option.PermessageDeflate
-	pd := PermessageDeflate{
-		Enabled:               clientPD.Enabled && strings.Contains(extensions, internal.PermessageDeflate),
-		Threshold:             clientPD.Threshold,
-		Level:                 clientPD.Level,
-		PoolSize:              clientPD.PoolSize,
-		ServerContextTakeover: serverPD.ServerContextTakeover,
-		ClientContextTakeover: serverPD.ClientContextTakeover,
-		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
-		ClientMaxWindowBits:   serverPD.ClientMaxWindowBits,
-	}
-	pd.setThreshold(false)
-	return pd
+// 初始化客户端启用的拓展, 按照偏好顺序排列: permessage-zstd, permessage-deflate, 自定义拓展
+func (c *connector) initExtensions() error {
+	c.extensions = c.extensions[:0]
+	if c.option.PermessageZstd.Enabled {
+		ext, err := newZstdExtension(c.option.PermessageZstd, c.option.ReadMaxPayloadSize, false)
+		if err != nil {
+			return err
+		}
+		c.zstd = ext
+		c.extensions = append(c.extensions, ext)
+	}
+	if c.option.PermessageDeflate.Enabled {
+		c.extensions = append(c.extensions, &deflateExtension{option: &c.option.PermessageDeflate})
+	}
+	c.extensions = append(c.extensions, c.option.Extensions...)
+	return nil
+}
+
+func (c *connector) getOffers() []ExtensionParams {
+	var offers = make([]ExtensionParams, 0, len(c.extensions))
+	for _, ext := range c.extensions {
+		offers = append(offers, ext.Offer())
+	}
+	return offers
 }
 
-func (c *connector) handshake() (*Conn, *http.Response, error) {
+func (c *connector) handshake() (socket *Conn, resp *http.Response, err error) {
+	if err = c.initExtensions(); err != nil {
+		return nil, nil, err
+	}
+	// 握手失败或者没有协商zstd时, 立即释放zstd拓展; 否则由连接关闭时释放
+	defer func() {
+		if c.zstd != nil && (err != nil || !c.zstd.confirmed) {
+			c.zstd.close()
+		}
+	}()
+
 	resp, br, err := c.request()
 	if err != nil {
 		return nil, resp, err
@@ -158,13 +179,19 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 		return nil, resp, err
 	}
 
-	var extensions = resp.Header.Get(internal.SecWebSocketExtensions.Key)
-	var pd = c.getPermessageDeflate(extensions)
-	socket := &Conn{
+	extensions, err := confirmExtensions(c.extensions, resp.Header.Get(internal.SecWebSocketExtensions.Key))
+	if err != nil {
+		return nil, resp, err
+	}
+	var pd = extensions.pd
+	socket = &Conn{
 		ss:                c.option.NewSession(),
 		isServer:          false,
 		subprotocol:       subprotocol,
+		codec:             selectCodec(c.option.Codecs, subprotocol),
 		pd:                pd,
+		rsv:               extensions.rsv,
+		extensions:        extensions.sessions,
 		conn:              c.conn,
 		config:            c.option.getConfig(),
 		br:                br,
@@ -174,10 +201,14 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 		closed:            0,
 		deflater:          new(deflater),
 		writeQueue:        workerQueue{maxConcurrency: 1},
+		controlQueue:      workerQueue{maxConcurrency: 1},
 		readQueue:         make(channel, c.option.ParallelGolimit),
 	}
 	if pd.Enabled {
 		socket.deflater.initialize(false, pd, c.option.ReadMaxPayloadSize)
+		if pd.AdaptiveEnabled {
+			socket.sampler = newCompressSampler(pd)
+		}
 		if pd.ServerContextTakeover {
 			socket.dpsWindow.initialize(nil, pd.ServerMaxWindowBits)
 		}
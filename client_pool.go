@@ -0,0 +1,416 @@
+package gws
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultClientPoolSize          = 4
+	defaultClientPoolPingInterval  = 10 * time.Second
+	defaultClientPoolRetryInterval = time.Second
+)
+
+// ErrClientPoolClosed 连接池已关闭
+// Client pool closed
+var ErrClientPoolClosed = errors.New("gws: client pool closed")
+
+// PoolStrategy 连接选择策略
+// Connection selection strategy
+type PoolStrategy uint8
+
+const (
+	// PoolRoundRobin 轮询
+	// Pick connections in turn
+	PoolRoundRobin PoolStrategy = iota
+
+	// PoolLeastPending 选择待发送任务最少的连接
+	// Pick the connection with the fewest pending writes
+	PoolLeastPending
+)
+
+type ClientPoolOption struct {
+	// 每个地址保持的连接数量
+	// Number of live connections kept per address
+	Size int
+
+	// 连接选择策略
+	// Connection selection strategy
+	Strategy PoolStrategy
+
+	// 心跳间隔
+	// Interval between health-check pings
+	PingInterval time.Duration
+
+	// 心跳超时, 超过该时长没有收到任何帧的连接会被关闭并重建, 默认为3倍心跳间隔
+	// Connections that receive no frame within this duration are closed and replaced, 3 * PingInterval by default.
+	PingTimeout time.Duration
+
+	// 重连间隔
+	// Interval between reconnection attempts
+	RetryInterval time.Duration
+
+	// 根据地址生成客户端配置, Addr字段会被覆盖
+	// Build the client option for an address, the Addr field is overwritten.
+	NewClientOption func(addr string) *ClientOption
+}
+
+func initClientPoolOption(c *ClientPoolOption) *ClientPoolOption {
+	if c == nil {
+		c = new(ClientPoolOption)
+	}
+	if c.Size <= 0 {
+		c.Size = defaultClientPoolSize
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = defaultClientPoolPingInterval
+	}
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = 3 * c.PingInterval
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultClientPoolRetryInterval
+	}
+	if c.NewClientOption == nil {
+		c.NewClientOption = func(addr string) *ClientOption { return new(ClientOption) }
+	}
+	return c
+}
+
+// ClientPool 客户端连接池
+// 按地址维护固定数量的长连接, 定时发送心跳, 自动替换断开的连接.
+// Keeps a fixed number of live connections per address, pings them periodically and replaces broken ones.
+type ClientPool struct {
+	mu      sync.Mutex
+	option  *ClientPoolOption
+	handler Event
+	groups  map[string]*clientGroup
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewClientPool 创建客户端连接池
+// 所有连接共用同一个事件处理器, 连接的ReadLoop由连接池负责启动.
+// Create a client pool. All connections share the same event handler, the pool starts their ReadLoop.
+func NewClientPool(handler Event, option *ClientPoolOption) *ClientPool {
+	c := &ClientPool{
+		option:  initClientPoolOption(option),
+		handler: handler,
+		groups:  make(map[string]*clientGroup),
+		closed:  make(chan struct{}),
+	}
+	go c.heartbeat()
+	return c
+}
+
+func (c *ClientPool) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get 获取一个可用连接, 首次访问某个地址时会同步建立连接
+// Get a live connection. The first call for an address dials synchronously.
+func (c *ClientPool) Get(addr string) (*Conn, error) {
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil, ErrClientPoolClosed
+	}
+	group, ok := c.groups[addr]
+	if !ok {
+		group = &clientGroup{pool: c, addr: addr}
+		c.groups[addr] = group
+	}
+	c.mu.Unlock()
+
+	if err := group.initialize(); err != nil {
+		return nil, err
+	}
+	if socket := group.pick(c.option.Strategy); socket != nil {
+		return socket, nil
+	}
+	return nil, ErrConnClosed
+}
+
+// Remove 关闭并移除某个地址的全部连接
+// Close and remove all connections of an address
+func (c *ClientPool) Remove(addr string) {
+	c.mu.Lock()
+	group, ok := c.groups[addr]
+	delete(c.groups, addr)
+	c.mu.Unlock()
+
+	if ok {
+		group.close()
+	}
+}
+
+// Close 关闭连接池和全部连接
+// Close the pool and all of its connections
+func (c *ClientPool) Close() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		var groups = c.groups
+		c.groups = make(map[string]*clientGroup)
+		c.mu.Unlock()
+
+		for _, group := range groups {
+			group.close()
+		}
+	})
+}
+
+func (c *ClientPool) getGroups() []*clientGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var groups = make([]*clientGroup, 0, len(c.groups))
+	for _, group := range c.groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// 心跳检测
+func (c *ClientPool) heartbeat() {
+	var ticker = time.NewTicker(c.option.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			for _, group := range c.getGroups() {
+				group.healthCheck(c.option.PingTimeout)
+			}
+		}
+	}
+}
+
+type clientGroup struct {
+	mu     sync.RWMutex
+	pool   *ClientPool
+	addr   string
+	once   sync.Once
+	err    error
+	closed uint32
+	serial uint64
+	slots  []*clientSlot
+}
+
+// 建立初始连接, 只要有一个连接成功就视为可用.
+// 槽位在拨号之前发布, 拨号期间关闭分组也能找到并关闭新建的连接.
+func (c *clientGroup) initialize() error {
+	c.once.Do(func() {
+		var size = c.pool.option.Size
+		var slots = make([]*clientSlot, size)
+		for i := range slots {
+			slots[i] = &clientSlot{group: c}
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+
+		var errs = make([]error, size)
+		var wg sync.WaitGroup
+		wg.Add(size)
+		for i := 0; i < size; i++ {
+			go func(i int) {
+				errs[i] = slots[i].dial()
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+
+		var failures = 0
+		for _, err := range errs {
+			if err != nil {
+				failures++
+				c.err = err
+			}
+		}
+
+		// 全部失败时丢弃该分组, 下次Get重新拨号
+		if failures == size {
+			c.pool.mu.Lock()
+			if c.pool.groups[c.addr] == c {
+				delete(c.pool.groups, c.addr)
+			}
+			c.pool.mu.Unlock()
+			return
+		}
+
+		c.err = nil
+		for i, err := range errs {
+			if err != nil {
+				go slots[i].redial()
+			}
+		}
+	})
+	return c.err
+}
+
+func (c *clientGroup) isClosed() bool {
+	return atomic.LoadUint32(&c.closed) == 1 || c.pool.isClosed()
+}
+
+func (c *clientGroup) getSlots() []*clientSlot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots
+}
+
+func (c *clientGroup) pick(strategy PoolStrategy) *Conn {
+	var slots = c.getSlots()
+	var n = uint64(len(slots))
+	if n == 0 {
+		return nil
+	}
+
+	if strategy == PoolLeastPending {
+		var result *Conn
+		var minPending = math.MaxInt
+		for _, slot := range slots {
+			if socket := slot.get(); socket != nil {
+				if pending := socket.writeQueue.Len(); pending < minPending {
+					result, minPending = socket, pending
+				}
+			}
+		}
+		return result
+	}
+
+	var offset = atomic.AddUint64(&c.serial, 1)
+	for i := uint64(0); i < n; i++ {
+		if socket := slots[(offset+i)%n].get(); socket != nil {
+			return socket
+		}
+	}
+	return nil
+}
+
+func (c *clientGroup) healthCheck(timeout time.Duration) {
+	var deadline = time.Now().Add(-1 * timeout).UnixNano()
+	for _, slot := range c.getSlots() {
+		var socket = slot.get()
+		if socket == nil {
+			continue
+		}
+		if atomic.LoadInt64(&slot.lastActive) < deadline {
+			_ = socket.NetConn().Close()
+			continue
+		}
+		socket.WriteAsync(OpcodePing, nil, nil)
+	}
+}
+
+func (c *clientGroup) close() {
+	atomic.StoreUint32(&c.closed, 1)
+	for _, slot := range c.getSlots() {
+		if socket := slot.get(); socket != nil {
+			socket.WriteClose(1000, nil)
+		}
+	}
+}
+
+// clientSlot 连接槽位, 同时作为连接的事件处理器, 转发事件到用户的处理器
+type clientSlot struct {
+	lastActive int64 // 最近一次收到帧的时间
+	mu         sync.Mutex
+	group      *clientGroup
+	socket     *Conn
+}
+
+func (c *clientSlot) get() *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.socket == nil || c.socket.isClosed() {
+		return nil
+	}
+	return c.socket
+}
+
+func (c *clientSlot) touch() { atomic.StoreInt64(&c.lastActive, time.Now().UnixNano()) }
+
+func (c *clientSlot) dial() error {
+	var option = c.group.pool.option.NewClientOption(c.group.addr)
+	if option == nil {
+		option = new(ClientOption)
+	}
+	option.Addr = c.group.addr
+	socket, _, err := NewClient(c, option)
+	if err != nil {
+		return err
+	}
+
+	// 分组在拨号期间被关闭. 关闭分组时先设置标记再遍历槽位, 所以在锁内检查不会遗漏.
+	c.mu.Lock()
+	if c.group.isClosed() {
+		c.mu.Unlock()
+		socket.WriteClose(1000, nil)
+		return ErrClientPoolClosed
+	}
+	c.socket = socket
+	c.mu.Unlock()
+	c.touch()
+	go socket.ReadLoop()
+	return nil
+}
+
+// 不断重连直到成功或者连接池被关闭
+func (c *clientSlot) redial() {
+	var interval = c.group.pool.option.RetryInterval
+	for !c.group.isClosed() {
+		if err := c.dial(); err == nil {
+			return
+		}
+		select {
+		case <-c.group.pool.closed:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *clientSlot) OnOpen(socket *Conn) {
+	c.touch()
+	c.group.pool.handler.OnOpen(socket)
+}
+
+func (c *clientSlot) OnClose(socket *Conn, err error) {
+	c.group.pool.handler.OnClose(socket, err)
+
+	c.mu.Lock()
+	var replace = c.socket == socket
+	if replace {
+		c.socket = nil
+	}
+	c.mu.Unlock()
+
+	if replace && !c.group.isClosed() {
+		go c.redial()
+	}
+}
+
+func (c *clientSlot) OnPing(socket *Conn, payload []byte) {
+	c.touch()
+	c.group.pool.handler.OnPing(socket, payload)
+}
+
+func (c *clientSlot) OnPong(socket *Conn, payload []byte) {
+	c.touch()
+	c.group.pool.handler.OnPong(socket, payload)
+}
+
+func (c *clientSlot) OnMessage(socket *Conn, message *Message) {
+	c.touch()
+	c.group.pool.handler.OnMessage(socket, message)
+}
@@ -0,0 +1,159 @@
+package gws
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientPool(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("round robin", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(BuiltinEventHandler), nil)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var pool = NewClientPool(new(BuiltinEventHandler), &ClientPoolOption{Size: 3})
+		defer pool.Close()
+
+		var conns = make(map[*Conn]bool)
+		for i := 0; i < 6; i++ {
+			socket, err := pool.Get("ws://localhost" + addr)
+			as.NoError(err)
+			conns[socket] = true
+		}
+		as.Equal(3, len(conns))
+	})
+
+	t.Run("least pending", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(BuiltinEventHandler), nil)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var pool = NewClientPool(new(BuiltinEventHandler), &ClientPoolOption{Size: 2, Strategy: PoolLeastPending})
+		defer pool.Close()
+
+		socket, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		socket.Async(func() { wg.Wait() })
+
+		another, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+		as.False(socket == another)
+		wg.Done()
+	})
+
+	t.Run("replace broken conn", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(BuiltinEventHandler), nil)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var handler = new(webSocketMocker)
+		handler.onOpen = func(socket *Conn) { wg.Done() }
+		var pool = NewClientPool(handler, &ClientPoolOption{Size: 1, RetryInterval: 10 * time.Millisecond})
+		defer pool.Close()
+
+		socket, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+		_ = socket.NetConn().Close()
+		wg.Wait()
+
+		another, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+		as.False(socket == another)
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(webSocketMocker), nil)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var handler = new(webSocketMocker)
+		handler.onClose = func(socket *Conn, err error) { wg.Done() }
+		var pool = NewClientPool(handler, &ClientPoolOption{
+			Size:          1,
+			PingInterval:  20 * time.Millisecond,
+			PingTimeout:   50 * time.Millisecond,
+			RetryInterval: time.Second,
+		})
+		defer pool.Close()
+
+		_, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+		wg.Wait()
+	})
+
+	t.Run("dial failed", func(t *testing.T) {
+		var pool = NewClientPool(new(BuiltinEventHandler), nil)
+		defer pool.Close()
+		_, err := pool.Get("ws://localhost:" + nextPort())
+		as.Error(err)
+		_, err = pool.Get("tcp://localhost:" + nextPort())
+		as.Error(err)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(BuiltinEventHandler), nil)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var pool = NewClientPool(new(BuiltinEventHandler), &ClientPoolOption{Size: 1})
+		socket, err := pool.Get("ws://localhost" + addr)
+		as.NoError(err)
+		pool.Remove("ws://localhost" + addr)
+		time.Sleep(50 * time.Millisecond)
+		as.True(socket.isClosed())
+
+		pool.Close()
+		_, err = pool.Get("ws://localhost" + addr)
+		as.ErrorIs(err, ErrClientPoolClosed)
+	})
+
+	t.Run("close while dialing", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var opened, closed int64
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onOpen = func(socket *Conn) { atomic.AddInt64(&opened, 1) }
+		serverHandler.onClose = func(socket *Conn, err error) { atomic.AddInt64(&closed, 1) }
+		var server = NewServer(serverHandler, &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				time.Sleep(100 * time.Millisecond)
+				return true
+			},
+		})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var pool = NewClientPool(new(BuiltinEventHandler), &ClientPoolOption{Size: 3})
+		var done = make(chan error, 1)
+		go func() {
+			_, err := pool.Get("ws://localhost" + addr)
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		pool.Close()
+		as.ErrorIs(<-done, ErrClientPoolClosed)
+
+		// 拨号期间建立的连接都要被关闭
+		as.Eventually(func() bool {
+			return atomic.LoadInt64(&opened) == 3 && atomic.LoadInt64(&closed) == 3
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,204 @@
+package gws
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/marifcelik/gws/internal"
+)
+
+// ErrUnsupportedType 编解码器不支持该类型
+// The codec does not support the type
+var ErrUnsupportedType = errors.New("gws: unsupported type")
+
+var (
+	// JSONCodec JSON编解码器, 使用文本消息
+	// JSON codec, using text messages
+	JSONCodec Codec = jsonCodec{}
+
+	// BinaryCodec 二进制编解码器, 使用二进制消息.
+	// 支持[]byte, io.WriterTo, encoding.BinaryMarshaler/BinaryUnmarshaler, 以及Marshal/Unmarshal方法(protobuf生成的代码).
+	// Binary codec, using binary messages.
+	// Supports []byte, io.WriterTo, encoding.BinaryMarshaler/BinaryUnmarshaler and Marshal/Unmarshal methods (generated protobuf code).
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// Codec 消息编解码器
+// Message codec
+type Codec interface {
+	// Opcode 编码后的消息使用的操作码
+	// Opcode of the encoded messages
+	Opcode() Opcode
+
+	// Encode 将v编码后追加到buf
+	// Encode v and append it to buf
+	Encode(buf *bytes.Buffer, v any) error
+
+	// Decode 将data解码到v, 不要持有data
+	// Decode data into v, do not retain data
+	Decode(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (c jsonCodec) Opcode() Opcode { return OpcodeText }
+
+func (c jsonCodec) Encode(buf *bytes.Buffer, v any) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// 去掉json.Encoder追加的换行符
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+func (c jsonCodec) Decode(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type (
+	marshaler interface {
+		Marshal() ([]byte, error)
+	}
+
+	unmarshaler interface {
+		Unmarshal(data []byte) error
+	}
+)
+
+type binaryCodec struct{}
+
+func (c binaryCodec) Opcode() Opcode { return OpcodeBinary }
+
+func (c binaryCodec) Encode(buf *bytes.Buffer, v any) error {
+	var p []byte
+	var err error
+	switch value := v.(type) {
+	case []byte:
+		p = value
+	case io.WriterTo:
+		_, err = value.WriteTo(buf)
+		return err
+	case encoding.BinaryMarshaler:
+		p, err = value.MarshalBinary()
+	case marshaler:
+		p, err = value.Marshal()
+	default:
+		return ErrUnsupportedType
+	}
+	if err != nil {
+		return err
+	}
+	buf.Write(p)
+	return nil
+}
+
+func (c binaryCodec) Decode(data []byte, v any) error {
+	switch value := v.(type) {
+	case *[]byte:
+		*value = append((*value)[:0], data...)
+		return nil
+	case encoding.BinaryUnmarshaler:
+		return value.UnmarshalBinary(data)
+	case unmarshaler:
+		return value.Unmarshal(data)
+	default:
+		return ErrUnsupportedType
+	}
+}
+
+// 获取子协议对应的编解码器, 没有配置时使用JSON
+func selectCodec(codecs map[string]Codec, subprotocol string) Codec {
+	if codec, ok := codecs[subprotocol]; ok {
+		return codec
+	}
+	return JSONCodec
+}
+
+// encodedPayload 编解码器直接写入的帧缓冲区, 缓冲区头部预留了帧头的空间.
+// 不需要压缩和拓展变换时, genFrame直接复用该缓冲区, 避免再次拷贝.
+type encodedPayload struct {
+	buf *bytes.Buffer
+}
+
+func newEncodedPayload(codec Codec, v any) (*encodedPayload, error) {
+	var buf = binaryPool.Get(512)
+	buf.Write(framePadding[0:])
+	if err := codec.Encode(buf, v); err != nil {
+		binaryPool.Put(buf)
+		return nil, err
+	}
+	return &encodedPayload{buf: buf}, nil
+}
+
+func (c *encodedPayload) Bytes() []byte { return c.buf.Bytes()[frameHeaderSize:] }
+
+func (c *encodedPayload) Len() int { return c.buf.Len() - frameHeaderSize }
+
+func (c *encodedPayload) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(c.Bytes())
+	return int64(n), err
+}
+
+func (c *encodedPayload) CheckEncoding(enabled bool, opcode uint8) bool {
+	if enabled {
+		return internal.CheckEncoding(opcode, c.Bytes())
+	}
+	return true
+}
+
+// 转移缓冲区的所有权
+func (c *encodedPayload) take() *bytes.Buffer {
+	var buf = c.buf
+	c.buf = nil
+	return buf
+}
+
+// Close 回收缓冲区, 所有权已经转移时什么也不做
+func (c *encodedPayload) Close() {
+	if c.buf != nil {
+		binaryPool.Put(c.buf)
+		c.buf = nil
+	}
+}
+
+// Codec 获取连接按照子协议协商的编解码器
+// Get the codec selected by the negotiated subprotocol
+func (c *Conn) Codec() Codec {
+	return internal.SelectValue(c.codec == nil, JSONCodec, c.codec)
+}
+
+// WriteValue 使用连接的编解码器编码并写入消息, 操作码由编解码器决定
+// Encode v with the codec of the connection and write it, the opcode is decided by the codec.
+func WriteValue(socket *Conn, v any) error {
+	return WriteCodec(socket, socket.Codec(), v)
+}
+
+// WriteJSON 使用JSON编码并写入文本消息
+// Encode v as JSON and write a text message
+func WriteJSON(socket *Conn, v any) error {
+	return WriteCodec(socket, JSONCodec, v)
+}
+
+// WriteCodec 使用指定的编解码器编码并写入消息
+// Encode v with the given codec and write it
+func WriteCodec(socket *Conn, codec Codec, v any) error {
+	payload, err := newEncodedPayload(codec, v)
+	if err != nil {
+		return err
+	}
+	err = socket.doWrite(codec.Opcode(), payload, WriteOptions{})
+	payload.Close()
+	socket.emitError(err)
+	return err
+}
+
+// DecodeMessage 使用连接的编解码器解码消息, T不应该是指针类型
+// Decode the message with the codec of the connection, T should not be a pointer type.
+func DecodeMessage[T any](msg *Message) (T, error) {
+	var v T
+	var codec = internal.SelectValue(msg.codec == nil, JSONCodec, msg.codec)
+	err := codec.Decode(msg.Bytes(), &v)
+	return v, err
+}
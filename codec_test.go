@@ -0,0 +1,200 @@
+package gws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecUser struct {
+	ID   uint32 `json:"id"`
+	Name string `json:"name"`
+}
+
+// MarshalBinary 实现encoding.BinaryMarshaler
+func (c codecUser) MarshalBinary() ([]byte, error) {
+	var p = make([]byte, 4, 4+len(c.Name))
+	binary.BigEndian.PutUint32(p, c.ID)
+	return append(p, c.Name...), nil
+}
+
+func (c *codecUser) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	c.ID = binary.BigEndian.Uint32(data)
+	c.Name = string(data[4:])
+	return nil
+}
+
+// codecProto 模拟protobuf生成的代码
+type codecProto struct{ Value string }
+
+func (c codecProto) Marshal() ([]byte, error) { return []byte(c.Value), nil }
+
+func (c *codecProto) Unmarshal(data []byte) error {
+	c.Value = string(data)
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("json", func(t *testing.T) {
+		var buf = bytes.NewBuffer(nil)
+		as.NoError(JSONCodec.Encode(buf, codecUser{ID: 1, Name: "caster"}))
+		as.Equal(`{"id":1,"name":"caster"}`, buf.String())
+		var user codecUser
+		as.NoError(JSONCodec.Decode(buf.Bytes(), &user))
+		as.Equal("caster", user.Name)
+		as.Error(JSONCodec.Encode(buf, make(chan int)))
+		as.Equal(OpcodeText, JSONCodec.Opcode())
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		var buf = bytes.NewBuffer(nil)
+		as.NoError(BinaryCodec.Encode(buf, codecUser{ID: 2, Name: "gws"}))
+		var user codecUser
+		as.NoError(BinaryCodec.Decode(buf.Bytes(), &user))
+		as.Equal(codecUser{ID: 2, Name: "gws"}, user)
+
+		buf.Reset()
+		as.NoError(BinaryCodec.Encode(buf, codecProto{Value: "proto"}))
+		var msg codecProto
+		as.NoError(BinaryCodec.Decode(buf.Bytes(), &msg))
+		as.Equal("proto", msg.Value)
+
+		buf.Reset()
+		as.NoError(BinaryCodec.Encode(buf, []byte("raw")))
+		as.NoError(BinaryCodec.Encode(buf, bytes.NewBufferString("!")))
+		var p []byte
+		as.NoError(BinaryCodec.Decode(buf.Bytes(), &p))
+		as.Equal("raw!", string(p))
+
+		as.ErrorIs(BinaryCodec.Encode(buf, 1), ErrUnsupportedType)
+		var n int
+		as.ErrorIs(BinaryCodec.Decode(buf.Bytes(), &n), ErrUnsupportedType)
+		as.Equal(OpcodeBinary, BinaryCodec.Opcode())
+	})
+}
+
+func TestWriteCodec(t *testing.T) {
+	var as = assert.New(t)
+
+	var test = func(t *testing.T, serverOption *ServerOption, clientOption *ClientOption) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan *Message, 4)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(WriteJSON(server, codecUser{ID: 1, Name: "caster"}))
+		var msg = <-received
+		as.Equal(OpcodeText, msg.Opcode)
+		user, err := DecodeMessage[codecUser](msg)
+		as.NoError(err)
+		as.Equal(codecUser{ID: 1, Name: "caster"}, user)
+
+		as.NoError(WriteCodec(server, BinaryCodec, codecUser{ID: 2, Name: "gws"}))
+		msg = <-received
+		as.Equal(OpcodeBinary, msg.Opcode)
+		msg.codec = BinaryCodec
+		user, err = DecodeMessage[codecUser](msg)
+		as.NoError(err)
+		as.Equal(codecUser{ID: 2, Name: "gws"}, user)
+
+		var encodeErr = WriteJSON(server, make(chan int))
+		as.Error(encodeErr)
+		as.False(server.isClosed())
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		test(t, &ServerOption{}, &ClientOption{})
+	})
+
+	t.Run("compress", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+		test(t, &ServerOption{PermessageDeflate: pd}, &ClientOption{PermessageDeflate: pd})
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go client.ReadLoop()
+		server.WriteClose(1000, nil)
+		as.ErrorIs(WriteJSON(server, codecUser{}), ErrConnClosed)
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		var addr = "127.0.0.1:" + nextPort()
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			user, err := DecodeMessage[codecUser](message)
+			if err != nil {
+				socket.WriteClose(1003, nil)
+				return
+			}
+			user.ID++
+			_ = WriteValue(socket, user)
+		}
+		var codecs = map[string]Codec{"v2.binary": BinaryCodec}
+		var server = NewServer(serverHandler, &ServerOption{SubProtocols: []string{"v1.json", "v2.binary"}, Codecs: codecs})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		for _, subprotocol := range []string{"v1.json", "v2.binary"} {
+			var received = make(chan *Message, 1)
+			var clientHandler = new(webSocketMocker)
+			clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+			var header = http.Header{}
+			header.Set("Sec-WebSocket-Protocol", subprotocol)
+			client, _, err := NewClient(clientHandler, &ClientOption{Addr: "ws://" + addr, RequestHeader: header, Codecs: codecs})
+			if !as.NoError(err) {
+				return
+			}
+			go client.ReadLoop()
+			as.NoError(WriteValue(client, codecUser{ID: 1, Name: subprotocol}))
+			var msg = <-received
+			as.Equal(client.Codec().Opcode(), msg.Opcode)
+			user, err := DecodeMessage[codecUser](msg)
+			as.NoError(err)
+			as.Equal(codecUser{ID: 2, Name: subprotocol}, user)
+			_ = client.NetConn().Close()
+		}
+	})
+
+	t.Run("extension", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan string, 1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		server.rsv = RSV2
+		server.extensions = []*extensionSessionWrapper{{rsv: RSV2, session: new(checksumSession)}}
+		client.extensions = []*extensionSessionWrapper{{rsv: RSV2, session: new(checksumSession)}}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(WriteJSON(client, []int{1, 2, 3}))
+		as.Equal("[1,2,3]", <-received)
+	})
+}
+
+func TestDecodeMessage(t *testing.T) {
+	var as = assert.New(t)
+	var msg = &Message{Opcode: OpcodeText, Data: bytes.NewBufferString(`{"id":3}`)}
+	user, err := DecodeMessage[codecUser](msg)
+	as.NoError(err)
+	as.Equal(uint32(3), user.ID)
+
+	msg = &Message{Opcode: OpcodeText, Data: bytes.NewBufferString(`{`)}
+	_, err = DecodeMessage[codecUser](msg)
+	as.Error(err)
+	as.False(errors.Is(err, ErrUnsupportedType))
+}
@@ -19,12 +19,18 @@ import (
 var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
 
 type deflaterPool struct {
-	serial uint64
-	num    uint64
-	pool   []*deflater
+	serial  uint64
+	num     uint64
+	pool    []*deflater
+	options PermessageDeflate
+	limit   int
+	mu      sync.Mutex // 保证每种窗口大小的压缩器池只创建一次
+	windows sync.Map   // 客户端请求了更小的server_max_window_bits时使用的压缩器, windowBits => *deflaterPool
 }
 
 func (c *deflaterPool) initialize(options PermessageDeflate, limit int) *deflaterPool {
+	c.options = options
+	c.limit = limit
 	c.num = uint64(options.PoolSize)
 	for i := uint64(0); i < c.num; i++ {
 		c.pool = append(c.pool, new(deflater).initialize(true, options, limit))
@@ -37,6 +43,27 @@ func (c *deflaterPool) Select() *deflater {
 	return c.pool[j]
 }
 
+// SelectWindow 按照协商的窗口大小选择压缩器, 非默认窗口大小的压缩器池在第一次使用时创建
+func (c *deflaterPool) SelectWindow(windowBits int) *deflater {
+	if windowBits == c.options.ServerMaxWindowBits {
+		return c.Select()
+	}
+	if v, ok := c.windows.Load(windowBits); ok {
+		return v.(*deflaterPool).Select()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.windows.Load(windowBits); ok {
+		return v.(*deflaterPool).Select()
+	}
+	var options = c.options
+	options.ServerMaxWindowBits = windowBits
+	var pool = new(deflaterPool).initialize(options, c.limit)
+	c.windows.Store(windowBits, pool)
+	return pool.Select()
+}
+
 type deflater struct {
 	dpsLocker sync.Mutex
 	buf       []byte
@@ -107,27 +134,57 @@ func (c *deflater) Compress(src internal.Payload, dst *bytes.Buffer, dict []byte
 	return nil
 }
 
+// slideWindow 上下文接管的滑动窗口
+// 字典在第一条压缩消息到来时才分配, 从未压缩过消息的连接不占用窗口内存.
 type slideWindow struct {
 	enabled bool
+	pool    *internal.Pool[[]byte]
 	dict    []byte
 	size    int
+	memory  int64 // 字典占用的内存, 原子读写
 }
 
 func (c *slideWindow) initialize(pool *internal.Pool[[]byte], windowBits int) *slideWindow {
 	c.enabled = true
+	c.pool = pool
 	c.size = internal.BinaryPow(windowBits)
-	if pool != nil {
-		c.dict = pool.Get()[:0]
+	return c
+}
+
+// 分配字典
+func (c *slideWindow) alloc() {
+	if c.pool != nil {
+		c.dict = c.pool.Get()[:0]
 	} else {
 		c.dict = make([]byte, 0, c.size)
 	}
-	return c
+	atomic.StoreInt64(&c.memory, int64(cap(c.dict)))
+}
+
+// 释放字典, 有内存池时归还到内存池
+func (c *slideWindow) release() {
+	if c.dict == nil {
+		return
+	}
+	if c.pool != nil {
+		c.pool.Put(c.dict)
+	}
+	c.dict = nil
+	atomic.StoreInt64(&c.memory, 0)
+}
+
+// Memory 字典占用的内存
+func (c *slideWindow) Memory() int {
+	return int(atomic.LoadInt64(&c.memory))
 }
 
 func (c *slideWindow) Write(p []byte) (int, error) {
-	if !c.enabled {
+	if !c.enabled || len(p) == 0 {
 		return 0, nil
 	}
+	if c.dict == nil {
+		c.alloc()
+	}
 
 	var total = len(p)
 	var n = total
@@ -153,6 +210,62 @@ func (c *slideWindow) Write(p []byte) (int, error) {
 	return total, nil
 }
 
+// compressSampler 自适应压缩采样器
+// 按操作码统计压缩率, 收益低于下限时暂停压缩, 每隔一定数量的消息重新探测一次.
+type compressSampler struct {
+	minGain       float64
+	probeInterval int
+	states        [3]samplerState // 按操作码索引, 仅数据帧
+}
+
+type samplerState struct {
+	sampled bool    // 是否已有采样
+	paused  bool    // 是否暂停压缩
+	skipped int     // 暂停以来跳过的消息数
+	ratio   float64 // 压缩后长度/原始长度的滑动平均
+}
+
+func newCompressSampler(options PermessageDeflate) *compressSampler {
+	return &compressSampler{
+		minGain:       options.AdaptiveMinGain,
+		probeInterval: options.AdaptiveProbeInterval,
+	}
+}
+
+// Allow 判断是否压缩这条消息
+func (c *compressSampler) Allow(opcode Opcode) bool {
+	var state = &c.states[opcode]
+	if !state.paused {
+		return true
+	}
+	state.skipped++
+	return state.skipped >= c.probeInterval
+}
+
+// Record 记录一次压缩的结果
+func (c *compressSampler) Record(opcode Opcode, rawSize, compressedSize int) {
+	if rawSize <= 0 {
+		return
+	}
+	var state = &c.states[opcode]
+	var ratio = float64(compressedSize) / float64(rawSize)
+	if !state.sampled || state.paused {
+		// 首次采样或者重新探测, 使用新的样本
+		state.ratio = ratio
+		state.sampled = true
+	} else {
+		state.ratio = 0.75*state.ratio + 0.25*ratio
+	}
+	state.paused = 1-state.ratio < c.minGain
+	state.skipped = 0
+}
+
+// Ratio 获取某个操作码的压缩率统计
+func (c *compressSampler) Ratio(opcode Opcode) (ratio float64, paused bool) {
+	var state = &c.states[opcode]
+	return state.ratio, state.paused
+}
+
 func (c *PermessageDeflate) genRequestHeader() string {
 	var options = make([]string, 0, 5)
 	options = append(options, internal.PermessageDeflate)
@@ -192,41 +305,68 @@ func (c *PermessageDeflate) genResponseHeader() string {
 }
 
 // 压缩拓展握手协商
-func permessageNegotiation(str string) PermessageDeflate {
+// 严格按照RFC 7692解析请求或者响应参数, 未知参数, 重复参数和非法取值都视为无效.
+// 请求中的client_max_window_bits可以不带值, 表示客户端支持该参数; 响应中必须带值.
+// Strictly parse an offer or a response according to RFC 7692.
+// Unknown or duplicate parameters and invalid values are rejected.
+func permessageNegotiation(params ExtensionParams, isResponse bool) (PermessageDeflate, error) {
 	var options = PermessageDeflate{
 		ServerContextTakeover: true,
 		ClientContextTakeover: true,
 		ServerMaxWindowBits:   15,
 		ClientMaxWindowBits:   15,
 	}
+	if params.Name != internal.PermessageDeflate {
+		return options, ErrCompressionNegotiation
+	}
+
+	var seen = make(map[string]bool, len(params.Params))
+	for _, item := range params.Params {
+		if seen[item.Key] {
+			return options, ErrCompressionNegotiation
+		}
+		seen[item.Key] = true
 
-	var ss = internal.Split(str, ";")
-	for _, s := range ss {
-		var pair = strings.SplitN(s, "=", 2)
-		switch pair[0] {
-		case internal.PermessageDeflate:
+		switch item.Key {
 		case internal.ServerNoContextTakeover:
+			if item.Value != "" {
+				return options, ErrCompressionNegotiation
+			}
 			options.ServerContextTakeover = false
 		case internal.ClientNoContextTakeover:
+			if item.Value != "" {
+				return options, ErrCompressionNegotiation
+			}
 			options.ClientContextTakeover = false
 		case internal.ServerMaxWindowBits:
-			if len(pair) == 2 {
-				x, _ := strconv.Atoi(pair[1])
-				x = internal.WithDefault(x, 15)
-				options.ServerMaxWindowBits = internal.Min(options.ServerMaxWindowBits, x)
+			bits, ok := parseWindowBits(item.Value)
+			if !ok {
+				return options, ErrCompressionNegotiation
 			}
+			options.ServerMaxWindowBits = bits
 		case internal.ClientMaxWindowBits:
-			if len(pair) == 2 {
-				x, _ := strconv.Atoi(pair[1])
-				x = internal.WithDefault(x, 15)
-				options.ClientMaxWindowBits = internal.Min(options.ClientMaxWindowBits, x)
+			if item.Value == "" && !isResponse {
+				continue
+			}
+			bits, ok := parseWindowBits(item.Value)
+			if !ok {
+				return options, ErrCompressionNegotiation
 			}
+			options.ClientMaxWindowBits = bits
+		default:
+			return options, ErrCompressionNegotiation
 		}
 	}
+	return options, nil
+}
 
-	options.ClientMaxWindowBits = internal.SelectValue(options.ClientMaxWindowBits < 8, 8, options.ClientMaxWindowBits)
-	options.ServerMaxWindowBits = internal.SelectValue(options.ServerMaxWindowBits < 8, 8, options.ServerMaxWindowBits)
-	return options
+// 解析窗口大小, 取值范围[8, 15], 不允许前导零和符号
+func parseWindowBits(s string) (int, bool) {
+	x, err := strconv.Atoi(s)
+	if err != nil || x < 8 || x > 15 || strconv.Itoa(x) != s {
+		return 0, false
+	}
+	return x, true
 }
 
 func limitReader(r io.Reader, limit int) io.Reader { return &limitedReader{R: r, M: limit} }
@@ -1,8 +1,12 @@
 package gws
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,9 +60,73 @@ func TestSlideWindow(t *testing.T) {
 	})
 }
 
+func TestSlideWindow_Lazy(t *testing.T) {
+	var as = assert.New(t)
+	var pool = internal.NewPool[[]byte](func() []byte { return make([]byte, 0, 1024) })
+	var sw = new(slideWindow).initialize(pool, 10)
+	as.Nil(sw.dict)
+	as.Equal(0, sw.Memory())
+
+	sw.Write(nil)
+	as.Nil(sw.dict)
+	sw.Write([]byte("hello"))
+	as.Equal("hello", string(sw.dict))
+	as.Equal(1024, sw.Memory())
+
+	sw.release()
+	as.Nil(sw.dict)
+	as.Equal(0, sw.Memory())
+	sw.release()
+	sw.Write([]byte("world"))
+	as.Equal("world", string(sw.dict))
+}
+
+func TestConn_ShrinkWindow(t *testing.T) {
+	var as = assert.New(t)
+	var pd = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   12,
+		ClientMaxWindowBits:   12,
+		Threshold:             1,
+	}
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan string, 8)
+	clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+	server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+	client.dpsWindow.initialize(nil, server.pd.ServerMaxWindowBits)
+	client.cpsWindow.initialize(nil, server.pd.ClientMaxWindowBits)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.Equal(0, server.CompressionMemory())
+	as.Equal(0, client.CompressionMemory())
+
+	var messages = []string{"hello, world!", "hello, gws!", "hello, world!", "hello, gws!"}
+	for i, item := range messages {
+		if i == 2 {
+			server.ShrinkWindow()
+			as.Equal(0, server.CompressionMemory())
+		}
+		as.NoError(server.WriteString(item))
+		as.Equal(item, <-received)
+		as.Equal(4096, server.CompressionMemory())
+	}
+	as.Equal(4096, client.CompressionMemory())
+	as.Equal("hello, world!hello, gws!", string(server.cpsWindow.dict))
+	as.Equal(strings.Join(messages, ""), string(client.dpsWindow.dict))
+}
+
 func TestNegotiation(t *testing.T) {
+	var parse = func(s string, isResponse bool) (PermessageDeflate, error) {
+		return permessageNegotiation(ParseExtensions(s)[0], isResponse)
+	}
+
 	t.Run("", func(t *testing.T) {
-		var pd = permessageNegotiation("permessage-deflate; client_no_context_takeover; client_max_window_bits=9")
+		pd, err := parse("permessage-deflate; client_no_context_takeover; client_max_window_bits=9", false)
+		assert.NoError(t, err)
 		assert.Equal(t, pd.ClientMaxWindowBits, 9)
 		assert.Equal(t, pd.ServerMaxWindowBits, 15)
 		assert.True(t, pd.ServerContextTakeover)
@@ -66,12 +134,154 @@ func TestNegotiation(t *testing.T) {
 	})
 
 	t.Run("", func(t *testing.T) {
-		var pd = permessageNegotiation("permessage-deflate; client_max_window_bits=9; server_max_window_bits=10")
+		pd, err := parse("permessage-deflate; client_max_window_bits=9; server_max_window_bits=10", false)
+		assert.NoError(t, err)
 		assert.Equal(t, pd.ClientMaxWindowBits, 9)
 		assert.Equal(t, pd.ServerMaxWindowBits, 10)
 		assert.True(t, pd.ServerContextTakeover)
 		assert.True(t, pd.ClientContextTakeover)
 	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var offers = []string{
+			"permessage-deflate; server_max_window_bits",
+			"permessage-deflate; server_max_window_bits=7",
+			"permessage-deflate; server_max_window_bits=16",
+			"permessage-deflate; server_max_window_bits=010",
+			"permessage-deflate; server_max_window_bits=+10",
+			"permessage-deflate; client_max_window_bits=abc",
+			"permessage-deflate; server_no_context_takeover=1",
+			"permessage-deflate; client_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_max_window_bits=10; server_max_window_bits=11",
+			"permessage-deflate; x-unknown",
+			"x-webkit-deflate-frame",
+		}
+		for _, item := range offers {
+			_, err := parse(item, false)
+			assert.ErrorIs(t, err, ErrCompressionNegotiation, item)
+		}
+
+		_, err := parse("permessage-deflate; client_max_window_bits", false)
+		assert.NoError(t, err)
+		_, err = parse("permessage-deflate; client_max_window_bits", true)
+		assert.ErrorIs(t, err, ErrCompressionNegotiation)
+		_, err = parse(`permessage-deflate; client_max_window_bits="10"`, true)
+		assert.NoError(t, err)
+	})
+}
+
+// 服务端协商矩阵
+func TestDeflateExtension_Accept(t *testing.T) {
+	var option = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   12,
+		ClientMaxWindowBits:   12,
+	}
+	var ext = &deflateExtension{option: &option}
+
+	var cases = []struct {
+		offer    string
+		ok       bool
+		response string
+	}{
+		{"permessage-deflate", true, "permessage-deflate; client_no_context_takeover; server_max_window_bits=12"},
+		{"permessage-deflate; client_max_window_bits", true, "permessage-deflate; server_max_window_bits=12; client_max_window_bits=12"},
+		{"permessage-deflate; client_max_window_bits=10", true, "permessage-deflate; server_max_window_bits=12; client_max_window_bits=10"},
+		{"permessage-deflate; client_max_window_bits=15", true, "permessage-deflate; server_max_window_bits=12; client_max_window_bits=12"},
+		{"permessage-deflate; server_max_window_bits=9; client_max_window_bits", true, "permessage-deflate; server_max_window_bits=9; client_max_window_bits=12"},
+		{"permessage-deflate; server_max_window_bits=15; client_max_window_bits", true, "permessage-deflate; server_max_window_bits=12; client_max_window_bits=12"},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover", true, "permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=12"},
+		{"permessage-deflate; server_max_window_bits", false, ""},
+		{"permessage-deflate; client_max_window_bits=20", false, ""},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", false, ""},
+	}
+	for _, item := range cases {
+		response, session, err := ext.Accept(ParseExtensions(item.offer)[0])
+		if !item.ok {
+			assert.ErrorIs(t, err, ErrCompressionNegotiation, item.offer)
+			continue
+		}
+		if assert.NoError(t, err, item.offer) {
+			assert.Equal(t, item.response, response.String(), item.offer)
+			var pd = session.(*deflateSession).pd
+			assert.Equal(t, pd, mustConfirm(t, item.response, pd), item.offer)
+		}
+	}
+
+	t.Run("preference order", func(t *testing.T) {
+		var result = acceptExtensions(
+			[]Extension{ext},
+			"permessage-deflate; server_max_window_bits=7, permessage-deflate; server_max_window_bits=10, permessage-deflate",
+		)
+		assert.True(t, result.pd.Enabled)
+		assert.Equal(t, 10, result.pd.ServerMaxWindowBits)
+		assert.Equal(t, 1, len(result.responses))
+	})
+
+	t.Run("decline", func(t *testing.T) {
+		var result = acceptExtensions([]Extension{ext}, "permessage-deflate; x-unknown, permessage-deflate; server_max_window_bits=1")
+		assert.False(t, result.pd.Enabled)
+		assert.Equal(t, 0, len(result.responses))
+	})
+}
+
+// 服务端的响应在客户端看来应该得到相同的协商结果
+func mustConfirm(t *testing.T, response string, serverPD PermessageDeflate) PermessageDeflate {
+	var option = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   15,
+		ClientMaxWindowBits:   15,
+		Threshold:             serverPD.Threshold,
+	}
+	session, err := (&deflateExtension{option: &option}).Confirm(ParseExtensions(response)[0])
+	assert.NoError(t, err)
+	return session.(*deflateSession).pd
+}
+
+// 客户端协商矩阵
+func TestDeflateExtension_Confirm(t *testing.T) {
+	var option = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: false,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   10,
+		ClientMaxWindowBits:   15,
+	}
+	var ext = &deflateExtension{option: &option}
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; server_max_window_bits=10; client_max_window_bits", ext.Offer().String())
+
+	var cases = []struct {
+		response string
+		ok       bool
+	}{
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=10", true},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=9; client_max_window_bits=11", true},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=8; client_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10", true},
+		{"permessage-deflate; server_no_context_takeover", false},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=11", false},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=10; client_max_window_bits", false},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=10; x-unknown", false},
+	}
+	for _, item := range cases {
+		_, err := ext.Confirm(ParseExtensions(item.response)[0])
+		if item.ok {
+			assert.NoError(t, err, item.response)
+		} else {
+			assert.ErrorIs(t, err, ErrCompressionNegotiation, item.response)
+		}
+	}
+
+	t.Run("client bits not offered", func(t *testing.T) {
+		var option = PermessageDeflate{Enabled: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+		var ext = &deflateExtension{option: &option}
+		_, err := ext.Confirm(ParseExtensions("permessage-deflate; client_max_window_bits=10")[0])
+		assert.ErrorIs(t, err, ErrCompressionNegotiation)
+	})
 }
 
 func TestPermessageNegotiation(t *testing.T) {
@@ -218,6 +428,49 @@ func TestPermessageNegotiation(t *testing.T) {
 		assert.Equal(t, string(client.cpsWindow.dict), "hello, world!")
 	})
 
+	t.Run("client requested window", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var serverHandler = &webSocketMocker{}
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		var server = NewServer(serverHandler, &ServerOption{PermessageDeflate: PermessageDeflate{
+			Enabled:               true,
+			ServerContextTakeover: true,
+			ClientContextTakeover: true,
+			ServerMaxWindowBits:   12,
+			ClientMaxWindowBits:   12,
+		}})
+		go server.Run(addr)
+
+		time.Sleep(100 * time.Millisecond)
+		var received = make(chan string, 8)
+		var clientHandler = &webSocketMocker{}
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		client, resp, err := NewClient(clientHandler, &ClientOption{
+			Addr: "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{
+				Enabled:               true,
+				ServerContextTakeover: true,
+				ClientContextTakeover: true,
+				ServerMaxWindowBits:   9,
+				ClientMaxWindowBits:   10,
+			},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "permessage-deflate; server_max_window_bits=9; client_max_window_bits=10", resp.Header.Get(internal.SecWebSocketExtensions.Key))
+		assert.Equal(t, 512, client.dpsWindow.size)
+		assert.Equal(t, 1024, client.cpsWindow.size)
+		go client.ReadLoop()
+		for i := 0; i < 8; i++ {
+			var text = string(internal.AlphabetNumeric.Generate(internal.AlphabetNumeric.Intn(2048)))
+			_ = client.WriteString(text + text)
+			assert.Equal(t, text+text, <-received)
+		}
+	})
+
 	t.Run("fail", func(t *testing.T) {
 		var addr = ":" + nextPort()
 		var serverHandler = &webSocketMocker{}
@@ -241,7 +494,7 @@ func TestPermessageNegotiation(t *testing.T) {
 			},
 		})
 		assert.NoError(t, err)
-		err = client.doWrite(OpcodeText, new(writerTo))
+		err = client.doWrite(OpcodeText, new(writerTo), WriteOptions{})
 		assert.Equal(t, err.Error(), "1")
 	})
 }
@@ -259,3 +512,163 @@ func (c *writerTo) Len() int {
 func (c *writerTo) WriteTo(w io.Writer) (n int64, err error) {
 	return 0, errors.New("1")
 }
+
+func TestCompressSampler(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("pause and probe", func(t *testing.T) {
+		var sampler = newCompressSampler(PermessageDeflate{AdaptiveMinGain: 0.1, AdaptiveProbeInterval: 4})
+		as.True(sampler.Allow(OpcodeBinary))
+		sampler.Record(OpcodeBinary, 100, 98)
+		ratio, paused := sampler.Ratio(OpcodeBinary)
+		as.Equal(0.98, ratio)
+		as.True(paused)
+
+		// 其他操作码不受影响
+		as.True(sampler.Allow(OpcodeText))
+
+		as.False(sampler.Allow(OpcodeBinary))
+		as.False(sampler.Allow(OpcodeBinary))
+		as.False(sampler.Allow(OpcodeBinary))
+		as.True(sampler.Allow(OpcodeBinary))
+		sampler.Record(OpcodeBinary, 100, 20)
+		ratio, paused = sampler.Ratio(OpcodeBinary)
+		as.Equal(0.2, ratio)
+		as.False(paused)
+		as.True(sampler.Allow(OpcodeBinary))
+	})
+
+	t.Run("moving average", func(t *testing.T) {
+		var sampler = newCompressSampler(PermessageDeflate{AdaptiveMinGain: 0.5, AdaptiveProbeInterval: 4})
+		sampler.Record(OpcodeText, 100, 20)
+		sampler.Record(OpcodeText, 100, 100)
+		ratio, paused := sampler.Ratio(OpcodeText)
+		as.Equal(0.4, ratio)
+		as.False(paused)
+		sampler.Record(OpcodeText, 100, 100)
+		_, paused = sampler.Ratio(OpcodeText)
+		as.True(paused)
+		sampler.Record(OpcodeText, 0, 0)
+		_, paused = sampler.Ratio(OpcodeText)
+		as.True(paused)
+	})
+
+	t.Run("payload length", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1, AdaptiveEnabled: true}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{PermessageDeflate: pd}, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		client.sampler = newCompressSampler(client.pd)
+
+		// 采样只统计压缩后的载荷, 不包括帧头和掩码
+		for _, n := range []int{100, 1000, 70000} {
+			var payload = internal.AlphabetNumeric.Generate(n)
+			var done = make(chan struct{})
+			go func() {
+				_ = client.WriteMessage(OpcodeBinary, payload)
+				close(done)
+			}()
+
+			var header = make([]byte, 2)
+			_, _ = io.ReadFull(server.conn, header)
+			var size = int(header[1] & 127)
+			switch size {
+			case 126:
+				var ext = make([]byte, 2)
+				_, _ = io.ReadFull(server.conn, ext)
+				size = int(binary.BigEndian.Uint16(ext))
+			case 127:
+				var ext = make([]byte, 8)
+				_, _ = io.ReadFull(server.conn, ext)
+				size = int(binary.BigEndian.Uint64(ext))
+			}
+			var mask = make([]byte, 4)
+			_, _ = io.ReadFull(server.conn, mask)
+			_, _ = io.ReadFull(server.conn, make([]byte, size))
+			<-done
+
+			ratio, _ := client.sampler.Ratio(OpcodeBinary)
+			as.InDelta(float64(size)/float64(n), ratio, 1e-9)
+			client.sampler = newCompressSampler(client.pd)
+		}
+	})
+
+	t.Run("adaptive write", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1, AdaptiveEnabled: true, AdaptiveProbeInterval: 3}
+		var serverOption = &ServerOption{PermessageDeflate: pd}
+		var clientOption = &ClientOption{PermessageDeflate: pd}
+		var results = make(chan bool, 16)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			results <- message.compressed
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		server.sampler = newCompressSampler(serverOption.PermessageDeflate)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var random = make([]byte, 1024)
+		_, _ = rand.Read(random)
+		for i := 0; i < 4; i++ {
+			as.NoError(server.WriteMessage(OpcodeBinary, random))
+		}
+		as.True(<-results)
+		as.False(<-results)
+		as.False(<-results)
+		as.True(<-results)
+
+		// 文本消息单独统计
+		as.NoError(server.WriteMessage(OpcodeText, githubData))
+		as.NoError(server.WriteMessage(OpcodeText, githubData))
+		as.True(<-results)
+		as.True(<-results)
+	})
+}
+
+func TestAdaptiveOption(t *testing.T) {
+	var as = assert.New(t)
+	var addr = ":" + nextPort()
+	var server = NewServer(new(BuiltinEventHandler), &ServerOption{
+		PermessageDeflate: PermessageDeflate{Enabled: true, AdaptiveEnabled: true},
+	})
+	as.Equal(defaultAdaptiveMinGain, server.option.PermessageDeflate.AdaptiveMinGain)
+	as.Equal(defaultAdaptiveProbe, server.option.PermessageDeflate.AdaptiveProbeInterval)
+	go server.Run(addr)
+	time.Sleep(100 * time.Millisecond)
+
+	client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+		Addr:              "ws://localhost" + addr,
+		PermessageDeflate: PermessageDeflate{Enabled: true, AdaptiveEnabled: true, AdaptiveMinGain: 0.3},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	as.NotNil(client.sampler)
+	as.Equal(0.3, client.sampler.minGain)
+	as.Equal(defaultAdaptiveProbe, client.sampler.probeInterval)
+}
+
+func TestDeflaterPool_SelectWindow(t *testing.T) {
+	var as = assert.New(t)
+	var options = PermessageDeflate{Enabled: true, PoolSize: 4, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+	var pool = new(deflaterPool).initialize(options, defaultReadMaxPayloadSize)
+	as.Contains(pool.pool, pool.SelectWindow(15))
+
+	// 并发第一次使用同一种窗口大小时只创建一个压缩器池
+	var results = make(chan *deflater, 32)
+	var wg = &sync.WaitGroup{}
+	wg.Add(cap(results))
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			defer wg.Done()
+			results <- pool.SelectWindow(10)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	v, ok := pool.windows.Load(10)
+	as.True(ok)
+	for item := range results {
+		as.Contains(v.(*deflaterPool).pool, item)
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,25 +18,40 @@ import (
 )
 
 type Conn struct {
-	mu                sync.Mutex        // 写锁
-	ss                SessionStorage    // 会话
-	err               atomic.Value      // 错误
-	isServer          bool              // 是否为服务器
-	subprotocol       string            // 子协议
-	conn              net.Conn          // 底层连接
-	config            *Config           // 配置
-	br                *bufio.Reader     // 读缓存
-	continuationFrame continuationFrame // 连续帧
-	fh                frameHeader       // 帧头
-	handler           Event             // 事件处理器
-	closed            uint32            // 是否关闭
-	readQueue         channel           // 消息处理队列
-	writeQueue        workerQueue       // 发送队列
-	deflater          *deflater         // 压缩编码器
-	dpsWindow         slideWindow       // 解压器滑动窗口
-	cpsWindow         slideWindow       // 压缩器滑动窗口
-	pd                PermessageDeflate // 压缩拓展协商结果
-	ctx               context.Context   // 上下文
+	mu                sync.Mutex                 // 写锁
+	ss                SessionStorage             // 会话
+	err               atomic.Value               // 错误
+	isServer          bool                       // 是否为服务器
+	subprotocol       string                     // 子协议
+	conn              net.Conn                   // 底层连接
+	config            *Config                    // 配置
+	br                *bufio.Reader              // 读缓存
+	continuationFrame continuationFrame          // 连续帧
+	fh                frameHeader                // 帧头
+	handler           Event                      // 事件处理器
+	closed            uint32                     // 是否关闭
+	readQueue         channel                    // 消息处理队列
+	poll              pollDesc                   // 事件循环模式下注册的连接
+	deadlineMu        sync.Mutex                 // 保护readDeadline和底层连接的读超时
+	readDeadline      time.Time                  // 用户设置的读超时
+	idleReader        idleReader                 // 空闲模式下, 带上已经读取的1字节
+	keyedQueue        *keyedQueue                // 按键分组的消息处理队列
+	poolQueue         *poolQueue                 // 在共享协程池中的消息队列
+	writeQueue        workerQueue                // 发送队列
+	controlQueue      workerQueue                // 控制帧的发送队列
+	fragmenting       bool                       // 是否正在分片写入消息
+	fragmentCond      *sync.Cond                 // 等待分片写入完成
+	controls          controlSlot                // 等待写入的控制帧
+	batch             writeBatch                 // 合并写入的帧
+	deflater          *deflater                  // 压缩编码器
+	dpsWindow         slideWindow                // 解压器滑动窗口
+	cpsWindow         slideWindow                // 压缩器滑动窗口
+	pd                PermessageDeflate          // 压缩拓展协商结果
+	sampler           *compressSampler           // 自适应压缩采样器
+	rsv               uint8                      // 拓展占用的保留位
+	extensions        []*extensionSessionWrapper // 自定义拓展
+	codec             Codec                      // 编解码器
+	ctx               context.Context            // 上下文
 }
 
 func (c *Conn) Context() context.Context {
@@ -45,30 +63,203 @@ func (c *Conn) Context() context.Context {
 // If HTTP Server is reused, it is recommended to enable goroutine, as blocking will prevent the context from being GC.
 func (c *Conn) ReadLoop() {
 	c.handler.OnOpen(c)
+	c.readLoop()
+}
+
+// 事件循环关闭后, 在当前协程中继续读取, 不再触发OnOpen
+func (c *Conn) resume() {
+	if c.br == nil {
+		c.br = c.config.brPool.Get()
+		c.br.Reset(c.conn)
+	}
+	c.readLoop()
+}
+
+func (c *Conn) readLoop() {
 	for {
+		if err := c.waitIdle(); err != nil {
+			c.emitError(err)
+			break
+		}
 		if err := c.readMessage(); err != nil {
 			c.emitError(err)
 			break
 		}
 	}
-	err, ok := c.err.Load().(error)
-	c.handler.OnClose(c, internal.SelectValue(ok, err, errEmpty))
+	c.finish()
+}
 
-	// 回收资源
-	if c.isServer {
+// 空闲模式下, 等待下一帧. 超过IdleReleaseTimeout没有数据时, 归还读缓冲区和压缩器的滑动窗口, 然后阻塞在1字节的读取上.
+func (c *Conn) waitIdle() error {
+	var timeout = c.config.IdleReleaseTimeout
+	if timeout <= 0 || !c.isServer || c.br.Buffered() > 0 {
+		return nil
+	}
+
+	// 与SetDeadline和SetReadDeadline持有同一把锁, 期间用户设置的读超时不会被覆盖
+	c.deadlineMu.Lock()
+	var deadline = time.Now().Add(timeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	var setErr = c.conn.SetReadDeadline(deadline)
+	c.deadlineMu.Unlock()
+	if setErr != nil {
+		return setErr
+	}
+
+	_, err := c.br.Peek(1)
+
+	c.deadlineMu.Lock()
+	var userDeadline = c.readDeadline
+	setErr = c.conn.SetReadDeadline(userDeadline)
+	c.deadlineMu.Unlock()
+	if setErr != nil {
+		return setErr
+	}
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) || (!userDeadline.IsZero() && !time.Now().Before(userDeadline)) {
+		return err
+	}
+
+	c.releaseReader()
+	c.ShrinkWindow()
+
+	var b [1]byte
+	n, err := c.conn.Read(b[:])
+	if n == 0 {
+		return internal.SelectValue(err == nil, io.ErrNoProgress, err)
+	}
+	c.idleReader = idleReader{conn: c.conn, b: b[0], buffered: true}
+	c.br = c.config.brPool.Get()
+	c.br.Reset(&c.idleReader)
+	return nil
+}
+
+// 事件循环中的连接
+type pollDesc interface {
+	// 关闭之前从事件循环中移除
+	detach()
+
+	// 由事件循环检查读超时
+	setDeadline(t time.Time)
+}
+
+// 先返回空闲时读取的1字节, 然后从连接读取
+type idleReader struct {
+	conn     net.Conn
+	b        byte
+	buffered bool
+}
+
+func (c *idleReader) Read(p []byte) (int, error) {
+	if !c.buffered {
+		return c.conn.Read(p)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = c.b
+	c.buffered = false
+	return 1, nil
+}
+
+// 处理已经到达的完整帧, 直到读缓冲区为空, 然后归还读缓冲区. 用于事件循环模式.
+// 剩余的帧不完整时返回false并保留读缓冲区, 由调用者在单独的协程中等待剩余的数据.
+func (c *Conn) readReady() (bool, error) {
+	if c.br == nil {
+		c.br = c.config.brPool.Get()
+		c.br.Reset(c.conn)
+		// 可读事件触发之后, 单次读取不会阻塞
+		if _, err := c.br.Peek(1); err != nil {
+			return true, err
+		}
+	}
+	for c.br.Buffered() > 0 {
+		if !c.frameBuffered() {
+			return false, nil
+		}
+		if err := c.readMessage(); err != nil {
+			return true, err
+		}
+	}
+	c.releaseReader()
+	return true, nil
+}
+
+// 读缓冲区中是否已经有完整的帧, 不会读取连接
+func (c *Conn) frameBuffered() bool {
+	var p, _ = c.br.Peek(c.br.Buffered())
+	if len(p) < 2 {
+		return false
+	}
+	var n = 2
+	var payloadLength = uint64(p[1] & 127)
+	switch payloadLength {
+	case 126:
+		if n += 2; len(p) < n {
+			return false
+		}
+		payloadLength = uint64(binary.BigEndian.Uint16(p[2:4]))
+	case 127:
+		if n += 8; len(p) < n {
+			return false
+		}
+		payloadLength = binary.BigEndian.Uint64(p[2:10])
+	}
+	if p[1]&128 != 0 {
+		n += 4
+	}
+	return len(p) >= n && uint64(len(p)-n) >= payloadLength
+}
+
+func (c *Conn) releaseReader() {
+	if c.br != nil {
 		c.br.Reset(nil)
 		c.config.brPool.Put(c.br)
 		c.br = nil
+	}
+}
 
-		if c.cpsWindow.enabled {
-			c.config.cswPool.Put(c.cpsWindow.dict)
-			c.cpsWindow.dict = nil
-		}
-		if c.dpsWindow.enabled {
-			c.config.dswPool.Put(c.dpsWindow.dict)
-			c.dpsWindow.dict = nil
+// 触发OnClose并回收资源
+func (c *Conn) finish() {
+	err, ok := c.err.Load().(error)
+	c.handler.OnClose(c, internal.SelectValue(ok, err, errEmpty))
+
+	// 写入在持有锁时检查连接是否关闭, 之后不会再调用拓展会话
+	c.mu.Lock()
+	for _, item := range c.extensions {
+		if v, ok := item.session.(releaseSession); ok {
+			v.release()
 		}
 	}
+	c.mu.Unlock()
+
+	// 回收资源
+	if c.isServer {
+		c.releaseReader()
+
+		c.mu.Lock()
+		c.cpsWindow.release()
+		c.mu.Unlock()
+		c.dpsWindow.release()
+	}
+}
+
+// ShrinkWindow 释放压缩器的滑动窗口, 适合在连接空闲时调用.
+// 压缩器可以随时放弃历史上下文而不影响对端解压, 下一条压缩消息会重新分配窗口; 解压器的窗口由对端决定, 不会被释放.
+// Release the sliding window of the compressor, intended to be called when the connection is idle.
+// The compressor may drop its history at any time without breaking the peer's decompressor,
+// the window is reallocated on the next compressed message; the decompressor's window is kept as the peer relies on it.
+func (c *Conn) ShrinkWindow() {
+	c.mu.Lock()
+	c.cpsWindow.release()
+	c.mu.Unlock()
+}
+
+// CompressionMemory 连接的滑动窗口占用的内存(字节), 不包含多个连接共享的压缩器
+// Memory in bytes held by the connection's sliding windows, excluding the compressors shared among connections
+func (c *Conn) CompressionMemory() int {
+	return c.cpsWindow.Memory() + c.dpsWindow.Memory()
 }
 
 func (c *Conn) getCpsDict(isBroadcast bool) []byte {
@@ -85,6 +276,11 @@ func (c *Conn) getCpsDict(isBroadcast bool) []byte {
 	return nil
 }
 
+// 获取协商成功的拓展占用的保留位
+func (c *Conn) getRSV() uint8 {
+	return c.rsv | internal.SelectValue(c.pd.Enabled, RSV1, 0)
+}
+
 func (c *Conn) getDpsDict() []byte {
 	if c.isServer && c.pd.ClientContextTakeover {
 		return c.dpsWindow.dict
@@ -106,7 +302,11 @@ func (c *Conn) isClosed() bool { return atomic.LoadUint32(&c.closed) == 1 }
 
 func (c *Conn) close(reason []byte, err error) {
 	c.err.Store(err)
-	_ = c.doWrite(OpcodeCloseConnection, internal.Bytes(reason))
+	_ = c.doWrite(OpcodeCloseConnection, internal.Bytes(reason), WriteOptions{})
+	// 必须在关闭之前移除, 否则文件描述符可能被新的连接复用
+	if c.poll != nil {
+		c.poll.detach()
+	}
 	_ = c.conn.Close()
 }
 
@@ -177,14 +377,26 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 
 // SetDeadline sets deadline
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	if c.poll != nil {
+		c.poll.setDeadline(t)
+	}
 	err := c.conn.SetDeadline(t)
+	c.deadlineMu.Unlock()
 	c.emitError(err)
 	return err
 }
 
 // SetReadDeadline sets read deadline
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	if c.poll != nil {
+		c.poll.setDeadline(t)
+	}
 	err := c.conn.SetReadDeadline(t)
+	c.deadlineMu.Unlock()
 	c.emitError(err)
 	return err
 }
@@ -200,6 +412,10 @@ func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
 
 func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
 
+// Config 获取连接的配置, 不要修改
+// Get the config of the connection, do not modify it.
+func (c *Conn) Config() *Config { return c.config }
+
 // NetConn get tcp/tls/kcp... connection
 func (c *Conn) NetConn() net.Conn { return c.conn }
 
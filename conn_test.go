@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -154,3 +155,80 @@ func TestConn_EmitError(t *testing.T) {
 	server.emitError(err)
 	wg.Wait()
 }
+
+func TestConn_IdleRelease(t *testing.T) {
+	var pd = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   12,
+		ClientMaxWindowBits:   12,
+		Threshold:             1,
+	}
+
+	t.Run("release", func(t *testing.T) {
+		var as = assert.New(t)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan string, 8)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { _ = socket.WriteString(message.Data.String()) }
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		var serverOption = &ServerOption{PermessageDeflate: pd, IdleReleaseTimeout: 20 * time.Millisecond}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{PermessageDeflate: pd})
+		client.dpsWindow.initialize(nil, server.pd.ServerMaxWindowBits)
+		client.cpsWindow.initialize(nil, server.pd.ClientMaxWindowBits)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		for _, item := range []string{"hello", "world", "hello, gws!"} {
+			as.NoError(client.WriteString(item))
+			as.Equal(item, <-received)
+
+			// 空闲之后释放压缩器的窗口, 解压器的窗口由对端决定, 不会被释放. 重新收到数据后消息仍然完整.
+			as.Eventually(func() bool { return server.cpsWindow.Memory() == 0 }, time.Second, 5*time.Millisecond)
+			as.Equal(4096, server.dpsWindow.Memory())
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		var as = assert.New(t)
+		var serverHandler = new(webSocketMocker)
+		var closed = make(chan error, 1)
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{IdleReleaseTimeout: 10 * time.Millisecond}, new(webSocketMocker), nil)
+		as.NoError(server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 用户设置的读超时仍然生效
+		select {
+		case err := <-closed:
+			as.ErrorIs(err, os.ErrDeadlineExceeded)
+		case <-time.After(time.Second):
+			as.Fail("read deadline is not respected")
+		}
+	})
+
+	t.Run("set deadline while waiting", func(t *testing.T) {
+		var as = assert.New(t)
+		var serverHandler = new(webSocketMocker)
+		var closed = make(chan error, 1)
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{IdleReleaseTimeout: time.Millisecond}, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 空闲等待期间并发设置读超时, 最后一次设置不会被空闲模式恢复的旧值覆盖
+		for i := 0; i < 50; i++ {
+			as.NoError(client.WriteString("hello"))
+			as.NoError(server.SetReadDeadline(time.Time{}))
+		}
+		as.NoError(server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+		select {
+		case err := <-closed:
+			as.ErrorIs(err, os.ErrDeadlineExceeded)
+		case <-time.After(time.Second):
+			as.Fail("read deadline is not respected")
+		}
+	})
+}
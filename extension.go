@@ -0,0 +1,392 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/marifcelik/gws/internal"
+)
+
+// 保留位
+// Reserved bits of the first frame byte
+const (
+	RSV1 uint8 = 0x40
+	RSV2 uint8 = 0x20
+	RSV3 uint8 = 0x10
+)
+
+// ErrExtensionNegotiation 拓展协商失败
+// Extension negotiation failed
+var ErrExtensionNegotiation = errors.New("gws: extension negotiation failed")
+
+type (
+	// Extension WebSocket拓展
+	// 拓展通过Sec-WebSocket-Extensions协商, 可以占用保留位, 并对收发的消息做变换.
+	// permessage-deflate也是基于这个接口实现的.
+	// WebSocket extension negotiated via Sec-WebSocket-Extensions. It may own reserved bits and
+	// transform inbound and outbound messages. permessage-deflate is implemented on top of it as well.
+	Extension interface {
+		// Name 拓展名称
+		// Extension token, e.g. permessage-deflate
+		Name() string
+
+		// RSV 占用的保留位, RSV1/RSV2/RSV3的组合, 不占用返回0. 同一连接上协商成功的拓展不能占用相同的保留位.
+		// Reserved bits owned by the extension, 0 if none. Extensions negotiated on the same connection must not share bits.
+		RSV() uint8
+
+		// Offer 客户端生成握手请求中的拓展参数
+		// Client side: the offer written into the handshake request.
+		Offer() ExtensionParams
+
+		// Accept 服务端处理客户端的一个拓展请求, 返回响应参数和拓展会话. 返回错误表示拒绝该请求, 不会导致握手失败.
+		// Server side: accept an offer and return the response and a session.
+		// Returning an error declines the offer without failing the handshake.
+		Accept(offer ExtensionParams) (ExtensionParams, ExtensionSession, error)
+
+		// Confirm 客户端处理服务端的响应, 返回拓展会话. 返回错误会导致握手失败.
+		// Client side: confirm the response of the server. Returning an error fails the handshake.
+		Confirm(response ExtensionParams) (ExtensionSession, error)
+	}
+
+	// ExtensionSession 单个连接上的拓展实例, 非并发安全, 由连接串行调用
+	// Per-connection extension state. It's not concurrency safe, the connection calls it serially.
+	ExtensionSession interface {
+		// Encode 出站变换, 返回新的消息内容和是否设置拓展的保留位. 不要持有payload.
+		// Outbound transform. Returns the new payload and whether to set the reserved bits. Do not retain payload.
+		Encode(opcode Opcode, payload []byte) ([]byte, bool, error)
+
+		// Decode 入站变换, rsv表示消息是否设置了拓展的保留位. 不要持有payload.
+		// Inbound transform, rsv reports whether the reserved bits were set. Do not retain payload.
+		Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error)
+	}
+
+	// ExtensionParams 一个拓展请求或者响应, 例如 permessage-deflate; client_max_window_bits=10
+	// One extension offer or response, e.g. permessage-deflate; client_max_window_bits=10
+	ExtensionParams struct {
+		Name   string
+		Params []ExtensionParam
+	}
+
+	// ExtensionParam 拓展参数, 没有值时Value为空
+	// Extension parameter, Value is empty when absent.
+	ExtensionParam struct {
+		Key   string
+		Value string
+	}
+)
+
+// ParseExtensions 解析Sec-WebSocket-Extensions, 多个拓展以逗号分隔, 参数以分号分隔
+// Parse Sec-WebSocket-Extensions. Extensions are separated by commas, parameters by semicolons.
+func ParseExtensions(header string) []ExtensionParams {
+	var results []ExtensionParams
+	for _, item := range internal.Split(header, ",") {
+		var ss = internal.Split(item, ";")
+		if len(ss) == 0 {
+			continue
+		}
+		var params = ExtensionParams{Name: ss[0]}
+		for _, s := range ss[1:] {
+			var pair = strings.SplitN(s, "=", 2)
+			var param = ExtensionParam{Key: strings.TrimSpace(pair[0])}
+			if len(pair) == 2 {
+				param.Value = strings.Trim(strings.TrimSpace(pair[1]), `"`)
+			}
+			params.Params = append(params.Params, param)
+		}
+		results = append(results, params)
+	}
+	return results
+}
+
+// Get 获取参数
+// Get a parameter
+func (c ExtensionParams) Get(key string) (string, bool) {
+	for _, item := range c.Params {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return "", false
+}
+
+// With 追加参数, 返回新的对象
+// Append a parameter and return a new object
+func (c ExtensionParams) With(key, value string) ExtensionParams {
+	var params = make([]ExtensionParam, 0, len(c.Params)+1)
+	params = append(params, c.Params...)
+	params = append(params, ExtensionParam{Key: key, Value: value})
+	return ExtensionParams{Name: c.Name, Params: params}
+}
+
+func (c ExtensionParams) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	for _, item := range c.Params {
+		b.WriteString("; ")
+		b.WriteString(item.Key)
+		if item.Value != "" {
+			b.WriteString(internal.EQ)
+			b.WriteString(item.Value)
+		}
+	}
+	return b.String()
+}
+
+func joinExtensions(list []ExtensionParams) string {
+	var ss = make([]string, 0, len(list))
+	for _, item := range list {
+		ss = append(ss, item.String())
+	}
+	return strings.Join(ss, ", ")
+}
+
+// 拓展协商结果
+type extensionResult struct {
+	rsv       uint8
+	pd        PermessageDeflate
+	sessions  []*extensionSessionWrapper
+	responses []ExtensionParams
+}
+
+// 服务端拓展协商
+// 按照客户端请求的顺序依次尝试, 同名拓展只接受第一个成功的请求, 保留位冲突或者被拒绝的请求会被跳过.
+func acceptExtensions(extensions []Extension, header string) *extensionResult {
+	var result = new(extensionResult)
+	var accepted = make(map[string]bool)
+	for _, offer := range ParseExtensions(header) {
+		if accepted[offer.Name] {
+			continue
+		}
+		for _, ext := range extensions {
+			if ext.Name() != offer.Name || ext.RSV()&result.rsv != 0 {
+				continue
+			}
+			response, session, err := ext.Accept(offer)
+			if err != nil {
+				continue
+			}
+			accepted[offer.Name] = true
+			result.add(ext, response, session)
+			break
+		}
+	}
+	return result
+}
+
+// 客户端确认服务端的协商结果
+// 服务端响应了没有请求过的拓展, 或者保留位冲突, 握手失败.
+func confirmExtensions(extensions []Extension, header string) (*extensionResult, error) {
+	var result = new(extensionResult)
+	var confirmed = make(map[string]bool)
+	for _, response := range ParseExtensions(header) {
+		var ext = findExtension(extensions, response.Name)
+		if ext == nil || confirmed[response.Name] || ext.RSV()&result.rsv != 0 {
+			return nil, ErrExtensionNegotiation
+		}
+		session, err := ext.Confirm(response)
+		if err != nil {
+			return nil, err
+		}
+		confirmed[response.Name] = true
+		result.add(ext, response, session)
+	}
+	return result, nil
+}
+
+func findExtension(extensions []Extension, name string) Extension {
+	for _, ext := range extensions {
+		if ext.Name() == name {
+			return ext
+		}
+	}
+	return nil
+}
+
+func (c *extensionResult) add(ext Extension, response ExtensionParams, session ExtensionSession) {
+	c.rsv |= ext.RSV()
+	c.responses = append(c.responses, response)
+	if v, ok := session.(*deflateSession); ok {
+		c.pd = v.pd
+		return
+	}
+	if session != nil {
+		c.sessions = append(c.sessions, &extensionSessionWrapper{rsv: ext.RSV(), session: session})
+	}
+}
+
+// extensionSessionWrapper 记录拓展会话占用的保留位
+type extensionSessionWrapper struct {
+	rsv     uint8
+	session ExtensionSession
+}
+
+// 压缩类的拓展会话, 按照单条消息的压缩策略决定是否压缩
+type compressSession interface {
+	EncodeMode(opcode Opcode, payload []byte, mode CompressMode) ([]byte, bool, error)
+}
+
+// 持有连接独占资源的拓展会话, 连接关闭时释放
+type releaseSession interface {
+	release()
+}
+
+// 出站变换, 按照协商顺序依次执行. mode是已经解析过自适应采样的压缩策略, 压缩类的拓展按照它决定是否压缩.
+func (c *Conn) encodeExtensions(opcode Opcode, payload internal.Payload, mode CompressMode) (internal.Payload, uint8, error) {
+	if len(c.extensions) == 0 || !opcode.isDataFrame() {
+		return payload, 0, nil
+	}
+
+	var p []byte
+	switch v := payload.(type) {
+	case internal.Bytes:
+		p = v
+	default:
+		var buf = bytes.NewBuffer(make([]byte, 0, payload.Len()))
+		_, _ = payload.WriteTo(buf)
+		p = buf.Bytes()
+	}
+
+	var rsv uint8
+	for _, item := range c.extensions {
+		var result []byte
+		var ok bool
+		var err error
+		if session, isCompress := item.session.(compressSession); isCompress {
+			result, ok, err = session.EncodeMode(opcode, p, mode)
+		} else {
+			result, ok, err = item.session.Encode(opcode, p)
+		}
+		if err != nil {
+			return nil, 0, internal.NewError(internal.CloseInternalServerErr, err)
+		}
+		p = result
+		if ok {
+			rsv |= item.rsv
+		}
+	}
+	// 编码在变换之前已经检查过, 这里只检查长度
+	if len(p) > c.config.WriteMaxPayloadSize {
+		return nil, 0, internal.CloseMessageTooLarge
+	}
+	return internal.Bytes(p), rsv, nil
+}
+
+// 入站变换, 按照协商顺序逆序执行
+func (c *Conn) decodeExtensions(msg *Message) error {
+	if len(c.extensions) == 0 {
+		return nil
+	}
+
+	var p = msg.Bytes()
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		var item = c.extensions[i]
+		result, err := item.session.Decode(msg.Opcode, msg.rsv&item.rsv != 0, p)
+		if err != nil {
+			if _, ok := err.(internal.StatusCode); ok {
+				return err
+			}
+			return internal.NewError(internal.CloseUnsupportedData, err)
+		}
+		p = result
+	}
+	if !internal.IsSameBytes(p, msg.Bytes()) {
+		var buf = binaryPool.Get(len(p))
+		buf.Write(p)
+		binaryPool.Put(msg.Data)
+		msg.Data = buf
+	}
+	return nil
+}
+
+// deflateExtension 基于Extension接口的permessage-deflate协商
+type deflateExtension struct {
+	option *PermessageDeflate
+}
+
+func (c *deflateExtension) Name() string { return internal.PermessageDeflate }
+
+func (c *deflateExtension) RSV() uint8 { return RSV1 }
+
+func (c *deflateExtension) Offer() ExtensionParams {
+	return ParseExtensions(c.option.genRequestHeader())[0]
+}
+
+// Accept 服务端按照客户端的请求协商参数, 请求无效时拒绝, 由下一个请求或者不压缩兜底
+func (c *deflateExtension) Accept(offer ExtensionParams) (ExtensionParams, ExtensionSession, error) {
+	if !c.option.Enabled {
+		return ExtensionParams{}, nil, ErrCompressionNegotiation
+	}
+	clientPD, err := permessageNegotiation(offer, false)
+	if err != nil {
+		return ExtensionParams{}, nil, err
+	}
+	var serverPD = *c.option
+	pd := PermessageDeflate{
+		Enabled:               true,
+		Threshold:             serverPD.Threshold,
+		Level:                 serverPD.Level,
+		PoolSize:              serverPD.PoolSize,
+		AdaptiveEnabled:       serverPD.AdaptiveEnabled,
+		AdaptiveMinGain:       serverPD.AdaptiveMinGain,
+		AdaptiveProbeInterval: serverPD.AdaptiveProbeInterval,
+		ServerContextTakeover: clientPD.ServerContextTakeover && serverPD.ServerContextTakeover,
+		ClientContextTakeover: clientPD.ClientContextTakeover && serverPD.ClientContextTakeover,
+		ServerMaxWindowBits:   internal.Min(clientPD.ServerMaxWindowBits, serverPD.ServerMaxWindowBits),
+		ClientMaxWindowBits:   15,
+	}
+	if _, ok := offer.Get(internal.ClientMaxWindowBits); ok {
+		pd.ClientMaxWindowBits = internal.Min(clientPD.ClientMaxWindowBits, serverPD.ClientMaxWindowBits)
+	} else if serverPD.ClientMaxWindowBits < 15 {
+		// 客户端不支持限制窗口大小, 关闭客户端的上下文接管, 避免解压字典小于客户端的窗口
+		pd.ClientContextTakeover = false
+	}
+	pd.setThreshold(true)
+	return ParseExtensions(pd.genResponseHeader())[0], &deflateSession{pd: pd}, nil
+}
+
+// Confirm 客户端校验服务端的响应, 窗口大小必须在请求的范围之内
+// 服务端忽略server_no_context_takeover时, 客户端保留解压字典兼容对端
+func (c *deflateExtension) Confirm(response ExtensionParams) (ExtensionSession, error) {
+	serverPD, err := permessageNegotiation(response, true)
+	if err != nil {
+		return nil, err
+	}
+	var clientPD = *c.option
+	var _, hasClientBits = response.Get(internal.ClientMaxWindowBits)
+	var offeredClientBits = clientPD.ClientMaxWindowBits != 15 || clientPD.ClientContextTakeover
+	if serverPD.ServerMaxWindowBits > clientPD.ServerMaxWindowBits ||
+		serverPD.ClientMaxWindowBits > clientPD.ClientMaxWindowBits ||
+		(hasClientBits && !offeredClientBits) {
+		return nil, ErrCompressionNegotiation
+	}
+	pd := PermessageDeflate{
+		Enabled:               true,
+		Threshold:             clientPD.Threshold,
+		Level:                 clientPD.Level,
+		PoolSize:              clientPD.PoolSize,
+		AdaptiveEnabled:       clientPD.AdaptiveEnabled,
+		AdaptiveMinGain:       clientPD.AdaptiveMinGain,
+		AdaptiveProbeInterval: clientPD.AdaptiveProbeInterval,
+		ServerContextTakeover: serverPD.ServerContextTakeover,
+		ClientContextTakeover: serverPD.ClientContextTakeover && clientPD.ClientContextTakeover,
+		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
+		ClientMaxWindowBits:   serverPD.ClientMaxWindowBits,
+	}
+	pd.setThreshold(false)
+	return &deflateSession{pd: pd}, nil
+}
+
+// deflateSession permessage-deflate的协商结果
+// 压缩和解压由连接内置的帧读写逻辑完成, 以便复用内存池和滑动窗口, 这里只保存协商参数.
+type deflateSession struct {
+	pd PermessageDeflate
+}
+
+func (c *deflateSession) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	return payload, false, nil
+}
+
+func (c *deflateSession) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	return payload, nil
+}
@@ -0,0 +1,249 @@
+package gws
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// checksumExtension 测试用拓展, 在消息末尾追加crc32校验和
+type checksumExtension struct {
+	name string
+	rsv  uint8
+}
+
+func (c *checksumExtension) Name() string {
+	return internal.SelectValue(c.name == "", "x-checksum", c.name)
+}
+
+func (c *checksumExtension) RSV() uint8 { return c.rsv }
+
+func (c *checksumExtension) Offer() ExtensionParams {
+	return ExtensionParams{Name: c.Name()}.With("algorithm", "crc32")
+}
+
+func (c *checksumExtension) Accept(offer ExtensionParams) (ExtensionParams, ExtensionSession, error) {
+	if v, _ := offer.Get("algorithm"); v != "crc32" {
+		return ExtensionParams{}, nil, errors.New("unsupported algorithm")
+	}
+	return offer, new(checksumSession), nil
+}
+
+func (c *checksumExtension) Confirm(response ExtensionParams) (ExtensionSession, error) {
+	return new(checksumSession), nil
+}
+
+type checksumSession struct{}
+
+func (c *checksumSession) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	var p = make([]byte, len(payload)+4)
+	copy(p, payload)
+	binary.BigEndian.PutUint32(p[len(payload):], crc32.ChecksumIEEE(payload))
+	return p, true, nil
+}
+
+func (c *checksumSession) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	var n = len(payload)
+	if !rsv || n < 4 || binary.BigEndian.Uint32(payload[n-4:]) != crc32.ChecksumIEEE(payload[:n-4]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload[:n-4], nil
+}
+
+func TestParseExtensions(t *testing.T) {
+	var as = assert.New(t)
+	var list = ParseExtensions(`permessage-deflate; client_max_window_bits, x-checksum; algorithm="crc32" , `)
+	as.Equal(2, len(list))
+	as.Equal("permessage-deflate", list[0].Name)
+	v, ok := list[0].Get("client_max_window_bits")
+	as.True(ok)
+	as.Equal("", v)
+	_, ok = list[0].Get("server_max_window_bits")
+	as.False(ok)
+	v, _ = list[1].Get("algorithm")
+	as.Equal("crc32", v)
+	as.Equal("x-checksum; algorithm=crc32", list[1].String())
+	as.Equal("permessage-deflate; client_max_window_bits, x-checksum; algorithm=crc32", joinExtensions(list))
+
+	var params = list[1].With("level", "1")
+	as.Equal(1, len(list[1].Params))
+	as.Equal(2, len(params.Params))
+	as.Nil(ParseExtensions(""))
+}
+
+func TestAcceptExtensions(t *testing.T) {
+	var as = assert.New(t)
+	var pd = PermessageDeflate{Enabled: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+
+	t.Run("order and rsv", func(t *testing.T) {
+		var extensions = []Extension{
+			&deflateExtension{option: &pd},
+			&checksumExtension{rsv: RSV2},
+			&checksumExtension{name: "x-conflict", rsv: RSV1},
+		}
+		var result = acceptExtensions(extensions, "x-checksum; algorithm=md5, x-checksum; algorithm=crc32, x-checksum; algorithm=crc32, permessage-deflate, x-conflict; algorithm=crc32, x-unknown")
+		as.Equal(RSV1|RSV2, result.rsv)
+		as.True(result.pd.Enabled)
+		as.Equal(1, len(result.sessions))
+		as.Equal(2, len(result.responses))
+		as.Equal("x-checksum; algorithm=crc32", result.responses[0].String())
+		as.Equal("permessage-deflate", result.responses[1].Name)
+	})
+
+	t.Run("deflate disabled", func(t *testing.T) {
+		var option = PermessageDeflate{}
+		var result = acceptExtensions([]Extension{&deflateExtension{option: &option}}, "permessage-deflate")
+		as.False(result.pd.Enabled)
+		as.Equal(uint8(0), result.rsv)
+	})
+
+	t.Run("confirm", func(t *testing.T) {
+		var extensions = []Extension{&deflateExtension{option: &pd}, &checksumExtension{rsv: RSV1}}
+		_, err := confirmExtensions(extensions, "x-unknown")
+		as.Error(err)
+		_, err = confirmExtensions(extensions, "permessage-deflate, permessage-deflate")
+		as.Error(err)
+		_, err = confirmExtensions(extensions, "permessage-deflate, x-checksum")
+		as.Error(err)
+		result, err := confirmExtensions(extensions, "x-checksum")
+		as.NoError(err)
+		as.Equal(RSV1, result.rsv)
+		as.False(result.pd.Enabled)
+	})
+}
+
+func TestExtension(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("message transform", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		var server = NewServer(serverHandler, &ServerOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+			Extensions:        []Extension{&checksumExtension{rsv: RSV2}},
+		})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var received = make(chan *Message, 4)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+		client, resp, err := NewClient(clientHandler, &ClientOption{
+			Addr:              "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+			Extensions:        []Extension{&checksumExtension{rsv: RSV2}},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("permessage-deflate; server_no_context_takeover; client_no_context_takeover, x-checksum; algorithm=crc32",
+			resp.Header.Get(internal.SecWebSocketExtensions.Key))
+		as.Equal(RSV1|RSV2, client.getRSV())
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("hello"))
+		as.NoError(client.Writev(OpcodeBinary, []byte("hello, "), []byte("world!")))
+		var msg = <-received
+		as.Equal("hello", msg.Data.String())
+		as.True(msg.compressed)
+		as.Equal(RSV1|RSV2, msg.rsv)
+		msg = <-received
+		as.Equal("hello, world!", msg.Data.String())
+
+		var broadcaster = NewBroadcaster(OpcodeText, []byte("broadcast"))
+		as.NoError(broadcaster.Broadcast(client))
+		as.Equal("broadcast", (<-received).Data.String())
+		as.NoError(broadcaster.Close())
+	})
+
+	t.Run("text check before transform", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan string, 4)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+			socket.WriteAsync(message.Opcode, message.Bytes(), nil)
+		}
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		server, client := newPeer(
+			serverHandler, &ServerOption{CheckUtf8Enabled: true, WriteCoalesceEnabled: true},
+			clientHandler, &ClientOption{CheckUtf8Enabled: true},
+		)
+		for _, socket := range []*Conn{server, client} {
+			socket.rsv = RSV2
+			socket.extensions = []*extensionSessionWrapper{{rsv: RSV2, session: new(checksumSession)}}
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 校验和不是合法的utf8, 只检查变换之前的文本
+		as.NoError(client.WriteString("hello"))
+		for i := 0; i < 2; i++ {
+			select {
+			case msg := <-received:
+				as.Equal("hello", msg)
+			case <-time.After(time.Second):
+				as.Fail("text message is not echoed")
+			}
+		}
+		as.EqualError(client.WriteString("\xff"), ErrTextEncoding.Error())
+	})
+
+	t.Run("unowned rsv", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var closed = make(chan error, 1)
+		clientHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		client.extensions = []*extensionSessionWrapper{{rsv: RSV3, session: new(checksumSession)}}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		_ = client.WriteString("hello")
+		var err = <-closed
+		if as.IsType(&CloseError{}, err) {
+			as.Equal(internal.CloseProtocolError.Uint16(), err.(*CloseError).Code)
+		}
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var closed = make(chan error, 1)
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		server.rsv = RSV2
+		server.extensions = []*extensionSessionWrapper{{rsv: RSV2, session: new(checksumSession)}}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		_ = client.WriteString("hello")
+		as.Error(<-closed)
+	})
+
+	t.Run("handshake fail", func(t *testing.T) {
+		srv, cli := net.Pipe()
+		var d = &connector{
+			option:          initClientOption(&ClientOption{RequestHeader: http.Header{}}),
+			conn:            cli,
+			secWebsocketKey: "1fTfP/qALD+eAWcU80P0bg==",
+			eventHandler:    new(BuiltinEventHandler),
+		}
+		go func() {
+			var text = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Extensions: x-checksum\r\nSec-WebSocket-Accept: ygR8UkmG67DM75dkgZzwplwlEEo=\r\n\r\n"
+			var buf = make([]byte, 1024)
+			_, _ = srv.Read(buf)
+			_, _ = srv.Write([]byte(text))
+		}()
+		_, _, err := d.handshake()
+		as.ErrorIs(err, ErrExtensionNegotiation)
+	})
+}
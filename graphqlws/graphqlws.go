@@ -0,0 +1,431 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/marifcelik/gws"
+)
+
+const (
+	// Protocol graphql-transport-ws子协议, 需要配置在gws.ServerOption.SubProtocols中
+	// The graphql-transport-ws subprotocol, it should be configured in gws.ServerOption.SubProtocols.
+	Protocol = "graphql-transport-ws"
+
+	defaultInitTimeout = 3 * time.Second
+	graphqlSessionKey  = "gws:graphql-ws"
+)
+
+// graphql-transport-ws 消息类型
+// Message types of graphql-transport-ws
+const (
+	graphqlConnectionInit = "connection_init"
+	graphqlConnectionAck  = "connection_ack"
+	graphqlPing           = "ping"
+	graphqlPong           = "pong"
+	graphqlSubscribe      = "subscribe"
+	graphqlNext           = "next"
+	graphqlError          = "error"
+	graphqlComplete       = "complete"
+)
+
+// graphql-transport-ws 关闭状态码
+// Close codes of graphql-transport-ws
+const (
+	CloseInternalError   uint16 = 4500
+	CloseBadRequest      uint16 = 4400
+	CloseUnauthorized    uint16 = 4401
+	CloseForbidden       uint16 = 4403
+	CloseInitTimeout     uint16 = 4408
+	CloseSubscriberExist uint16 = 4409
+	CloseTooManyInit     uint16 = 4429
+)
+
+// Error GraphQL错误对象
+// GraphQL error object
+type Error struct {
+	Message    string         `json:"message"`
+	Locations  []Location     `json:"locations,omitempty"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (c *Error) Error() string { return "gws: graphql error, message=" + c.Message }
+
+// Errors 解析或者校验失败时Resolver返回的错误, 以error消息发送给客户端
+// Errors returned by the Resolver when parsing or validation fails, they are sent as an error message.
+type Errors []*Error
+
+func (c Errors) Error() string {
+	if len(c) == 0 {
+		return "gws: graphql error"
+	}
+	return c[0].Error()
+}
+
+// Request subscribe消息的内容
+// Payload of a subscribe message
+type Request struct {
+	OperationName string          `json:"operationName,omitempty"`
+	Query         string          `json:"query"`
+	Variables     map[string]any  `json:"variables,omitempty"`
+	Extensions    map[string]any  `json:"extensions,omitempty"`
+	ID            string          `json:"-"`
+	InitPayload   json.RawMessage `json:"-"`
+}
+
+// Result 执行结果, 以next消息发送给客户端
+// Execution result, it's sent as a next message.
+type Result struct {
+	Data       any            `json:"data,omitempty"`
+	Errors     []*Error       `json:"errors,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// Resolver 执行GraphQL操作
+// 返回的通道中的每个结果作为一条next消息发送, 通道关闭后发送complete; query和mutation只需要发送一个结果.
+// 客户端取消订阅或者连接关闭时ctx被取消, 此时应该尽快关闭通道.
+// 返回Errors或者*Error时原样发送error消息, 返回其他错误时使用错误信息作为message.
+// Execute a GraphQL operation.
+// Every result of the returned channel is sent as a next message and complete is sent after the channel is closed;
+// queries and mutations only send a single result.
+// ctx is canceled when the client unsubscribes or the connection closes, the channel should be closed soon after.
+// Errors or *Error is sent as an error message as is, the message of other errors is used otherwise.
+type Resolver interface {
+	Subscribe(ctx context.Context, socket *gws.Conn, request *Request) (<-chan *Result, error)
+}
+
+// ResolverFunc 函数形式的Resolver
+// Resolver as a function
+type ResolverFunc func(ctx context.Context, socket *gws.Conn, request *Request) (<-chan *Result, error)
+
+func (f ResolverFunc) Subscribe(ctx context.Context, socket *gws.Conn, request *Request) (<-chan *Result, error) {
+	return f(ctx, socket, request)
+}
+
+type Option struct {
+	// 等待connection_init的超时, 超时后以4408关闭连接
+	// Timeout of waiting for connection_init, the connection is closed with 4408 after it.
+	InitTimeout time.Duration
+
+	// 收到connection_init时调用, 返回值作为connection_ack的payload; 返回错误时以4403关闭连接
+	// Called on connection_init, the returned value is the payload of connection_ack;
+	// the connection is closed with 4403 on error.
+	OnConnect func(socket *gws.Conn, payload json.RawMessage) (any, error)
+
+	// 确认连接后主动发送ping的间隔, 为0时不发送
+	// Interval of sending pings after the connection is acknowledged, disabled when 0.
+	KeepAlive time.Duration
+}
+
+func (c *Option) initialize() *Option {
+	if c.InitTimeout <= 0 {
+		c.InitTimeout = defaultInitTimeout
+	}
+	return c
+}
+
+type graphqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type graphqlOutMessage struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Payload any    `json:"payload,omitempty"`
+}
+
+// graphqlSubscription 执行中的操作
+type graphqlSubscription struct {
+	mu     sync.Mutex
+	done   bool
+	cancel context.CancelFunc
+}
+
+// 结束订阅, 返回false表示已经结束
+func (c *graphqlSubscription) finish() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return false
+	}
+	c.done = true
+	c.cancel()
+	return true
+}
+
+// graphqlSession 连接的协议状态
+type graphqlSession struct {
+	mu            sync.Mutex
+	initialized   bool
+	acknowledged  bool
+	closed        bool
+	initPayload   json.RawMessage
+	timer         *time.Timer
+	subscriptions map[string]*graphqlSubscription
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+// 注销订阅, ID已经被新的订阅使用时什么也不做
+func (c *graphqlSession) unregister(id string, sub *graphqlSubscription) {
+	c.mu.Lock()
+	if c.subscriptions[id] == sub {
+		delete(c.subscriptions, id)
+	}
+	c.mu.Unlock()
+}
+
+// EventHandler 实现graphql-transport-ws协议的事件处理器
+// 连接上的所有消息都按照协议处理, 其他事件转发给内嵌的Event.
+// Event handler implementing the graphql-transport-ws protocol.
+// All messages of the connection are handled by the protocol, other events are forwarded to the embedded Event.
+type EventHandler struct {
+	gws.Event
+	mu       sync.Mutex
+	resolver Resolver
+	option   *Option
+}
+
+// NewEventHandler 创建graphql-transport-ws事件处理器, handler为nil时使用gws.BuiltinEventHandler
+// Create a graphql-transport-ws event handler, gws.BuiltinEventHandler is used when handler is nil.
+func NewEventHandler(resolver Resolver, option *Option, handler gws.Event) *EventHandler {
+	if option == nil {
+		option = new(Option)
+	}
+	if handler == nil {
+		handler = gws.BuiltinEventHandler{}
+	}
+	var opt = *option
+	return &EventHandler{Event: handler, resolver: resolver, option: opt.initialize()}
+}
+
+func (c *EventHandler) getSession(socket *gws.Conn) *graphqlSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(graphqlSessionKey); ok {
+		return v.(*graphqlSession)
+	}
+	var parent = socket.Context()
+	if parent == nil {
+		parent = context.Background()
+	}
+	var session = &graphqlSession{subscriptions: make(map[string]*graphqlSubscription)}
+	session.ctx, session.cancel = context.WithCancel(parent)
+	socket.Session().Store(graphqlSessionKey, session)
+	return session
+}
+
+func (c *EventHandler) OnOpen(socket *gws.Conn) {
+	var session = c.getSession(socket)
+	session.mu.Lock()
+	session.timer = time.AfterFunc(c.option.InitTimeout, func() {
+		session.mu.Lock()
+		var initialized = session.initialized
+		session.mu.Unlock()
+		if !initialized {
+			socket.WriteClose(CloseInitTimeout, []byte("Connection initialisation timeout"))
+		}
+	})
+	session.mu.Unlock()
+	c.Event.OnOpen(socket)
+}
+
+func (c *EventHandler) OnClose(socket *gws.Conn, err error) {
+	var session = c.getSession(socket)
+	session.mu.Lock()
+	session.closed = true
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	var subscriptions = session.subscriptions
+	session.subscriptions = make(map[string]*graphqlSubscription)
+	session.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.finish()
+	}
+	session.cancel()
+	c.Event.OnClose(socket, err)
+}
+
+func (c *EventHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	var msg graphqlMessage
+	var err = json.Unmarshal(message.Bytes(), &msg)
+	_ = message.Close()
+	if err != nil {
+		socket.WriteClose(CloseBadRequest, []byte("Invalid message received"))
+		return
+	}
+
+	var session = c.getSession(socket)
+	switch msg.Type {
+	case graphqlConnectionInit:
+		c.onInit(socket, session, msg.Payload)
+	case graphqlPing:
+		c.write(socket, &graphqlOutMessage{Type: graphqlPong})
+	case graphqlPong:
+	case graphqlSubscribe:
+		c.onSubscribe(socket, session, &msg)
+	case graphqlComplete:
+		if msg.ID == "" {
+			socket.WriteClose(CloseBadRequest, []byte("Invalid message received"))
+			return
+		}
+		session.mu.Lock()
+		var sub = session.subscriptions[msg.ID]
+		delete(session.subscriptions, msg.ID)
+		session.mu.Unlock()
+		if sub != nil {
+			sub.finish()
+		}
+	default:
+		socket.WriteClose(CloseBadRequest, []byte("Invalid message received"))
+	}
+}
+
+func (c *EventHandler) onInit(socket *gws.Conn, session *graphqlSession, payload json.RawMessage) {
+	session.mu.Lock()
+	if session.initialized {
+		session.mu.Unlock()
+		socket.WriteClose(CloseTooManyInit, []byte("Too many initialisation requests"))
+		return
+	}
+	session.initialized = true
+	session.initPayload = payload
+	session.mu.Unlock()
+
+	var ack any
+	if c.option.OnConnect != nil {
+		var err error
+		if ack, err = c.option.OnConnect(socket, payload); err != nil {
+			socket.WriteClose(CloseForbidden, []byte("Forbidden"))
+			return
+		}
+	}
+
+	session.mu.Lock()
+	session.acknowledged = true
+	session.mu.Unlock()
+	c.write(socket, &graphqlOutMessage{Type: graphqlConnectionAck, Payload: ack})
+	if c.option.KeepAlive > 0 {
+		c.keepAlive(socket, session)
+	}
+}
+
+// 定时发送ping, 直到连接关闭
+func (c *EventHandler) keepAlive(socket *gws.Conn, session *graphqlSession) {
+	time.AfterFunc(c.option.KeepAlive, func() {
+		if session.ctx.Err() != nil {
+			return
+		}
+		if err := c.write(socket, &graphqlOutMessage{Type: graphqlPing}); err == nil {
+			c.keepAlive(socket, session)
+		}
+	})
+}
+
+func (c *EventHandler) onSubscribe(socket *gws.Conn, session *graphqlSession, msg *graphqlMessage) {
+	var request = new(Request)
+	if msg.ID == "" || json.Unmarshal(msg.Payload, request) != nil || request.Query == "" {
+		socket.WriteClose(CloseBadRequest, []byte("Invalid message received"))
+		return
+	}
+
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		return
+	}
+	if !session.acknowledged {
+		session.mu.Unlock()
+		socket.WriteClose(CloseUnauthorized, []byte("Unauthorized"))
+		return
+	}
+	if _, ok := session.subscriptions[msg.ID]; ok {
+		session.mu.Unlock()
+		socket.WriteClose(CloseSubscriberExist, []byte("Subscriber for "+msg.ID+" already exists"))
+		return
+	}
+	var sub = new(graphqlSubscription)
+	var ctx context.Context
+	ctx, sub.cancel = context.WithCancel(session.ctx)
+	session.subscriptions[msg.ID] = sub
+	request.ID, request.InitPayload = msg.ID, session.initPayload
+	session.mu.Unlock()
+
+	go c.execute(ctx, socket, session, sub, request)
+}
+
+// 执行操作并发送结果
+func (c *EventHandler) execute(ctx context.Context, socket *gws.Conn, session *graphqlSession, sub *graphqlSubscription, request *Request) {
+	defer socket.Config().Recovery(socket.Config().Logger)
+	defer func() {
+		session.unregister(request.ID, sub)
+		sub.finish()
+	}()
+
+	results, err := c.resolver.Subscribe(ctx, socket, request)
+	if err != nil {
+		c.send(socket, session, sub, &graphqlOutMessage{ID: request.ID, Type: graphqlError, Payload: graphqlErrors(err)}, true)
+		return
+	}
+
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				c.send(socket, session, sub, &graphqlOutMessage{ID: request.ID, Type: graphqlComplete}, true)
+				return
+			}
+			if !c.send(socket, session, sub, &graphqlOutMessage{ID: request.ID, Type: graphqlNext, Payload: result}, false) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 订阅没有结束时发送消息, last为true时同时结束订阅. 客户端发送complete之后不再发送任何消息.
+// 结束的订阅在发送最后一条消息之前注销, 客户端收到之后可以立即复用ID.
+func (c *EventHandler) send(socket *gws.Conn, session *graphqlSession, sub *graphqlSubscription, msg *graphqlOutMessage, last bool) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.done {
+		return false
+	}
+	if last {
+		sub.done = true
+		sub.cancel()
+		session.unregister(msg.ID, sub)
+	}
+	return c.write(socket, msg) == nil
+}
+
+func (c *EventHandler) write(socket *gws.Conn, msg *graphqlOutMessage) error {
+	return gws.WriteCodec(socket, gws.JSONCodec, msg)
+}
+
+// 将Resolver返回的错误转换为error消息的payload
+func graphqlErrors(err error) []*Error {
+	var list Errors
+	if errors.As(err, &list) && len(list) > 0 {
+		return list
+	}
+	var item *Error
+	if errors.As(err, &item) {
+		return []*Error{item}
+	}
+	return []*Error{{Message: err.Error()}}
+}
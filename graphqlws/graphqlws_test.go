@@ -0,0 +1,261 @@
+package graphqlws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+var graphqlTestResolver = ResolverFunc(func(ctx context.Context, socket *gws.Conn, request *Request) (<-chan *Result, error) {
+	switch request.Query {
+	case "invalid":
+		return nil, Errors{{Message: "syntax error", Locations: []Location{{Line: 1, Column: 1}}}}
+	case "fail":
+		return nil, errors.New("oops")
+	case "panic":
+		panic("resolver panic")
+	}
+	var results = make(chan *Result)
+	go func() {
+		defer close(results)
+		var n = 1
+		if v, ok := request.Variables["n"].(float64); ok {
+			n = int(v)
+		}
+		// n为负数时一直发送, 直到取消
+		for i := 0; n < 0 || i < n; i++ {
+			select {
+			case results <- &Result{Data: map[string]any{"count": i}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results, nil
+})
+
+type graphqlTestClient struct {
+	conn     *gws.Conn
+	messages chan *graphqlMessage
+	closed   chan *gws.CloseError
+}
+
+func newGraphQLTestClient(option *Option) *graphqlTestClient {
+	var c = &graphqlTestClient{messages: make(chan *graphqlMessage, 64), closed: make(chan *gws.CloseError, 1)}
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *gws.Conn, message *gws.Message) {
+		var msg = new(graphqlMessage)
+		_ = json.Unmarshal(message.Bytes(), msg)
+		c.messages <- msg
+	}
+	clientHandler.onClose = func(socket *gws.Conn, err error) {
+		var closeErr *gws.CloseError
+		errors.As(err, &closeErr)
+		c.closed <- closeErr
+	}
+	var serverHandler = NewEventHandler(graphqlTestResolver, option, nil)
+	server, client := newPeer(serverHandler, &gws.ServerOption{Recovery: gws.Recovery}, clientHandler, &gws.ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	c.conn = client
+	return c
+}
+
+func (c *graphqlTestClient) send(s string) { _ = c.conn.WriteString(s) }
+
+func (c *graphqlTestClient) next() *graphqlMessage {
+	select {
+	case msg := <-c.messages:
+		return msg
+	case <-time.After(time.Second):
+		return &graphqlMessage{Type: "timeout"}
+	}
+}
+
+func (c *graphqlTestClient) closeCode() uint16 {
+	select {
+	case err := <-c.closed:
+		if err == nil {
+			return 0
+		}
+		return err.Code
+	case <-time.After(time.Second):
+		return 0
+	}
+}
+
+func (c *graphqlTestClient) init() {
+	c.send(`{"type":"connection_init"}`)
+	c.next()
+}
+
+func TestGraphQLEventHandler(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("lifecycle", func(t *testing.T) {
+		var client = newGraphQLTestClient(&Option{
+			OnConnect: func(socket *gws.Conn, payload json.RawMessage) (any, error) {
+				return map[string]any{"token": string(payload)}, nil
+			},
+		})
+		client.send(`{"type":"ping"}`)
+		as.Equal(graphqlPong, client.next().Type)
+
+		client.send(`{"type":"connection_init","payload":"abc"}`)
+		var ack = client.next()
+		as.Equal(graphqlConnectionAck, ack.Type)
+		as.JSONEq(`{"token":"\"abc\""}`, string(ack.Payload))
+
+		client.send(`{"id":"1","type":"subscribe","payload":{"query":"counter","variables":{"n":3}}}`)
+		for i := 0; i < 3; i++ {
+			var msg = client.next()
+			as.Equal(graphqlNext, msg.Type)
+			as.Equal("1", msg.ID)
+			as.JSONEq(`{"data":{"count":`+string(rune('0'+i))+`}}`, string(msg.Payload))
+		}
+		var msg = client.next()
+		as.Equal(graphqlComplete, msg.Type)
+		as.Equal("1", msg.ID)
+
+		// 完成之后可以复用ID
+		client.send(`{"id":"1","type":"subscribe","payload":{"query":"counter"}}`)
+		as.Equal(graphqlNext, client.next().Type)
+		as.Equal(graphqlComplete, client.next().Type)
+
+		client.send(`{"type":"pong"}`)
+		client.send(`{"type":"ping"}`)
+		as.Equal(graphqlPong, client.next().Type)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var client = newGraphQLTestClient(nil)
+		client.init()
+		client.send(`{"id":"a","type":"subscribe","payload":{"query":"invalid"}}`)
+		var msg = client.next()
+		as.Equal(graphqlError, msg.Type)
+		as.Equal("a", msg.ID)
+		as.JSONEq(`[{"message":"syntax error","locations":[{"line":1,"column":1}]}]`, string(msg.Payload))
+
+		client.send(`{"id":"b","type":"subscribe","payload":{"query":"fail"}}`)
+		msg = client.next()
+		as.Equal(graphqlError, msg.Type)
+		as.JSONEq(`[{"message":"oops"}]`, string(msg.Payload))
+
+		client.send(`{"id":"c","type":"subscribe","payload":{"query":"panic"}}`)
+		client.send(`{"type":"ping"}`)
+		as.Equal(graphqlPong, client.next().Type)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		var client = newGraphQLTestClient(nil)
+		client.init()
+		client.send(`{"id":"1","type":"subscribe","payload":{"query":"counter","variables":{"n":-1}}}`)
+		as.Equal(graphqlNext, client.next().Type)
+		client.send(`{"id":"1","type":"complete"}`)
+		client.send(`{"id":"unknown","type":"complete"}`)
+
+		// complete之后不再收到该订阅的消息
+		time.Sleep(50 * time.Millisecond)
+		for len(client.messages) > 0 {
+			<-client.messages
+		}
+		client.send(`{"type":"ping"}`)
+		as.Equal(graphqlPong, client.next().Type)
+		as.Equal(0, len(client.messages))
+	})
+
+	t.Run("close codes", func(t *testing.T) {
+		var cases = []struct {
+			option   *Option
+			messages []string
+			code     uint16
+		}{
+			{nil, []string{`{`}, CloseBadRequest},
+			{nil, []string{`{"type":"unknown"}`}, CloseBadRequest},
+			{nil, []string{`{"type":"next","id":"1"}`}, CloseBadRequest},
+			{nil, []string{`{"type":"connection_init"}`, `{"type":"subscribe","payload":{"query":"counter"}}`}, CloseBadRequest},
+			{nil, []string{`{"type":"connection_init"}`, `{"id":"1","type":"subscribe","payload":{}}`}, CloseBadRequest},
+			{nil, []string{`{"type":"complete"}`}, CloseBadRequest},
+			{nil, []string{`{"id":"1","type":"subscribe","payload":{"query":"counter"}}`}, CloseUnauthorized},
+			{nil, []string{`{"type":"connection_init"}`, `{"type":"connection_init"}`}, CloseTooManyInit},
+			{nil, []string{
+				`{"type":"connection_init"}`,
+				`{"id":"1","type":"subscribe","payload":{"query":"counter","variables":{"n":-1}}}`,
+				`{"id":"1","type":"subscribe","payload":{"query":"counter"}}`,
+			}, CloseSubscriberExist},
+			{&Option{OnConnect: func(socket *gws.Conn, payload json.RawMessage) (any, error) {
+				return nil, errors.New("denied")
+			}}, []string{`{"type":"connection_init"}`}, CloseForbidden},
+			{&Option{InitTimeout: 50 * time.Millisecond}, nil, CloseInitTimeout},
+		}
+		for i, item := range cases {
+			var client = newGraphQLTestClient(item.option)
+			for _, s := range item.messages {
+				client.send(s)
+			}
+			as.Equal(item.code, client.closeCode(), i)
+		}
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		var client = newGraphQLTestClient(&Option{KeepAlive: 20 * time.Millisecond, InitTimeout: 50 * time.Millisecond})
+		client.init()
+		as.Equal(graphqlPing, client.next().Type)
+		as.Equal(graphqlPing, client.next().Type)
+
+		// 确认之后不会触发初始化超时
+		time.Sleep(60 * time.Millisecond)
+		select {
+		case <-client.closed:
+			as.Fail("unexpected close")
+		default:
+		}
+	})
+}
+
+type webSocketMocker struct {
+	gws.BuiltinEventHandler
+	onMessage func(socket *gws.Conn, message *gws.Message)
+	onClose   func(socket *gws.Conn, err error)
+}
+
+func (c *webSocketMocker) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if c.onMessage != nil {
+		c.onMessage(socket, message)
+	}
+}
+
+func (c *webSocketMocker) OnClose(socket *gws.Conn, err error) {
+	if c.onClose != nil {
+		c.onClose(socket, err)
+	}
+}
+
+// 在内存管道上完成握手, 返回服务端和客户端的连接
+func newPeer(serverHandler gws.Event, serverOption *gws.ServerOption, clientHandler gws.Event, clientOption *gws.ClientOption) (server, client *gws.Conn) {
+	var s, c = net.Pipe()
+	var upgrader = gws.NewUpgrader(serverHandler, serverOption)
+	var accepted = make(chan *gws.Conn, 1)
+	go func() {
+		var br = bufio.NewReader(s)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		socket, _ := upgrader.UpgradeFromConn(s, br, r)
+		accepted <- socket
+	}()
+	clientOption.Addr = "ws://localhost/"
+	client, _, _ = gws.NewClientFromConn(clientHandler, clientOption, c)
+	server = <-accepted
+	return server, client
+}
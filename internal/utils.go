@@ -230,3 +230,11 @@ func IsSameSlice[T comparable](a, b []T) bool {
 	}
 	return true
 }
+
+// IsSameBytes 判断两个切片是否引用同一段内存
+func IsSameBytes(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
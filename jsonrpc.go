@@ -0,0 +1,478 @@
+package gws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	rpcVersion    = "2.0"
+	rpcSessionKey = "gws:jsonrpc"
+)
+
+// JSON-RPC 2.0 预定义的错误码
+// Error codes defined by JSON-RPC 2.0
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+// RPCError JSON-RPC错误对象. 方法返回*RPCError时原样响应, 返回其他错误时响应RPCInternalError.
+// JSON-RPC error object. A method returning *RPCError responds with it as is, other errors respond with RPCInternalError.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (c *RPCError) Error() string {
+	return "gws: jsonrpc error, code=" + strconv.Itoa(c.Code) + ", message=" + c.Message
+}
+
+// RPCMethod JSON-RPC方法, 通知的返回值会被忽略
+// JSON-RPC method, the result of a notification is discarded.
+type RPCMethod func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error)
+
+// RPCMux JSON-RPC方法路由, 可以被多个连接共享
+// JSON-RPC method router, it can be shared by connections.
+type RPCMux struct {
+	mu      sync.RWMutex
+	methods map[string]RPCMethod
+}
+
+func NewRPCMux() *RPCMux {
+	return &RPCMux{methods: make(map[string]RPCMethod)}
+}
+
+// Register 注册方法
+// Register a method
+func (c *RPCMux) Register(method string, handler RPCMethod) {
+	c.mu.Lock()
+	c.methods[method] = handler
+	c.mu.Unlock()
+}
+
+func (c *RPCMux) get(method string) (RPCMethod, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	handler, ok := c.methods[method]
+	c.mu.RUnlock()
+	return handler, ok
+}
+
+// RegisterRPC 注册类型化的方法, 参数解码失败时响应RPCInvalidParams
+// Register a typed method, RPCInvalidParams is responded when the params cannot be decoded.
+func RegisterRPC[P any, R any](mux *RPCMux, method string, handler func(ctx context.Context, peer *RPCPeer, params P) (R, error)) {
+	mux.Register(method, func(ctx context.Context, peer *RPCPeer, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &RPCError{Code: RPCInvalidParams, Message: "invalid params"}
+			}
+		}
+		return handler(ctx, peer, params)
+	})
+}
+
+// rpcMessage 请求, 通知和响应共用的结构
+type rpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+func (c *rpcMessage) isResponse() bool {
+	return c.Method == "" && (c.Result != nil || c.Error != nil)
+}
+
+// rpcRequest 出站请求, params为nil时省略
+type rpcRequest struct {
+	Version string  `json:"jsonrpc"`
+	ID      *uint64 `json:"id,omitempty"`
+	Method  string  `json:"method"`
+	Params  any     `json:"params,omitempty"`
+}
+
+// rpcResponse 出站响应, result和error二选一, id为空时必须响应null
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+func newRPCResponse(id json.RawMessage, result any, err error) *rpcResponse {
+	var resp = &rpcResponse{Version: rpcVersion, ID: id}
+	if len(resp.ID) == 0 {
+		resp.ID = json.RawMessage("null")
+	}
+	if err == nil {
+		// 成功的响应必须包含result
+		resp.Result = rpcResult(result)
+		return resp
+	}
+	if e, ok := err.(*RPCError); ok {
+		resp.Error = e
+	} else {
+		resp.Error = &RPCError{Code: RPCInternalError, Message: err.Error()}
+	}
+	return resp
+}
+
+// result为nil时响应null
+func rpcResult(v any) any {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
+
+// RPCCall 批量请求中的一个调用
+// A call of a batch request
+type RPCCall struct {
+	// 方法名
+	Method string
+
+	// 参数
+	Params any
+
+	// 结果, 为nil时丢弃结果
+	// Result, discarded when nil
+	Result any
+
+	// 是否为通知, 通知没有响应
+	// Whether it's a notification, which has no response
+	Notify bool
+
+	// 调用错误
+	// Error of the call
+	Error error
+}
+
+// rpcPending 等待响应的调用
+type rpcPending struct {
+	done chan struct{}
+	msg  *rpcMessage
+	err  error
+}
+
+// RPCPeer 连接上的JSON-RPC端点, 服务端和客户端是对等的, 都可以发起调用.
+// 请求在连接的任务队列中执行, 开启ParallelEnabled时最大并发为ParallelGolimit, 否则按顺序执行;
+// 响应在读协程中直接处理, 所以方法内部可以安全地调用对端.
+// JSON-RPC endpoint of a connection. Both ends are peers and can initiate calls.
+// Requests are executed in a task queue with a concurrency of ParallelGolimit if ParallelEnabled, otherwise in order;
+// responses are handled in the read goroutine, so a method may call the peer safely.
+type RPCPeer struct {
+	socket  *Conn
+	mux     *RPCMux
+	serial  uint64
+	mu      sync.Mutex
+	pending map[uint64]*rpcPending
+	err     error
+	queue   *workerQueue
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newRPCPeer(socket *Conn, mux *RPCMux) *RPCPeer {
+	var concurrency = int32(1)
+	if socket.config.ParallelEnabled {
+		concurrency = int32(socket.config.ParallelGolimit)
+	}
+	var c = &RPCPeer{
+		socket:  socket,
+		mux:     mux,
+		pending: make(map[uint64]*rpcPending),
+		queue:   newWorkerQueue(concurrency),
+	}
+	var parent = socket.Context()
+	if parent == nil {
+		parent = context.Background()
+	}
+	c.ctx, c.cancel = context.WithCancel(parent)
+	return c
+}
+
+// Conn 获取连接
+// Get the connection
+func (c *RPCPeer) Conn() *Conn { return c.socket }
+
+// Call 调用对端的方法, result为nil时丢弃结果. 对端返回的错误为*RPCError.
+// Call a method of the peer, the result is discarded when nil. Errors returned by the peer are *RPCError.
+func (c *RPCPeer) Call(ctx context.Context, method string, params any, result any) error {
+	var call = &RPCCall{Method: method, Params: params, Result: result}
+	if err := c.Batch(ctx, call); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+// Notify 发送通知
+// Send a notification
+func (c *RPCPeer) Notify(method string, params any) error {
+	return WriteCodec(c.socket, JSONCodec, &rpcRequest{Version: rpcVersion, Method: method, Params: params})
+}
+
+// Batch 批量调用, 每个调用的错误保存在RPCCall.Error中. 只有一个调用时按照普通请求发送.
+// 返回的错误表示请求没有完成, 比如上下文超时或者连接关闭.
+// Batch call, the error of each call is stored in RPCCall.Error. A single call is sent as a plain request.
+// The returned error means the request did not complete, e.g. the context expired or the connection was closed.
+func (c *RPCPeer) Batch(ctx context.Context, calls ...*RPCCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	var requests = make([]*rpcRequest, 0, len(calls))
+	var ids = make([]uint64, len(calls))
+	var waits = make([]*rpcPending, len(calls))
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	for i, call := range calls {
+		var request = &rpcRequest{Version: rpcVersion, Method: call.Method, Params: call.Params}
+		if !call.Notify {
+			ids[i] = atomic.AddUint64(&c.serial, 1)
+			request.ID = &ids[i]
+			waits[i] = &rpcPending{done: make(chan struct{})}
+			c.pending[ids[i]] = waits[i]
+		}
+		requests = append(requests, request)
+	}
+	c.mu.Unlock()
+
+	var err error
+	if len(requests) == 1 {
+		err = WriteCodec(c.socket, JSONCodec, requests[0])
+	} else {
+		err = WriteCodec(c.socket, JSONCodec, requests)
+	}
+	if err != nil {
+		c.forget(ids)
+		return err
+	}
+
+	for i, wait := range waits {
+		if wait == nil {
+			continue
+		}
+		select {
+		case <-wait.done:
+			calls[i].Error = c.decodeResult(wait, calls[i].Result)
+		case <-ctx.Done():
+			c.forget(ids)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (c *RPCPeer) decodeResult(wait *rpcPending, result any) error {
+	if wait.err != nil {
+		return wait.err
+	}
+	if wait.msg.Error != nil {
+		return wait.msg.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(wait.msg.Result, result)
+}
+
+// 删除等待中的调用
+func (c *RPCPeer) forget(ids []uint64) {
+	c.mu.Lock()
+	for _, id := range ids {
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// 处理响应
+func (c *RPCPeer) resolve(msg *rpcMessage) {
+	id, err := strconv.ParseUint(string(msg.ID), 10, 64)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	wait, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ok {
+		wait.msg = msg
+		close(wait.done)
+	}
+}
+
+// Serve 处理收到的消息
+// Handle an inbound message
+func (c *RPCPeer) Serve(message *Message) {
+	var data = bytes.TrimSpace(message.Bytes())
+	if len(data) > 0 && data[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			c.reply(newRPCResponse(nil, nil, &RPCError{Code: RPCParseError, Message: "parse error"}))
+			return
+		}
+		if len(items) == 0 {
+			c.reply(newRPCResponse(nil, nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"}))
+			return
+		}
+		var requests = make([]*rpcMessage, 0, len(items))
+		for _, item := range items {
+			var msg = new(rpcMessage)
+			if err := json.Unmarshal(item, msg); err != nil {
+				msg = &rpcMessage{}
+			}
+			if msg.isResponse() {
+				c.resolve(msg)
+				continue
+			}
+			requests = append(requests, msg)
+		}
+		if len(requests) > 0 {
+			c.queue.Push(func() { c.serveBatch(requests) })
+		}
+		return
+	}
+
+	var msg = new(rpcMessage)
+	if err := json.Unmarshal(data, msg); err != nil {
+		if json.Valid(data) {
+			c.reply(newRPCResponse(nil, nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"}))
+		} else {
+			c.reply(newRPCResponse(nil, nil, &RPCError{Code: RPCParseError, Message: "parse error"}))
+		}
+		return
+	}
+	if msg.isResponse() {
+		c.resolve(msg)
+		return
+	}
+	c.queue.Push(func() {
+		if resp := c.serveRequest(msg); resp != nil {
+			c.reply(resp)
+		}
+	})
+}
+
+func (c *RPCPeer) serveBatch(requests []*rpcMessage) {
+	var responses = make([]*rpcResponse, 0, len(requests))
+	for _, msg := range requests {
+		if resp := c.serveRequest(msg); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) > 0 {
+		c.reply(responses)
+	}
+}
+
+// 执行请求, 通知返回nil
+func (c *RPCPeer) serveRequest(msg *rpcMessage) *rpcResponse {
+	defer c.socket.config.Recovery(c.socket.config.Logger)
+
+	if msg.Version != rpcVersion || msg.Method == "" {
+		return newRPCResponse(msg.ID, nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid request"})
+	}
+	var isNotification = len(msg.ID) == 0
+	handler, ok := c.mux.get(msg.Method)
+	if !ok {
+		if isNotification {
+			return nil
+		}
+		return newRPCResponse(msg.ID, nil, &RPCError{Code: RPCMethodNotFound, Message: "method not found"})
+	}
+	result, err := handler(c.ctx, c, msg.Params)
+	if isNotification {
+		return nil
+	}
+	return newRPCResponse(msg.ID, result, err)
+}
+
+func (c *RPCPeer) reply(v any) {
+	_ = WriteCodec(c.socket, JSONCodec, v)
+}
+
+// Close 取消执行中的方法, 等待中的调用返回err
+// Cancel the running methods, pending calls return err.
+func (c *RPCPeer) Close(err error) {
+	if err == nil {
+		err = ErrConnClosed
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	var pending = c.pending
+	c.pending = make(map[uint64]*rpcPending)
+	c.mu.Unlock()
+
+	c.cancel()
+	for _, wait := range pending {
+		wait.err = err
+		close(wait.done)
+	}
+}
+
+// RPCEventHandler 将连接上的消息作为JSON-RPC处理的事件处理器
+// 其他事件转发给内嵌的Event.
+// Event handler that serves messages of the connection as JSON-RPC, other events are forwarded to the embedded Event.
+type RPCEventHandler struct {
+	Event
+	mu  sync.Mutex
+	mux *RPCMux
+}
+
+// NewRPCEventHandler 创建JSON-RPC事件处理器, handler为nil时使用BuiltinEventHandler
+// Create a JSON-RPC event handler, BuiltinEventHandler is used when handler is nil.
+func NewRPCEventHandler(mux *RPCMux, handler Event) *RPCEventHandler {
+	if handler == nil {
+		handler = BuiltinEventHandler{}
+	}
+	return &RPCEventHandler{Event: handler, mux: mux}
+}
+
+// Peer 获取连接的JSON-RPC端点, 不存在时创建
+// Get the JSON-RPC endpoint of the connection, created if absent
+func (c *RPCEventHandler) Peer(socket *Conn) *RPCPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(rpcSessionKey); ok {
+		return v.(*RPCPeer)
+	}
+	var peer = newRPCPeer(socket, c.mux)
+	socket.Session().Store(rpcSessionKey, peer)
+	return peer
+}
+
+func (c *RPCEventHandler) OnOpen(socket *Conn) {
+	c.Peer(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *RPCEventHandler) OnClose(socket *Conn, err error) {
+	c.Peer(socket).Close(err)
+	c.Event.OnClose(socket, err)
+}
+
+func (c *RPCEventHandler) OnMessage(socket *Conn, message *Message) {
+	c.Peer(socket).Serve(message)
+	_ = message.Close()
+}
@@ -0,0 +1,253 @@
+package gws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type rpcAddParams struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func newRPCTestMux() *RPCMux {
+	var mux = NewRPCMux()
+	RegisterRPC(mux, "add", func(ctx context.Context, peer *RPCPeer, params rpcAddParams) (int, error) {
+		return params.A + params.B, nil
+	})
+	mux.Register("fail", func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error) {
+		return nil, errors.New("oops")
+	})
+	mux.Register("deny", func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error) {
+		return nil, &RPCError{Code: 4001, Message: "denied", Data: "token expired"}
+	})
+	mux.Register("sleep", func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		return nil, nil
+	})
+	return mux
+}
+
+// 建立一对JSON-RPC端点
+func newRPCPeers(serverMux, clientMux *RPCMux, serverOption *ServerOption) (server, client *RPCPeer) {
+	var serverHandler = NewRPCEventHandler(serverMux, nil)
+	var clientHandler = NewRPCEventHandler(clientMux, nil)
+	serverConn, clientConn := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go serverConn.ReadLoop()
+	go clientConn.ReadLoop()
+	return serverHandler.Peer(serverConn), clientHandler.Peer(clientConn)
+}
+
+func TestRPCPeer_Call(t *testing.T) {
+	var as = assert.New(t)
+	var ctx = context.Background()
+	_, client := newRPCPeers(newRPCTestMux(), nil, &ServerOption{})
+
+	var sum int
+	as.NoError(client.Call(ctx, "add", rpcAddParams{A: 1, B: 2}, &sum))
+	as.Equal(3, sum)
+	as.NoError(client.Call(ctx, "add", nil, nil))
+
+	var err = client.Call(ctx, "add", "invalid", &sum)
+	if as.IsType(&RPCError{}, err) {
+		as.Equal(RPCInvalidParams, err.(*RPCError).Code)
+	}
+
+	err = client.Call(ctx, "missing", nil, nil)
+	if as.IsType(&RPCError{}, err) {
+		as.Equal(RPCMethodNotFound, err.(*RPCError).Code)
+	}
+
+	err = client.Call(ctx, "fail", nil, nil)
+	if as.IsType(&RPCError{}, err) {
+		as.Equal(RPCInternalError, err.(*RPCError).Code)
+		as.Equal("oops", err.(*RPCError).Message)
+	}
+
+	err = client.Call(ctx, "deny", nil, nil)
+	if as.IsType(&RPCError{}, err) {
+		as.Equal(4001, err.(*RPCError).Code)
+		as.Equal("token expired", err.(*RPCError).Data)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	as.ErrorIs(client.Call(timeout, "sleep", nil, nil), context.DeadlineExceeded)
+	client.mu.Lock()
+	as.Equal(0, len(client.pending))
+	client.mu.Unlock()
+}
+
+func TestRPCPeer_Notify(t *testing.T) {
+	var as = assert.New(t)
+	var mux = NewRPCMux()
+	var received = make(chan string, 1)
+	RegisterRPC(mux, "log", func(ctx context.Context, peer *RPCPeer, params []string) (any, error) {
+		received <- params[0]
+		return "ignored", nil
+	})
+	_, client := newRPCPeers(mux, nil, &ServerOption{})
+	as.NoError(client.Notify("log", []string{"hello"}))
+	as.NoError(client.Notify("missing", nil))
+	as.Equal("hello", <-received)
+}
+
+func TestRPCPeer_Batch(t *testing.T) {
+	var as = assert.New(t)
+	var mux = newRPCTestMux()
+	var notified = make(chan struct{}, 1)
+	mux.Register("ping", func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error) {
+		notified <- struct{}{}
+		return nil, nil
+	})
+	_, client := newRPCPeers(mux, nil, &ServerOption{})
+
+	var a, b int
+	var calls = []*RPCCall{
+		{Method: "add", Params: rpcAddParams{A: 1, B: 2}, Result: &a},
+		{Method: "ping", Notify: true},
+		{Method: "missing"},
+		{Method: "add", Params: rpcAddParams{A: 3, B: 4}, Result: &b},
+	}
+	as.NoError(client.Batch(context.Background(), calls...))
+	<-notified
+	as.Equal(3, a)
+	as.Equal(7, b)
+	as.NoError(calls[0].Error)
+	as.NoError(calls[1].Error)
+	as.Error(calls[2].Error)
+	as.NoError(calls[3].Error)
+
+	as.NoError(client.Batch(context.Background()))
+	as.NoError(client.Batch(context.Background(), &RPCCall{Method: "ping", Notify: true}))
+	<-notified
+}
+
+// 服务端在处理请求时回调客户端
+func TestRPCPeer_ServerCall(t *testing.T) {
+	var as = assert.New(t)
+	var serverMux = NewRPCMux()
+	RegisterRPC(serverMux, "greet", func(ctx context.Context, peer *RPCPeer, name string) (string, error) {
+		var title string
+		if err := peer.Call(ctx, "title", name, &title); err != nil {
+			return "", err
+		}
+		return "hello, " + title + " " + name, nil
+	})
+	var clientMux = NewRPCMux()
+	RegisterRPC(clientMux, "title", func(ctx context.Context, peer *RPCPeer, name string) (string, error) {
+		return "dr.", nil
+	})
+
+	for _, parallel := range []bool{false, true} {
+		server, client := newRPCPeers(serverMux, clientMux, &ServerOption{ParallelEnabled: parallel, ParallelGolimit: 2})
+		var greeting string
+		as.NoError(client.Call(context.Background(), "greet", "who", &greeting))
+		as.Equal("hello, dr. who", greeting)
+
+		var title string
+		as.NoError(server.Call(context.Background(), "title", "who", &title))
+		as.Equal("dr.", title)
+	}
+}
+
+func TestRPCPeer_Parallel(t *testing.T) {
+	var as = assert.New(t)
+	var mux = NewRPCMux()
+	var running, maxRunning int32
+	mux.Register("work", func(ctx context.Context, peer *RPCPeer, params json.RawMessage) (any, error) {
+		var n = atomic.AddInt32(&running, 1)
+		for {
+			var m = atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil, nil
+	})
+
+	var test = func(option *ServerOption) int32 {
+		atomic.StoreInt32(&maxRunning, 0)
+		_, client := newRPCPeers(mux, nil, option)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				as.NoError(client.Call(context.Background(), "work", nil, nil))
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&maxRunning)
+	}
+
+	as.Equal(int32(1), test(&ServerOption{}))
+	var n = test(&ServerOption{ParallelEnabled: true, ParallelGolimit: 4})
+	as.True(n > 1 && n <= 4)
+}
+
+func TestRPCPeer_Close(t *testing.T) {
+	var as = assert.New(t)
+	server, client := newRPCPeers(newRPCTestMux(), nil, &ServerOption{})
+	var done = make(chan error, 1)
+	go func() { done <- client.Call(context.Background(), "sleep", nil, nil) }()
+	time.Sleep(20 * time.Millisecond)
+	_ = server.Conn().NetConn().Close()
+	as.Error(<-done)
+	as.Error(client.Call(context.Background(), "add", nil, nil))
+	client.Close(nil)
+}
+
+// 直接发送原始报文, 校验协议细节
+func TestRPCPeer_Protocol(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = NewRPCEventHandler(newRPCTestMux(), nil)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan string, 8)
+	clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var cases = []struct {
+		request  string
+		response string
+	}{
+		{`{"jsonrpc":"2.0","method":"add","params":{"a":1,"b":1},"id":"abc"}`, `{"jsonrpc":"2.0","id":"abc","result":2}`},
+		{`{"jsonrpc":"2.0","method":"add","params":{"a":1,"b":1},"id":null}`, `{"jsonrpc":"2.0","id":null,"result":2}`},
+		{`{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid params"}}`},
+		{`{"jsonrpc":"1.0","method":"add","id":2}`, `{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`{"jsonrpc":"2.0","method":"add","params":{"a":1,"b":1}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+		{`1`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}`},
+		{`[1`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+		{`[1,{"jsonrpc":"2.0","method":"add","params":{"a":2,"b":2},"id":3},{"jsonrpc":"2.0","method":"add"}]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}},{"jsonrpc":"2.0","id":3,"result":4}]`},
+	}
+	for _, item := range cases {
+		as.NoError(client.WriteString(item.request))
+		as.JSONEq(item.response, <-received, item.request)
+	}
+
+	// 全部是通知的批量请求没有响应
+	as.NoError(client.WriteString(`[{"jsonrpc":"2.0","method":"add"},{"jsonrpc":"2.0","method":"missing"}]`))
+	as.NoError(client.WriteString(`{"jsonrpc":"2.0","method":"add","params":{"a":0,"b":0},"id":4}`))
+	as.JSONEq(`{"jsonrpc":"2.0","id":4,"result":0}`, <-received)
+
+	// 未知的响应被忽略
+	as.NoError(client.WriteString(`{"jsonrpc":"2.0","id":100,"result":1}`))
+	as.NoError(client.WriteString(`[{"jsonrpc":"2.0","id":"x","result":1}]`))
+	as.NoError(client.WriteString(`{"jsonrpc":"2.0","method":"add","id":5}`))
+	as.JSONEq(`{"jsonrpc":"2.0","id":5,"result":0}`, <-received)
+}
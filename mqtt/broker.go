@@ -0,0 +1,593 @@
+package mqtt
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marifcelik/gws"
+	"github.com/marifcelik/gws/internal"
+)
+
+const mqttBrokerSessionKey = "gws:mqtt-broker"
+
+// MQTT 5 原因码和属性
+const (
+	mqttReasonSuccess              byte = 0x00
+	mqttReasonNoSubscription       byte = 0x11
+	mqttReasonUnspecified          byte = 0x80
+	mqttReasonProtocolError        byte = 0x82
+	mqttReasonUnsupportedVersion   byte = 0x84
+	mqttReasonBadAuth              byte = 0x86
+	mqttReasonSessionTakenOver     byte = 0x8E
+	mqttReasonTopicFilterInvalid   byte = 0x8F
+	mqttReasonDisconnectWithWill   byte = 0x04
+	mqttPropertyAssignedClientID   byte = 0x12
+	mqttPropertyMaximumQoS         byte = 0x24
+	mqttPropertySharedSubAvailable byte = 0x2A
+)
+
+// MQTT 3.1.1 CONNACK返回码
+const (
+	mqttReturnUnacceptableVersion byte = 0x01
+	mqttReturnIdentifierRejected  byte = 0x02
+	mqttReturnNotAuthorized       byte = 0x05
+)
+
+var errMQTTProtocol = errors.New("gws: mqtt protocol error")
+
+type BrokerOption struct {
+	// 校验客户端的身份, 返回false时拒绝连接
+	// Authenticate the client, the connection is refused when it returns false.
+	Authenticate func(socket *gws.Conn, clientID, username string, password []byte) bool
+}
+
+// Broker 进程内的MQTT代理, 支持MQTT 3.1.1和MQTT 5, QoS 0/1, 保留消息和通配符主题.
+// 会话总是按照clean session处理, 连接断开后不保留订阅; 不支持QoS 2和共享订阅.
+// QoS 0的消息使用Broadcaster向订阅者扇出.
+// In-process MQTT broker supporting MQTT 3.1.1 and MQTT 5, QoS 0/1, retained messages and wildcard topics.
+// Sessions are always clean and subscriptions are dropped on disconnect; QoS 2 and shared subscriptions are not supported.
+// QoS 0 messages are fanned out to subscribers with Broadcaster.
+type Broker struct {
+	option        *BrokerOption
+	mu            sync.RWMutex
+	serial        uint64
+	sessions      map[string]*mqttSession
+	subscriptions map[string]map[*mqttSession]mqttSubOption
+	retained      map[string]*mqttMessage
+}
+
+func NewBroker(option *BrokerOption) *Broker {
+	if option == nil {
+		option = new(BrokerOption)
+	}
+	return &Broker{
+		option:        option,
+		sessions:      make(map[string]*mqttSession),
+		subscriptions: make(map[string]map[*mqttSession]mqttSubOption),
+		retained:      make(map[string]*mqttMessage),
+	}
+}
+
+// mqttMessage 应用消息, 字段不引用读缓冲区
+type mqttMessage struct {
+	topic      string
+	payload    []byte
+	qos        byte
+	retain     bool
+	properties []byte // MQTT 5的原始属性, 包含长度
+}
+
+type mqttSubOption struct {
+	qos               byte
+	noLocal           bool
+	retainAsPublished bool
+}
+
+// mqttSession 连接的会话
+type mqttSession struct {
+	stream    *Stream
+	clientID  string
+	version   byte
+	keepAlive time.Duration
+	packetID  uint32
+	mu        sync.Mutex
+	connected bool
+	will      *mqttMessage
+	filters   map[string]struct{}
+}
+
+func (c *mqttSession) nextPacketID() uint16 {
+	for {
+		if id := uint16(atomic.AddUint32(&c.packetID, 1)); id != 0 {
+			return id
+		}
+	}
+}
+
+func (c *mqttSession) write(packetType byte, flags byte, body []byte) error {
+	return c.stream.WritePacket(&Packet{Type: packetType, Flags: flags, Body: body})
+}
+
+// 刷新读超时, 超过1.5倍保活时间没有收到报文时断开连接
+func (c *mqttSession) touch() {
+	if c.keepAlive > 0 {
+		_ = c.stream.Conn().SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+	}
+}
+
+func (c *Broker) getSession(stream *Stream) *mqttSession {
+	var ss = stream.Conn().Session()
+	if v, ok := ss.Load(mqttBrokerSessionKey); ok {
+		return v.(*mqttSession)
+	}
+	var session = &mqttSession{stream: stream, filters: make(map[string]struct{})}
+	ss.Store(mqttBrokerSessionKey, session)
+	return session
+}
+
+// OnPacket 实现Handler
+// Implements Handler
+func (c *Broker) OnPacket(stream *Stream, packet *Packet) error {
+	var session = c.getSession(stream)
+	session.touch()
+	if !session.connected {
+		if packet.Type != Connect {
+			return errMQTTProtocol
+		}
+		return c.connect(session, packet)
+	}
+
+	var err error
+	switch packet.Type {
+	case Publish:
+		err = c.onPublish(session, packet)
+	case Puback:
+		// QoS 1的消息不会重发, 确认只需要校验格式
+		if len(packet.Body) < 2 {
+			err = ErrPacket
+		}
+	case Subscribe:
+		err = c.subscribe(session, packet)
+	case Unsubscribe:
+		err = c.unsubscribe(session, packet)
+	case Pingreq:
+		err = session.write(Pingresp, 0, nil)
+	case Disconnect:
+		// MQTT 5可以要求发布遗嘱消息
+		var withWill = session.version == 5 && len(packet.Body) > 0 && packet.Body[0] == mqttReasonDisconnectWithWill
+		if !withWill {
+			session.mu.Lock()
+			session.will = nil
+			session.mu.Unlock()
+		}
+		stream.Conn().WriteClose(1000, nil)
+	default:
+		err = errMQTTProtocol
+	}
+
+	if err != nil && session.version == 5 {
+		var reason = mqttReasonProtocolError
+		if errors.Is(err, ErrPacket) {
+			reason = mqttReasonUnspecified
+		}
+		_ = session.write(Disconnect, 0, []byte{reason, 0})
+	}
+	return err
+}
+
+// OnClose 实现Handler, 取消订阅并发布遗嘱消息
+// Implements Handler, the subscriptions are removed and the will message is published.
+func (c *Broker) OnClose(stream *Stream, err error) {
+	var session = c.getSession(stream)
+	session.mu.Lock()
+	var will = session.will
+	var connected = session.connected
+	session.will = nil
+	session.connected = false
+	var filters = session.filters
+	session.filters = make(map[string]struct{})
+	session.mu.Unlock()
+	if !connected {
+		return
+	}
+
+	c.mu.Lock()
+	for filter := range filters {
+		c.removeSubscription(filter, session)
+	}
+	if c.sessions[session.clientID] == session {
+		delete(c.sessions, session.clientID)
+	}
+	c.mu.Unlock()
+
+	if will != nil {
+		c.publish(nil, will)
+	}
+}
+
+func (c *Broker) connack(session *mqttSession, code byte, properties []byte) error {
+	var body = []byte{0, code}
+	if session.version == 5 {
+		body = mqttAppendVarint(body, len(properties))
+		body = append(body, properties...)
+	}
+	return session.write(Connack, 0, body)
+}
+
+func (c *Broker) connect(session *mqttSession, packet *Packet) error {
+	var r = &mqttReader{data: packet.Body}
+	var name = r.string()
+	var version = r.byte()
+	var flags = r.byte()
+	var keepAlive = r.uint16()
+	if r.err != nil || (name != "MQTT" && name != "MQIsdp") {
+		return ErrPacket
+	}
+	if version != 4 && version != 5 {
+		// 不支持的版本按照MQTT 3.1.1回复
+		session.version = 4
+		if version > 5 {
+			session.version = 5
+		}
+		_ = c.connack(session, internal.SelectValue(session.version == 5, mqttReasonUnsupportedVersion, mqttReturnUnacceptableVersion), nil)
+		return errMQTTProtocol
+	}
+	session.version = version
+	if flags&0x01 != 0 {
+		return errMQTTProtocol
+	}
+	if version == 5 {
+		r.properties()
+	}
+
+	var clientID = r.string()
+	var will *mqttMessage
+	if flags&0x04 != 0 {
+		will = &mqttMessage{qos: flags >> 3 & 0x03, retain: flags&0x20 != 0}
+		if version == 5 {
+			will.properties = append([]byte(nil), r.properties()...)
+		}
+		will.topic = r.string()
+		will.payload = append([]byte(nil), r.binary()...)
+		if will.qos > 1 || !mqttValidTopic(will.topic) {
+			return errMQTTProtocol
+		}
+	}
+	var username string
+	var password []byte
+	if flags&0x80 != 0 {
+		username = r.string()
+	}
+	if flags&0x40 != 0 {
+		password = r.binary()
+	}
+	if r.err != nil {
+		return ErrPacket
+	}
+
+	var properties []byte
+	if clientID == "" {
+		if version == 4 && flags&0x02 == 0 {
+			_ = c.connack(session, mqttReturnIdentifierRejected, nil)
+			return errMQTTProtocol
+		}
+		clientID = "gws-" + strconv.FormatUint(atomic.AddUint64(&c.serial, 1), 10)
+		properties = append(properties, mqttPropertyAssignedClientID)
+		properties = mqttAppendString(properties, clientID)
+	}
+	if c.option.Authenticate != nil && !c.option.Authenticate(session.stream.Conn(), clientID, username, password) {
+		_ = c.connack(session, internal.SelectValue(version == 5, mqttReasonBadAuth, mqttReturnNotAuthorized), nil)
+		return errMQTTProtocol
+	}
+
+	session.mu.Lock()
+	session.clientID = clientID
+	session.keepAlive = time.Duration(keepAlive) * time.Second
+	session.will = will
+	session.connected = true
+	session.mu.Unlock()
+	session.touch()
+
+	// 相同客户端ID的旧连接被接管
+	c.mu.Lock()
+	var old = c.sessions[clientID]
+	c.sessions[clientID] = session
+	c.mu.Unlock()
+	if old != nil {
+		if old.version == 5 {
+			_ = old.write(Disconnect, 0, []byte{mqttReasonSessionTakenOver, 0})
+		}
+		old.stream.Conn().WriteClose(1000, nil)
+	}
+
+	properties = append(properties, mqttPropertyMaximumQoS, 1, mqttPropertySharedSubAvailable, 0)
+	return c.connack(session, mqttReasonSuccess, properties)
+}
+
+func (c *Broker) onPublish(session *mqttSession, packet *Packet) error {
+	var msg = &mqttMessage{qos: packet.Flags >> 1 & 0x03, retain: packet.Flags&0x01 != 0}
+	var r = &mqttReader{data: packet.Body}
+	msg.topic = r.string()
+	var packetID uint16
+	if msg.qos > 0 {
+		packetID = r.uint16()
+	}
+	if session.version == 5 {
+		msg.properties = r.properties()
+	}
+	msg.payload = r.rest()
+	if r.err != nil {
+		return ErrPacket
+	}
+	if msg.qos > 1 || !mqttValidTopic(msg.topic) {
+		return errMQTTProtocol
+	}
+
+	c.publish(session, msg)
+	if msg.qos == 1 {
+		return session.write(Puback, 0, mqttAppendUint16(nil, packetID))
+	}
+	return nil
+}
+
+// Publish 发布消息, qos大于1时按照1处理
+// Publish a message, qos greater than 1 is treated as 1.
+func (c *Broker) Publish(topic string, payload []byte, qos byte, retain bool) {
+	if qos > 1 {
+		qos = 1
+	}
+	c.publish(nil, &mqttMessage{topic: topic, payload: payload, qos: qos, retain: retain})
+}
+
+// mqttDelivery 投递给一个会话的消息
+type mqttDelivery struct {
+	qos    byte
+	retain bool
+}
+
+func (c *Broker) publish(from *mqttSession, msg *mqttMessage) {
+	var deliveries = make(map[*mqttSession]mqttDelivery)
+	c.mu.Lock()
+	if msg.retain {
+		if len(msg.payload) == 0 {
+			delete(c.retained, msg.topic)
+		} else {
+			c.retained[msg.topic] = &mqttMessage{
+				topic:      msg.topic,
+				payload:    append([]byte(nil), msg.payload...),
+				qos:        msg.qos,
+				retain:     true,
+				properties: append([]byte(nil), msg.properties...),
+			}
+		}
+	}
+	// 一个会话的多个订阅匹配时只投递一次, 使用最大的QoS
+	for filter, subs := range c.subscriptions {
+		if !mqttMatch(filter, msg.topic) {
+			continue
+		}
+		for session, opt := range subs {
+			if opt.noLocal && session == from {
+				continue
+			}
+			var d = deliveries[session]
+			if q := internal.SelectValue(opt.qos < msg.qos, opt.qos, msg.qos); q > d.qos {
+				d.qos = q
+			}
+			d.retain = d.retain || (opt.retainAsPublished && msg.retain)
+			deliveries[session] = d
+		}
+	}
+	c.mu.Unlock()
+
+	// QoS 0的报文对同一协议版本的订阅者完全相同, 共享Broadcaster
+	var broadcasters = make(map[[2]byte]*gws.Broadcaster)
+	for session, d := range deliveries {
+		if d.qos == 1 {
+			session.stream.WritePacketAsync(mqttPublishPacket(session.version, msg, d.qos, d.retain, session.nextPacketID()), nil)
+			continue
+		}
+		var key = [2]byte{session.version, internal.SelectValue[byte](d.retain, 1, 0)}
+		var b, ok = broadcasters[key]
+		if !ok {
+			b = gws.NewBroadcaster(gws.OpcodeBinary, mqttPublishPacket(session.version, msg, 0, d.retain, 0).Bytes())
+			broadcasters[key] = b
+		}
+		_ = b.Broadcast(session.stream.Conn())
+	}
+	for _, b := range broadcasters {
+		_ = b.Close()
+	}
+}
+
+func mqttPublishPacket(version byte, msg *mqttMessage, qos byte, retain bool, packetID uint16) *Packet {
+	var packet = &Packet{Type: Publish, Flags: qos << 1}
+	if retain {
+		packet.Flags |= 0x01
+	}
+	var body = make([]byte, 0, len(msg.topic)+len(msg.properties)+len(msg.payload)+8)
+	body = mqttAppendString(body, msg.topic)
+	if qos > 0 {
+		body = mqttAppendUint16(body, packetID)
+	}
+	if version == 5 {
+		if len(msg.properties) > 0 {
+			body = append(body, msg.properties...)
+		} else {
+			body = append(body, 0)
+		}
+	}
+	packet.Body = append(body, msg.payload...)
+	return packet
+}
+
+func (c *Broker) subscribe(session *mqttSession, packet *Packet) error {
+	if packet.Flags != 0x02 {
+		return errMQTTProtocol
+	}
+	var r = &mqttReader{data: packet.Body}
+	var packetID = r.uint16()
+	if session.version == 5 {
+		r.properties()
+	}
+	var body = mqttAppendUint16(nil, packetID)
+	if session.version == 5 {
+		body = append(body, 0)
+	}
+
+	var retained []*mqttMessage
+	var retainedQoS []byte
+	for len(r.data) > 0 && r.err == nil {
+		var filter = r.string()
+		var options = r.byte()
+		if r.err != nil {
+			break
+		}
+		if options&0x03 > 2 || options&0xC0 != 0 || (session.version == 4 && options&0xFC != 0) {
+			return errMQTTProtocol
+		}
+		if !mqttValidFilter(filter) {
+			body = append(body, internal.SelectValue(session.version == 5, mqttReasonTopicFilterInvalid, 0x80))
+			continue
+		}
+
+		var opt = mqttSubOption{qos: internal.SelectValue(options&0x03 > 1, 1, options&0x03)}
+		var retainHandling = options >> 4 & 0x03
+		if session.version == 5 {
+			opt.noLocal = options&0x04 != 0
+			opt.retainAsPublished = options&0x08 != 0
+		}
+
+		c.mu.Lock()
+		var subs, ok = c.subscriptions[filter]
+		if !ok {
+			subs = make(map[*mqttSession]mqttSubOption)
+			c.subscriptions[filter] = subs
+		}
+		_, exists := subs[session]
+		subs[session] = opt
+		if retainHandling == 0 || (retainHandling == 1 && !exists) {
+			for topic, msg := range c.retained {
+				if mqttMatch(filter, topic) {
+					retained = append(retained, msg)
+					retainedQoS = append(retainedQoS, opt.qos)
+				}
+			}
+		}
+		c.mu.Unlock()
+
+		session.mu.Lock()
+		session.filters[filter] = struct{}{}
+		session.mu.Unlock()
+		body = append(body, opt.qos)
+	}
+	if r.err != nil || len(body) == 2 || (session.version == 5 && len(body) == 3) {
+		return ErrPacket
+	}
+
+	if err := session.write(Suback, 0, body); err != nil {
+		return err
+	}
+	// 保留消息在SUBACK之后发送
+	for i, msg := range retained {
+		var qos = internal.SelectValue(retainedQoS[i] < msg.qos, retainedQoS[i], msg.qos)
+		session.stream.WritePacketAsync(mqttPublishPacket(session.version, msg, qos, true, session.nextPacketID()), nil)
+	}
+	return nil
+}
+
+func (c *Broker) unsubscribe(session *mqttSession, packet *Packet) error {
+	if packet.Flags != 0x02 {
+		return errMQTTProtocol
+	}
+	var r = &mqttReader{data: packet.Body}
+	var packetID = r.uint16()
+	if session.version == 5 {
+		r.properties()
+	}
+	var body = mqttAppendUint16(nil, packetID)
+	if session.version == 5 {
+		body = append(body, 0)
+	}
+	var n = 0
+	for len(r.data) > 0 && r.err == nil {
+		var filter = r.string()
+		if r.err != nil {
+			break
+		}
+		n++
+		session.mu.Lock()
+		_, exists := session.filters[filter]
+		delete(session.filters, filter)
+		session.mu.Unlock()
+
+		c.mu.Lock()
+		c.removeSubscription(filter, session)
+		c.mu.Unlock()
+		body = append(body, internal.SelectValue(exists, mqttReasonSuccess, mqttReasonNoSubscription))
+	}
+	if r.err != nil || n == 0 {
+		return ErrPacket
+	}
+	if session.version == 4 {
+		body = body[:2]
+	}
+	return session.write(Unsuback, 0, body)
+}
+
+func (c *Broker) removeSubscription(filter string, session *mqttSession) {
+	if subs, ok := c.subscriptions[filter]; ok {
+		delete(subs, session)
+		if len(subs) == 0 {
+			delete(c.subscriptions, filter)
+		}
+	}
+}
+
+// 主题名不能为空, 不能包含通配符
+func mqttValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// 主题过滤器中的+必须占据整个层级, #必须是最后一个层级
+func mqttValidFilter(filter string) bool {
+	if filter == "" || strings.IndexByte(filter, 0) >= 0 {
+		return false
+	}
+	var levels = strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// mqttMatch 主题是否匹配过滤器, 以$开头的主题不匹配首层的通配符
+func mqttMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	for {
+		var f, filterRest, filterMore = strings.Cut(filter, "/")
+		var t, topicRest, topicMore = strings.Cut(topic, "/")
+		if f == "#" {
+			return true
+		}
+		if f != "+" && f != t {
+			return false
+		}
+		if !filterMore || !topicMore {
+			// "a/#"也匹配"a"
+			return filterMore == topicMore || (filterMore && filterRest == "#")
+		}
+		filter, topic = filterRest, topicRest
+	}
+}
@@ -0,0 +1,326 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/marifcelik/gws"
+)
+
+const (
+	// Protocol MQTT over WebSocket子协议, 需要配置在gws.ServerOption.SubProtocols中
+	// The MQTT over WebSocket subprotocol, it should be configured in gws.ServerOption.SubProtocols.
+	Protocol = "mqtt"
+
+	defaultMaxPacketSize = 1024 * 1024
+	mqttStreamSessionKey = "gws:mqtt"
+)
+
+// MQTT 控制报文类型
+// MQTT control packet types
+const (
+	Connect     byte = 1
+	Connack     byte = 2
+	Publish     byte = 3
+	Puback      byte = 4
+	Pubrec      byte = 5
+	Pubrel      byte = 6
+	Pubcomp     byte = 7
+	Subscribe   byte = 8
+	Suback      byte = 9
+	Unsubscribe byte = 10
+	Unsuback    byte = 11
+	Pingreq     byte = 12
+	Pingresp    byte = 13
+	Disconnect  byte = 14
+	Auth        byte = 15
+)
+
+var (
+	// ErrPacket MQTT报文格式错误
+	// Malformed MQTT packet
+	ErrPacket = errors.New("gws: malformed mqtt packet")
+
+	// ErrPacketTooLarge MQTT报文超过大小限制
+	// MQTT packet exceeds the size limit
+	ErrPacketTooLarge = errors.New("gws: mqtt packet too large")
+)
+
+// Packet MQTT控制报文
+// MQTT control packet
+type Packet struct {
+	// 报文类型
+	// Packet type
+	Type byte
+
+	// 固定报头的标志位
+	// Flags of the fixed header
+	Flags byte
+
+	// 可变报头和有效载荷
+	// Variable header and payload
+	Body []byte
+}
+
+// Bytes 编码报文
+// Encode the packet
+func (c *Packet) Bytes() []byte {
+	var p = make([]byte, 0, 5+len(c.Body))
+	p = append(p, c.Type<<4|c.Flags&0x0F)
+	p = mqttAppendVarint(p, len(c.Body))
+	return append(p, c.Body...)
+}
+
+// parseMQTTPacket 解析一个报文, 返回消耗的字节数; 数据不完整时返回nil
+func parseMQTTPacket(data []byte, maxSize int) (*Packet, int, error) {
+	if len(data) < 2 {
+		return nil, 0, nil
+	}
+	length, n, err := mqttVarint(data[1:])
+	if err != nil || n == 0 {
+		return nil, 0, err
+	}
+	if length > maxSize {
+		return nil, 0, ErrPacketTooLarge
+	}
+	var total = 1 + n + length
+	if len(data) < total {
+		return nil, 0, nil
+	}
+	return &Packet{Type: data[0] >> 4, Flags: data[0] & 0x0F, Body: data[1+n : total]}, total, nil
+}
+
+// 解析变长整数, 数据不完整时n为0
+func mqttVarint(data []byte) (value int, n int, err error) {
+	var multiplier = 1
+	for i := 0; i < 4; i++ {
+		if i == len(data) {
+			return 0, 0, nil
+		}
+		value += int(data[i]&0x7F) * multiplier
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		multiplier *= 128
+	}
+	return 0, 0, ErrPacket
+}
+
+func mqttAppendVarint(p []byte, n int) []byte {
+	for {
+		var b = byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			return p
+		}
+	}
+}
+
+func mqttAppendUint16(p []byte, n uint16) []byte {
+	return append(p, byte(n>>8), byte(n))
+}
+
+func mqttAppendString(p []byte, s string) []byte {
+	p = mqttAppendUint16(p, uint16(len(s)))
+	return append(p, s...)
+}
+
+// mqttReader 读取报文字段, 出错之后的读取都返回零值
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (c *mqttReader) next(n int) []byte {
+	if c.err != nil || n > len(c.data) {
+		c.err = ErrPacket
+		return nil
+	}
+	var p = c.data[:n]
+	c.data = c.data[n:]
+	return p
+}
+
+func (c *mqttReader) byte() byte {
+	if p := c.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (c *mqttReader) uint16() uint16 {
+	if p := c.next(2); p != nil {
+		return uint16(p[0])<<8 | uint16(p[1])
+	}
+	return 0
+}
+
+func (c *mqttReader) binary() []byte {
+	return c.next(int(c.uint16()))
+}
+
+func (c *mqttReader) string() string {
+	return string(c.binary())
+}
+
+// properties 读取MQTT 5的属性, 返回包含长度的原始字节
+func (c *mqttReader) properties() []byte {
+	if c.err != nil {
+		return nil
+	}
+	length, n, err := mqttVarint(c.data)
+	if err != nil || n == 0 {
+		c.err = ErrPacket
+		return nil
+	}
+	return c.next(n + length)
+}
+
+func (c *mqttReader) rest() []byte {
+	var p = c.data
+	c.data = nil
+	return p
+}
+
+// Stream 连接上的MQTT报文流
+// MQTT报文可能跨越多条WebSocket消息, 一条消息也可能包含多个报文, Stream负责重组.
+// MQTT packet stream of a connection.
+// A packet may span WebSocket messages and a message may contain several packets, Stream reassembles them.
+type Stream struct {
+	socket  *gws.Conn
+	maxSize int
+	buf     []byte
+}
+
+// NewStream 创建报文流, maxPacketSize为报文剩余长度的上限
+// Create a packet stream, maxPacketSize is the limit of the remaining length of a packet.
+func NewStream(socket *gws.Conn, maxPacketSize int) *Stream {
+	if maxPacketSize <= 0 {
+		maxPacketSize = defaultMaxPacketSize
+	}
+	return &Stream{socket: socket, maxSize: maxPacketSize}
+}
+
+// Conn 获取连接
+// Get the connection
+func (c *Stream) Conn() *gws.Conn { return c.socket }
+
+// Feed 追加收到的数据, 对每个完整的报文调用handle. 报文的Body只在handle执行期间有效.
+// Append received data and call handle for every complete packet. The Body of a packet is only valid during handle.
+func (c *Stream) Feed(data []byte, handle func(packet *Packet) error) error {
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, data...)
+		data = c.buf
+	}
+	for {
+		packet, n, err := parseMQTTPacket(data, c.maxSize)
+		if err != nil {
+			return err
+		}
+		if packet == nil {
+			break
+		}
+		if err := handle(packet); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	// 保存不完整的报文, 等待后续的消息
+	c.buf = append(c.buf[:0], data...)
+	return nil
+}
+
+// WritePacket 写入报文
+// Write a packet
+func (c *Stream) WritePacket(packet *Packet) error {
+	return c.socket.WriteMessage(gws.OpcodeBinary, packet.Bytes())
+}
+
+// WritePacketAsync 异步写入报文
+// Write a packet asynchronously
+func (c *Stream) WritePacketAsync(packet *Packet, callback func(error)) {
+	c.socket.WriteAsync(gws.OpcodeBinary, packet.Bytes(), callback)
+}
+
+// Handler 处理MQTT报文流
+// Handler of MQTT packet streams
+type Handler interface {
+	// OnPacket 收到完整的报文, 返回错误时关闭连接. packet.Body只在调用期间有效.
+	// A complete packet is received, the connection is closed on error. packet.Body is only valid during the call.
+	OnPacket(stream *Stream, packet *Packet) error
+
+	// OnClose 连接关闭
+	// The connection is closed
+	OnClose(stream *Stream, err error)
+}
+
+type Option struct {
+	// 报文剩余长度的上限, 默认为1MB
+	// Limit of the remaining length of a packet, 1MB by default
+	MaxPacketSize int
+}
+
+// EventHandler 将连接转换为MQTT报文流的事件处理器, 其他事件转发给内嵌的Event.
+// 按照规范, MQTT报文只能使用二进制消息, 收到文本消息时以1003关闭连接; 报文错误时以1002关闭连接.
+// Event handler turning the connection into an MQTT packet stream, other events are forwarded to the embedded Event.
+// MQTT packets must be carried in binary messages, the connection is closed with 1003 on text messages
+// and with 1002 on packet errors.
+type EventHandler struct {
+	gws.Event
+	mu      sync.Mutex
+	handler Handler
+	option  *Option
+}
+
+// NewEventHandler 创建MQTT事件处理器, event为nil时使用gws.BuiltinEventHandler
+// Create an MQTT event handler, gws.BuiltinEventHandler is used when event is nil.
+func NewEventHandler(handler Handler, option *Option, event gws.Event) *EventHandler {
+	if option == nil {
+		option = new(Option)
+	}
+	if event == nil {
+		event = gws.BuiltinEventHandler{}
+	}
+	return &EventHandler{Event: event, handler: handler, option: option}
+}
+
+// Stream 获取连接的报文流, 不存在时创建
+// Get the packet stream of the connection, created if absent
+func (c *EventHandler) Stream(socket *gws.Conn) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(mqttStreamSessionKey); ok {
+		return v.(*Stream)
+	}
+	var stream = NewStream(socket, c.option.MaxPacketSize)
+	socket.Session().Store(mqttStreamSessionKey, stream)
+	return stream
+}
+
+func (c *EventHandler) OnOpen(socket *gws.Conn) {
+	c.Stream(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *EventHandler) OnClose(socket *gws.Conn, err error) {
+	c.handler.OnClose(c.Stream(socket), err)
+	c.Event.OnClose(socket, err)
+}
+
+func (c *EventHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	if message.Opcode != gws.OpcodeBinary {
+		socket.WriteClose(1003, []byte("mqtt requires binary messages"))
+		return
+	}
+	var stream = c.Stream(socket)
+	err := stream.Feed(message.Bytes(), func(packet *Packet) error {
+		return c.handler.OnPacket(stream, packet)
+	})
+	if err != nil {
+		socket.WriteClose(1002, []byte(err.Error()))
+	}
+}
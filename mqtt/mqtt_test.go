@@ -0,0 +1,437 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMQTTStream(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("reassembly", func(t *testing.T) {
+		var large = &Packet{Type: Publish, Body: make([]byte, 300)}
+		var data []byte
+		data = append(data, (&Packet{Type: Pingreq}).Bytes()...)
+		data = append(data, large.Bytes()...)
+		data = append(data, (&Packet{Type: Subscribe, Flags: 2, Body: []byte{0, 1}}).Bytes()...)
+
+		// 逐字节输入和一次性输入的结果相同
+		for _, step := range []int{1, 2, 7, len(data)} {
+			var stream = NewStream(nil, 0)
+			var packets []*Packet
+			for i := 0; i < len(data); i += step {
+				var end = i + step
+				if end > len(data) {
+					end = len(data)
+				}
+				as.NoError(stream.Feed(data[i:end], func(packet *Packet) error {
+					packets = append(packets, &Packet{Type: packet.Type, Flags: packet.Flags, Body: append([]byte(nil), packet.Body...)})
+					return nil
+				}))
+			}
+			if as.Equal(3, len(packets)) {
+				as.Equal(Pingreq, packets[0].Type)
+				as.Equal(300, len(packets[1].Body))
+				as.Equal(byte(2), packets[2].Flags)
+			}
+			as.Empty(stream.buf)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var handle = func(packet *Packet) error { return nil }
+		as.ErrorIs(NewStream(nil, 0).Feed([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, handle), ErrPacket)
+		as.ErrorIs(NewStream(nil, 100).Feed([]byte{0x30, 0xff, 0x01}, handle), ErrPacketTooLarge)
+
+		var stop = errors.New("stop")
+		as.ErrorIs(NewStream(nil, 0).Feed([]byte{0xc0, 0x00}, func(packet *Packet) error { return stop }), stop)
+	})
+
+	t.Run("varint", func(t *testing.T) {
+		for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+			var p = mqttAppendVarint(nil, n)
+			v, size, err := mqttVarint(p)
+			as.NoError(err)
+			as.Equal(n, v)
+			as.Equal(len(p), size)
+		}
+	})
+}
+
+func TestMQTTTopic(t *testing.T) {
+	var as = assert.New(t)
+	var cases = []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "/a", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+	}
+	for _, item := range cases {
+		as.Equal(item.match, mqttMatch(item.filter, item.topic), item.filter+" "+item.topic)
+	}
+
+	for _, filter := range []string{"a", "a/+/b", "#", "+", "a/#", "/"} {
+		as.True(mqttValidFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "a/#/b", "a+", "a/b#", "#a"} {
+		as.False(mqttValidFilter(filter), filter)
+	}
+	as.False(mqttValidTopic("a/+"))
+	as.False(mqttValidTopic(""))
+}
+
+type mqttTestClient struct {
+	conn    *gws.Conn
+	version byte
+	packets chan *Packet
+	closed  chan error
+}
+
+func newMQTTTestClient(broker *Broker) *mqttTestClient {
+	var c = &mqttTestClient{packets: make(chan *Packet, 64), closed: make(chan error, 1)}
+	var clientHandler = new(webSocketMocker)
+	var stream = NewStream(nil, 0)
+	clientHandler.onMessage = func(socket *gws.Conn, message *gws.Message) {
+		_ = stream.Feed(message.Bytes(), func(packet *Packet) error {
+			c.packets <- &Packet{Type: packet.Type, Flags: packet.Flags, Body: append([]byte(nil), packet.Body...)}
+			return nil
+		})
+	}
+	clientHandler.onClose = func(socket *gws.Conn, err error) { c.closed <- err }
+	server, client := newPeer(NewEventHandler(broker, nil, nil), &gws.ServerOption{}, clientHandler, &gws.ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	c.conn = client
+	return c
+}
+
+func (c *mqttTestClient) write(packetType byte, flags byte, body []byte) {
+	_ = c.conn.WriteMessage(gws.OpcodeBinary, (&Packet{Type: packetType, Flags: flags, Body: body}).Bytes())
+}
+
+func (c *mqttTestClient) next() *Packet {
+	select {
+	case packet := <-c.packets:
+		return packet
+	case <-time.After(time.Second):
+		return &Packet{}
+	}
+}
+
+func (c *mqttTestClient) closeCode() uint16 {
+	select {
+	case err := <-c.closed:
+		var closeErr *gws.CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.Code
+		}
+		return 0
+	case <-time.After(2 * time.Second):
+		return 0
+	}
+}
+
+func (c *mqttTestClient) connect(version byte, clientID string, keepAlive uint16, will *mqttMessage) *Packet {
+	c.version = version
+	var flags byte = 0x02
+	if will != nil {
+		flags |= 0x04 | will.qos<<3
+	}
+	var body = mqttAppendString(nil, "MQTT")
+	body = append(body, version, flags)
+	body = mqttAppendUint16(body, keepAlive)
+	if version == 5 {
+		body = append(body, 0)
+	}
+	body = mqttAppendString(body, clientID)
+	if will != nil {
+		if version == 5 {
+			body = append(body, 0)
+		}
+		body = mqttAppendString(body, will.topic)
+		body = mqttAppendString(body, string(will.payload))
+	}
+	c.write(Connect, 0, body)
+	return c.next()
+}
+
+func (c *mqttTestClient) subscribe(packetID uint16, filter string, options byte) *Packet {
+	var body = mqttAppendUint16(nil, packetID)
+	if c.version == 5 {
+		body = append(body, 0)
+	}
+	body = mqttAppendString(body, filter)
+	body = append(body, options)
+	c.write(Subscribe, 2, body)
+	return c.next()
+}
+
+func (c *mqttTestClient) publish(topic string, payload string, qos byte, retain bool, packetID uint16) {
+	var msg = &mqttMessage{topic: topic, payload: []byte(payload)}
+	var packet = mqttPublishPacket(c.version, msg, qos, retain, packetID)
+	c.write(packet.Type, packet.Flags, packet.Body)
+}
+
+// 解析收到的PUBLISH报文
+func (c *mqttTestClient) message() (msg *mqttMessage, packetID uint16) {
+	var packet = c.next()
+	if packet.Type != Publish {
+		return &mqttMessage{}, 0
+	}
+	msg = &mqttMessage{qos: packet.Flags >> 1 & 0x03, retain: packet.Flags&0x01 != 0}
+	var r = &mqttReader{data: packet.Body}
+	msg.topic = r.string()
+	if msg.qos > 0 {
+		packetID = r.uint16()
+	}
+	if c.version == 5 {
+		msg.properties = r.properties()
+	}
+	msg.payload = r.rest()
+	return msg, packetID
+}
+
+func TestMQTTBroker(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("v3.1.1", func(t *testing.T) {
+		var broker = NewBroker(nil)
+		var sub = newMQTTTestClient(broker)
+		var pub = newMQTTTestClient(broker)
+		as.Equal(&Packet{Type: Connack, Body: []byte{0, 0}}, sub.connect(4, "sub", 0, nil))
+		pub.connect(4, "pub", 0, nil)
+
+		var suback = sub.subscribe(1, "sensor/+/temp", 1)
+		as.Equal(&Packet{Type: Suback, Body: []byte{0, 1, 1}}, suback)
+		as.Equal([]byte{0, 2, 0}, sub.subscribe(2, "sensor/#", 0).Body)
+		as.Equal([]byte{0, 3, 0x80}, sub.subscribe(3, "sensor/#/x", 2).Body)
+
+		// 多个订阅匹配时只投递一次, 使用最大的QoS
+		pub.publish("sensor/1/temp", "21.5", 1, false, 7)
+		as.Equal(&Packet{Type: Puback, Body: []byte{0, 7}}, pub.next())
+		msg, packetID := sub.message()
+		as.Equal("sensor/1/temp", msg.topic)
+		as.Equal("21.5", string(msg.payload))
+		as.Equal(byte(1), msg.qos)
+		as.NotZero(packetID)
+		sub.write(Puback, 0, mqttAppendUint16(nil, packetID))
+
+		pub.publish("sensor/1/humidity", "40", 0, false, 0)
+		msg, _ = sub.message()
+		as.Equal("sensor/1/humidity", msg.topic)
+		as.Equal(byte(0), msg.qos)
+
+		sub.write(Pingreq, 0, nil)
+		as.Equal(Pingresp, sub.next().Type)
+
+		sub.write(Unsubscribe, 2, mqttAppendString(mqttAppendUint16(nil, 4), "sensor/#"))
+		as.Equal(&Packet{Type: Unsuback, Body: []byte{0, 4}}, sub.next())
+		pub.publish("sensor/1/humidity", "41", 0, false, 0)
+		pub.publish("sensor/2/temp", "19", 0, false, 0)
+		msg, _ = sub.message()
+		as.Equal("19", string(msg.payload))
+
+		pub.write(Disconnect, 0, nil)
+		as.Equal(uint16(1000), pub.closeCode())
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		var broker = NewBroker(nil)
+		var pub = newMQTTTestClient(broker)
+		pub.connect(4, "pub", 0, nil)
+		pub.publish("status/a", "online", 1, true, 1)
+		pub.next()
+		broker.Publish("status/b", []byte("offline"), 0, true)
+		broker.Publish("status/c", []byte("x"), 0, true)
+		broker.Publish("status/c", nil, 0, true)
+
+		var sub = newMQTTTestClient(broker)
+		sub.connect(4, "sub", 0, nil)
+		as.Equal(Suback, sub.subscribe(1, "status/+", 0).Type)
+		var received = map[string]string{}
+		for i := 0; i < 2; i++ {
+			msg, _ := sub.message()
+			as.True(msg.retain)
+			as.Equal(byte(0), msg.qos)
+			received[msg.topic] = string(msg.payload)
+		}
+		as.Equal(map[string]string{"status/a": "online", "status/b": "offline"}, received)
+
+		// 转发给已有订阅者时不设置retain标志
+		pub.publish("status/a", "away", 0, true, 0)
+		msg, _ := sub.message()
+		as.False(msg.retain)
+		as.Equal("away", string(msg.payload))
+	})
+
+	t.Run("v5", func(t *testing.T) {
+		var broker = NewBroker(nil)
+		var client = newMQTTTestClient(broker)
+		var connack = client.connect(5, "", 30, nil)
+		as.Equal(Connack, connack.Type)
+		var r = &mqttReader{data: connack.Body}
+		as.Equal(byte(0), r.byte())
+		as.Equal(byte(0), r.byte())
+		var properties = &mqttReader{data: r.properties()[1:]}
+		as.Equal(mqttPropertyAssignedClientID, properties.byte())
+		as.Contains(properties.string(), "gws-")
+		as.Equal(mqttPropertyMaximumQoS, properties.byte())
+		as.Equal(byte(1), properties.byte())
+
+		// No Local的订阅不接收自己发布的消息, Retain As Published保留retain标志
+		as.Equal([]byte{0, 1, 0, 0}, client.subscribe(1, "a", 0x04).Body)
+		as.Equal([]byte{0, 2, 0, 1}, client.subscribe(2, "b", 0x08|0x01).Body)
+		as.Equal([]byte{0, 3, 0, mqttReasonTopicFilterInvalid}, client.subscribe(3, "a#", 0).Body)
+		client.publish("a", "self", 0, false, 0)
+		client.publish("b", "retained", 0, true, 0)
+		msg, _ := client.message()
+		as.Equal("b", msg.topic)
+		as.True(msg.retain)
+		as.Equal([]byte{0}, msg.properties)
+
+		var body = append(mqttAppendUint16(nil, 4), 0)
+		body = mqttAppendString(mqttAppendString(body, "a"), "missing")
+		client.write(Unsubscribe, 2, body)
+		as.Equal(&Packet{Type: Unsuback, Body: []byte{0, 4, 0, mqttReasonSuccess, mqttReasonNoSubscription}}, client.next())
+
+		// QoS 2不受支持
+		client.publish("a", "qos2", 2, false, 1)
+		as.Equal(&Packet{Type: Disconnect, Body: []byte{mqttReasonProtocolError, 0}}, client.next())
+		as.Equal(uint16(1002), client.closeCode())
+	})
+
+	t.Run("will", func(t *testing.T) {
+		var broker = NewBroker(nil)
+		var sub = newMQTTTestClient(broker)
+		sub.connect(4, "sub", 0, nil)
+		sub.subscribe(1, "will/#", 0)
+
+		var client = newMQTTTestClient(broker)
+		client.connect(4, "a", 0, &mqttMessage{topic: "will/a", payload: []byte("gone")})
+		_ = client.conn.NetConn().Close()
+		msg, _ := sub.message()
+		as.Equal("will/a", msg.topic)
+		as.Equal("gone", string(msg.payload))
+
+		// 正常断开时不发布遗嘱
+		client = newMQTTTestClient(broker)
+		client.connect(4, "b", 0, &mqttMessage{topic: "will/b", payload: []byte("gone")})
+		client.write(Disconnect, 0, nil)
+		client.closeCode()
+		sub.write(Pingreq, 0, nil)
+		as.Equal(Pingresp, sub.next().Type)
+	})
+
+	t.Run("takeover", func(t *testing.T) {
+		var broker = NewBroker(nil)
+		var first = newMQTTTestClient(broker)
+		first.connect(5, "device", 0, nil)
+		first.subscribe(1, "x", 0)
+		var second = newMQTTTestClient(broker)
+		as.Equal(Connack, second.connect(5, "device", 0, nil).Type)
+		as.Equal(&Packet{Type: Disconnect, Body: []byte{mqttReasonSessionTakenOver, 0}}, first.next())
+		as.Equal(uint16(1000), first.closeCode())
+		time.Sleep(20 * time.Millisecond)
+		broker.mu.RLock()
+		as.Equal(1, len(broker.sessions))
+		as.Equal(0, len(broker.subscriptions))
+		broker.mu.RUnlock()
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var broker = NewBroker(&BrokerOption{
+			Authenticate: func(socket *gws.Conn, clientID, username string, password []byte) bool { return clientID != "guest" },
+		})
+
+		var client = newMQTTTestClient(broker)
+		client.write(Pingreq, 0, nil)
+		as.Equal(uint16(1002), client.closeCode())
+
+		client = newMQTTTestClient(broker)
+		_ = client.conn.WriteString("hello")
+		as.Equal(uint16(1003), client.closeCode())
+
+		client = newMQTTTestClient(broker)
+		as.Equal([]byte{0, mqttReturnNotAuthorized}, client.connect(4, "guest", 0, nil).Body)
+		as.Equal(uint16(1002), client.closeCode())
+
+		client = newMQTTTestClient(broker)
+		as.Equal([]byte{0, mqttReasonBadAuth, 0}, client.connect(5, "guest", 0, nil).Body)
+
+		client = newMQTTTestClient(broker)
+		as.Equal([]byte{0, mqttReturnUnacceptableVersion}, client.connect(3, "a", 0, nil).Body)
+
+		client = newMQTTTestClient(broker)
+		client.connect(4, "a", 0, nil)
+		client.write(Subscribe, 0, nil)
+		as.Equal(uint16(1002), client.closeCode())
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		var client = newMQTTTestClient(NewBroker(nil))
+		client.connect(4, "a", 1, nil)
+		var start = time.Now()
+		as.NotZero(client.closeCode())
+		as.True(time.Since(start) > time.Second)
+	})
+}
+
+type webSocketMocker struct {
+	gws.BuiltinEventHandler
+	onMessage func(socket *gws.Conn, message *gws.Message)
+	onClose   func(socket *gws.Conn, err error)
+}
+
+func (c *webSocketMocker) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if c.onMessage != nil {
+		c.onMessage(socket, message)
+	}
+}
+
+func (c *webSocketMocker) OnClose(socket *gws.Conn, err error) {
+	if c.onClose != nil {
+		c.onClose(socket, err)
+	}
+}
+
+// 在内存管道上完成握手, 返回服务端和客户端的连接
+func newPeer(serverHandler gws.Event, serverOption *gws.ServerOption, clientHandler gws.Event, clientOption *gws.ClientOption) (server, client *gws.Conn) {
+	var s, c = net.Pipe()
+	var upgrader = gws.NewUpgrader(serverHandler, serverOption)
+	var accepted = make(chan *gws.Conn, 1)
+	go func() {
+		var br = bufio.NewReader(s)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		socket, _ := upgrader.UpgradeFromConn(s, br, r)
+		accepted <- socket
+	}()
+	clientOption.Addr = "ws://localhost/"
+	client, _, _ = gws.NewClientFromConn(clientHandler, clientOption, c)
+	server = <-accepted
+	return server, client
+}
@@ -0,0 +1,588 @@
+package gws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/marifcelik/gws/internal"
+)
+
+const (
+	defaultMuxStreamWindow  = 256 * 1024
+	defaultMuxMaxFrameSize  = 32 * 1024
+	defaultMuxAcceptBacklog = 256
+	muxSessionKey           = "gws:mux"
+	muxHeaderSize           = 5
+)
+
+// 多路复用帧类型. 帧格式为 类型(1字节) + 流ID(4字节, 大端序) + 载荷, 每帧占用一条二进制消息.
+const (
+	muxFrameOpen   byte = 1 // 打开流
+	muxFrameData   byte = 2 // 数据
+	muxFrameWindow byte = 3 // 增加发送窗口, 载荷为4字节增量
+	muxFrameClose  byte = 4 // 关闭写入方向
+	muxFrameReset  byte = 5 // 重置流
+)
+
+var (
+	// ErrMuxClosed 多路复用会话已关闭
+	// The multiplexing session is closed
+	ErrMuxClosed = errors.New("gws: mux session closed")
+
+	// ErrMuxStreamReset 流被重置
+	// The stream is reset
+	ErrMuxStreamReset = errors.New("gws: mux stream reset")
+
+	// ErrMuxProtocol 多路复用协议错误
+	// Multiplexing protocol error
+	ErrMuxProtocol = errors.New("gws: mux protocol error")
+)
+
+type MuxOption struct {
+	// 每个流的接收窗口, 默认和最小值为256KB
+	// Receive window of every stream, 256KB by default and at minimum
+	StreamWindow int
+
+	// 数据帧载荷的最大长度, 默认为32KB
+	// Max payload length of a data frame, 32KB by default
+	MaxFrameSize int
+
+	// 等待Accept的流的数量上限, 超出时新的流会被重置, 默认为256
+	// Limit of streams waiting for Accept, new streams are reset beyond it, 256 by default
+	AcceptBacklog int
+}
+
+func (c *MuxOption) initialize() *MuxOption {
+	if c.StreamWindow < defaultMuxStreamWindow {
+		c.StreamWindow = defaultMuxStreamWindow
+	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = defaultMuxMaxFrameSize
+	}
+	if c.AcceptBacklog <= 0 {
+		c.AcceptBacklog = defaultMuxAcceptBacklog
+	}
+	return c
+}
+
+// Mux 连接上的多路复用会话, 实现了net.Listener
+// 客户端打开的流ID为奇数, 服务端为偶数. 帧通过WriteAsync按顺序写入.
+// 双方的初始发送窗口都是256KB, 更大的接收窗口在打开流之后通过窗口更新帧通告.
+// Multiplexing session of a connection implementing net.Listener.
+// Streams opened by the client have odd IDs and those opened by the server have even IDs. Frames are written in order with WriteAsync.
+// The initial send window is 256KB on both sides, a larger receive window is announced with a window update after the stream is opened.
+type Mux struct {
+	socket  *Conn
+	option  *MuxOption
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	accepts chan *MuxStream
+	closed  chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newMux(socket *Conn, option *MuxOption) *Mux {
+	return &Mux{
+		socket:  socket,
+		option:  option,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  internal.SelectValue[uint32](socket.isServer, 2, 1),
+		accepts: make(chan *MuxStream, option.AcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Conn 获取WebSocket连接
+// Get the WebSocket connection
+func (c *Mux) Conn() *Conn { return c.socket }
+
+// NumStreams 获取未关闭的流的数量
+// Get the number of streams not yet closed
+func (c *Mux) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// Open 打开一个新的流, 无需等待对端确认即可读写
+// Open a new stream, it can be used without waiting for the peer.
+func (c *Mux) Open() (*MuxStream, error) {
+	c.mu.Lock()
+	if isClosedChan(c.closed) {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	var stream = newMuxStream(c, c.nextID)
+	c.nextID += 2
+	c.streams[stream.id] = stream
+	c.mu.Unlock()
+
+	c.writeFrame(muxFrameOpen, stream.id, nil)
+	c.announce(stream.id)
+	return stream, nil
+}
+
+// AcceptStream 等待对端打开的流
+// Wait for a stream opened by the peer
+func (c *Mux) AcceptStream() (*MuxStream, error) {
+	select {
+	case stream := <-c.accepts:
+		return stream, nil
+	case <-c.closed:
+		return nil, c.err
+	}
+}
+
+// Accept 等待对端打开的流
+// Wait for a stream opened by the peer
+func (c *Mux) Accept() (net.Conn, error) {
+	stream, err := c.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Addr 获取本地地址
+// Get the local address
+func (c *Mux) Addr() net.Addr { return c.socket.LocalAddr() }
+
+// Close 关闭会话和WebSocket连接, 未关闭的流的读写返回ErrMuxClosed
+// Close the session and the WebSocket connection, reads and writes of open streams return ErrMuxClosed.
+func (c *Mux) Close() error {
+	c.close(nil)
+	c.socket.WriteClose(1000, nil)
+	return nil
+}
+
+// 关闭会话, 正常关闭时错误为ErrMuxClosed
+func (c *Mux) close(err error) {
+	c.once.Do(func() {
+		var closeErr *CloseError
+		switch {
+		case err == nil, err == errEmpty:
+			err = ErrMuxClosed
+		case errors.As(err, &closeErr) && (closeErr.Code == 1000 || closeErr.Code == 1001):
+			err = ErrMuxClosed
+		}
+
+		c.mu.Lock()
+		c.err = err
+		close(c.closed)
+		var streams = c.streams
+		c.streams = make(map[uint32]*MuxStream)
+		c.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.fail(err)
+		}
+	})
+}
+
+func (c *Mux) remove(id uint32) {
+	c.mu.Lock()
+	delete(c.streams, id)
+	c.mu.Unlock()
+}
+
+func (c *Mux) writeFrame(typ byte, id uint32, payload []byte) {
+	var frame = make([]byte, muxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[muxHeaderSize:], payload)
+	c.socket.WriteAsync(OpcodeBinary, frame, nil)
+}
+
+func (c *Mux) writeWindow(id uint32, delta uint32) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], delta)
+	c.writeFrame(muxFrameWindow, id, payload[:])
+}
+
+// 通告超出初始值的接收窗口
+func (c *Mux) announce(id uint32) {
+	if delta := c.option.StreamWindow - defaultMuxStreamWindow; delta > 0 {
+		c.writeWindow(id, uint32(delta))
+	}
+}
+
+// 处理一帧数据, 返回错误时应该关闭连接
+func (c *Mux) handle(data []byte) error {
+	if len(data) < muxHeaderSize {
+		return ErrMuxProtocol
+	}
+	var typ, id, payload = data[0], binary.BigEndian.Uint32(data[1:]), data[muxHeaderSize:]
+	if typ == muxFrameOpen {
+		return c.accept(id)
+	}
+
+	c.mu.Lock()
+	var stream = c.streams[id]
+	c.mu.Unlock()
+	if stream == nil {
+		// 流已经被移除, 忽略在途的帧
+		return nil
+	}
+
+	switch typ {
+	case muxFrameData:
+		return stream.receive(payload)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return ErrMuxProtocol
+		}
+		return stream.grow(binary.BigEndian.Uint32(payload))
+	case muxFrameClose:
+		stream.remoteClose()
+		return nil
+	case muxFrameReset:
+		stream.reset(ErrMuxStreamReset, false)
+		return nil
+	default:
+		return ErrMuxProtocol
+	}
+}
+
+func (c *Mux) accept(id uint32) error {
+	// 对端打开的流ID的奇偶性和自己相反
+	if id == 0 || (id%2 == 1) != c.socket.isServer {
+		return ErrMuxProtocol
+	}
+
+	c.mu.Lock()
+	if isClosedChan(c.closed) {
+		c.mu.Unlock()
+		return nil
+	}
+	if _, ok := c.streams[id]; ok {
+		c.mu.Unlock()
+		return ErrMuxProtocol
+	}
+	var stream = newMuxStream(c, id)
+	c.streams[id] = stream
+	c.mu.Unlock()
+
+	select {
+	case c.accepts <- stream:
+		c.announce(id)
+	default:
+		stream.reset(ErrMuxStreamReset, true)
+	}
+	return nil
+}
+
+// MuxStream 多路复用的流, 实现了net.Conn
+// Close只关闭写入方向, 之后仍然可以读取到对端关闭为止; Reset立即中止双向的读写.
+// Multiplexed stream implementing net.Conn.
+// Close only shuts the write direction and reading goes on until the peer closes; Reset aborts both directions at once.
+type MuxStream struct {
+	session       *Mux
+	id            uint32
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	recvWindow    uint32 // 对端还可以发送的字节数
+	consumed      uint32 // 已读取但还未通告的字节数
+	sendWindow    uint32
+	localClosed   bool
+	remoteClosed  bool
+	err           error
+	readNotify    chan struct{} // 读取的等待者, 没有等待者时为nil
+	writeNotify   chan struct{} // 写入的等待者, 没有等待者时为nil
+	readDeadline  *streamDeadline
+	writeDeadline *streamDeadline
+}
+
+func newMuxStream(session *Mux, id uint32) *MuxStream {
+	return &MuxStream{
+		session:       session,
+		id:            id,
+		recvWindow:    uint32(session.option.StreamWindow),
+		sendWindow:    defaultMuxStreamWindow,
+		readDeadline:  newStreamDeadline(),
+		writeDeadline: newStreamDeadline(),
+	}
+}
+
+// 获取等待通知的通道, 需要持有锁
+func muxWait(ch *chan struct{}) <-chan struct{} {
+	if *ch == nil {
+		*ch = make(chan struct{})
+	}
+	return *ch
+}
+
+// 唤醒所有等待者, 需要持有锁
+func muxNotify(ch *chan struct{}) {
+	if *ch != nil {
+		close(*ch)
+		*ch = nil
+	}
+}
+
+// ID 获取流ID
+// Get the stream ID
+func (c *MuxStream) ID() uint32 { return c.id }
+
+// Session 获取所属的会话
+// Get the session the stream belongs to
+func (c *MuxStream) Session() *Mux { return c.session }
+
+func (c *MuxStream) receive(payload []byte) error {
+	c.mu.Lock()
+	if uint32(len(payload)) > c.recvWindow {
+		c.mu.Unlock()
+		return ErrMuxProtocol
+	}
+	c.recvWindow -= uint32(len(payload))
+	if c.err == nil && !c.remoteClosed {
+		c.buf.Write(payload)
+	}
+	muxNotify(&c.readNotify)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MuxStream) grow(delta uint32) error {
+	c.mu.Lock()
+	if c.sendWindow+delta < c.sendWindow {
+		c.mu.Unlock()
+		return ErrMuxProtocol
+	}
+	c.sendWindow += delta
+	muxNotify(&c.writeNotify)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MuxStream) remoteClose() {
+	c.mu.Lock()
+	if c.remoteClosed {
+		c.mu.Unlock()
+		return
+	}
+	c.remoteClosed = true
+	var done = c.localClosed
+	muxNotify(&c.readNotify)
+	c.mu.Unlock()
+	if done {
+		c.session.remove(c.id)
+	}
+}
+
+// 重置流, 丢弃未读取的数据
+func (c *MuxStream) reset(err error, send bool) {
+	c.mu.Lock()
+	if c.err != nil || (c.localClosed && c.remoteClosed) {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.buf.Reset()
+	muxNotify(&c.readNotify)
+	muxNotify(&c.writeNotify)
+	c.mu.Unlock()
+	if send {
+		c.session.writeFrame(muxFrameReset, c.id, nil)
+	}
+	c.session.remove(c.id)
+}
+
+// 会话关闭, 已收到的数据仍然可以读取
+func (c *MuxStream) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	muxNotify(&c.readNotify)
+	muxNotify(&c.writeNotify)
+	c.mu.Unlock()
+}
+
+// Read 读取数据, 对端关闭写入方向之后返回io.EOF
+// Read data, io.EOF is returned after the peer closes its write direction.
+func (c *MuxStream) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.buf.Len() > 0 {
+			if len(p) == 0 {
+				c.mu.Unlock()
+				return 0, nil
+			}
+			n, _ := c.buf.Read(p)
+			var delta uint32
+			if c.consumed += uint32(n); c.consumed >= uint32(c.session.option.StreamWindow/2) && !c.remoteClosed {
+				delta, c.consumed = c.consumed, 0
+				c.recvWindow += delta
+			}
+			c.mu.Unlock()
+			if delta > 0 {
+				c.session.writeWindow(c.id, delta)
+			}
+			return n, nil
+		}
+		var err = c.err
+		if err == nil && c.remoteClosed {
+			err = io.EOF
+		}
+		if err != nil || len(p) == 0 {
+			c.mu.Unlock()
+			return 0, err
+		}
+		var notify = muxWait(&c.readNotify)
+		c.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write 写入数据, 发送窗口耗尽时阻塞, 数据按MaxFrameSize分帧
+// Write data, it blocks while the send window is exhausted and data is split into frames of MaxFrameSize.
+func (c *MuxStream) Write(p []byte) (int, error) {
+	var total = 0
+	for total < len(p) {
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return total, c.err
+		}
+		if c.localClosed {
+			c.mu.Unlock()
+			return total, net.ErrClosed
+		}
+		if c.sendWindow == 0 {
+			var notify = muxWait(&c.writeNotify)
+			c.mu.Unlock()
+			select {
+			case <-notify:
+				continue
+			case <-c.writeDeadline.wait():
+				return total, os.ErrDeadlineExceeded
+			}
+		}
+
+		var n = internal.Min(len(p)-total, c.session.option.MaxFrameSize)
+		n = internal.Min(n, int(c.sendWindow))
+		c.sendWindow -= uint32(n)
+		// 持有锁入队, 保证并发写入时帧的顺序和窗口的扣减一致
+		c.session.writeFrame(muxFrameData, c.id, p[total:total+n])
+		c.mu.Unlock()
+		total += n
+	}
+	return total, nil
+}
+
+// Close 关闭写入方向, 双方都关闭之后流被移除
+// Close the write direction, the stream is removed once both sides are closed.
+func (c *MuxStream) Close() error {
+	c.mu.Lock()
+	if c.localClosed || c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.localClosed = true
+	var done = c.remoteClosed
+	muxNotify(&c.writeNotify)
+	c.mu.Unlock()
+
+	c.session.writeFrame(muxFrameClose, c.id, nil)
+	if done {
+		c.session.remove(c.id)
+	}
+	return nil
+}
+
+// Reset 重置流, 双方之后的读写都返回ErrMuxStreamReset
+// Reset the stream, later reads and writes on both sides return ErrMuxStreamReset.
+func (c *MuxStream) Reset() error {
+	c.reset(ErrMuxStreamReset, true)
+	return nil
+}
+
+func (c *MuxStream) LocalAddr() net.Addr { return c.session.socket.LocalAddr() }
+
+func (c *MuxStream) RemoteAddr() net.Addr { return c.session.socket.RemoteAddr() }
+
+func (c *MuxStream) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *MuxStream) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *MuxStream) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// MuxEventHandler 在连接上运行多路复用会话的事件处理器, 其他事件转发给内嵌的Event.
+// 帧必须按顺序处理, 不要开启ParallelEnabled; 收到文本消息时以1003关闭连接, 协议错误时以1002关闭连接.
+// Event handler running a multiplexing session on the connection, other events are forwarded to the embedded Event.
+// Frames must be handled in order, do not enable ParallelEnabled; the connection is closed with 1003 on text messages
+// and with 1002 on protocol errors.
+type MuxEventHandler struct {
+	Event
+	mu     sync.Mutex
+	option *MuxOption
+}
+
+// NewMuxEventHandler 创建多路复用事件处理器, handler为nil时使用BuiltinEventHandler
+// Create a multiplexing event handler, BuiltinEventHandler is used when handler is nil.
+func NewMuxEventHandler(option *MuxOption, handler Event) *MuxEventHandler {
+	if option == nil {
+		option = new(MuxOption)
+	}
+	if handler == nil {
+		handler = BuiltinEventHandler{}
+	}
+	return &MuxEventHandler{Event: handler, option: option.initialize()}
+}
+
+// Session 获取连接的多路复用会话, 不存在时创建
+// Get the multiplexing session of the connection, created if absent
+func (c *MuxEventHandler) Session(socket *Conn) *Mux {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(muxSessionKey); ok {
+		return v.(*Mux)
+	}
+	var session = newMux(socket, c.option)
+	socket.Session().Store(muxSessionKey, session)
+	return session
+}
+
+func (c *MuxEventHandler) OnOpen(socket *Conn) {
+	c.Session(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *MuxEventHandler) OnClose(socket *Conn, err error) {
+	c.Session(socket).close(err)
+	c.Event.OnClose(socket, err)
+}
+
+func (c *MuxEventHandler) OnMessage(socket *Conn, message *Message) {
+	defer message.Close()
+	if message.Opcode != OpcodeBinary {
+		socket.WriteClose(1003, []byte("mux requires binary messages"))
+		return
+	}
+	if err := c.Session(socket).handle(message.Bytes()); err != nil {
+		socket.WriteClose(1002, []byte(err.Error()))
+	}
+}
@@ -0,0 +1,282 @@
+package gws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ net.Listener = (*Mux)(nil)
+	_ net.Conn     = (*MuxStream)(nil)
+)
+
+func newMuxPeers(serverOption, clientOption *MuxOption) (server, client *Mux) {
+	var serverHandler = NewMuxEventHandler(serverOption, nil)
+	var clientHandler = NewMuxEventHandler(clientOption, nil)
+	serverConn, clientConn := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go serverConn.ReadLoop()
+	go clientConn.ReadLoop()
+	return serverHandler.Session(serverConn), clientHandler.Session(clientConn)
+}
+
+func TestMux(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		go func() {
+			for {
+				stream, err := server.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(stream, stream)
+					_ = stream.Close()
+				}()
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stream, err := client.Open()
+				if !as.NoError(err) {
+					return
+				}
+				as.Equal(uint32(1), stream.ID()%2)
+				var data = internal.AlphabetNumeric.Generate(512 * 1024)
+				go func() {
+					_, _ = stream.Write(data)
+					_ = stream.Close()
+				}()
+				received, err := io.ReadAll(stream)
+				as.NoError(err)
+				as.Equal(data, received)
+			}()
+		}
+		wg.Wait()
+
+		time.Sleep(20 * time.Millisecond)
+		as.Equal(0, client.NumStreams())
+		as.Equal(0, server.NumStreams())
+		as.NoError(client.Close())
+		_, err := server.Accept()
+		as.ErrorIs(err, ErrMuxClosed)
+		_, err = client.Open()
+		as.ErrorIs(err, ErrMuxClosed)
+	})
+
+	t.Run("server open", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, err := server.Open()
+		as.NoError(err)
+		as.Equal(uint32(2), stream.ID())
+		_, _ = stream.Write([]byte("push"))
+
+		accepted, err := client.AcceptStream()
+		as.NoError(err)
+		as.Equal(stream.ID(), accepted.ID())
+		var p = make([]byte, 4)
+		_, err = io.ReadFull(accepted, p)
+		as.NoError(err)
+		as.Equal("push", string(p))
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		accepted, _ := server.AcceptStream()
+
+		// 对端不读取时, 写满窗口后阻塞
+		as.NoError(stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)))
+		n, err := stream.Write(make([]byte, defaultMuxStreamWindow+1))
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+		as.Equal(defaultMuxStreamWindow, n)
+
+		// 读取之后窗口恢复
+		as.NoError(stream.SetWriteDeadline(time.Time{}))
+		go func() { _, _ = io.CopyN(io.Discard, accepted, defaultMuxStreamWindow+1024) }()
+		n, err = stream.Write(make([]byte, 1024))
+		as.NoError(err)
+		as.Equal(1024, n)
+	})
+
+	t.Run("large window", func(t *testing.T) {
+		var window = 4 * defaultMuxStreamWindow
+		server, client := newMuxPeers(&MuxOption{StreamWindow: window}, nil)
+		stream, _ := client.Open()
+		_, _ = server.AcceptStream()
+
+		time.Sleep(20 * time.Millisecond)
+		as.NoError(stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)))
+		n, err := stream.Write(make([]byte, window+1))
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+		as.Equal(window, n)
+	})
+
+	t.Run("half close", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		_, _ = stream.Write([]byte("request"))
+		as.NoError(stream.Close())
+		_, err := stream.Write([]byte("x"))
+		as.ErrorIs(err, net.ErrClosed)
+
+		accepted, _ := server.AcceptStream()
+		request, err := io.ReadAll(accepted)
+		as.NoError(err)
+		as.Equal("request", string(request))
+		_, _ = accepted.Write([]byte("response"))
+		_ = accepted.Close()
+
+		response, err := io.ReadAll(stream)
+		as.NoError(err)
+		as.Equal("response", string(response))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		_, _ = stream.Write([]byte("discarded"))
+		accepted, _ := server.AcceptStream()
+		as.NoError(stream.Reset())
+
+		time.Sleep(20 * time.Millisecond)
+		_, err := accepted.Read(make([]byte, 16))
+		as.ErrorIs(err, ErrMuxStreamReset)
+		_, err = accepted.Write([]byte("x"))
+		as.ErrorIs(err, ErrMuxStreamReset)
+		_, err = stream.Read(make([]byte, 16))
+		as.ErrorIs(err, ErrMuxStreamReset)
+		as.Equal(0, server.NumStreams())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		_, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		as.NoError(stream.SetDeadline(time.Now().Add(20 * time.Millisecond)))
+		_, err := stream.Read(make([]byte, 1))
+		var netErr net.Error
+		as.True(errors.As(err, &netErr) && netErr.Timeout())
+		as.Equal(client.Conn().RemoteAddr(), stream.RemoteAddr())
+		as.Equal(client.Addr(), stream.LocalAddr())
+	})
+
+	t.Run("backlog", func(t *testing.T) {
+		server, client := newMuxPeers(&MuxOption{AcceptBacklog: 1}, nil)
+		first, _ := client.Open()
+		second, _ := client.Open()
+		_, err := second.Read(make([]byte, 1))
+		as.ErrorIs(err, ErrMuxStreamReset)
+
+		accepted, _ := server.AcceptStream()
+		as.Equal(first.ID(), accepted.ID())
+	})
+
+	t.Run("session close", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		_, _ = stream.Write([]byte("tail"))
+		accepted, _ := server.AcceptStream()
+		time.Sleep(20 * time.Millisecond)
+		client.Conn().WriteClose(1000, nil)
+
+		var p = make([]byte, 4)
+		_, err := io.ReadFull(accepted, p)
+		as.NoError(err)
+		as.Equal("tail", string(p))
+		_, err = accepted.Read(p)
+		as.ErrorIs(err, ErrMuxClosed)
+		_, err = stream.Write(p)
+		as.ErrorIs(err, ErrMuxClosed)
+	})
+
+	t.Run("concurrent waiters", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		stream, _ := client.Open()
+		_, _ = server.AcceptStream()
+		_, _ = stream.Write(make([]byte, defaultMuxStreamWindow))
+
+		// 窗口耗尽时阻塞的写入者和没有数据时阻塞的读取者, 会话关闭时全部被唤醒
+		const waiters = 4
+		var errs = make(chan error, 2*waiters)
+		for i := 0; i < waiters; i++ {
+			go func() {
+				_, err := stream.Write([]byte("x"))
+				errs <- err
+			}()
+			go func() {
+				_, err := stream.Read(make([]byte, 1))
+				errs <- err
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		as.NoError(client.Close())
+		for i := 0; i < 2*waiters; i++ {
+			select {
+			case err := <-errs:
+				as.ErrorIs(err, ErrMuxClosed)
+			case <-time.After(time.Second):
+				as.Fail("waiter is not woken")
+				return
+			}
+		}
+	})
+
+	t.Run("protocol error", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		_ = client.Conn().WriteMessage(OpcodeBinary, []byte{muxFrameOpen, 0, 0, 0, 2})
+		_, err := server.Accept()
+		as.Error(err)
+		_, err = client.Accept()
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(uint16(1002), closeErr.Code)
+		}
+
+		server, client = newMuxPeers(nil, nil)
+		_ = client.Conn().WriteString("text")
+		_, err = server.Accept()
+		as.Error(err)
+		_, err = client.Accept()
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(uint16(1003), closeErr.Code)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		server, client := newMuxPeers(nil, nil)
+		go func() {
+			_ = http.Serve(server, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = io.Copy(writer, request.Body)
+			}))
+		}()
+
+		var cli = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return client.Open() },
+		}}
+		for i := 0; i < 3; i++ {
+			resp, err := cli.Post("http://mux/echo", "text/plain", bytes.NewReader([]byte("hello")))
+			if !as.NoError(err) {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			as.Equal("hello", string(body))
+		}
+	})
+}
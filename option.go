@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+	"runtime"
 	"time"
 
 	"github.com/klauspost/compress/flate"
@@ -18,8 +19,12 @@ const (
 	defaultWriteMaxPayloadSize = 16 * 1024 * 1024
 	defaultCompressThreshold   = 512
 	defaultCompressorPoolSize  = 32
+	defaultAdaptiveMinGain     = 0.1
+	defaultAdaptiveProbe       = 64
 	defaultReadBufferSize      = 4 * 1024
 	defaultWriteBufferSize     = 4 * 1024
+	defaultWriteFlushSize      = 64 * 1024
+	defaultBroadcastShardSize  = 256
 	defaultHandshakeTimeout    = 5 * time.Second
 	defaultDialTimeout         = 5 * time.Second
 )
@@ -68,6 +73,21 @@ type (
 		// The client-side sliding window index
 		// Range 8<=n<=15, means pow(2,n) bytes.
 		ClientMaxWindowBits int
+
+		// 是否开启自适应压缩
+		// 按连接和操作码统计压缩率, 收益低于AdaptiveMinGain时暂停压缩, 定期重新探测.
+		// Whether to turn on adaptive compression
+		// The compression ratio is sampled per connection and per opcode. Compression is paused when
+		// the gain falls below AdaptiveMinGain and re-probed periodically.
+		AdaptiveEnabled bool
+
+		// 自适应压缩的最低收益, 即节省字节的比例, 取值范围 0<x<1, 默认0.1
+		// Minimum gain of adaptive compression, the fraction of bytes saved, range 0<x<1, default 0.1.
+		AdaptiveMinGain float64
+
+		// 暂停压缩后, 每隔多少条消息重新探测一次, 默认64
+		// Number of messages between re-probes after compression was paused, default 64.
+		AdaptiveProbeInterval int
 	}
 
 	Config struct {
@@ -88,6 +108,14 @@ type (
 		// Limit on the number of concurrent goroutine used for parallel message processing (single connection)
 		ParallelGolimit int
 
+		// 并行消息处理的分组键, 相同键的消息按到达顺序串行处理
+		// Key of parallel message processing, messages with the same key are handled serially in arrival order
+		ParallelKey func(message *Message) string
+
+		// 共享的消息处理协程池
+		// Shared worker pool handling messages
+		WorkerPool *WorkerPool
+
 		// 最大读取的消息内容长度
 		// Maximum read message content length
 		ReadMaxPayloadSize int
@@ -96,6 +124,10 @@ type (
 		// Size of the read buffer
 		ReadBufferSize int
 
+		// 连接空闲多久之后归还读缓冲区
+		// How long the connection stays quiet before its read buffer is returned
+		IdleReleaseTimeout time.Duration
+
 		// 最大写入的消息内容长度
 		// Maximum length of written message content
 		WriteMaxPayloadSize int
@@ -104,6 +136,22 @@ type (
 		// Deprecated: Size of the write buffer, v1.4.5 version of this parameter is deprecated
 		WriteBufferSize int
 
+		// 是否合并异步写入
+		// Whether to coalesce asynchronous writes
+		WriteCoalesceEnabled bool
+
+		// 合并写入的字节数上限
+		// Upper limit in bytes of coalesced writes
+		WriteFlushSize int
+
+		// 合并写入的最长等待时间
+		// Maximum waiting time of coalesced writes
+		WriteFlushLatency time.Duration
+
+		// 自动分片的帧大小
+		// Frame size of automatic fragmentation
+		WriteFragmentSize int
+
 		// 是否检查文本utf8编码, 关闭性能会好点
 		// Whether to check the text utf8 encoding, turn off the performance will be better
 		CheckUtf8Enabled bool
@@ -125,6 +173,7 @@ type (
 		WriteBufferSize int
 
 		PermessageDeflate   PermessageDeflate
+		PermessageZstd      PermessageZstd
 		ParallelEnabled     bool
 		ParallelGolimit     int
 		ReadMaxPayloadSize  int
@@ -134,6 +183,72 @@ type (
 		Logger              Logger
 		Recovery            func(logger Logger)
 
+		// 开启ParallelEnabled时, 按照返回的键分组处理消息: 相同键的消息按到达顺序串行处理, 不同键的消息并行处理.
+		// 排队和处理中的消息总数不超过ParallelGolimit, 达到上限时暂停读取. 只能通过Bytes读取消息内容, 不要消费Data.
+		// With ParallelEnabled, messages are grouped by the returned key: messages with the same key are handled serially
+		// in arrival order and messages with different keys are handled in parallel.
+		// At most ParallelGolimit messages are queued or running, reading pauses at the limit.
+		// Only read the content with Bytes, do not consume Data.
+		ParallelKey func(message *Message) string
+
+		// 共享的消息处理协程池, 设置之后优先于ParallelEnabled, 连接的消息在协程池中按顺序处理
+		// Shared worker pool handling messages, it takes precedence over ParallelEnabled when set
+		// and messages of the connection are handled in order on the pool.
+		WorkerPool *WorkerPool
+
+		// 合并异步写入, 默认关闭. 开启后WriteAsync和WritevAsync排队的消息合并为一次writev系统调用写入,
+		// 未压缩且不需要掩码的载荷直接引用, 不会被复制; 回调在实际写入之后执行.
+		// 同步写入之前会先写入已经合并的消息, 所以消息的顺序和压缩上下文保持一致.
+		// Coalesce asynchronous writes, disabled by default. Messages queued by WriteAsync and WritevAsync
+		// are flushed together with one writev system call, payloads that are neither compressed nor masked are referenced without copying,
+		// and callbacks run after the data is actually written.
+		// Coalesced messages are flushed before any synchronous write, so the order of messages and the compression context are kept.
+		WriteCoalesceEnabled bool
+
+		// 合并写入的字节数上限, 达到后立即写入, 默认64KB
+		// Upper limit in bytes of coalesced writes, they are flushed at once when it is reached, 64KB by default.
+		WriteFlushSize int
+
+		// 合并写入的最长等待时间. 默认为0, 只合并发送队列中已经排队的消息, 不额外等待.
+		// Maximum waiting time of coalesced writes. It is 0 by default, only messages already queued are coalesced without extra waiting.
+		WriteFlushLatency time.Duration
+
+		// 自动分片的帧大小, 载荷超过它的消息拆分为多个帧写入, 帧之间释放写锁, 控制帧可以插入到分片之间,
+		// 其他数据帧等待整条消息写完. 默认为0, 不分片.
+		// Frame size of automatic fragmentation. Messages with larger payloads are written in multiple frames
+		// and the write lock is released between them, so control frames can be interleaved between fragments,
+		// while other data frames wait for the whole message. It is 0 by default, which disables fragmentation.
+		WriteFragmentSize int
+
+		// 空闲模式, 默认关闭. 连接在ReadLoop中超过这段时间没有收到数据时, 归还读缓冲区和压缩器的滑动窗口,
+		// 然后阻塞在1字节的读取上, 收到数据后再重新借用. 它会覆盖底层连接的读超时, 请通过Conn.SetReadDeadline设置读超时.
+		// 事件循环模式下不生效, 连接在每次读取之后都会归还读缓冲区.
+		// Idle mode, disabled by default. When the connection receives nothing in ReadLoop for this period,
+		// the read buffer and the sliding window of the compressor are returned and the loop blocks on a 1-byte read,
+		// they are borrowed again once data arrives.
+		// It overrides the read deadline of the underlying connection, set read deadlines with Conn.SetReadDeadline.
+		// It has no effect in the event loop mode, where the read buffer is returned after every read.
+		IdleReleaseTimeout time.Duration
+
+		// 开启事件循环模式, 仅对Linux上Server接受的非TLS连接生效, 其他连接仍然使用ReadLoop.
+		// 空闲的连接不占用协程和读缓冲区, 可读时才借用读缓冲区并在协程池中读取已经到达的帧.
+		// Conn.SetDeadline和Conn.SetReadDeadline设置的读超时由事件循环检查, 超时的连接会被关闭.
+		// Enable the event loop mode, it only applies to non-TLS connections accepted by Server on Linux,
+		// other connections still use ReadLoop. Idle connections hold neither a goroutine nor a read buffer,
+		// the buffer is borrowed when the socket becomes readable and the arrived frames are read in a worker pool.
+		// Read deadlines set with Conn.SetDeadline and Conn.SetReadDeadline are checked by the event loops,
+		// connections past their deadline are closed.
+		ReactorEnabled bool
+
+		// 事件循环的数量, 默认为CPU核数的1/4, 至少为1
+		// Number of event loops, a quarter of the CPU cores by default and at least 1
+		ReactorLoops int
+
+		// 事件循环模式下读取消息的协程数量上限, 默认为256. 帧不完整的连接改由单独的协程等待剩余的数据, 不占用这些协程.
+		// Max number of goroutines reading messages in the event loop mode, 256 by default.
+		// A connection with an incomplete frame waits for the rest in a goroutine of its own and does not occupy them.
+		ReactorWorkers int
+
 		// TLS设置
 		TlsConfig *tls.Config
 
@@ -144,11 +259,32 @@ type (
 		// WebSocket sub-protocol, handshake failure disconnects the connection
 		SubProtocols []string
 
+		// 子协议选择, offered为客户端请求的子协议. 返回空字符串表示不使用子协议, 返回错误会导致握手失败.
+		// 默认选择SubProtocols中第一个客户端也支持的子协议, 没有交集时握手失败;
+		// 没有配置SubProtocols时, 选择客户端请求的第一个配置了事件处理器的子协议.
+		// Subprotocol selection, offered is the list requested by the client.
+		// Return an empty string to accept the connection without a subprotocol, return an error to fail the handshake.
+		// By default, the first element of SubProtocols offered by the client is chosen and the handshake fails if there is none;
+		// without SubProtocols, the first offered subprotocol that has a handler in SubProtocolHandlers is chosen.
+		SelectSubProtocol func(r *http.Request, offered []string) (string, error)
+
+		// 按照协商的子协议路由事件处理器, 没有匹配的连接使用默认的事件处理器
+		// Event handlers routed by the negotiated subprotocol, the default handler is used when there is no match.
+		SubProtocolHandlers map[string]Event
+
+		// 按照协商的子协议选择编解码器, 空字符串表示没有子协议, 没有匹配时使用JSONCodec
+		// Codecs selected by the negotiated subprotocol, the empty key means no subprotocol, JSONCodec is used when there is no match.
+		Codecs map[string]Codec
+
 		// 额外的响应头(可能不受客户端支持)
 		// Additional response headers (may not be supported by the client)
 		// https://www.rfc-editor.org/rfc/rfc6455.html#section-1.3
 		ResponseHeader http.Header
 
+		// 自定义拓展, 按客户端请求的顺序协商
+		// Custom extensions, negotiated in the order offered by the client
+		Extensions []Extension
+
 		// 鉴权
 		// Authentication of requests for connection establishment
 		Authorize func(r *http.Request, session SessionStorage) bool
@@ -160,6 +296,16 @@ type (
 	}
 )
 
+// 设置自适应压缩的默认值
+func (c *PermessageDeflate) setAdaptive() {
+	if c.AdaptiveMinGain <= 0 || c.AdaptiveMinGain >= 1 {
+		c.AdaptiveMinGain = defaultAdaptiveMinGain
+	}
+	if c.AdaptiveProbeInterval <= 0 {
+		c.AdaptiveProbeInterval = defaultAdaptiveProbe
+	}
+}
+
 // 设置压缩阈值
 // 开启上下文接管时, 必须不论长短压缩全部消息, 否则浏览器会报错
 // when context takeover is enabled, all messages must be compressed regardless of length,
@@ -170,6 +316,22 @@ func (c *PermessageDeflate) setThreshold(isServer bool) {
 	}
 }
 
+// 默认的子协议选择
+func (c *ServerOption) selectSubProtocol(r *http.Request, offered []string) (string, error) {
+	if len(c.SubProtocols) > 0 {
+		if subprotocol := internal.GetIntersectionElem(c.SubProtocols, offered); subprotocol != "" {
+			return subprotocol, nil
+		}
+		return "", ErrSubprotocolNegotiation
+	}
+	for _, item := range offered {
+		if _, ok := c.SubProtocolHandlers[item]; ok {
+			return item, nil
+		}
+	}
+	return "", nil
+}
+
 func (c *ServerOption) deleteProtectedHeaders() {
 	c.ResponseHeader.Del(internal.Upgrade.Key)
 	c.ResponseHeader.Del(internal.Connection.Key)
@@ -197,12 +359,18 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.WriteBufferSize <= 0 {
 		c.WriteBufferSize = defaultWriteBufferSize
 	}
+	if c.WriteFlushSize <= 0 {
+		c.WriteFlushSize = defaultWriteFlushSize
+	}
 	if c.Authorize == nil {
 		c.Authorize = func(r *http.Request, session SessionStorage) bool { return true }
 	}
 	if c.NewSession == nil {
 		c.NewSession = func() SessionStorage { return newSmap() }
 	}
+	if c.SelectSubProtocol == nil {
+		c.SelectSubProtocol = c.selectSubProtocol
+	}
 	if c.ResponseHeader == nil {
 		c.ResponseHeader = http.Header{}
 	}
@@ -215,6 +383,12 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.Recovery == nil {
 		c.Recovery = func(logger Logger) {}
 	}
+	if c.ReactorLoops <= 0 {
+		c.ReactorLoops = internal.Max(1, runtime.NumCPU()/4)
+	}
+	if c.ReactorWorkers <= 0 {
+		c.ReactorWorkers = defaultWorkerPoolMaxWorkers
+	}
 
 	if c.PermessageDeflate.Enabled {
 		if c.PermessageDeflate.ServerMaxWindowBits < 8 || c.PermessageDeflate.ServerMaxWindowBits > 15 {
@@ -233,20 +407,31 @@ func initServerOption(c *ServerOption) *ServerOption {
 			c.PermessageDeflate.PoolSize = defaultCompressorPoolSize
 		}
 		c.PermessageDeflate.PoolSize = internal.ToBinaryNumber(c.PermessageDeflate.PoolSize)
+		c.PermessageDeflate.setAdaptive()
+	}
+	if c.PermessageZstd.Enabled {
+		c.PermessageZstd.setDefault()
 	}
 
 	c.deleteProtectedHeaders()
 
 	c.config = &Config{
-		ParallelEnabled:     c.ParallelEnabled,
-		ParallelGolimit:     c.ParallelGolimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		Recovery:            c.Recovery,
-		Logger:              c.Logger,
+		ParallelEnabled:      c.ParallelEnabled,
+		ParallelGolimit:      c.ParallelGolimit,
+		ParallelKey:          c.ParallelKey,
+		WorkerPool:           c.WorkerPool,
+		ReadMaxPayloadSize:   c.ReadMaxPayloadSize,
+		ReadBufferSize:       c.ReadBufferSize,
+		IdleReleaseTimeout:   c.IdleReleaseTimeout,
+		WriteMaxPayloadSize:  c.WriteMaxPayloadSize,
+		WriteBufferSize:      c.WriteBufferSize,
+		WriteCoalesceEnabled: c.WriteCoalesceEnabled,
+		WriteFlushSize:       c.WriteFlushSize,
+		WriteFlushLatency:    c.WriteFlushLatency,
+		WriteFragmentSize:    c.WriteFragmentSize,
+		CheckUtf8Enabled:     c.CheckUtf8Enabled,
+		Recovery:             c.Recovery,
+		Logger:               c.Logger,
 		brPool: internal.NewPool(func() *bufio.Reader {
 			return bufio.NewReaderSize(nil, c.ReadBufferSize)
 		}),
@@ -279,6 +464,7 @@ type ClientOption struct {
 	WriteBufferSize int
 
 	PermessageDeflate   PermessageDeflate
+	PermessageZstd      PermessageZstd
 	ParallelEnabled     bool
 	ParallelGolimit     int
 	ReadMaxPayloadSize  int
@@ -288,6 +474,43 @@ type ClientOption struct {
 	Logger              Logger
 	Recovery            func(logger Logger)
 
+	// 开启ParallelEnabled时, 按照返回的键分组处理消息: 相同键的消息按到达顺序串行处理, 不同键的消息并行处理.
+	// 排队和处理中的消息总数不超过ParallelGolimit, 达到上限时暂停读取. 只能通过Bytes读取消息内容, 不要消费Data.
+	// With ParallelEnabled, messages are grouped by the returned key: messages with the same key are handled serially
+	// in arrival order and messages with different keys are handled in parallel.
+	// At most ParallelGolimit messages are queued or running, reading pauses at the limit.
+	// Only read the content with Bytes, do not consume Data.
+	ParallelKey func(message *Message) string
+
+	// 共享的消息处理协程池, 设置之后优先于ParallelEnabled, 连接的消息在协程池中按顺序处理
+	// Shared worker pool handling messages, it takes precedence over ParallelEnabled when set
+	// and messages of the connection are handled in order on the pool.
+	WorkerPool *WorkerPool
+
+	// 合并异步写入, 默认关闭. 开启后WriteAsync和WritevAsync排队的消息合并为一次writev系统调用写入,
+	// 未压缩且不需要掩码的载荷直接引用, 不会被复制; 回调在实际写入之后执行.
+	// 同步写入之前会先写入已经合并的消息, 所以消息的顺序和压缩上下文保持一致.
+	// Coalesce asynchronous writes, disabled by default. Messages queued by WriteAsync and WritevAsync
+	// are flushed together with one writev system call, payloads that are neither compressed nor masked are referenced without copying,
+	// and callbacks run after the data is actually written.
+	// Coalesced messages are flushed before any synchronous write, so the order of messages and the compression context are kept.
+	WriteCoalesceEnabled bool
+
+	// 合并写入的字节数上限, 达到后立即写入, 默认64KB
+	// Upper limit in bytes of coalesced writes, they are flushed at once when it is reached, 64KB by default.
+	WriteFlushSize int
+
+	// 合并写入的最长等待时间. 默认为0, 只合并发送队列中已经排队的消息, 不额外等待.
+	// Maximum waiting time of coalesced writes. It is 0 by default, only messages already queued are coalesced without extra waiting.
+	WriteFlushLatency time.Duration
+
+	// 自动分片的帧大小, 载荷超过它的消息拆分为多个帧写入, 帧之间释放写锁, 控制帧可以插入到分片之间,
+	// 其他数据帧等待整条消息写完. 默认为0, 不分片.
+	// Frame size of automatic fragmentation. Messages with larger payloads are written in multiple frames
+	// and the write lock is released between them, so control frames can be interleaved between fragments,
+	// while other data frames wait for the whole message. It is 0 by default, which disables fragmentation.
+	WriteFragmentSize int
+
 	// 连接地址, 例如 wss://example.com/connect
 	// server address, eg: wss://example.com/connect
 	Addr string
@@ -296,6 +519,14 @@ type ClientOption struct {
 	// extra request header
 	RequestHeader http.Header
 
+	// 自定义拓展, 按顺序写入握手请求, 排在permessage-deflate之后
+	// Custom extensions, offered in order after permessage-deflate
+	Extensions []Extension
+
+	// 按照协商的子协议选择编解码器, 空字符串表示没有子协议, 没有匹配时使用JSONCodec
+	// Codecs selected by the negotiated subprotocol, the empty key means no subprotocol, JSONCodec is used when there is no match.
+	Codecs map[string]Codec
+
 	// 握手超时时间
 	HandshakeTimeout time.Duration
 
@@ -336,6 +567,9 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.WriteBufferSize <= 0 {
 		c.WriteBufferSize = defaultWriteBufferSize
 	}
+	if c.WriteFlushSize <= 0 {
+		c.WriteFlushSize = defaultWriteFlushSize
+	}
 	if c.HandshakeTimeout <= 0 {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
@@ -368,21 +602,31 @@ func initClientOption(c *ClientOption) *ClientOption {
 			c.PermessageDeflate.Level = defaultCompressLevel
 		}
 		c.PermessageDeflate.PoolSize = 1
+		c.PermessageDeflate.setAdaptive()
+	}
+	if c.PermessageZstd.Enabled {
+		c.PermessageZstd.setDefault()
 	}
 	return c
 }
 
 func (c *ClientOption) getConfig() *Config {
 	config := &Config{
-		ParallelEnabled:     c.ParallelEnabled,
-		ParallelGolimit:     c.ParallelGolimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		Recovery:            c.Recovery,
-		Logger:              c.Logger,
+		ParallelEnabled:      c.ParallelEnabled,
+		ParallelGolimit:      c.ParallelGolimit,
+		ParallelKey:          c.ParallelKey,
+		WorkerPool:           c.WorkerPool,
+		ReadMaxPayloadSize:   c.ReadMaxPayloadSize,
+		ReadBufferSize:       c.ReadBufferSize,
+		WriteMaxPayloadSize:  c.WriteMaxPayloadSize,
+		WriteBufferSize:      c.WriteBufferSize,
+		WriteCoalesceEnabled: c.WriteCoalesceEnabled,
+		WriteFlushSize:       c.WriteFlushSize,
+		WriteFlushLatency:    c.WriteFlushLatency,
+		WriteFragmentSize:    c.WriteFragmentSize,
+		CheckUtf8Enabled:     c.CheckUtf8Enabled,
+		Recovery:             c.Recovery,
+		Logger:               c.Logger,
 	}
 	return config
 }
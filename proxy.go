@@ -0,0 +1,264 @@
+package gws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/marifcelik/gws/internal"
+)
+
+const proxySessionKey = "gws:proxy"
+
+// 默认转发到上游的请求头
+var defaultProxyForwardHeaders = []string{"Authorization", "Cookie", "Origin", "User-Agent"}
+
+var (
+	// ErrProxyUpstream 没有配置上游地址
+	// The upstream address is not configured
+	ErrProxyUpstream = errors.New("gws: proxy upstream is not configured")
+)
+
+// ProxyDirection 代理消息的方向
+// Direction of proxied messages
+type ProxyDirection uint8
+
+const (
+	// ProxyClientToUpstream 客户端发往上游
+	// From the client to the upstream
+	ProxyClientToUpstream ProxyDirection = iota
+
+	// ProxyUpstreamToClient 上游发往客户端
+	// From the upstream to the client
+	ProxyUpstreamToClient
+)
+
+// ProxySession 一对代理连接
+// A pair of proxied connections
+type ProxySession struct {
+	// 客户端连接
+	// The client connection
+	Client *Conn
+
+	// 上游连接
+	// The upstream connection
+	Upstream *Conn
+}
+
+func (c *ProxySession) peer(socket *Conn) *Conn {
+	return internal.SelectValue(socket == c.Client, c.Upstream, c.Client)
+}
+
+type ProxyOption struct {
+	// 上游地址, 例如 ws://127.0.0.1:8080, 请求的路径和查询参数会附加在后面
+	// The upstream address, eg: ws://127.0.0.1:8080, the path and query of the request are appended.
+	Upstream string
+
+	// 按请求选择上游地址, 优先于Upstream. 返回错误时响应502.
+	// Select the upstream address by request, it takes precedence over Upstream. 502 is responded on error.
+	Director func(r *http.Request) (string, error)
+
+	// 转发到上游的请求头, 默认为Authorization, Cookie, Origin, User-Agent
+	// Request headers forwarded to the upstream, Authorization, Cookie, Origin and User-Agent by default
+	ForwardHeaders []string
+
+	// 上游连接的配置模板, 每个连接复制一份并覆盖Addr和RequestHeader. 压缩在两侧独立协商.
+	// Template of the upstream connection options, copied for every connection with Addr and RequestHeader overwritten.
+	// Compression is negotiated independently on each side.
+	ClientOption *ClientOption
+
+	// 消息检查, 可用于鉴权和限流. 返回错误时以相同的状态码关闭两侧连接,
+	// 错误为*CloseError时使用其状态码和原因, 否则使用1008. 在读协程中执行, 阻塞会对该方向施加背压.
+	// Message inspection for auth and rate limiting. Both connections are closed with the same code on error,
+	// the code and reason of a *CloseError are used, or else 1008.
+	// It runs in the read goroutine, blocking applies backpressure to that direction.
+	Inspect func(session *ProxySession, direction ProxyDirection, message *Message) error
+}
+
+func (c *ProxyOption) initialize() *ProxyOption {
+	if c.ForwardHeaders == nil {
+		c.ForwardHeaders = defaultProxyForwardHeaders
+	}
+	if c.ClientOption == nil {
+		c.ClientOption = new(ClientOption)
+	}
+	return c
+}
+
+type proxyContextKey struct{}
+
+// Proxy WebSocket反向代理, 实现了http.Handler
+// 先连接上游, 再以上游选中的子协议升级客户端连接. 消息的操作码, 分片和关闭状态码原样转发, Ping和Pong也会转发.
+// 上游握手失败时, 响应上游的状态码, 无法连接时响应502.
+// WebSocket reverse proxy implementing http.Handler.
+// The upstream is dialed first and the client is upgraded with the subprotocol chosen by the upstream.
+// Opcodes, fragmentation and close codes are relayed as is, so are pings and pongs.
+// The status code of the upstream is responded when its handshake fails, and 502 when it can not be reached.
+type Proxy struct {
+	option   *ProxyOption
+	upgrader *Upgrader
+	handler  *proxyHandler
+}
+
+// NewProxy 创建反向代理, serverOption的SelectSubProtocol会被替换. 不要在两侧开启ParallelEnabled.
+// Create a reverse proxy, SelectSubProtocol of serverOption is replaced. Do not enable ParallelEnabled on either side.
+func NewProxy(option *ProxyOption, serverOption *ServerOption) *Proxy {
+	if option == nil {
+		option = new(ProxyOption)
+	}
+	option.initialize()
+	if serverOption == nil {
+		serverOption = new(ServerOption)
+	}
+	serverOption.SubProtocols = nil
+	serverOption.SelectSubProtocol = func(r *http.Request, offered []string) (string, error) {
+		if upstream, ok := r.Context().Value(proxyContextKey{}).(*Conn); ok {
+			return upstream.SubProtocol(), nil
+		}
+		return "", nil
+	}
+
+	var handler = &proxyHandler{inspect: option.Inspect}
+	return &Proxy{option: option, upgrader: NewUpgrader(handler, serverOption), handler: handler}
+}
+
+// Upgrader 获取客户端一侧的升级器
+// Get the upgrader of the client side
+func (c *Proxy) Upgrader() *Upgrader { return c.upgrader }
+
+func (c *Proxy) target(r *http.Request) (string, error) {
+	if c.option.Director != nil {
+		return c.option.Director(r)
+	}
+	if c.option.Upstream == "" {
+		return "", ErrProxyUpstream
+	}
+	return strings.TrimSuffix(c.option.Upstream, "/") + r.URL.RequestURI(), nil
+}
+
+// 连接上游, 转发选定的请求头, 子协议和客户端地址
+func (c *Proxy) dial(r *http.Request) (*Conn, *http.Response, error) {
+	addr, err := c.target(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var option = *c.option.ClientOption
+	if option.TlsConfig != nil {
+		option.TlsConfig = option.TlsConfig.Clone()
+	}
+	option.Addr = addr
+	option.RequestHeader = http.Header{}
+	for _, key := range c.option.ForwardHeaders {
+		for _, value := range r.Header.Values(key) {
+			option.RequestHeader.Add(key, value)
+		}
+	}
+	if v := r.Header.Get(internal.SecWebSocketProtocol.Key); v != "" {
+		option.RequestHeader.Set(internal.SecWebSocketProtocol.Key, v)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		var forwarded = append(r.Header.Values("X-Forwarded-For"), host)
+		option.RequestHeader.Set("X-Forwarded-For", strings.Join(forwarded, ", "))
+	}
+	return NewClient(c.handler, &option)
+}
+
+func (c *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upstream, resp, err := c.dial(r)
+	if err != nil {
+		var code = http.StatusBadGateway
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			code = resp.StatusCode
+		}
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	var ctx = context.WithValue(r.Context(), proxyContextKey{}, upstream)
+	client, err := c.upgrader.Upgrade(w, r.WithContext(ctx))
+	if err != nil {
+		upstream.WriteClose(1001, nil)
+		return
+	}
+
+	var session = &ProxySession{Client: client, Upstream: upstream}
+	client.Session().Store(proxySessionKey, session)
+	upstream.Session().Store(proxySessionKey, session)
+	go upstream.ReadLoop()
+	go client.ReadLoop()
+}
+
+// 把关闭原因转换为可以发送的状态码, 1005, 1006和1015不能出现在关闭帧中
+func proxyCloseCode(err error) (uint16, []byte) {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return 1001, nil
+	}
+	switch closeErr.Code {
+	case 1005:
+		return 1000, nil
+	case 1006, 1015:
+		return 1001, nil
+	default:
+		return closeErr.Code, closeErr.Reason
+	}
+}
+
+// 两侧连接共用的事件处理器, 消息写入另一侧
+type proxyHandler struct {
+	inspect func(session *ProxySession, direction ProxyDirection, message *Message) error
+}
+
+func (c *proxyHandler) session(socket *Conn) *ProxySession {
+	v, _ := socket.Session().Load(proxySessionKey)
+	session, _ := v.(*ProxySession)
+	return session
+}
+
+func (c *proxyHandler) OnOpen(socket *Conn) {}
+
+func (c *proxyHandler) OnClose(socket *Conn, err error) {
+	if session := c.session(socket); session != nil {
+		code, reason := proxyCloseCode(err)
+		session.peer(socket).WriteClose(code, reason)
+	}
+}
+
+func (c *proxyHandler) OnPing(socket *Conn, payload []byte) {
+	if session := c.session(socket); session != nil {
+		_ = session.peer(socket).WritePing(payload)
+	}
+}
+
+func (c *proxyHandler) OnPong(socket *Conn, payload []byte) {
+	if session := c.session(socket); session != nil {
+		_ = session.peer(socket).WritePong(payload)
+	}
+}
+
+func (c *proxyHandler) OnMessage(socket *Conn, message *Message) {
+	defer message.Close()
+	var session = c.session(socket)
+	if session == nil {
+		return
+	}
+
+	if c.inspect != nil {
+		var direction = internal.SelectValue(socket == session.Client, ProxyClientToUpstream, ProxyUpstreamToClient)
+		if err := c.inspect(session, direction, message); err != nil {
+			var code, reason = uint16(1008), []byte(err.Error())
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				code, reason = closeErr.Code, closeErr.Reason
+			}
+			socket.WriteClose(code, reason)
+			session.peer(socket).WriteClose(code, reason)
+			return
+		}
+	}
+
+	_ = session.peer(socket).writeFragments(message.Opcode, message.Bytes(), message.fragments, WriteOptions{})
+}
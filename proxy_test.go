@@ -0,0 +1,244 @@
+package gws
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type proxyBackend struct {
+	server   *httptest.Server
+	requests chan *http.Request
+	messages chan *Message
+	closed   chan error
+}
+
+// 启动上游服务, 回显收到的消息并保留分片
+func newProxyBackend(option *ServerOption) *proxyBackend {
+	var backend = &proxyBackend{
+		requests: make(chan *http.Request, 16),
+		messages: make(chan *Message, 16),
+		closed:   make(chan error, 16),
+	}
+	var handler = &webSocketMocker{
+		onMessage: func(socket *Conn, message *Message) {
+			if string(message.Bytes()) == "close" {
+				socket.WriteClose(4001, []byte("bye"))
+				return
+			}
+			_ = socket.writeFragments(message.Opcode, message.Bytes(), message.fragments, WriteOptions{})
+			backend.messages <- message
+		},
+		onPing:  func(socket *Conn, payload []byte) { _ = socket.WritePong(payload) },
+		onClose: func(socket *Conn, err error) { backend.closed <- err },
+	}
+	var upgrader = NewUpgrader(handler, option)
+	backend.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend.requests <- r
+		socket, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		go socket.ReadLoop()
+	}))
+	return backend
+}
+
+func (c *proxyBackend) addr() string { return "ws" + strings.TrimPrefix(c.server.URL, "http") }
+
+type proxyClient struct {
+	socket   *Conn
+	messages chan *Message
+	closed   chan error
+}
+
+func newProxyClient(option *ClientOption) (*proxyClient, *http.Response, error) {
+	var client = &proxyClient{messages: make(chan *Message, 16), closed: make(chan error, 1)}
+	var handler = &webSocketMocker{
+		onMessage: func(socket *Conn, message *Message) { client.messages <- message },
+		onClose:   func(socket *Conn, err error) { client.closed <- err },
+	}
+	socket, resp, err := NewClient(handler, option)
+	if err != nil {
+		return nil, resp, err
+	}
+	client.socket = socket
+	go socket.ReadLoop()
+	return client, resp, nil
+}
+
+func proxyCloseError(ch chan error) *CloseError {
+	select {
+	case err := <-ch:
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr
+		}
+		return &CloseError{}
+	case <-time.After(time.Second):
+		return &CloseError{}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var as = assert.New(t)
+	var backend = newProxyBackend(&ServerOption{SubProtocols: []string{"chat"}})
+	defer backend.server.Close()
+
+	var proxy = NewProxy(&ProxyOption{
+		Upstream: backend.addr(),
+		Inspect: func(session *ProxySession, direction ProxyDirection, message *Message) error {
+			if direction == ProxyClientToUpstream && string(message.Bytes()) == "forbidden" {
+				return &CloseError{Code: 4003, Reason: []byte("policy")}
+			}
+			if direction == ProxyUpstreamToClient && string(message.Bytes()) == "secret" {
+				return errors.New("leak")
+			}
+			return nil
+		},
+	}, &ServerOption{PermessageDeflate: PermessageDeflate{Enabled: true}})
+	var server = httptest.NewServer(proxy)
+	defer server.Close()
+	var addr = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	var dial = func() (*proxyClient, *http.Request) {
+		client, _, err := newProxyClient(&ClientOption{
+			Addr:              addr + "/chat?room=1",
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			RequestHeader: http.Header{
+				"Sec-Websocket-Protocol": []string{"chat"},
+				"Authorization":          []string{"Bearer token"},
+				"X-Forwarded-For":        []string{"10.0.0.1"},
+				"X-Private":              []string{"1"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, <-backend.requests
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		var client, request = dial()
+		as.Equal("/chat?room=1", request.URL.RequestURI())
+		as.Equal("Bearer token", request.Header.Get("Authorization"))
+		as.Equal("10.0.0.1, 127.0.0.1", request.Header.Get("X-Forwarded-For"))
+		as.Equal("", request.Header.Get("X-Private"))
+		as.Equal("", request.Header.Get("Sec-WebSocket-Extensions"))
+		as.Equal("chat", client.socket.SubProtocol())
+
+		// 压缩在两侧独立协商
+		as.True(client.socket.pd.Enabled)
+		client.socket.WriteClose(1000, nil)
+		as.Equal(uint16(1000), proxyCloseError(backend.closed).Code)
+	})
+
+	t.Run("relay", func(t *testing.T) {
+		var client, _ = dial()
+		as.NoError(client.socket.WriteString("hello"))
+		var message = <-client.messages
+		as.Equal(OpcodeText, message.Opcode)
+		as.Equal("hello", string(message.Bytes()))
+		<-backend.messages
+
+		var payload = []byte(strings.Repeat("binary", 1024))
+		as.NoError(client.socket.WriteMessage(OpcodeBinary, payload))
+		message = <-client.messages
+		as.Equal(OpcodeBinary, message.Opcode)
+		as.Equal(payload, message.Bytes())
+		<-backend.messages
+		client.socket.WriteClose(1000, nil)
+		<-backend.closed
+	})
+
+	t.Run("fragments", func(t *testing.T) {
+		var client, _ = dial()
+		as.NoError(client.socket.writeFragments(OpcodeText, []byte("hello, world"), []int{3, 4, 5}, WriteOptions{Compress: CompressNever}))
+		var upstream = <-backend.messages
+		as.Equal([]int{3, 4, 5}, upstream.fragments)
+		var message = <-client.messages
+		as.Equal("hello, world", string(message.Bytes()))
+		as.Equal([]int{3, 4, 5}, message.fragments)
+
+		// 压缩的分片消息保持分片数量
+		var payload = []byte(strings.Repeat("compressed", 1024))
+		as.NoError(client.socket.writeFragments(OpcodeBinary, payload, []int{1, 2, len(payload) - 3}, WriteOptions{Compress: CompressAlways}))
+		upstream = <-backend.messages
+		as.Equal(3, len(upstream.fragments))
+		message = <-client.messages
+		as.Equal(payload, message.Bytes())
+		as.Equal(3, len(message.fragments))
+		client.socket.WriteClose(1000, nil)
+		<-backend.closed
+	})
+
+	t.Run("close code", func(t *testing.T) {
+		var client, _ = dial()
+		as.NoError(client.socket.WriteString("close"))
+		var closeErr = proxyCloseError(client.closed)
+		as.Equal(uint16(4001), closeErr.Code)
+		as.Equal("bye", string(closeErr.Reason))
+		<-backend.closed
+
+		client, _ = dial()
+		client.socket.WriteClose(4002, []byte("leaving"))
+		closeErr = proxyCloseError(backend.closed)
+		as.Equal(uint16(4002), closeErr.Code)
+		as.Equal("leaving", string(closeErr.Reason))
+	})
+
+	t.Run("inspect", func(t *testing.T) {
+		var client, _ = dial()
+		as.NoError(client.socket.WriteString("forbidden"))
+		as.Equal(uint16(4003), proxyCloseError(client.closed).Code)
+		as.Equal(uint16(4003), proxyCloseError(backend.closed).Code)
+
+		client, _ = dial()
+		as.NoError(client.socket.WriteString("secret"))
+		<-backend.messages
+		as.Equal(uint16(1008), proxyCloseError(client.closed).Code)
+		as.Equal(uint16(1008), proxyCloseError(backend.closed).Code)
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		var client, _ = dial()
+		var pong = make(chan string, 1)
+		client.socket.handler.(*webSocketMocker).onPong = func(socket *Conn, payload []byte) { pong <- string(payload) }
+		as.NoError(client.socket.WritePing([]byte("ping")))
+		select {
+		case payload := <-pong:
+			as.Equal("ping", payload)
+		case <-time.After(time.Second):
+			as.Fail("pong is not relayed")
+		}
+		client.socket.WriteClose(1000, nil)
+		<-backend.closed
+	})
+
+	t.Run("upstream failure", func(t *testing.T) {
+		var proxy = httptest.NewServer(NewProxy(&ProxyOption{Upstream: "ws://127.0.0.1:1"}, nil))
+		defer proxy.Close()
+		_, resp, err := newProxyClient(&ClientOption{Addr: "ws" + strings.TrimPrefix(proxy.URL, "http")})
+		as.Error(err)
+		if as.NotNil(resp) {
+			as.Equal(http.StatusBadGateway, resp.StatusCode)
+		}
+
+		proxy = httptest.NewServer(NewProxy(&ProxyOption{Upstream: backend.addr()}, nil))
+		defer proxy.Close()
+		_, resp, err = newProxyClient(&ClientOption{
+			Addr:          "ws" + strings.TrimPrefix(proxy.URL, "http"),
+			RequestHeader: http.Header{"Sec-Websocket-Protocol": []string{"unknown"}},
+		})
+		<-backend.requests
+		as.Error(err)
+		if as.NotNil(resp) {
+			as.Equal(http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,398 @@
+//go:build linux
+
+package gws
+
+import (
+	"container/heap"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const reactorEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// 基于epoll的事件循环. 连接以EPOLLONESHOT注册, 每次可读只会唤醒一次,
+// 由协程池读完已经到达的帧之后重新注册, 所以同一个连接同时最多只有一个读协程.
+// 帧不完整时改由单独的协程等待剩余的数据, 发送半帧的客户端不会占满协程池.
+// 用户设置的读超时由事件循环检查, 空闲的连接超时后会被关闭.
+type reactor struct {
+	loops []*reactorLoop
+	pool  *WorkerPool // 读取已经到达的完整帧
+	next  uint32
+}
+
+type reactorLoop struct {
+	epfd   int
+	pipe   [2]int // 唤醒事件循环
+	pool   *WorkerPool
+	mu     sync.Mutex
+	conns  map[int]*reactorConn
+	timers reactorTimers // 设置了读超时的连接
+	wakeAt time.Time     // 当前等待的截止时间, 零值表示没有超时
+	closed bool
+}
+
+type reactorConn struct {
+	loop       *reactorLoop
+	socket     *Conn
+	fd         int
+	queue      poolQueue // 在协程池中的队列
+	deadline   time.Time // 读超时
+	index      int       // 在timers中的位置, 不在时为-1
+	registered bool      // 是否已经加入epoll
+	serving    bool      // 是否有协程正在读取
+	closed     bool      // 是否已经移除
+	released   bool      // 事件循环关闭后, 交还给ReadLoop
+}
+
+func newReactor(loops int, workers int) (*reactor, error) {
+	var c = &reactor{
+		loops: make([]*reactorLoop, 0, loops),
+		pool:  NewWorkerPool(&WorkerPoolOption{MaxWorkers: workers}),
+	}
+	for i := 0; i < loops; i++ {
+		loop, err := newReactorLoop(c.pool)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.loops = append(c.loops, loop)
+		go loop.run()
+	}
+	return c, nil
+}
+
+func newReactorLoop(pool *WorkerPool) (*reactorLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var c = &reactorLoop{epfd: epfd, pool: pool, conns: make(map[int]*reactorConn)}
+	if err := syscall.Pipe2(c.pipe[0:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(epfd)
+		return nil, err
+	}
+	var event = syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(c.pipe[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, c.pipe[0], &event); err != nil {
+		_ = syscall.Close(epfd)
+		_ = syscall.Close(c.pipe[0])
+		_ = syscall.Close(c.pipe[1])
+		return nil, err
+	}
+	return c, nil
+}
+
+// 把升级完成的连接加入事件循环, 并触发OnOpen. 无法获取文件描述符或者事件循环已经关闭时返回false, 由调用者继续使用ReadLoop.
+func (c *reactor) add(socket *Conn) bool {
+	sc, ok := socket.conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var fd = -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil || fd < 0 {
+		return false
+	}
+
+	var loop = c.loops[atomic.AddUint32(&c.next, 1)%uint32(len(c.loops))]
+	var rc = &reactorConn{loop: loop, socket: socket, fd: fd, index: -1, serving: true}
+	loop.mu.Lock()
+	if loop.closed {
+		loop.mu.Unlock()
+		return false
+	}
+	loop.conns[fd] = rc
+	loop.mu.Unlock()
+	socket.poll = rc
+
+	socket.handler.OnOpen(socket)
+
+	// 握手请求之后可能已经收到了帧
+	if socket.br != nil && socket.br.Buffered() > 0 {
+		loop.pool.push(&rc.queue, rc.serve)
+	} else {
+		socket.releaseReader()
+		loop.arm(rc)
+	}
+	return true
+}
+
+// 停止事件循环, 已经注册的连接交还给ReadLoop
+func (c *reactor) close() {
+	for _, loop := range c.loops {
+		loop.mu.Lock()
+		if !loop.closed {
+			loop.closed = true
+			loop.wake()
+		}
+		loop.mu.Unlock()
+	}
+}
+
+func (c *reactorLoop) run() {
+	var events = make([]syscall.EpollEvent, 128)
+	var ready, expired []*reactorConn
+	for {
+		n, err := syscall.EpollWait(c.epfd, events, c.waitTimeout())
+		if err != nil && err != syscall.EINTR {
+			break
+		}
+
+		ready, expired = ready[:0], expired[:0]
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			break
+		}
+		for i := 0; i < n; i++ {
+			var fd = int(events[i].Fd)
+			if fd == c.pipe[0] {
+				c.drain()
+				continue
+			}
+			if rc, ok := c.conns[fd]; ok && !rc.serving {
+				rc.serving = true
+				ready = append(ready, rc)
+			}
+		}
+		// 正在读取的连接由arm检查超时
+		var now = time.Now()
+		for len(c.timers) > 0 && !now.Before(c.timers[0].deadline) {
+			var rc = heap.Pop(&c.timers).(*reactorConn)
+			if !rc.serving {
+				rc.serving = true
+				expired = append(expired, rc)
+			}
+		}
+		c.mu.Unlock()
+
+		// 协程池已满时阻塞, 暂停接收新的事件
+		for _, rc := range ready {
+			c.pool.push(&rc.queue, rc.serve)
+		}
+		for _, rc := range expired {
+			c.pool.push(&rc.queue, rc.expire)
+		}
+	}
+	c.shutdown()
+}
+
+// 距离最早的读超时的毫秒数, 没有读超时时无限等待
+func (c *reactorLoop) waitTimeout() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.timers) == 0 {
+		c.wakeAt = time.Time{}
+		return -1
+	}
+	c.wakeAt = c.timers[0].deadline
+	var d = time.Until(c.wakeAt)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// 唤醒事件循环, 需要持有锁
+func (c *reactorLoop) wake() {
+	_, _ = syscall.Write(c.pipe[1], []byte{0})
+}
+
+// 读空唤醒管道, 需要持有锁
+func (c *reactorLoop) drain() {
+	var buf [64]byte
+	for {
+		if n, err := syscall.Read(c.pipe[0], buf[0:]); n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+// 事件循环退出, 剩余的连接在各自的协程中继续读取
+func (c *reactorLoop) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for fd, rc := range c.conns {
+		delete(c.conns, fd)
+		if rc.index >= 0 {
+			heap.Remove(&c.timers, rc.index)
+		}
+		rc.released = true
+		if !rc.serving {
+			go rc.socket.resume()
+		}
+	}
+	_ = syscall.Close(c.epfd)
+	_ = syscall.Close(c.pipe[0])
+	_ = syscall.Close(c.pipe[1])
+}
+
+// 读取已经到达的帧, 然后重新注册. 帧不完整时交给单独的协程等待, 不占用协程池.
+func (c *reactorConn) serve() {
+	complete, err := c.socket.readReady()
+	if err != nil {
+		c.socket.emitError(err)
+	} else if !complete {
+		go c.await()
+		return
+	}
+	c.loop.arm(c)
+}
+
+// 阻塞读取不完整的帧, 之后继续处理缓冲区中剩余的帧. 读超时由连接本身的超时控制.
+func (c *reactorConn) await() {
+	if err := c.socket.readMessage(); err != nil {
+		c.socket.emitError(err)
+		c.loop.arm(c)
+		return
+	}
+	c.serve()
+}
+
+// 读超时之后没有新的数据, 由arm关闭连接
+func (c *reactorConn) expire() { c.loop.arm(c) }
+
+func (c *reactorConn) detach() { c.loop.detach(c) }
+
+func (c *reactorConn) setDeadline(t time.Time) { c.loop.setDeadline(c, t) }
+
+// 与ReadLoop中读超时返回的错误一致
+func (c *reactorConn) timeout() error {
+	var conn = c.socket.conn
+	return &net.OpError{
+		Op:     "read",
+		Net:    conn.LocalAddr().Network(),
+		Source: conn.LocalAddr(),
+		Addr:   conn.RemoteAddr(),
+		Err:    os.ErrDeadlineExceeded,
+	}
+}
+
+// 重新注册可读事件. 连接在读取期间被关闭时, 由读协程触发OnClose; 读超时已过时关闭连接.
+func (c *reactorLoop) arm(rc *reactorConn) {
+	c.mu.Lock()
+	if !rc.closed && !rc.released && !rc.deadline.IsZero() && !time.Now().Before(rc.deadline) {
+		c.mu.Unlock()
+		rc.socket.emitError(rc.timeout())
+		c.mu.Lock()
+	}
+
+	rc.serving = false
+	if rc.closed {
+		c.mu.Unlock()
+		rc.socket.finish()
+		return
+	}
+	if rc.released {
+		c.mu.Unlock()
+		go rc.socket.resume()
+		return
+	}
+
+	// 读取期间到期的超时已经从堆中移除
+	if !rc.deadline.IsZero() && rc.index < 0 {
+		heap.Push(&c.timers, rc)
+	}
+	var event = syscall.EpollEvent{Events: reactorEvents, Fd: int32(rc.fd)}
+	var err error
+	if rc.registered {
+		err = syscall.EpollCtl(c.epfd, syscall.EPOLL_CTL_MOD, rc.fd, &event)
+	} else {
+		err = syscall.EpollCtl(c.epfd, syscall.EPOLL_CTL_ADD, rc.fd, &event)
+		rc.registered = err == nil
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		rc.socket.emitError(err)
+	}
+}
+
+// 更新读超时. 新的超时早于事件循环当前的等待时间时, 唤醒事件循环.
+func (c *reactorLoop) setDeadline(rc *reactorConn, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rc.closed || rc.released {
+		return
+	}
+	rc.deadline = t
+	switch {
+	case t.IsZero():
+		if rc.index >= 0 {
+			heap.Remove(&c.timers, rc.index)
+		}
+		return
+	case rc.index >= 0:
+		heap.Fix(&c.timers, rc.index)
+	default:
+		heap.Push(&c.timers, rc)
+	}
+	if c.wakeAt.IsZero() || t.Before(c.wakeAt) {
+		c.wakeAt = t
+		c.wake()
+	}
+}
+
+// 连接关闭之前调用. 没有协程在读取时, 由这里触发OnClose. 已经交还给ReadLoop的连接由ReadLoop触发OnClose.
+func (c *reactorLoop) detach(rc *reactorConn) {
+	c.mu.Lock()
+	if rc.closed || rc.released {
+		c.mu.Unlock()
+		return
+	}
+	rc.closed = true
+	if c.conns[rc.fd] == rc {
+		delete(c.conns, rc.fd)
+	}
+	if rc.index >= 0 {
+		heap.Remove(&c.timers, rc.index)
+	}
+	if rc.registered {
+		_ = syscall.EpollCtl(c.epfd, syscall.EPOLL_CTL_DEL, rc.fd, nil)
+	}
+	var serving = rc.serving
+	c.mu.Unlock()
+
+	if !serving {
+		go rc.socket.finish()
+	}
+}
+
+// 按读超时排序的最小堆
+type reactorTimers []*reactorConn
+
+func (c reactorTimers) Len() int { return len(c) }
+
+func (c reactorTimers) Less(i, j int) bool { return c[i].deadline.Before(c[j].deadline) }
+
+func (c reactorTimers) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+	c[i].index = i
+	c[j].index = j
+}
+
+func (c *reactorTimers) Push(x any) {
+	var rc = x.(*reactorConn)
+	rc.index = len(*c)
+	*c = append(*c, rc)
+}
+
+func (c *reactorTimers) Pop() any {
+	var old = *c
+	var n = len(old)
+	var rc = old[n-1]
+	old[n-1] = nil
+	rc.index = -1
+	*c = old[:n-1]
+	return rc
+}
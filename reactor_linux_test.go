@@ -0,0 +1,237 @@
+//go:build linux
+
+package gws
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动事件循环模式的服务器, 回显收到的消息
+func newReactorServer(t *testing.T, option *ServerOption, onOpen func(socket *Conn), onClose func(socket *Conn, err error)) (*Server, string, *int64) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opened int64
+	var handler = &webSocketMocker{
+		onOpen: func(socket *Conn) {
+			atomic.AddInt64(&opened, 1)
+			if onOpen != nil {
+				onOpen(socket)
+			}
+		},
+		onMessage: func(socket *Conn, message *Message) {
+			defer message.Close()
+			if message.Opcode == OpcodeText && message.Data.String() == "close" {
+				socket.WriteClose(4000, []byte("bye"))
+				return
+			}
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		},
+		onPing:  func(socket *Conn, payload []byte) { _ = socket.WritePong(payload) },
+		onClose: onClose,
+	}
+	if option == nil {
+		option = new(ServerOption)
+	}
+	option.ReactorEnabled = true
+	var server = NewServer(handler, option)
+	go func() { _ = server.RunListener(listener) }()
+	return server, "ws://" + listener.Addr().String(), &opened
+}
+
+func TestReactor(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		var _, addr, _ = newReactorServer(t, &ServerOption{ReactorLoops: 2, PermessageDeflate: PermessageDeflate{Enabled: true}}, nil, nil)
+		var clients []*proxyClient
+		for i := 0; i < 8; i++ {
+			client, _, err := newProxyClient(&ClientOption{Addr: addr, PermessageDeflate: PermessageDeflate{Enabled: true}})
+			if !as.NoError(err) {
+				return
+			}
+			clients = append(clients, client)
+		}
+
+		// 大消息需要多次读取才能完整到达
+		var payload = []byte(strings.Repeat("reactor", 64*1024))
+		for _, client := range clients {
+			as.NoError(client.socket.WriteString("hello"))
+			as.NoError(client.socket.WriteMessage(OpcodeBinary, payload))
+		}
+		for _, client := range clients {
+			as.Equal("hello", string((<-client.messages).Bytes()))
+			as.Equal(payload, (<-client.messages).Bytes())
+			client.socket.WriteClose(1000, nil)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		var _, addr, opened = newReactorServer(t, nil, nil, nil)
+		const count = 64
+		var before = runtime.NumGoroutine()
+		for i := 0; i < count; i++ {
+			client, _, err := newProxyClient(&ClientOption{Addr: addr})
+			if !as.NoError(err) {
+				return
+			}
+			defer client.socket.WriteClose(1000, nil)
+		}
+		as.Eventually(func() bool { return atomic.LoadInt64(opened) == count }, time.Second, 10*time.Millisecond)
+
+		// 每个客户端占用一个读协程, 空闲的服务端连接不占用协程
+		as.Eventually(func() bool { return runtime.NumGoroutine()-before < count+count/2 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var closed = make(chan error, 8)
+		var _, addr, _ = newReactorServer(t, nil, nil, func(socket *Conn, err error) { closed <- err })
+
+		// 服务端主动关闭
+		client, _, err := newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.socket.WriteString("close"))
+		var closeErr = proxyCloseError(client.closed)
+		as.Equal(uint16(4000), closeErr.Code)
+		as.Equal("bye", string(closeErr.Reason))
+		as.Error(<-closed)
+
+		// 客户端主动关闭
+		client, _, err = newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		client.socket.WriteClose(4001, nil)
+		as.Equal(uint16(4001), proxyCloseError(closed).Code)
+
+		// 连接中断
+		client, _, err = newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.socket.WritePing([]byte("ping")))
+		_ = client.socket.NetConn().Close()
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			as.False(errors.As(err, &closeErr))
+		case <-time.After(time.Second):
+			as.Fail("OnClose is not called")
+		}
+
+		select {
+		case <-closed:
+			as.Fail("OnClose is called more than once")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		var closed = make(chan error, 1)
+		var _, addr, _ = newReactorServer(t, nil, func(socket *Conn) {
+			_ = socket.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		}, func(socket *Conn, err error) { closed <- err })
+
+		client, _, err := newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		var start = time.Now()
+		select {
+		case err := <-closed:
+			as.True(errors.Is(err, os.ErrDeadlineExceeded))
+			as.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+		case <-time.After(time.Second):
+			as.Fail("idle connection is not closed after its deadline")
+		}
+		// SetDeadline同时设置了写超时, 关闭帧无法发出
+		select {
+		case <-client.closed:
+		case <-time.After(time.Second):
+			as.Fail("client is not closed")
+		}
+	})
+
+	t.Run("partial frame", func(t *testing.T) {
+		var _, addr, _ = newReactorServer(t, &ServerOption{ReactorLoops: 1, ReactorWorkers: 2}, nil, nil)
+
+		// 发送半帧的客户端多于读协程
+		var frame = []byte{0x81, 0x80 | 5, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+		var stalled []*proxyClient
+		for i := 0; i < 8; i++ {
+			client, _, err := newProxyClient(&ClientOption{Addr: addr})
+			if !as.NoError(err) {
+				return
+			}
+			defer client.socket.WriteClose(1000, nil)
+			_, err = client.socket.NetConn().Write(frame[:4])
+			as.NoError(err)
+			stalled = append(stalled, client)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		// 正常的客户端仍然可以收发消息
+		client, _, err := newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		defer client.socket.WriteClose(1000, nil)
+		as.NoError(client.socket.WriteString("healthy"))
+		select {
+		case message := <-client.messages:
+			as.Equal("healthy", string(message.Bytes()))
+		case <-time.After(time.Second):
+			as.Fail("healthy client is not served")
+		}
+
+		// 剩余的数据到达后, 半帧和之后的帧都被处理
+		for _, item := range stalled {
+			_, err = item.socket.NetConn().Write(append(frame[4:], frame...))
+			as.NoError(err)
+		}
+		for _, item := range stalled {
+			for i := 0; i < 2; i++ {
+				select {
+				case message := <-item.messages:
+					as.Equal("hello", string(message.Bytes()))
+				case <-time.After(time.Second):
+					as.Fail("stalled client is not served")
+					return
+				}
+			}
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		var closed = make(chan error, 1)
+		var server, addr, _ = newReactorServer(t, nil, nil, func(socket *Conn, err error) { closed <- err })
+		client, _, err := newProxyClient(&ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(server.Close())
+		as.Equal(ErrServerClosed, server.RunListener(&net.TCPListener{}))
+
+		// 已经建立的连接转为ReadLoop, 继续收发消息
+		as.NoError(client.socket.WriteString("hello"))
+		as.Equal("hello", string((<-client.messages).Bytes()))
+		_, _, err = newProxyClient(&ClientOption{Addr: addr})
+		as.Error(err)
+
+		client.socket.WriteClose(4001, nil)
+		as.Equal(uint16(4001), proxyCloseError(closed).Code)
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package gws
+
+import "errors"
+
+// 事件循环模式仅支持Linux, 其他平台上连接仍然使用ReadLoop
+type reactor struct{}
+
+func newReactor(loops int, workers int) (*reactor, error) {
+	return nil, errors.New("gws: reactor is only supported on linux")
+}
+
+func (c *reactor) add(socket *Conn) bool { return false }
+
+func (c *reactor) close() {}
@@ -73,7 +73,8 @@ func (c *Conn) readMessage() error {
 	//      the negotiated extensions defines the meaning of such a nonzero
 	//      value, the receiving endpoint MUST _Fail the WebSocket
 	//      Connection_.
-	if !c.pd.Enabled && (c.fh.GetRSV1() || c.fh.GetRSV2() || c.fh.GetRSV3()) {
+	var rsv = c.fh.GetRSV()
+	if rsv&^c.getRSV() != 0 {
 		return internal.CloseProtocolError
 	}
 
@@ -111,12 +112,13 @@ func (c *Conn) readMessage() error {
 		if !compressed {
 			closer.Data = nil
 		}
-		return c.emitMessage(&Message{Opcode: opcode, Data: buf, compressed: compressed})
+		return c.emitMessage(&Message{Opcode: opcode, Data: buf, compressed: compressed, rsv: rsv})
 	}
 
 	if !fin && opcode != OpcodeContinuation {
 		c.continuationFrame.initialized = true
 		c.continuationFrame.compressed = compressed
+		c.continuationFrame.rsv = rsv
 		c.continuationFrame.opcode = opcode
 		c.continuationFrame.buffer = bytes.NewBuffer(make([]byte, 0, contentLength))
 	}
@@ -126,6 +128,7 @@ func (c *Conn) readMessage() error {
 	}
 
 	c.continuationFrame.buffer.Write(p)
+	c.continuationFrame.fragments = append(c.continuationFrame.fragments, contentLength)
 	if c.continuationFrame.buffer.Len() > c.config.ReadMaxPayloadSize {
 		return internal.CloseMessageTooLarge
 	}
@@ -133,7 +136,13 @@ func (c *Conn) readMessage() error {
 		return nil
 	}
 
-	msg := &Message{Opcode: c.continuationFrame.opcode, Data: c.continuationFrame.buffer, compressed: c.continuationFrame.compressed}
+	msg := &Message{
+		Opcode:     c.continuationFrame.opcode,
+		Data:       c.continuationFrame.buffer,
+		compressed: c.continuationFrame.compressed,
+		rsv:        c.continuationFrame.rsv,
+		fragments:  c.continuationFrame.fragments,
+	}
 	c.continuationFrame.reset()
 	return c.emitMessage(msg)
 }
@@ -152,9 +161,27 @@ func (c *Conn) emitMessage(msg *Message) (err error) {
 		}
 		c.dpsWindow.Write(msg.Bytes())
 	}
+	if err := c.decodeExtensions(msg); err != nil {
+		return err
+	}
 	if !c.isTextValid(msg.Opcode, msg.Bytes()) {
 		return internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
 	}
+	msg.codec = c.codec
+	// keyedQueue和poolQueue只有读协程访问, 不需要加锁
+	if c.config.WorkerPool != nil {
+		if c.poolQueue == nil {
+			c.poolQueue = new(poolQueue)
+		}
+		c.config.WorkerPool.push(c.poolQueue, func() { _ = c.dispatch(msg) })
+		return nil
+	}
+	if c.config.ParallelEnabled && c.config.ParallelKey != nil {
+		if c.keyedQueue == nil {
+			c.keyedQueue = newKeyedQueue(c.readQueue)
+		}
+		return c.keyedQueue.Go(c.config.ParallelKey(msg), msg, c.dispatch)
+	}
 	if c.config.ParallelEnabled {
 		return c.readQueue.Go(msg, c.dispatch)
 	}
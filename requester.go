@@ -0,0 +1,356 @@
+package gws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRequesterTimeout     = 10 * time.Second
+	defaultRequesterMaxInflight = 1024
+	requesterSessionKey         = "gws:requester"
+)
+
+var (
+	// ErrRequestTimeout 请求超时
+	// Request timed out
+	ErrRequestTimeout = errors.New("gws: request timeout")
+
+	// ErrRequestCanceled 请求已取消
+	// Request canceled
+	ErrRequestCanceled = errors.New("gws: request canceled")
+)
+
+// RequestFraming 请求响应的关联ID编码方式
+// Framing of the correlation ID of requests and responses
+type RequestFraming interface {
+	// Frame 为请求附加关联ID, 返回的切片会通过Writev一次写入
+	// Attach the correlation ID to a request, the returned slices are written at once with Writev.
+	Frame(id uint64, payload []byte) [][]byte
+
+	// Parse 解析消息的关联ID和内容, ok为false表示不是响应, 交给下一个事件处理器
+	// Parse the correlation ID and the content of a message, ok=false means it's not a response and it's passed on.
+	Parse(data []byte) (id uint64, payload []byte, ok bool)
+}
+
+// PrefixFraming 在消息头部使用Size字节的大端序关联ID, Size取值为1, 2, 4, 8, 默认为8
+// The correlation ID is a big-endian integer of Size bytes at the head of the message, Size is one of 1, 2, 4, 8, default 8.
+type PrefixFraming struct {
+	Size int
+}
+
+func (c PrefixFraming) size() int {
+	switch c.Size {
+	case 1, 2, 4:
+		return c.Size
+	default:
+		return 8
+	}
+}
+
+func (c PrefixFraming) Frame(id uint64, payload []byte) [][]byte {
+	var n = c.size()
+	var header = make([]byte, 8)
+	binary.BigEndian.PutUint64(header, id)
+	return [][]byte{header[8-n:], payload}
+}
+
+func (c PrefixFraming) Parse(data []byte) (id uint64, payload []byte, ok bool) {
+	var n = c.size()
+	if len(data) < n {
+		return 0, nil, false
+	}
+	var header [8]byte
+	copy(header[8-n:], data[:n])
+	return binary.BigEndian.Uint64(header[:]), data[n:], true
+}
+
+type RequesterOption struct {
+	// 请求的操作码, 默认为OpcodeBinary
+	// Opcode of requests, OpcodeBinary by default
+	Opcode Opcode
+
+	// 上下文没有截止时间时的默认超时
+	// Default timeout when the context has no deadline
+	Timeout time.Duration
+
+	// 最大在途请求数量, 达到上限时Send会阻塞
+	// Maximum number of requests in flight, Send blocks when it's reached.
+	MaxInflight int
+}
+
+func (c *RequesterOption) initialize() *RequesterOption {
+	if c.Opcode != OpcodeText {
+		c.Opcode = OpcodeBinary
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultRequesterTimeout
+	}
+	if c.MaxInflight <= 0 {
+		c.MaxInflight = defaultRequesterMaxInflight
+	}
+	return c
+}
+
+// Requester 基于关联ID的请求响应
+// ID由Requester分配, 对端的响应需要携带相同的ID. 关联ID的编码方式由RequestFraming决定.
+// Request/response correlation. IDs are allocated by the Requester and the peer replies with the same ID.
+// How the ID is carried is decided by the RequestFraming.
+type Requester struct {
+	socket   *Conn
+	framing  RequestFraming
+	option   *RequesterOption
+	serial   uint64
+	mu       sync.Mutex
+	pending  map[uint64]*Future
+	canceled map[uint64]*time.Timer // 没有收到响应就结束的请求, 在Timeout之内到达的响应会被丢弃
+	err      error
+	slots    chan struct{}
+}
+
+// NewRequester 创建Requester. 需要在OnMessage中调用Resolve, 在OnClose中调用Close; 使用RequesterEventHandler时会自动处理.
+// Create a Requester. Resolve must be called in OnMessage and Close in OnClose, which RequesterEventHandler does automatically.
+func NewRequester(socket *Conn, framing RequestFraming, option *RequesterOption) *Requester {
+	if option == nil {
+		option = new(RequesterOption)
+	}
+	var opt = *option
+	return &Requester{
+		socket:   socket,
+		framing:  framing,
+		option:   opt.initialize(),
+		pending:  make(map[uint64]*Future),
+		canceled: make(map[uint64]*time.Timer),
+		slots:    make(chan struct{}, opt.MaxInflight),
+	}
+}
+
+// Len 在途请求数量
+// Number of requests in flight
+func (c *Requester) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Request 发送请求并等待响应
+// Send a request and wait for the response
+func (c *Requester) Request(ctx context.Context, payload []byte) ([]byte, error) {
+	future, err := c.Send(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return future.Wait(ctx)
+}
+
+// Send 发送请求, 返回等待响应的Future. 在途请求达到上限时阻塞, 直到有请求完成或者上下文结束.
+// Send a request and return the Future of the response.
+// It blocks while the in-flight limit is reached until a request completes or the context is done.
+func (c *Requester) Send(ctx context.Context, payload []byte) (*Future, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// 上下文有截止时间时, 超时错误和上下文保持一致
+	var timeout, timeoutErr = c.option.Timeout, ErrRequestTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout, timeoutErr = time.Until(deadline), context.DeadlineExceeded
+	}
+
+	var future = &Future{requester: c, done: make(chan struct{})}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		<-c.slots
+		return nil, c.err
+	}
+	future.id = atomic.AddUint64(&c.serial, 1)
+	future.timer = time.AfterFunc(timeout, func() { c.finish(future.id, nil, nil, timeoutErr) })
+	c.pending[future.id] = future
+	c.mu.Unlock()
+
+	if err := c.socket.Writev(c.option.Opcode, c.framing.Frame(future.id, payload)...); err != nil {
+		c.finish(future.id, nil, nil, err)
+		return nil, err
+	}
+	return future, nil
+}
+
+// 完成请求, 重复调用无效. 连接关闭之前没有收到响应就结束的请求会记录下来, 在Timeout之后清除.
+func (c *Requester) finish(id uint64, msg *Message, payload []byte, err error) bool {
+	c.mu.Lock()
+	future, ok := c.pending[id]
+	delete(c.pending, id)
+	if ok && msg == nil && c.err == nil {
+		c.canceled[id] = time.AfterFunc(c.option.Timeout, func() { c.forget(id) })
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	future.timer.Stop()
+	future.msg, future.payload, future.err = msg, payload, err
+	close(future.done)
+	<-c.slots
+	return true
+}
+
+// 清除已结束请求的记录, 返回是否存在
+func (c *Requester) forget(id uint64) bool {
+	c.mu.Lock()
+	timer, ok := c.canceled[id]
+	delete(c.canceled, id)
+	c.mu.Unlock()
+	if ok {
+		timer.Stop()
+	}
+	return ok
+}
+
+// Resolve 处理收到的消息, 返回true表示消息是在途请求的响应, 所有权转移给了对应的Future;
+// 已取消或者超时的请求的响应也返回true, 消息会被回收.
+// Handle an inbound message. It returns true if the message is the response of a request in flight,
+// and the ownership of the message is transferred to the Future.
+// It also returns true for the response of a canceled or timed out request, and the message is recycled.
+func (c *Requester) Resolve(message *Message) bool {
+	id, payload, ok := c.framing.Parse(message.Bytes())
+	if !ok {
+		return false
+	}
+	if c.finish(id, message, payload, nil) {
+		return true
+	}
+	if c.forget(id) {
+		_ = message.Close()
+		return true
+	}
+	return false
+}
+
+// Close 所有在途请求返回err, 之后的请求直接返回err
+// All requests in flight fail with err, later requests fail immediately.
+func (c *Requester) Close(err error) {
+	if err == nil || err == errEmpty {
+		err = ErrConnClosed
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	var ids = make([]uint64, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	for id, timer := range c.canceled {
+		timer.Stop()
+		delete(c.canceled, id)
+	}
+	c.mu.Unlock()
+
+	for _, id := range ids {
+		c.finish(id, nil, nil, err)
+	}
+}
+
+// Future 等待中的响应
+// Pending response
+type Future struct {
+	requester *Requester
+	id        uint64
+	done      chan struct{}
+	timer     *time.Timer
+	msg       *Message
+	payload   []byte
+	err       error
+}
+
+// ID 关联ID
+// Correlation ID
+func (c *Future) ID() uint64 { return c.id }
+
+// Done 收到响应, 超时, 取消或者连接关闭时关闭
+// Closed when the response arrives, or the request times out, is canceled or the connection is closed.
+func (c *Future) Done() <-chan struct{} { return c.done }
+
+// Wait 等待响应. 上下文结束时取消请求. 返回的内容引用了消息的缓冲区, 使用完毕后可以调用Close回收.
+// Wait for the response. The request is canceled when the context is done.
+// The returned payload references the message buffer, call Close to recycle it when done.
+func (c *Future) Wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-c.done:
+		return c.payload, c.err
+	case <-ctx.Done():
+		c.requester.finish(c.id, nil, nil, ctx.Err())
+		<-c.done
+		return c.payload, c.err
+	}
+}
+
+// Cancel 取消请求, 之后在Timeout之内到达的响应会被丢弃, 不会交给内嵌的事件处理器
+// Cancel the request, the response arriving within Timeout afterwards is dropped
+// and not passed on to the embedded event handler.
+func (c *Future) Cancel() {
+	c.requester.finish(c.id, nil, nil, ErrRequestCanceled)
+}
+
+// Close 回收响应消息
+// Recycle the response message
+func (c *Future) Close() {
+	<-c.done
+	if c.msg != nil {
+		_ = c.msg.Close()
+		c.msg = nil
+		c.payload = nil
+	}
+}
+
+// RequesterEventHandler 为连接创建Requester的事件处理器
+// 响应由Requester处理, 其他消息和事件转发给内嵌的Event; 连接关闭时在途请求全部失败.
+// Event handler creating a Requester for the connection.
+// Responses are handled by the Requester, other messages and events are forwarded to the embedded Event;
+// requests in flight fail when the connection is closed.
+type RequesterEventHandler struct {
+	Event
+	mu      sync.Mutex
+	framing RequestFraming
+	option  *RequesterOption
+}
+
+// NewRequesterEventHandler handler为nil时使用BuiltinEventHandler
+// BuiltinEventHandler is used when handler is nil.
+func NewRequesterEventHandler(framing RequestFraming, option *RequesterOption, handler Event) *RequesterEventHandler {
+	if handler == nil {
+		handler = BuiltinEventHandler{}
+	}
+	return &RequesterEventHandler{Event: handler, framing: framing, option: option}
+}
+
+// Requester 获取连接的Requester, 不存在时创建
+// Get the Requester of the connection, created if absent
+func (c *RequesterEventHandler) Requester(socket *Conn) *Requester {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(requesterSessionKey); ok {
+		return v.(*Requester)
+	}
+	var requester = NewRequester(socket, c.framing, c.option)
+	socket.Session().Store(requesterSessionKey, requester)
+	return requester
+}
+
+func (c *RequesterEventHandler) OnClose(socket *Conn, err error) {
+	c.Requester(socket).Close(err)
+	c.Event.OnClose(socket, err)
+}
+
+func (c *RequesterEventHandler) OnMessage(socket *Conn, message *Message) {
+	if !c.Requester(socket).Resolve(message) {
+		c.Event.OnMessage(socket, message)
+	}
+}
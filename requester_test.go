@@ -0,0 +1,200 @@
+package gws
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 建立一对连接, 服务端原样返回收到的消息, 以"sleep"结尾的请求延迟返回, 以"drop"结尾的请求不返回
+func newRequesterPeers(option *RequesterOption, handler Event) (server *Conn, requester *Requester) {
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		var p = append([]byte(nil), message.Bytes()...)
+		_ = message.Close()
+		go func() {
+			switch {
+			case len(p) >= 4 && string(p[len(p)-4:]) == "drop":
+				return
+			case len(p) >= 5 && string(p[len(p)-5:]) == "sleep":
+				time.Sleep(100 * time.Millisecond)
+			}
+			_ = socket.WriteMessage(OpcodeBinary, p)
+		}()
+	}
+	var clientHandler = NewRequesterEventHandler(PrefixFraming{}, option, handler)
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	return server, clientHandler.Requester(client)
+}
+
+func TestPrefixFraming(t *testing.T) {
+	var as = assert.New(t)
+	for _, size := range []int{0, 1, 2, 4, 8} {
+		var framing = PrefixFraming{Size: size}
+		var data []byte
+		for _, b := range framing.Frame(0x0102, []byte("hello")) {
+			data = append(data, b...)
+		}
+		as.Equal(framing.size()+5, len(data))
+		id, payload, ok := framing.Parse(data)
+		as.True(ok)
+		as.Equal("hello", string(payload))
+		if size == 1 {
+			as.Equal(uint64(0x02), id)
+		} else {
+			as.Equal(uint64(0x0102), id)
+		}
+	}
+	_, _, ok := PrefixFraming{Size: 4}.Parse([]byte{1, 2})
+	as.False(ok)
+}
+
+func TestRequester(t *testing.T) {
+	var as = assert.New(t)
+	var ctx = context.Background()
+
+	t.Run("request", func(t *testing.T) {
+		_, requester := newRequesterPeers(nil, nil)
+		p, err := requester.Request(ctx, []byte("hello"))
+		as.NoError(err)
+		as.Equal("hello", string(p))
+
+		future, err := requester.Send(ctx, []byte("world"))
+		as.NoError(err)
+		<-future.Done()
+		p, err = future.Wait(ctx)
+		as.NoError(err)
+		as.Equal("world", string(p))
+		future.Close()
+		as.Equal(0, requester.Len())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		_, requester := newRequesterPeers(&RequesterOption{MaxInflight: 4}, nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var s = strconv.Itoa(i)
+				future, err := requester.Send(ctx, []byte(s))
+				if !as.NoError(err) {
+					return
+				}
+				p, err := future.Wait(ctx)
+				as.NoError(err)
+				as.Equal(s, string(p))
+				future.Close()
+			}(i)
+		}
+		wg.Wait()
+		as.Equal(0, requester.Len())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, requester := newRequesterPeers(&RequesterOption{Timeout: 50 * time.Millisecond}, nil)
+		_, err := requester.Request(ctx, []byte("drop"))
+		as.ErrorIs(err, ErrRequestTimeout)
+		as.Equal(0, requester.Len())
+
+		// 超时之后到达的响应被忽略
+		_, err = requester.Request(ctx, []byte("sleep"))
+		as.ErrorIs(err, ErrRequestTimeout)
+		time.Sleep(100 * time.Millisecond)
+		p, err := requester.Request(ctx, []byte("ok"))
+		as.NoError(err)
+		as.Equal("ok", string(p))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, requester := newRequesterPeers(nil, nil)
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := requester.Request(timeout, []byte("drop"))
+		as.ErrorIs(err, context.DeadlineExceeded)
+
+		future, err := requester.Send(ctx, []byte("drop"))
+		as.NoError(err)
+		future.Cancel()
+		_, err = future.Wait(ctx)
+		as.ErrorIs(err, ErrRequestCanceled)
+		as.Equal(0, requester.Len())
+	})
+
+	t.Run("inflight", func(t *testing.T) {
+		_, requester := newRequesterPeers(&RequesterOption{MaxInflight: 1}, nil)
+		first, err := requester.Send(ctx, []byte("drop"))
+		as.NoError(err)
+
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err = requester.Send(timeout, []byte("blocked"))
+		as.ErrorIs(err, context.DeadlineExceeded)
+
+		// 释放之后可以继续发送
+		first.Cancel()
+		p, err := requester.Request(ctx, []byte("next"))
+		as.NoError(err)
+		as.Equal("next", string(p))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		server, requester := newRequesterPeers(nil, nil)
+		future, err := requester.Send(ctx, []byte("drop"))
+		as.NoError(err)
+		_ = server.NetConn().Close()
+		_, err = future.Wait(ctx)
+		as.Error(err)
+		_, err = requester.Send(ctx, []byte("hello"))
+		as.Error(err)
+		as.Equal(0, requester.Len())
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		var handler = new(webSocketMocker)
+		var received = make(chan string, 1)
+		handler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		server, requester := newRequesterPeers(nil, handler)
+
+		// 不属于任何请求的消息交给内嵌的处理器
+		as.NoError(server.WriteMessage(OpcodeBinary, []byte{1, 2}))
+		as.Equal(string([]byte{1, 2}), <-received)
+		var unknown = append([]byte{0, 0, 0, 0, 0, 0, 0, 99}, "push"...)
+		as.NoError(server.WriteMessage(OpcodeBinary, unknown))
+		as.Equal(string(unknown), <-received)
+
+		p, err := requester.Request(ctx, []byte("hello"))
+		as.NoError(err)
+		as.Equal("hello", string(p))
+	})
+
+	t.Run("late response", func(t *testing.T) {
+		var handler = new(webSocketMocker)
+		var received = make(chan string, 2)
+		handler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		_, requester := newRequesterPeers(&RequesterOption{Timeout: 80 * time.Millisecond}, handler)
+
+		// 取消和超时的请求, 之后在Timeout之内到达的响应被丢弃
+		future, err := requester.Send(ctx, []byte("sleep"))
+		as.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+		future.Cancel()
+		_, err = requester.Request(ctx, []byte("sleep"))
+		as.ErrorIs(err, ErrRequestTimeout)
+		select {
+		case s := <-received:
+			t.Errorf("unexpected message %q", s)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		requester.mu.Lock()
+		as.Equal(0, len(requester.canceled))
+		requester.mu.Unlock()
+	})
+}
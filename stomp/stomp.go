@@ -0,0 +1,803 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/marifcelik/gws"
+	"github.com/marifcelik/gws/internal"
+)
+
+const (
+	// Protocol STOMP 1.2子协议, 需要配置在gws.ServerOption.SubProtocols中
+	// The STOMP 1.2 subprotocol, it should be configured in gws.ServerOption.SubProtocols.
+	Protocol = "v12.stomp"
+
+	defaultHeartBeat = 10 * time.Second
+	stompVersion     = "1.2"
+	stompSessionKey  = "gws:stomp"
+
+	// 心跳超时的容忍倍数
+	stompHeartBeatTolerance = 2
+)
+
+// STOMP 命令
+// STOMP commands
+const (
+	Connect     = "CONNECT"
+	Stomp       = "STOMP"
+	Connected   = "CONNECTED"
+	Send        = "SEND"
+	Subscribe   = "SUBSCRIBE"
+	Unsubscribe = "UNSUBSCRIBE"
+	Ack         = "ACK"
+	Nack        = "NACK"
+	Begin       = "BEGIN"
+	Commit      = "COMMIT"
+	Abort       = "ABORT"
+	Disconnect  = "DISCONNECT"
+	Message     = "MESSAGE"
+	Receipt     = "RECEIPT"
+	Error       = "ERROR"
+)
+
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+// ErrFrame STOMP帧格式错误
+// Malformed STOMP frame
+var ErrFrame = errors.New("gws: malformed stomp frame")
+
+// Header 有序的帧头, 重复的帧头以第一个为准
+// Ordered frame headers, the first one wins when a header is repeated.
+type Header [][2]string
+
+// Get 获取帧头, 不存在时返回空字符串
+// Get a header, an empty string is returned if it's absent.
+func (c Header) Get(key string) string {
+	v, _ := c.Lookup(key)
+	return v
+}
+
+// Lookup 获取帧头
+// Look up a header
+func (c Header) Lookup(key string) (string, bool) {
+	for _, kv := range c {
+		if kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// Add 追加帧头
+// Append a header
+func (c *Header) Add(key, value string) {
+	*c = append(*c, [2]string{key, value})
+}
+
+// Set 设置帧头, 替换已有的值
+// Set a header, replacing the existing values
+func (c *Header) Set(key, value string) {
+	c.Del(key)
+	c.Add(key, value)
+}
+
+// Del 删除帧头
+// Delete a header
+func (c *Header) Del(key string) {
+	var list = (*c)[:0]
+	for _, kv := range *c {
+		if kv[0] != key {
+			list = append(list, kv)
+		}
+	}
+	*c = list
+}
+
+// Frame STOMP帧
+// STOMP frame
+type Frame struct {
+	Command string
+	Header  Header
+	Body    []byte
+}
+
+// CONNECT和CONNECTED帧的帧头不转义
+func (c *Frame) isEscaped() bool {
+	return c.Command != Connect && c.Command != Stomp && c.Command != Connected
+}
+
+// Bytes 编码帧, 有消息体时自动设置content-length
+// Encode the frame, content-length is set automatically when there is a body.
+func (c *Frame) Bytes() []byte {
+	var buf = bytes.NewBuffer(make([]byte, 0, 64+len(c.Body)))
+	var escaped = c.isEscaped()
+	buf.WriteString(c.Command)
+	buf.WriteByte('\n')
+	for _, kv := range c.Header {
+		if kv[0] == "content-length" {
+			continue
+		}
+		stompEscape(buf, kv[0], escaped)
+		buf.WriteByte(':')
+		stompEscape(buf, kv[1], escaped)
+		buf.WriteByte('\n')
+	}
+	if len(c.Body) > 0 {
+		buf.WriteString("content-length:")
+		buf.WriteString(strconv.Itoa(len(c.Body)))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.Write(c.Body)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+var stompEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func stompEscape(buf *bytes.Buffer, s string, escaped bool) {
+	if escaped && strings.ContainsAny(s, "\\\r\n:") {
+		_, _ = stompEscaper.WriteString(buf, s)
+		return
+	}
+	buf.WriteString(s)
+}
+
+func stompUnescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", ErrFrame
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", ErrFrame
+		}
+	}
+	return b.String(), nil
+}
+
+// 读取一行, 兼容\r\n
+func stompLine(data []byte) (line string, rest []byte, ok bool) {
+	var i = bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", data, false
+	}
+	return string(bytes.TrimSuffix(data[:i], []byte{'\r'})), data[i+1:], true
+}
+
+// parseStompFrame 解析一个帧, 返回剩余的数据. 帧之前的空行是心跳, 会被跳过; 只有心跳时返回nil.
+// 消息体引用了data.
+func parseStompFrame(data []byte) (frame *Frame, rest []byte, err error) {
+	data = bytes.TrimLeft(data, "\r\n")
+	if len(data) == 0 {
+		return nil, nil, nil
+	}
+
+	command, data, ok := stompLine(data)
+	if !ok || command == "" {
+		return nil, nil, ErrFrame
+	}
+	frame = &Frame{Command: command}
+	var escaped = frame.isEscaped()
+	for {
+		var line string
+		if line, data, ok = stompLine(data); !ok {
+			return nil, nil, ErrFrame
+		}
+		if line == "" {
+			break
+		}
+		var i = strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, nil, ErrFrame
+		}
+		var key, value = line[:i], line[i+1:]
+		if escaped {
+			if key, err = stompUnescape(key); err != nil {
+				return nil, nil, err
+			}
+			if value, err = stompUnescape(value); err != nil {
+				return nil, nil, err
+			}
+		}
+		frame.Header.Add(key, value)
+	}
+
+	if v, ok := frame.Header.Lookup("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= len(data) || data[n] != 0 {
+			return nil, nil, ErrFrame
+		}
+		frame.Body, rest = data[:n], data[n+1:]
+	} else {
+		var n = bytes.IndexByte(data, 0)
+		if n < 0 {
+			return nil, nil, ErrFrame
+		}
+		frame.Body, rest = data[:n], data[n+1:]
+	}
+	return frame, rest, nil
+}
+
+// 文本消息必须是UTF8编码, 否则使用二进制消息
+func stompOpcode(p []byte) gws.Opcode {
+	return internal.SelectValue(utf8.Valid(p), gws.OpcodeText, gws.OpcodeBinary)
+}
+
+type Option struct {
+	// 服务端可以保证的发送心跳间隔, 为负数时不发送心跳, 默认为10s
+	// The interval of heart-beats the server can guarantee to send, disabled when negative, 10s by default.
+	HeartBeatSend time.Duration
+
+	// 服务端期望的接收心跳间隔, 为负数时不检查心跳, 默认为10s
+	// The interval of heart-beats the server expects to receive, disabled when negative, 10s by default.
+	HeartBeatReceive time.Duration
+
+	// 收到CONNECT帧时调用, 可以校验login/passcode, 返回错误时发送ERROR帧并关闭连接
+	// Called on the CONNECT frame to check login/passcode etc.,
+	// an ERROR frame is sent and the connection is closed on error.
+	OnConnect func(socket *gws.Conn, frame *Frame) error
+
+	// 收到SUBSCRIBE和SEND帧时调用, 可以校验目的地的权限, 返回错误时发送ERROR帧并关闭连接
+	// Called on SUBSCRIBE and SEND frames to check the permission of the destination,
+	// an ERROR frame is sent and the connection is closed on error.
+	Authorize func(socket *gws.Conn, frame *Frame) error
+}
+
+func (c *Option) initialize() *Option {
+	if c.HeartBeatSend == 0 {
+		c.HeartBeatSend = defaultHeartBeat
+	}
+	if c.HeartBeatReceive == 0 {
+		c.HeartBeatReceive = defaultHeartBeat
+	}
+	return c
+}
+
+// Broker 进程内的消息代理, 目的地是发布订阅模式, 使用Broadcaster向订阅者扇出消息.
+// 可以被多个EventHandler共享.
+// In-process message broker with publish-subscribe destinations, messages are fanned out to subscribers with Broadcaster.
+// It can be shared by multiple EventHandlers.
+type Broker struct {
+	mu           sync.RWMutex
+	serial       uint64
+	destinations map[string]map[*stompSubscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{destinations: make(map[string]map[*stompSubscription]struct{})}
+}
+
+func (c *Broker) subscribe(sub *stompSubscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var subs, ok = c.destinations[sub.destination]
+	if !ok {
+		subs = make(map[*stompSubscription]struct{})
+		c.destinations[sub.destination] = subs
+	}
+	subs[sub] = struct{}{}
+}
+
+func (c *Broker) unsubscribe(sub *stompSubscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if subs, ok := c.destinations[sub.destination]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(c.destinations, sub.destination)
+		}
+	}
+}
+
+// Subscribers 目的地的订阅数量
+// Number of subscriptions of the destination
+func (c *Broker) Subscribers(destination string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.destinations[destination])
+}
+
+// Publish 向目的地的所有订阅者发送MESSAGE帧, header中的自定义帧头会被转发
+// 订阅ID和确认模式相同的订阅者收到的帧完全相同, 共享同一个Broadcaster.
+// Send a MESSAGE frame to all subscribers of the destination, custom headers are forwarded.
+// Subscribers with the same subscription id and ack mode receive identical frames and share a Broadcaster.
+func (c *Broker) Publish(destination string, header Header, body []byte) {
+	c.mu.RLock()
+	var groups = make(map[[2]string][]*stompSubscription)
+	for sub := range c.destinations[destination] {
+		var key = [2]string{sub.id, sub.ack}
+		groups[key] = append(groups[key], sub)
+	}
+	c.mu.RUnlock()
+	if len(groups) == 0 {
+		return
+	}
+
+	var messageID = strconv.FormatUint(atomic.AddUint64(&c.serial, 1), 10)
+	for key, subs := range groups {
+		// 同一个会话可能有多个订阅匹配该目的地, 确认ID包含订阅ID以区分每次投递
+		var ackID = key[0] + "-" + messageID
+		var frame = &Frame{Command: Message, Header: make(Header, 0, len(header)+4), Body: body}
+		frame.Header.Add("destination", destination)
+		frame.Header.Add("message-id", messageID)
+		frame.Header.Add("subscription", key[0])
+		if key[1] != stompAckAuto {
+			frame.Header.Add("ack", ackID)
+		}
+		for _, kv := range header {
+			switch kv[0] {
+			case "destination", "message-id", "subscription", "ack", "receipt", "transaction", "content-length":
+			default:
+				frame.Header.Add(kv[0], kv[1])
+			}
+		}
+
+		var broadcaster = gws.NewBroadcaster(stompOpcode(body), frame.Bytes())
+		for _, sub := range subs {
+			if key[1] != stompAckAuto {
+				sub.session.track(ackID, sub)
+			}
+			_ = broadcaster.Broadcast(sub.session.socket)
+		}
+		_ = broadcaster.Close()
+	}
+}
+
+// stompSubscription 连接上的订阅
+type stompSubscription struct {
+	session     *stompSession
+	id          string
+	destination string
+	ack         string
+}
+
+// stompPending 等待确认的消息
+type stompPending struct {
+	sub *stompSubscription
+	seq uint64
+}
+
+// stompSession 连接的协议状态
+type stompSession struct {
+	mu            sync.Mutex
+	socket        *gws.Conn
+	connected     bool
+	closed        bool
+	seq           uint64
+	subscriptions map[string]*stompSubscription
+	pending       map[string]*stompPending
+	transactions  map[string][]*Frame
+	readTimeout   time.Duration
+	timer         *time.Timer
+}
+
+// 记录等待确认的消息
+func (c *stompSession) track(ackID string, sub *stompSubscription) {
+	c.mu.Lock()
+	c.seq++
+	c.pending[ackID] = &stompPending{sub: sub, seq: c.seq}
+	c.mu.Unlock()
+}
+
+// 刷新读超时
+func (c *stompSession) touch() {
+	c.mu.Lock()
+	var timeout = c.readTimeout
+	c.mu.Unlock()
+	if timeout > 0 {
+		_ = c.socket.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// EventHandler 实现STOMP 1.2协议的事件处理器, 目的地由Broker提供
+// 连接上的所有消息都按照协议处理, 其他事件转发给内嵌的Event.
+// Event handler implementing the STOMP 1.2 protocol, destinations are provided by the Broker.
+// All messages of the connection are handled by the protocol, other events are forwarded to the embedded Event.
+type EventHandler struct {
+	gws.Event
+	mu     sync.Mutex
+	broker *Broker
+	option *Option
+}
+
+// NewEventHandler 创建STOMP事件处理器, handler为nil时使用gws.BuiltinEventHandler
+// Create a STOMP event handler, gws.BuiltinEventHandler is used when handler is nil.
+func NewEventHandler(broker *Broker, option *Option, handler gws.Event) *EventHandler {
+	if option == nil {
+		option = new(Option)
+	}
+	if handler == nil {
+		handler = gws.BuiltinEventHandler{}
+	}
+	var opt = *option
+	return &EventHandler{Event: handler, broker: broker, option: opt.initialize()}
+}
+
+// Broker 获取消息代理
+// Get the message broker
+func (c *EventHandler) Broker() *Broker { return c.broker }
+
+func (c *EventHandler) getSession(socket *gws.Conn) *stompSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(stompSessionKey); ok {
+		return v.(*stompSession)
+	}
+	var session = &stompSession{
+		socket:        socket,
+		subscriptions: make(map[string]*stompSubscription),
+		pending:       make(map[string]*stompPending),
+		transactions:  make(map[string][]*Frame),
+	}
+	socket.Session().Store(stompSessionKey, session)
+	return session
+}
+
+func (c *EventHandler) OnOpen(socket *gws.Conn) {
+	c.getSession(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *EventHandler) OnClose(socket *gws.Conn, err error) {
+	var session = c.getSession(socket)
+	session.mu.Lock()
+	session.closed = true
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	var subscriptions = session.subscriptions
+	session.subscriptions = make(map[string]*stompSubscription)
+	session.pending = make(map[string]*stompPending)
+	session.transactions = make(map[string][]*Frame)
+	session.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		c.broker.unsubscribe(sub)
+	}
+	c.Event.OnClose(socket, err)
+}
+
+// OnPing 客户端的Ping也视为心跳
+// Pings from the client count as heart-beats as well.
+func (c *EventHandler) OnPing(socket *gws.Conn, payload []byte) {
+	c.getSession(socket).touch()
+	c.Event.OnPing(socket, payload)
+}
+
+func (c *EventHandler) OnPong(socket *gws.Conn, payload []byte) {
+	c.getSession(socket).touch()
+	c.Event.OnPong(socket, payload)
+}
+
+func (c *EventHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	var session = c.getSession(socket)
+	session.touch()
+	var data = message.Bytes()
+	for {
+		frame, rest, err := parseStompFrame(data)
+		if err != nil {
+			c.fail(session, nil, err.Error())
+			break
+		}
+		if frame == nil || !c.handle(session, frame) {
+			break
+		}
+		data = rest
+	}
+	_ = message.Close()
+}
+
+// 处理一个帧, 返回false表示连接已经关闭
+func (c *EventHandler) handle(session *stompSession, frame *Frame) bool {
+	session.mu.Lock()
+	var connected = session.connected
+	session.mu.Unlock()
+
+	var err error
+	switch {
+	case frame.Command == Connect || frame.Command == Stomp:
+		if connected {
+			err = errors.New("already connected")
+		} else {
+			err = c.connect(session, frame)
+		}
+		if err != nil {
+			c.fail(session, frame, err.Error())
+			return false
+		}
+		return true
+	case !connected:
+		c.fail(session, frame, "expected CONNECT frame")
+		return false
+	case frame.Command == Disconnect:
+		c.receipt(session, frame)
+		session.socket.WriteClose(1000, nil)
+		return false
+	}
+
+	if tx, ok := frame.Header.Lookup("transaction"); ok {
+		err = c.buffer(session, tx, frame)
+	} else {
+		err = c.execute(session, frame)
+	}
+	if err != nil {
+		c.fail(session, frame, err.Error())
+		return false
+	}
+	c.receipt(session, frame)
+	return true
+}
+
+func (c *EventHandler) execute(session *stompSession, frame *Frame) error {
+	switch frame.Command {
+	case Send:
+		return c.send(session, frame)
+	case Subscribe:
+		return c.subscribe(session, frame)
+	case Unsubscribe:
+		return c.unsubscribe(session, frame)
+	case Ack, Nack:
+		return c.ack(session, frame)
+	case Begin, Commit, Abort:
+		return errors.New("missing transaction header")
+	default:
+		return errors.New("unknown command " + frame.Command)
+	}
+}
+
+func (c *EventHandler) connect(session *stompSession, frame *Frame) error {
+	if !internal.InCollection(stompVersion, internal.Split(frame.Header.Get("accept-version"), ",")) {
+		return errors.New("supported protocol versions are " + stompVersion)
+	}
+	var cx, cy int
+	if v, ok := frame.Header.Lookup("heart-beat"); ok {
+		var list = strings.Split(v, ",")
+		var err0, err1 error
+		if len(list) == 2 {
+			cx, err0 = strconv.Atoi(strings.TrimSpace(list[0]))
+			cy, err1 = strconv.Atoi(strings.TrimSpace(list[1]))
+		}
+		if len(list) != 2 || err0 != nil || err1 != nil || cx < 0 || cy < 0 {
+			return errors.New("invalid heart-beat header")
+		}
+	}
+	if c.option.OnConnect != nil {
+		if err := c.option.OnConnect(session.socket, frame); err != nil {
+			return err
+		}
+	}
+
+	// 心跳间隔取双方的较大值, 任意一方为0表示不使用
+	var sx = internal.Max(int(c.option.HeartBeatSend.Milliseconds()), 0)
+	var sy = internal.Max(int(c.option.HeartBeatReceive.Milliseconds()), 0)
+	var outgoing, incoming time.Duration
+	if sx > 0 && cy > 0 {
+		outgoing = time.Duration(internal.Max(sx, cy)) * time.Millisecond
+	}
+	if sy > 0 && cx > 0 {
+		incoming = time.Duration(internal.Max(sy, cx)) * time.Millisecond
+	}
+
+	var connected = &Frame{Command: Connected}
+	connected.Header.Add("version", stompVersion)
+	connected.Header.Add("heart-beat", strconv.Itoa(sx)+","+strconv.Itoa(sy))
+	connected.Header.Add("server", "gws")
+	if err := c.write(session, connected); err != nil {
+		return err
+	}
+
+	session.mu.Lock()
+	session.connected = true
+	session.readTimeout = incoming * stompHeartBeatTolerance
+	session.mu.Unlock()
+	session.touch()
+	if outgoing > 0 {
+		c.heartBeat(session, outgoing)
+	}
+	return nil
+}
+
+// 定时发送心跳, 直到连接关闭
+func (c *EventHandler) heartBeat(session *stompSession, interval time.Duration) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		return
+	}
+	session.timer = time.AfterFunc(interval, func() {
+		if session.socket.WriteString("\n") == nil {
+			c.heartBeat(session, interval)
+		}
+	})
+}
+
+func (c *EventHandler) authorize(session *stompSession, frame *Frame) error {
+	if c.option.Authorize == nil {
+		return nil
+	}
+	return c.option.Authorize(session.socket, frame)
+}
+
+func (c *EventHandler) send(session *stompSession, frame *Frame) error {
+	var destination = frame.Header.Get("destination")
+	if destination == "" {
+		return errors.New("missing destination header")
+	}
+	if err := c.authorize(session, frame); err != nil {
+		return err
+	}
+	c.broker.Publish(destination, frame.Header, frame.Body)
+	return nil
+}
+
+func (c *EventHandler) subscribe(session *stompSession, frame *Frame) error {
+	var sub = &stompSubscription{
+		session:     session,
+		id:          frame.Header.Get("id"),
+		destination: frame.Header.Get("destination"),
+		ack:         frame.Header.Get("ack"),
+	}
+	if sub.id == "" || sub.destination == "" {
+		return errors.New("missing id or destination header")
+	}
+	switch sub.ack {
+	case "":
+		sub.ack = stompAckAuto
+	case stompAckAuto, stompAckClient, stompAckClientIndividual:
+	default:
+		return errors.New("invalid ack header")
+	}
+	if err := c.authorize(session, frame); err != nil {
+		return err
+	}
+
+	session.mu.Lock()
+	if _, ok := session.subscriptions[sub.id]; ok {
+		session.mu.Unlock()
+		return errors.New("duplicate subscription id " + sub.id)
+	}
+	session.subscriptions[sub.id] = sub
+	session.mu.Unlock()
+	c.broker.subscribe(sub)
+	return nil
+}
+
+func (c *EventHandler) unsubscribe(session *stompSession, frame *Frame) error {
+	var id = frame.Header.Get("id")
+	if id == "" {
+		return errors.New("missing id header")
+	}
+	session.mu.Lock()
+	var sub = session.subscriptions[id]
+	delete(session.subscriptions, id)
+	for ackID, item := range session.pending {
+		if item.sub == sub {
+			delete(session.pending, ackID)
+		}
+	}
+	session.mu.Unlock()
+	if sub != nil {
+		c.broker.unsubscribe(sub)
+	}
+	return nil
+}
+
+// ACK和NACK: client模式累积确认该订阅之前的所有消息, client-individual模式只确认一条. NACK的消息会被丢弃.
+func (c *EventHandler) ack(session *stompSession, frame *Frame) error {
+	var id = frame.Header.Get("id")
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	var item, ok = session.pending[id]
+	if !ok {
+		return errors.New("unknown ack id " + id)
+	}
+	delete(session.pending, id)
+	if item.sub.ack == stompAckClient {
+		for k, v := range session.pending {
+			if v.sub == item.sub && v.seq < item.seq {
+				delete(session.pending, k)
+			}
+		}
+	}
+	return nil
+}
+
+// 处理事务帧, 事务中的SEND, ACK和NACK在COMMIT时执行
+func (c *EventHandler) buffer(session *stompSession, tx string, frame *Frame) error {
+	session.mu.Lock()
+	var frames, ok = session.transactions[tx]
+	switch frame.Command {
+	case Begin:
+		if ok {
+			session.mu.Unlock()
+			return errors.New("duplicate transaction " + tx)
+		}
+		session.transactions[tx] = nil
+		session.mu.Unlock()
+		return nil
+	case Send, Ack, Nack, Commit, Abort:
+		if !ok {
+			session.mu.Unlock()
+			return errors.New("unknown transaction " + tx)
+		}
+	default:
+		session.mu.Unlock()
+		return c.execute(session, frame)
+	}
+
+	if frame.Command == Send || frame.Command == Ack || frame.Command == Nack {
+		// 消息体引用了读缓冲区, 需要复制
+		var clone = &Frame{Command: frame.Command, Header: frame.Header, Body: append([]byte(nil), frame.Body...)}
+		session.transactions[tx] = append(frames, clone)
+		session.mu.Unlock()
+		return nil
+	}
+
+	delete(session.transactions, tx)
+	session.mu.Unlock()
+	if frame.Command == Commit {
+		for _, item := range frames {
+			if err := c.execute(session, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *EventHandler) receipt(session *stompSession, frame *Frame) {
+	if id, ok := frame.Header.Lookup("receipt"); ok {
+		var receipt = &Frame{Command: Receipt}
+		receipt.Header.Add("receipt-id", id)
+		_ = c.write(session, receipt)
+	}
+}
+
+// 发送ERROR帧并关闭连接
+func (c *EventHandler) fail(session *stompSession, frame *Frame, message string) {
+	var e = &Frame{Command: Error, Body: []byte(message)}
+	e.Header.Add("message", message)
+	e.Header.Add("content-type", "text/plain")
+	if frame != nil {
+		if id, ok := frame.Header.Lookup("receipt"); ok {
+			e.Header.Add("receipt-id", id)
+		}
+		if frame.Command == Connect || frame.Command == Stomp {
+			e.Header.Add("version", stompVersion)
+		}
+	}
+	_ = c.write(session, e)
+	session.socket.WriteClose(1000, nil)
+}
+
+func (c *EventHandler) write(session *stompSession, frame *Frame) error {
+	return session.socket.WriteMessage(stompOpcode(frame.Body), frame.Bytes())
+}
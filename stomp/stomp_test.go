@@ -0,0 +1,445 @@
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStompFrame(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("encode", func(t *testing.T) {
+		var frame = &Frame{Command: Message, Body: []byte("a\x00b")}
+		frame.Header.Add("destination", "/topic/a:b")
+		frame.Header.Add("note", "line1\nline2\\")
+		frame.Header.Add("content-length", "100")
+		var p = frame.Bytes()
+		as.Equal("MESSAGE\ndestination:/topic/a\\cb\nnote:line1\\nline2\\\\\ncontent-length:3\n\na\x00b\x00", string(p))
+
+		parsed, rest, err := parseStompFrame(p)
+		as.NoError(err)
+		as.Empty(rest)
+		as.Equal(Message, parsed.Command)
+		as.Equal("/topic/a:b", parsed.Header.Get("destination"))
+		as.Equal("line1\nline2\\", parsed.Header.Get("note"))
+		as.Equal("a\x00b", string(parsed.Body))
+
+		// CONNECT帧不转义
+		frame = &Frame{Command: Connect}
+		frame.Header.Add("passcode", "a:b")
+		as.Equal("CONNECT\npasscode:a:b\n\n\x00", string(frame.Bytes()))
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		var data = []byte("\n\r\nSEND\r\ndestination:/a\r\ndestination:/b\r\n\r\nhello\x00\nSEND\ndestination:/c\n\n\x00\n")
+		frame, rest, err := parseStompFrame(data)
+		as.NoError(err)
+		as.Equal(Send, frame.Command)
+		as.Equal("/a", frame.Header.Get("destination"))
+		as.Equal("hello", string(frame.Body))
+
+		frame, rest, err = parseStompFrame(rest)
+		as.NoError(err)
+		as.Equal("/c", frame.Header.Get("destination"))
+		as.Empty(frame.Body)
+
+		frame, _, err = parseStompFrame(rest)
+		as.NoError(err)
+		as.Nil(frame)
+
+		var header Header
+		header.Add("a", "1")
+		header.Add("b", "2")
+		header.Set("a", "3")
+		as.Equal(Header{{"b", "2"}, {"a", "3"}}, header)
+		header.Del("b")
+		_, ok := header.Lookup("b")
+		as.False(ok)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		var cases = []string{
+			"SEND\ndestination:/a\n\nhello",
+			"SEND\ndestination:/a",
+			"SEND\ndestination\n\n\x00",
+			"SEND\ndestination:\\t\n\n\x00",
+			"SEND\ndestination:\\\n\n\x00",
+			"SEND\ncontent-length:10\n\nhello\x00",
+			"SEND\ncontent-length:2\n\nhello\x00",
+			"SEND\ncontent-length:x\n\nhello\x00",
+			"SEND\n\n",
+		}
+		for _, item := range cases {
+			_, _, err := parseStompFrame([]byte(item))
+			as.ErrorIs(err, ErrFrame, item)
+		}
+	})
+}
+
+type stompTestClient struct {
+	server     *gws.Conn
+	conn       *gws.Conn
+	frames     chan *Frame
+	heartBeats chan struct{}
+	closed     chan error
+}
+
+func newStompTestClient(handler *EventHandler) *stompTestClient {
+	var c = &stompTestClient{
+		frames:     make(chan *Frame, 64),
+		heartBeats: make(chan struct{}, 64),
+		closed:     make(chan error, 1),
+	}
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *gws.Conn, message *gws.Message) {
+		frame, _, err := parseStompFrame(message.Bytes())
+		if err == nil && frame == nil {
+			c.heartBeats <- struct{}{}
+			return
+		}
+		if err == nil {
+			frame.Body = append([]byte(nil), frame.Body...)
+			c.frames <- frame
+		}
+	}
+	clientHandler.onClose = func(socket *gws.Conn, err error) { c.closed <- err }
+	server, client := newPeer(handler, &gws.ServerOption{}, clientHandler, &gws.ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	c.server, c.conn = server, client
+	return c
+}
+
+func (c *stompTestClient) send(command string, body string, header ...string) {
+	var frame = &Frame{Command: command, Body: []byte(body)}
+	for i := 0; i+1 < len(header); i += 2 {
+		frame.Header.Add(header[i], header[i+1])
+	}
+	_ = c.conn.WriteMessage(gws.OpcodeText, frame.Bytes())
+}
+
+func (c *stompTestClient) next() *Frame {
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-time.After(time.Second):
+		return &Frame{Command: "TIMEOUT"}
+	}
+}
+
+func (c *stompTestClient) connect(heartBeat string) *Frame {
+	c.send(Connect, "", "accept-version", "1.1,1.2", "host", "localhost", "heart-beat", heartBeat)
+	return c.next()
+}
+
+func (c *stompTestClient) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestStompEventHandler(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("pubsub", func(t *testing.T) {
+		var handler = NewEventHandler(NewBroker(), nil, nil)
+		var alice = newStompTestClient(handler)
+		var bob = newStompTestClient(handler)
+		var carol = newStompTestClient(handler)
+
+		var connected = alice.connect("0,0")
+		as.Equal(Connected, connected.Command)
+		as.Equal("1.2", connected.Header.Get("version"))
+		as.Equal("10000,10000", connected.Header.Get("heart-beat"))
+		bob.connect("0,0")
+		carol.connect("0,0")
+
+		alice.send(Subscribe, "", "id", "sub-0", "destination", "/topic/chat")
+		bob.send(Subscribe, "", "id", "sub-0", "destination", "/topic/chat", "receipt", "r1")
+		carol.send(Subscribe, "", "id", "sub-9", "destination", "/topic/chat")
+		carol.send(Subscribe, "", "id", "sub-8", "destination", "/topic/other", "receipt", "r2")
+		var receipt = bob.next()
+		as.Equal(Receipt, receipt.Command)
+		as.Equal("r1", receipt.Header.Get("receipt-id"))
+		as.Equal("r2", carol.next().Header.Get("receipt-id"))
+		as.Equal(3, handler.Broker().Subscribers("/topic/chat"))
+
+		alice.send(Send, "hello", "destination", "/topic/chat", "x-custom", "1", "transaction-free", "yes")
+		for _, item := range []struct {
+			client *stompTestClient
+			sub    string
+		}{{alice, "sub-0"}, {bob, "sub-0"}, {carol, "sub-9"}} {
+			var msg = item.client.next()
+			as.Equal(Message, msg.Command)
+			as.Equal("/topic/chat", msg.Header.Get("destination"))
+			as.Equal(item.sub, msg.Header.Get("subscription"))
+			as.Equal("1", msg.Header.Get("x-custom"))
+			as.NotEmpty(msg.Header.Get("message-id"))
+			_, ok := msg.Header.Lookup("ack")
+			as.False(ok)
+			as.Equal("hello", string(msg.Body))
+		}
+
+		// 二进制消息体
+		handler.Broker().Publish("/topic/other", nil, []byte{0xff, 0x00})
+		as.Equal([]byte{0xff, 0x00}, carol.next().Body)
+
+		bob.send(Unsubscribe, "", "id", "sub-0", "receipt", "r3")
+		as.Equal("r3", bob.next().Header.Get("receipt-id"))
+		bob.send(Disconnect, "", "receipt", "bye")
+		as.Equal("bye", bob.next().Header.Get("receipt-id"))
+		as.True(bob.isClosed())
+
+		_ = carol.conn.NetConn().Close()
+		as.True(carol.isClosed())
+		time.Sleep(20 * time.Millisecond)
+		as.Equal(1, handler.Broker().Subscribers("/topic/chat"))
+		as.Equal(0, handler.Broker().Subscribers("/topic/other"))
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		var handler = NewEventHandler(NewBroker(), nil, nil)
+		var client = newStompTestClient(handler)
+		client.connect("0,0")
+		client.send(Subscribe, "", "id", "0", "destination", "/queue/a", "ack", "client")
+		client.send(Subscribe, "", "id", "1", "destination", "/queue/b", "ack", "client-individual", "receipt", "ok")
+		client.next()
+
+		var acks = map[string][]string{}
+		for i := 0; i < 3; i++ {
+			handler.Broker().Publish("/queue/a", nil, []byte("a"))
+			handler.Broker().Publish("/queue/b", nil, []byte("b"))
+		}
+		for i := 0; i < 6; i++ {
+			var msg = client.next()
+			as.Equal(msg.Header.Get("subscription")+"-"+msg.Header.Get("message-id"), msg.Header.Get("ack"))
+			var destination = msg.Header.Get("destination")
+			acks[destination] = append(acks[destination], msg.Header.Get("ack"))
+		}
+
+		var session = handler.getSession(client.server)
+		var pending = func() int {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			return len(session.pending)
+		}
+		as.Equal(6, pending())
+
+		// client模式累积确认
+		client.send(Ack, "", "id", acks["/queue/a"][1], "receipt", "1")
+		as.Equal("1", client.next().Header.Get("receipt-id"))
+		as.Equal(4, pending())
+
+		// client-individual模式只确认一条
+		client.send(Ack, "", "id", acks["/queue/b"][1], "receipt", "2")
+		as.Equal("2", client.next().Header.Get("receipt-id"))
+		as.Equal(3, pending())
+		client.send(Nack, "", "id", acks["/queue/a"][2], "receipt", "3")
+		as.Equal("3", client.next().Header.Get("receipt-id"))
+		as.Equal(2, pending())
+
+		// 取消订阅时丢弃等待确认的消息
+		client.send(Unsubscribe, "", "id", "1", "receipt", "4")
+		as.Equal("4", client.next().Header.Get("receipt-id"))
+		as.Equal(0, pending())
+
+		client.send(Ack, "", "id", acks["/queue/a"][0])
+		as.Equal(Error, client.next().Command)
+	})
+
+	t.Run("ack same destination", func(t *testing.T) {
+		var handler = NewEventHandler(NewBroker(), nil, nil)
+		var client = newStompTestClient(handler)
+		client.connect("0,0")
+		client.send(Subscribe, "", "id", "0", "destination", "/queue/a", "ack", "client-individual")
+		client.send(Subscribe, "", "id", "1", "destination", "/queue/a", "ack", "client-individual", "receipt", "ok")
+		client.next()
+
+		// 两个订阅收到同一条消息, 确认ID不同
+		handler.Broker().Publish("/queue/a", nil, []byte("a"))
+		var first, second = client.next(), client.next()
+		as.Equal(first.Header.Get("message-id"), second.Header.Get("message-id"))
+		as.NotEqual(first.Header.Get("ack"), second.Header.Get("ack"))
+
+		var session = handler.getSession(client.server)
+		var pending = func() int {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			return len(session.pending)
+		}
+		as.Equal(2, pending())
+
+		client.send(Ack, "", "id", first.Header.Get("ack"), "receipt", "1")
+		as.Equal("1", client.next().Header.Get("receipt-id"))
+		as.Equal(1, pending())
+		client.send(Ack, "", "id", second.Header.Get("ack"), "receipt", "2")
+		as.Equal("2", client.next().Header.Get("receipt-id"))
+		as.Equal(0, pending())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var option = &Option{
+			OnConnect: func(socket *gws.Conn, frame *Frame) error {
+				if frame.Header.Get("login") == "guest" {
+					return errors.New("access denied")
+				}
+				return nil
+			},
+			Authorize: func(socket *gws.Conn, frame *Frame) error {
+				if frame.Header.Get("destination") == "/private" {
+					return errors.New("forbidden")
+				}
+				return nil
+			},
+		}
+		var cases = []struct {
+			frames  [][]string
+			message string
+		}{
+			{[][]string{{Send, "destination", "/a"}}, "expected CONNECT frame"},
+			{[][]string{{Connect, "accept-version", "1.0,1.1"}}, "supported protocol versions are 1.2"},
+			{[][]string{{Connect, "accept-version", "1.2", "heart-beat", "1"}}, "invalid heart-beat header"},
+			{[][]string{{Connect, "accept-version", "1.2", "login", "guest"}}, "access denied"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Connect, "accept-version", "1.2"}}, "already connected"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Send}}, "missing destination header"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Send, "destination", "/private", "receipt", "7"}}, "forbidden"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Subscribe, "id", "1"}}, "missing id or destination header"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Subscribe, "id", "1", "destination", "/a", "ack", "x"}}, "invalid ack header"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Subscribe, "id", "1", "destination", "/a"}, {Subscribe, "id", "1", "destination", "/b"}}, "duplicate subscription id 1"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Ack, "id", "100"}}, "unknown ack id 100"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Begin}}, "missing transaction header"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {Commit, "transaction", "t"}}, "unknown transaction t"},
+			{[][]string{{Connect, "accept-version", "1.2"}, {"PUBLISH"}}, "unknown command PUBLISH"},
+		}
+		for _, item := range cases {
+			var client = newStompTestClient(NewEventHandler(NewBroker(), option, nil))
+			for _, frame := range item.frames {
+				client.send(frame[0], "", frame[1:]...)
+			}
+			var frame *Frame
+			for frame = client.next(); frame.Command == Connected; frame = client.next() {
+			}
+			as.Equal(Error, frame.Command, item.message)
+			as.Equal(item.message, frame.Header.Get("message"))
+			as.Equal(item.message, string(frame.Body))
+			if last := item.frames[len(item.frames)-1]; len(last) > 4 && last[3] == "receipt" {
+				as.Equal(last[4], frame.Header.Get("receipt-id"))
+			}
+			as.True(client.isClosed())
+		}
+
+		var client = newStompTestClient(NewEventHandler(NewBroker(), nil, nil))
+		_ = client.conn.WriteString("SEND\n")
+		as.Equal(ErrFrame.Error(), client.next().Header.Get("message"))
+		as.True(client.isClosed())
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		var handler = NewEventHandler(NewBroker(), nil, nil)
+		var client = newStompTestClient(handler)
+		client.connect("0,0")
+		client.send(Subscribe, "", "id", "0", "destination", "/a")
+		client.send(Begin, "", "transaction", "t1")
+		client.send(Send, "first", "destination", "/a", "transaction", "t1")
+		client.send(Begin, "", "transaction", "t2")
+		client.send(Send, "aborted", "destination", "/a", "transaction", "t2")
+		client.send(Abort, "", "transaction", "t2", "receipt", "abort")
+		as.Equal("abort", client.next().Header.Get("receipt-id"))
+
+		client.send(Send, "second", "destination", "/a")
+		as.Equal("second", string(client.next().Body))
+		client.send(Commit, "", "transaction", "t1")
+		as.Equal("first", string(client.next().Body))
+		client.send(Commit, "", "transaction", "t1")
+		as.Equal(Error, client.next().Command)
+	})
+
+	t.Run("heart-beat", func(t *testing.T) {
+		var handler = NewEventHandler(NewBroker(), &Option{
+			HeartBeatSend:    20 * time.Millisecond,
+			HeartBeatReceive: 30 * time.Millisecond,
+		}, nil)
+		var client = newStompTestClient(handler)
+		var connected = client.connect("10,10")
+		as.Equal("20,30", connected.Header.Get("heart-beat"))
+
+		// 客户端的心跳和Ping都会刷新读超时
+		for i := 0; i < 6; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if i%2 == 0 {
+				_ = client.conn.WriteString("\n")
+			} else {
+				_ = client.conn.WritePing(nil)
+			}
+		}
+		select {
+		case err := <-client.closed:
+			as.Fail("unexpected close", err)
+		default:
+		}
+		as.True(len(client.heartBeats) >= 3)
+
+		// 没有心跳时连接超时关闭
+		as.True(client.isClosed())
+
+		// 任意一方为0时不使用心跳
+		client = newStompTestClient(handler)
+		as.Equal("20,30", client.connect("0,0").Header.Get("heart-beat"))
+		time.Sleep(100 * time.Millisecond)
+		as.Equal(0, len(client.heartBeats))
+		select {
+		case err := <-client.closed:
+			as.Fail("unexpected close", err)
+		default:
+		}
+	})
+}
+
+type webSocketMocker struct {
+	gws.BuiltinEventHandler
+	onMessage func(socket *gws.Conn, message *gws.Message)
+	onClose   func(socket *gws.Conn, err error)
+}
+
+func (c *webSocketMocker) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if c.onMessage != nil {
+		c.onMessage(socket, message)
+	}
+}
+
+func (c *webSocketMocker) OnClose(socket *gws.Conn, err error) {
+	if c.onClose != nil {
+		c.onClose(socket, err)
+	}
+}
+
+// 在内存管道上完成握手, 返回服务端和客户端的连接
+func newPeer(serverHandler gws.Event, serverOption *gws.ServerOption, clientHandler gws.Event, clientOption *gws.ClientOption) (server, client *gws.Conn) {
+	var s, c = net.Pipe()
+	var upgrader = gws.NewUpgrader(serverHandler, serverOption)
+	var accepted = make(chan *gws.Conn, 1)
+	go func() {
+		var br = bufio.NewReader(s)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		socket, _ := upgrader.UpgradeFromConn(s, br, r)
+		accepted <- socket
+	}()
+	clientOption.Addr = "ws://localhost/"
+	client, _, _ = gws.NewClientFromConn(clientHandler, clientOption, c)
+	server = <-accepted
+	return server, client
+}
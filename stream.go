@@ -0,0 +1,238 @@
+package gws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const streamSessionKey = "gws:stream"
+
+// StreamConn 将WebSocket连接适配为字节流, 实现了net.Conn
+// 读取依次消费收到的二进制消息, 每次写入发送一条二进制消息.
+// 消息在被读取之前会阻塞读协程, 所以读取缓慢时背压会传递到TCP连接.
+// 读超时只影响Read调用, 不会断开连接; 写超时映射到底层连接, 超时之后连接会被关闭.
+// Adapts a WebSocket connection into a byte stream implementing net.Conn.
+// Reads drain successive binary messages and every write sends a binary message.
+// A message blocks the read goroutine until it is consumed, so backpressure propagates to the TCP connection when reads are slow.
+// The read deadline only affects Read calls and keeps the connection alive; the write deadline maps onto the
+// underlying connection, which is closed after a write timeout.
+type StreamConn struct {
+	socket   *Conn
+	messages chan *Message
+	closed   chan struct{}
+	once     sync.Once
+	err      error
+	mu       sync.Mutex
+	current  *Message
+	deadline *streamDeadline
+}
+
+func newStreamConn(socket *Conn) *StreamConn {
+	return &StreamConn{
+		socket:   socket,
+		messages: make(chan *Message),
+		closed:   make(chan struct{}),
+		deadline: newStreamDeadline(),
+	}
+}
+
+// Conn 获取WebSocket连接
+// Get the WebSocket connection
+func (c *StreamConn) Conn() *Conn { return c.socket }
+
+// 交给Read消费, 直到被读取或者流关闭
+func (c *StreamConn) push(message *Message) {
+	select {
+	case c.messages <- message:
+	case <-c.closed:
+		_ = message.Close()
+	}
+}
+
+// 关闭流, 正常关闭时读取返回io.EOF
+func (c *StreamConn) close(err error) {
+	c.once.Do(func() {
+		var closeErr *CloseError
+		switch {
+		case err == nil, err == errEmpty:
+			err = io.EOF
+		case errors.As(err, &closeErr) && (closeErr.Code == 1000 || closeErr.Code == 1001):
+			err = io.EOF
+		}
+		c.err = err
+		close(c.closed)
+	})
+}
+
+// Read 读取数据, 当前消息读完后等待下一条消息
+// Read data, the next message is awaited once the current one is drained.
+func (c *StreamConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.current == nil || c.current.Data.Len() == 0 {
+		if c.current != nil {
+			_ = c.current.Close()
+			c.current = nil
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+		select {
+		case c.current = <-c.messages:
+		case <-c.closed:
+			return 0, c.err
+		case <-c.deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	return c.current.Data.Read(p)
+}
+
+// Write 写入一条二进制消息
+// Write a binary message
+func (c *StreamConn) Write(p []byte) (int, error) {
+	if err := c.socket.WriteMessage(OpcodeBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 发送关闭帧并关闭连接, 之后的读取返回net.ErrClosed
+// Send a close frame and close the connection, later reads return net.ErrClosed.
+func (c *StreamConn) Close() error {
+	c.once.Do(func() {
+		c.err = net.ErrClosed
+		close(c.closed)
+	})
+	c.socket.WriteClose(1000, nil)
+	return nil
+}
+
+func (c *StreamConn) LocalAddr() net.Addr { return c.socket.LocalAddr() }
+
+func (c *StreamConn) RemoteAddr() net.Addr { return c.socket.RemoteAddr() }
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return c.socket.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.socket.SetWriteDeadline(t)
+}
+
+// streamDeadline 可以重复设置的截止时间, 到期时关闭通道
+type streamDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newStreamDeadline() *streamDeadline {
+	return &streamDeadline{cancel: make(chan struct{})}
+}
+
+func (c *streamDeadline) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil && !c.timer.Stop() {
+		// 定时器已经触发, 等待它关闭通道
+		<-c.cancel
+	}
+	c.timer = nil
+
+	var expired = isClosedChan(c.cancel)
+	if t.IsZero() {
+		if expired {
+			c.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	var d = time.Until(t)
+	if d <= 0 {
+		if !expired {
+			close(c.cancel)
+		}
+		return
+	}
+	if expired {
+		c.cancel = make(chan struct{})
+	}
+	var cancel = c.cancel
+	c.timer = time.AfterFunc(d, func() { close(cancel) })
+}
+
+func (c *streamDeadline) wait() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancel
+}
+
+func isClosedChan(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// StreamEventHandler 将连接适配为StreamConn的事件处理器, 其他事件转发给内嵌的Event.
+// 消息必须按顺序交付, 不要开启ParallelEnabled; 收到文本消息时以1003关闭连接.
+// Event handler adapting connections into StreamConn, other events are forwarded to the embedded Event.
+// Messages must be delivered in order, do not enable ParallelEnabled; the connection is closed with 1003 on text messages.
+type StreamEventHandler struct {
+	Event
+	mu sync.Mutex
+}
+
+// NewStreamEventHandler 创建字节流事件处理器, handler为nil时使用BuiltinEventHandler
+// Create a byte stream event handler, BuiltinEventHandler is used when handler is nil.
+func NewStreamEventHandler(handler Event) *StreamEventHandler {
+	if handler == nil {
+		handler = BuiltinEventHandler{}
+	}
+	return &StreamEventHandler{Event: handler}
+}
+
+// Stream 获取连接的字节流, 不存在时创建. 需要在另一个协程中运行ReadLoop.
+// Get the byte stream of the connection, created if absent. ReadLoop must run in another goroutine.
+func (c *StreamEventHandler) Stream(socket *Conn) *StreamConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := socket.Session().Load(streamSessionKey); ok {
+		return v.(*StreamConn)
+	}
+	var stream = newStreamConn(socket)
+	socket.Session().Store(streamSessionKey, stream)
+	return stream
+}
+
+func (c *StreamEventHandler) OnOpen(socket *Conn) {
+	c.Stream(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *StreamEventHandler) OnClose(socket *Conn, err error) {
+	c.Stream(socket).close(err)
+	c.Event.OnClose(socket, err)
+}
+
+func (c *StreamEventHandler) OnMessage(socket *Conn, message *Message) {
+	if message.Opcode != OpcodeBinary {
+		_ = message.Close()
+		socket.WriteClose(1003, []byte("stream requires binary messages"))
+		return
+	}
+	c.Stream(socket).push(message)
+}
@@ -0,0 +1,151 @@
+package gws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marifcelik/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ net.Conn = (*StreamConn)(nil)
+
+func newStreamPeers() (server, client *StreamConn) {
+	var serverHandler = NewStreamEventHandler(nil)
+	var clientHandler = NewStreamEventHandler(nil)
+	serverConn, clientConn := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go serverConn.ReadLoop()
+	go clientConn.ReadLoop()
+	return serverHandler.Stream(serverConn), clientHandler.Stream(clientConn)
+}
+
+func TestStreamConn(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		server, client := newStreamPeers()
+		go func() { _, _ = io.Copy(server, server) }()
+
+		var data = internal.AlphabetNumeric.Generate(64 * 1024)
+		go func() {
+			for i := 0; i < len(data); i += 1000 {
+				var end = i + 1000
+				if end > len(data) {
+					end = len(data)
+				}
+				_, _ = client.Write(data[i:end])
+			}
+		}()
+		var p = make([]byte, len(data))
+		_, err := io.ReadFull(client, p)
+		as.NoError(err)
+		as.Equal(data, p)
+		as.NoError(client.Close())
+	})
+
+	t.Run("boundary", func(t *testing.T) {
+		server, client := newStreamPeers()
+		go func() {
+			_, _ = server.Write([]byte("hello"))
+			_, _ = server.Write(nil)
+			_, _ = server.Write([]byte(", world"))
+		}()
+		var p = make([]byte, 3)
+		var received []byte
+		for len(received) < 12 {
+			n, err := client.Read(p)
+			as.NoError(err)
+			received = append(received, p[:n]...)
+		}
+		as.Equal("hello, world", string(received))
+		n, err := client.Read(nil)
+		as.Equal(0, n)
+		as.NoError(err)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		server, client := newStreamPeers()
+		as.NoError(client.SetReadDeadline(time.Now().Add(20 * time.Millisecond)))
+		_, err := client.Read(make([]byte, 8))
+		var netErr net.Error
+		as.True(errors.As(err, &netErr) && netErr.Timeout())
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+
+		// 超时不会断开连接
+		as.NoError(client.SetReadDeadline(time.Time{}))
+		go func() { _, _ = server.Write([]byte("ok")) }()
+		var p = make([]byte, 2)
+		_, err = io.ReadFull(client, p)
+		as.NoError(err)
+		as.Equal("ok", string(p))
+
+		as.NoError(client.SetDeadline(time.Now().Add(-time.Second)))
+		_, err = client.Read(p)
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+		as.NoError(client.SetDeadline(time.Time{}))
+		as.Equal(server.Conn().RemoteAddr(), client.LocalAddr())
+		as.Equal(server.Conn().LocalAddr(), client.RemoteAddr())
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		server, client := newStreamPeers()
+		var written int32
+		go func() {
+			for i := 0; i < 4; i++ {
+				_, _ = server.Write([]byte{byte(i)})
+				atomic.AddInt32(&written, 1)
+			}
+		}()
+
+		// 客户端不读取时, 服务端的写入被阻塞
+		time.Sleep(50 * time.Millisecond)
+		as.True(atomic.LoadInt32(&written) <= 2)
+
+		var p = make([]byte, 4)
+		_, err := io.ReadFull(client, p)
+		as.NoError(err)
+		as.Equal([]byte{0, 1, 2, 3}, p)
+		time.Sleep(10 * time.Millisecond)
+		as.Equal(int32(4), atomic.LoadInt32(&written))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		server, client := newStreamPeers()
+		go func() {
+			_, _ = server.Write([]byte("bye"))
+			_ = server.Close()
+		}()
+		data, err := io.ReadAll(client)
+		as.NoError(err)
+		as.Equal("bye", string(data))
+
+		_, err = server.Read(make([]byte, 1))
+		as.ErrorIs(err, net.ErrClosed)
+		_, err = server.Write([]byte("x"))
+		as.Error(err)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		server, client := newStreamPeers()
+		client.Conn().WriteClose(1011, nil)
+		_, err := server.Read(make([]byte, 1))
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(uint16(1011), closeErr.Code)
+		}
+
+		server, client = newStreamPeers()
+		_ = client.Conn().WriteString("text")
+		_, err = server.Read(make([]byte, 1))
+		as.Error(err)
+		_, err = client.Read(make([]byte, 1))
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(uint16(1003), closeErr.Code)
+		}
+	})
+}
@@ -10,6 +10,7 @@ type (
 	workerQueue struct {
 		mu             sync.Mutex               // 锁
 		q              internal.Deque[asyncJob] // 任务队列
+		pq             internal.Deque[asyncJob] // 高优先级任务队列
 		maxConcurrency int32                    // 最大并发
 		curConcurrency int32                    // 当前并发
 	}
@@ -39,7 +40,10 @@ func (c *workerQueue) getJob(newJob asyncJob, delta int32) asyncJob {
 	if c.curConcurrency >= c.maxConcurrency {
 		return nil
 	}
-	var job = c.q.PopFront()
+	var job = c.pq.PopFront()
+	if job == nil {
+		job = c.q.PopFront()
+	}
 	if job == nil {
 		return nil
 	}
@@ -47,6 +51,21 @@ func (c *workerQueue) getJob(newJob asyncJob, delta int32) asyncJob {
 	return job
 }
 
+// Len 获取排队中和执行中的任务数量
+// Number of queued and running jobs
+func (c *workerQueue) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.q.Len() + c.pq.Len() + int(c.curConcurrency)
+}
+
+// 排队中(不包括执行中)的任务数量
+func (c *workerQueue) queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.q.Len() + c.pq.Len()
+}
+
 // 循环执行任务
 func (c *workerQueue) do(job asyncJob) {
 	for job != nil {
@@ -62,6 +81,215 @@ func (c *workerQueue) Push(job asyncJob) {
 	}
 }
 
+// PushPriority 追加高优先级任务, 排在所有普通任务之前
+func (c *workerQueue) PushPriority(job asyncJob) {
+	c.mu.Lock()
+	c.pq.PushBack(job)
+	c.mu.Unlock()
+	if nextJob := c.getJob(nil, 0); nextJob != nil {
+		go c.do(nextJob)
+	}
+}
+
+// keyedQueue 按键分组的任务队列
+// 每个键对应一个并发度为1的workerQueue, 相同键的任务按顺序执行; 所有键共享limit, 限制排队和执行中的任务总数.
+type keyedQueue struct {
+	mu     sync.Mutex
+	queues map[string]*workerQueue
+	limit  channel
+}
+
+func newKeyedQueue(limit channel) *keyedQueue {
+	return &keyedQueue{queues: make(map[string]*workerQueue), limit: limit}
+}
+
+// Go 按键投递任务, 达到上限时阻塞
+func (c *keyedQueue) Go(key string, m *Message, f func(*Message) error) error {
+	c.limit.add()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q, ok := c.queues[key]
+	if !ok {
+		q = newWorkerQueue(1)
+		c.queues[key] = q
+	}
+	q.Push(func() {
+		_ = f(m)
+		c.mu.Lock()
+		// 只剩下当前任务时移除队列, 之后的任务会创建新的队列
+		if q.Len() == 1 {
+			delete(c.queues, key)
+		}
+		c.mu.Unlock()
+		c.limit.done()
+	})
+	return nil
+}
+
+// Len 获取有任务的键的数量
+func (c *keyedQueue) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queues)
+}
+
+const (
+	defaultWorkerPoolMaxWorkers     = 256
+	defaultWorkerPoolQueueLimit     = 4096
+	defaultWorkerPoolConnQueueLimit = 8
+)
+
+type WorkerPoolOption struct {
+	// 最大并发数, 默认为256
+	// Max number of concurrent workers, 256 by default
+	MaxWorkers int
+
+	// 所有连接排队中的消息总数上限, 默认为4096
+	// Limit of messages queued across all connections, 4096 by default
+	QueueLimit int
+
+	// 单个连接排队中的消息数量上限, 默认为8
+	// Limit of messages queued for a single connection, 8 by default
+	ConnQueueLimit int
+}
+
+func (c *WorkerPoolOption) initialize() *WorkerPoolOption {
+	if c.MaxWorkers <= 0 {
+		c.MaxWorkers = defaultWorkerPoolMaxWorkers
+	}
+	if c.QueueLimit <= 0 {
+		c.QueueLimit = defaultWorkerPoolQueueLimit
+	}
+	if c.ConnQueueLimit <= 0 {
+		c.ConnQueueLimit = defaultWorkerPoolConnQueueLimit
+	}
+	return c
+}
+
+// WorkerPool 多个连接共享的消息处理协程池
+// 每个连接有自己的队列, 消息按到达顺序串行处理; 有消息的连接轮流获得协程, 一个连接不会占满协程池.
+// 队列达到上限时, 投递消息的ReadLoop会阻塞, 直到有空位.
+// 不要在OnMessage中等待需要其他连接的OnMessage才能完成的操作, 协程池饱和时会死锁.
+// Worker pool handling messages of many connections.
+// Every connection has its own queue and its messages are handled serially in arrival order;
+// connections with messages take turns on the workers, so a single connection can not occupy the pool.
+// When a queue is full, the ReadLoop dispatching the message blocks until there is room.
+// Do not wait in OnMessage for work that needs OnMessage of other connections, it deadlocks when the pool is saturated.
+type WorkerPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // 等待全局队列有空位
+	option  *WorkerPoolOption
+	workers int // 协程数量
+	busy    int // 执行任务中的协程数量
+	queued  int
+	ready   internal.Deque[*poolQueue] // 有消息等待处理, 并且没有在执行中的连接队列
+}
+
+// poolQueue 连接在协程池中的队列
+type poolQueue struct {
+	jobs      internal.Deque[asyncJob]
+	scheduled bool       // 在ready中或者执行中
+	cond      *sync.Cond // 等待该连接的队列有空位, 第一次阻塞时创建
+}
+
+// NewWorkerPool 创建协程池, 通过ServerOption.WorkerPool或ClientOption.WorkerPool共享给多个连接
+// Create a worker pool, shared by connections with ServerOption.WorkerPool or ClientOption.WorkerPool.
+func NewWorkerPool(option *WorkerPoolOption) *WorkerPool {
+	if option == nil {
+		option = new(WorkerPoolOption)
+	}
+	var c = &WorkerPool{option: option.initialize()}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Len 获取排队中的消息数量
+// Number of queued messages
+func (c *WorkerPool) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued
+}
+
+// Workers 获取运行中的协程数量
+// Number of running workers
+func (c *WorkerPool) Workers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.workers
+}
+
+// 追加连接的任务, 队列已满时阻塞.
+// 每取出一个任务只唤醒一个等待者; 被唤醒后仍然不能追加时, 把空位转交给同一条件上的下一个等待者.
+func (c *WorkerPool) push(q *poolQueue, job asyncJob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if q.jobs.Len() >= c.option.ConnQueueLimit {
+			if c.queued < c.option.QueueLimit {
+				c.cond.Signal()
+			}
+			if q.cond == nil {
+				q.cond = sync.NewCond(&c.mu)
+			}
+			q.cond.Wait()
+			continue
+		}
+		if c.queued >= c.option.QueueLimit {
+			if q.cond != nil {
+				q.cond.Signal()
+			}
+			c.cond.Wait()
+			continue
+		}
+		break
+	}
+	q.jobs.PushBack(job)
+	c.queued++
+	if !q.scheduled {
+		q.scheduled = true
+		c.ready.PushBack(q)
+	}
+	// 空闲的协程不够处理就绪的连接时, 创建新的协程
+	if c.workers < c.option.MaxWorkers && c.workers-c.busy < c.ready.Len() {
+		c.workers++
+		go c.work()
+	}
+}
+
+// 轮流执行各个连接的任务, 没有任务时退出
+func (c *WorkerPool) work() {
+	c.mu.Lock()
+	for {
+		var q = c.ready.PopFront()
+		if q == nil {
+			c.workers--
+			c.mu.Unlock()
+			return
+		}
+		var job = q.jobs.PopFront()
+		c.queued--
+		c.busy++
+		c.cond.Signal()
+		if q.cond != nil {
+			q.cond.Signal()
+		}
+		c.mu.Unlock()
+
+		job()
+
+		c.mu.Lock()
+		c.busy--
+		if q.jobs.Len() > 0 {
+			c.ready.PushBack(q)
+		} else {
+			q.scheduled = false
+		}
+	}
+}
+
 type channel chan struct{}
 
 func (c channel) add() { c <- struct{}{} }
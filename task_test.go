@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,18 +26,19 @@ func serveWebSocket(
 	pd PermessageDeflate,
 ) *Conn {
 	socket := &Conn{
-		isServer:    isServer,
-		ss:          session,
-		config:      config,
-		conn:        netConn,
-		closed:      0,
-		br:          br,
-		fh:          frameHeader{},
-		handler:     handler,
-		subprotocol: subprotocol,
-		writeQueue:  workerQueue{maxConcurrency: 1},
-		readQueue:   make(channel, 8),
-		pd:          pd,
+		isServer:     isServer,
+		ss:           session,
+		config:       config,
+		conn:         netConn,
+		closed:       0,
+		br:           br,
+		fh:           frameHeader{},
+		handler:      handler,
+		subprotocol:  subprotocol,
+		writeQueue:   workerQueue{maxConcurrency: 1},
+		controlQueue: workerQueue{maxConcurrency: 1},
+		readQueue:    make(channel, 8),
+		pd:           pd,
 	}
 	if compressEnabled {
 		if isServer {
@@ -395,3 +397,253 @@ func TestRQueue(t *testing.T) {
 		<-done
 	})
 }
+
+func TestKeyedQueue(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("", func(t *testing.T) {
+		const total = 1000
+		const limit = 8
+		var q = newKeyedQueue(make(channel, limit))
+		var mu = &sync.Mutex{}
+		var results = make(map[string][]int)
+		var concurrency, maxConcurrency = int64(0), int64(0)
+		var wg = &sync.WaitGroup{}
+		wg.Add(total)
+		for i := 0; i < total; i++ {
+			var key = strconv.Itoa(i % 4)
+			var v = i
+			_ = q.Go(key, nil, func(message *Message) error {
+				defer wg.Done()
+				x := atomic.AddInt64(&concurrency, 1)
+				mu.Lock()
+				maxConcurrency = int64(internal.Max(int(maxConcurrency), int(x)))
+				results[key] = append(results[key], v)
+				mu.Unlock()
+				time.Sleep(time.Duration(internal.AlphabetNumeric.Intn(100)) * time.Microsecond)
+				atomic.AddInt64(&concurrency, -1)
+				return nil
+			})
+		}
+		wg.Wait()
+
+		for key, list := range results {
+			as.Equal(total/4, len(list))
+			for i, v := range list {
+				as.Equal(i*4+int(key[0]-'0'), v)
+			}
+		}
+		as.LessOrEqual(maxConcurrency, int64(4))
+		as.Greater(maxConcurrency, int64(1))
+		time.Sleep(10 * time.Millisecond)
+		as.Equal(0, q.Len())
+	})
+
+	t.Run("", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{
+			ParallelEnabled: true,
+			ParallelGolimit: 4,
+			ParallelKey: func(message *Message) string {
+				return string(message.Bytes()[:1])
+			},
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, nil)
+
+		const count = 400
+		var mu = &sync.Mutex{}
+		var results = make(map[string][]string)
+		var wg = &sync.WaitGroup{}
+		wg.Add(count)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			time.Sleep(time.Duration(internal.AlphabetNumeric.Intn(100)) * time.Microsecond)
+			var key = string(message.Bytes()[:1])
+			mu.Lock()
+			results[key] = append(results[key], message.Data.String())
+			mu.Unlock()
+			wg.Done()
+		}
+
+		go server.ReadLoop()
+		go client.ReadLoop()
+		var expected = make(map[string][]string)
+		for i := 0; i < count; i++ {
+			var key = string(rune('a' + i%5))
+			var content = key + strconv.Itoa(i)
+			expected[key] = append(expected[key], content)
+			as.NoError(client.WriteString(content))
+		}
+		wg.Wait()
+		as.Equal(expected, results)
+	})
+}
+
+func TestWorkerPool(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("concurrency", func(t *testing.T) {
+		const conns = 10
+		const count = 50
+		var pool = NewWorkerPool(&WorkerPoolOption{MaxWorkers: 4, QueueLimit: 16, ConnQueueLimit: 4})
+		var concurrency, maxConcurrency = int64(0), int64(0)
+		var mu = &sync.Mutex{}
+		var results = make([][]int, conns)
+		var wg = &sync.WaitGroup{}
+		wg.Add(conns * count)
+		for i := 0; i < conns; i++ {
+			var idx = i
+			var q = new(poolQueue)
+			go func() {
+				for j := 0; j < count; j++ {
+					var v = j
+					pool.push(q, func() {
+						defer wg.Done()
+						x := atomic.AddInt64(&concurrency, 1)
+						mu.Lock()
+						maxConcurrency = int64(internal.Max(int(maxConcurrency), int(x)))
+						results[idx] = append(results[idx], v)
+						mu.Unlock()
+						time.Sleep(time.Duration(internal.AlphabetNumeric.Intn(100)) * time.Microsecond)
+						atomic.AddInt64(&concurrency, -1)
+					})
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, list := range results {
+			as.Equal(count, len(list))
+			for j, v := range list {
+				as.Equal(j, v)
+			}
+		}
+		as.LessOrEqual(maxConcurrency, int64(4))
+		as.Greater(maxConcurrency, int64(1))
+		time.Sleep(10 * time.Millisecond)
+		as.Equal(0, pool.Len())
+		as.Equal(0, pool.Workers())
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		var pool = NewWorkerPool(&WorkerPoolOption{MaxWorkers: 1, QueueLimit: 2})
+		var gate = make(chan struct{})
+		var q = new(poolQueue)
+		pool.push(q, func() { <-gate })
+		time.Sleep(10 * time.Millisecond)
+		pool.push(q, func() {})
+		pool.push(q, func() {})
+		as.Equal(2, pool.Len())
+
+		var pushed = make(chan struct{})
+		go func() {
+			pool.push(new(poolQueue), func() {})
+			close(pushed)
+		}()
+		select {
+		case <-pushed:
+			as.Fail("push should block while the pool is saturated")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(gate)
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			as.Fail("push is not resumed")
+		}
+	})
+
+	t.Run("fairness", func(t *testing.T) {
+		var pool = NewWorkerPool(&WorkerPoolOption{MaxWorkers: 1})
+		var gate = make(chan struct{})
+		var mu = &sync.Mutex{}
+		var order []string
+		var wg = &sync.WaitGroup{}
+		var record = func(s string) asyncJob {
+			wg.Add(1)
+			return func() {
+				mu.Lock()
+				order = append(order, s)
+				mu.Unlock()
+				wg.Done()
+			}
+		}
+		var a, b = new(poolQueue), new(poolQueue)
+		wg.Add(1)
+		pool.push(a, func() {
+			<-gate
+			mu.Lock()
+			order = append(order, "a1")
+			mu.Unlock()
+			wg.Done()
+		})
+		time.Sleep(10 * time.Millisecond)
+		pool.push(a, record("a2"))
+		pool.push(a, record("a3"))
+		pool.push(b, record("b1"))
+		close(gate)
+		wg.Wait()
+		as.Equal([]string{"a1", "b1", "a2", "a3"}, order)
+	})
+
+	t.Run("wakeup", func(t *testing.T) {
+		// 同时有等待全局空位和等待连接队列空位的协程, 每个空位只唤醒一个等待者, 不能丢失唤醒
+		const conns = 6
+		const pushers = 3
+		const count = 30
+		var pool = NewWorkerPool(&WorkerPoolOption{MaxWorkers: 2, QueueLimit: 4, ConnQueueLimit: 2})
+		var wg = &sync.WaitGroup{}
+		wg.Add(conns * pushers * count)
+		for i := 0; i < conns; i++ {
+			var q = new(poolQueue)
+			for j := 0; j < pushers; j++ {
+				go func() {
+					for k := 0; k < count; k++ {
+						pool.push(q, func() {
+							time.Sleep(time.Duration(internal.AlphabetNumeric.Intn(50)) * time.Microsecond)
+							wg.Done()
+						})
+					}
+				}()
+			}
+		}
+
+		var done = make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			as.Fail("push is not resumed")
+		}
+		as.Equal(0, pool.Len())
+	})
+
+	t.Run("conn", func(t *testing.T) {
+		var pool = NewWorkerPool(nil)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		server, client := newPeer(serverHandler, &ServerOption{WorkerPool: pool}, clientHandler, nil)
+
+		const count = 100
+		var received []string
+		var wg = &sync.WaitGroup{}
+		wg.Add(count)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var expected []string
+		for i := 0; i < count; i++ {
+			expected = append(expected, strconv.Itoa(i))
+			as.NoError(client.WriteString(strconv.Itoa(i)))
+		}
+		wg.Wait()
+		as.Equal(expected, received)
+	})
+}
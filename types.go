@@ -31,6 +31,52 @@ func (c Opcode) isDataFrame() bool {
 	return c <= OpcodeBinary
 }
 
+// CompressMode 单条消息的压缩策略
+// Compression strategy of a single message
+type CompressMode uint8
+
+const (
+	// CompressAuto 由压缩阈值决定是否压缩
+	// Compress when the payload reaches the threshold
+	CompressAuto CompressMode = iota
+
+	// CompressNever 不压缩, 适用于已经压缩过的内容(JPEG, gzip...)
+	// Never compress, for payloads that are already compressed (JPEG, gzip...)
+	CompressNever
+
+	// CompressAlways 忽略压缩阈值总是压缩, 需要协商了压缩拓展
+	// Ignore the threshold and always compress, requires a negotiated compression extension
+	CompressAlways
+)
+
+// WritePriority 异步写入的优先级
+// Priority of asynchronous writes
+type WritePriority uint8
+
+const (
+	// PriorityNormal 普通数据, 按照提交的顺序写入
+	// Bulk data, written in submission order
+	PriorityNormal WritePriority = iota
+
+	// PriorityHigh 高优先级数据, 排在所有排队中的普通数据之前, 但不会打断正在写入的消息
+	// High priority data, it jumps ahead of queued bulk data without interrupting the message being written
+	PriorityHigh
+)
+
+// WriteOptions 写入选项
+// Options of a single write
+type WriteOptions struct {
+	// 压缩策略
+	// 开启上下文接管时, 未压缩的消息不会进入滑动窗口, 所以可以安全地跳过压缩.
+	// Compression strategy
+	// With context takeover, uncompressed messages do not enter the sliding window, so skipping compression is safe.
+	Compress CompressMode
+
+	// 异步写入的优先级, 控制帧总是使用独立的队列, 不受此参数影响
+	// Priority of asynchronous writes, control frames always use a separate queue regardless of it
+	Priority WritePriority
+}
+
 type CloseError struct {
 	Code   uint16
 	Reason []byte
@@ -70,6 +116,10 @@ var (
 	// ErrUnsupportedProtocol 不支持的网络协议
 	// Unsupported network protocols
 	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+	// ErrServerClosed 服务器已关闭
+	// Server closed
+	ErrServerClosed = errors.New("gws: server closed")
 )
 
 type Event interface {
@@ -128,6 +178,11 @@ func (c *frameHeader) GetRSV3() bool {
 	return ((*c)[0] << 3 >> 7) == 1
 }
 
+// GetRSV 获取全部保留位
+func (c *frameHeader) GetRSV() uint8 {
+	return (*c)[0] & (RSV1 | RSV2 | RSV3)
+}
+
 func (c *frameHeader) GetOpcode() Opcode {
 	return Opcode((*c)[0] << 4 >> 4)
 }
@@ -230,6 +285,15 @@ type Message struct {
 	// 是否压缩
 	compressed bool
 
+	// 首帧的保留位
+	rsv uint8
+
+	// 分片消息每一帧的载荷长度, 未分片时为nil
+	fragments []int
+
+	// 连接的编解码器
+	codec Codec
+
 	// 操作码
 	Opcode Opcode
 
@@ -255,15 +319,19 @@ func (c *Message) Close() error {
 type continuationFrame struct {
 	initialized bool
 	compressed  bool
+	rsv         uint8
 	opcode      Opcode
 	buffer      *bytes.Buffer
+	fragments   []int
 }
 
 func (c *continuationFrame) reset() {
 	c.initialized = false
 	c.compressed = false
+	c.rsv = 0
 	c.opcode = 0
 	c.buffer = nil
+	c.fragments = nil
 }
 
 type Logger interface {
@@ -9,13 +9,13 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/marifcelik/gws/internal"
 )
 
 type responseWriter struct {
-	err         error
 	b           *bytes.Buffer
 	subprotocol string
 }
@@ -46,21 +46,14 @@ func (c *responseWriter) WithExtraHeader(h http.Header) {
 	}
 }
 
-func (c *responseWriter) WithSubProtocol(requestHeader http.Header, expectedSubProtocols []string) {
-	if len(expectedSubProtocols) > 0 {
-		c.subprotocol = internal.GetIntersectionElem(expectedSubProtocols, internal.Split(requestHeader.Get(internal.SecWebSocketProtocol.Key), ","))
-		if c.subprotocol == "" {
-			c.err = ErrSubprotocolNegotiation
-			return
-		}
-		c.WithHeader(internal.SecWebSocketProtocol.Key, c.subprotocol)
+func (c *responseWriter) WithSubProtocol(subprotocol string) {
+	c.subprotocol = subprotocol
+	if subprotocol != "" {
+		c.WithHeader(internal.SecWebSocketProtocol.Key, subprotocol)
 	}
 }
 
 func (c *responseWriter) Write(conn net.Conn, timeout time.Duration) error {
-	if c.err != nil {
-		return c.err
-	}
 	c.b.WriteString("\r\n")
 	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return err
@@ -75,6 +68,7 @@ type Upgrader struct {
 	option       *ServerOption
 	deflaterPool *deflaterPool
 	eventHandler Event
+	extensions   []Extension
 }
 
 func NewUpgrader(eventHandler Event, option *ServerOption) *Upgrader {
@@ -86,9 +80,39 @@ func NewUpgrader(eventHandler Event, option *ServerOption) *Upgrader {
 	if u.option.PermessageDeflate.Enabled {
 		u.deflaterPool.initialize(u.option.PermessageDeflate, option.ReadMaxPayloadSize)
 	}
+	if u.option.PermessageZstd.Enabled {
+		ext, err := newZstdExtension(u.option.PermessageZstd, u.option.ReadMaxPayloadSize, true)
+		if err != nil {
+			panic("gws: invalid PermessageZstd: " + err.Error())
+		}
+		u.extensions = append(u.extensions, ext)
+	}
+	u.extensions = append(u.extensions, &deflateExtension{option: &u.option.PermessageDeflate})
+	u.extensions = append(u.extensions, u.option.Extensions...)
 	return u
 }
 
+// 子协议协商, 选中的子协议必须是客户端请求过的
+func (c *Upgrader) selectSubProtocol(r *http.Request) (string, error) {
+	var offered = internal.Split(r.Header.Get(internal.SecWebSocketProtocol.Key), ",")
+	subprotocol, err := c.option.SelectSubProtocol(r, offered)
+	if err != nil {
+		return "", err
+	}
+	if subprotocol != "" && !internal.InCollection(subprotocol, offered) {
+		return "", ErrSubprotocolNegotiation
+	}
+	return subprotocol, nil
+}
+
+// 按照子协议获取事件处理器
+func (c *Upgrader) getEventHandler(subprotocol string) Event {
+	if handler, ok := c.option.SubProtocolHandlers[subprotocol]; ok && subprotocol != "" {
+		return handler
+	}
+	return c.eventHandler
+}
+
 // 为了节省内存, 不复用hijack返回的bufio.ReadWriter
 func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error) {
 	hj, ok := w.(http.Hijacker)
@@ -104,23 +128,6 @@ func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error
 	return netConn, br, nil
 }
 
-func (c *Upgrader) getPermessageDeflate(extensions string) PermessageDeflate {
-	clientPD := permessageNegotiation(extensions)
-	serverPD := c.option.PermessageDeflate
-	pd := PermessageDeflate{
-		Enabled:               serverPD.Enabled && strings.Contains(extensions, internal.PermessageDeflate),
-		Threshold:             serverPD.Threshold,
-		Level:                 serverPD.Level,
-		PoolSize:              serverPD.PoolSize,
-		ServerContextTakeover: clientPD.ServerContextTakeover && serverPD.ServerContextTakeover,
-		ClientContextTakeover: clientPD.ClientContextTakeover && serverPD.ClientContextTakeover,
-		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
-		ClientMaxWindowBits:   serverPD.ClientMaxWindowBits,
-	}
-	pd.setThreshold(true)
-	return pd
-}
-
 // Upgrade
 // 升级HTTP到WebSocket协议
 // http upgrade to websocket protocol
@@ -179,10 +186,10 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 	var rw = new(responseWriter).Init()
 	defer rw.Close()
 
-	var extensions = r.Header.Get(internal.SecWebSocketExtensions.Key)
-	var pd = c.getPermessageDeflate(extensions)
-	if pd.Enabled {
-		rw.WithHeader(internal.SecWebSocketExtensions.Key, pd.genResponseHeader())
+	var extensions = acceptExtensions(c.extensions, r.Header.Get(internal.SecWebSocketExtensions.Key))
+	var pd = extensions.pd
+	if len(extensions.responses) > 0 {
+		rw.WithHeader(internal.SecWebSocketExtensions.Key, joinExtensions(extensions.responses))
 	}
 
 	var websocketKey = r.Header.Get(internal.SecWebSocketKey.Key)
@@ -190,7 +197,11 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 		return nil, ErrHandshake
 	}
 	rw.WithHeader(internal.SecWebSocketAccept.Key, internal.ComputeAcceptKey(websocketKey))
-	rw.WithSubProtocol(r.Header, c.option.SubProtocols)
+	subprotocol, err := c.selectSubProtocol(r)
+	if err != nil {
+		return nil, err
+	}
+	rw.WithSubProtocol(subprotocol)
 	rw.WithExtraHeader(c.option.ResponseHeader)
 	if err := rw.Write(netConn, c.option.HandshakeTimeout); err != nil {
 		return nil, err
@@ -202,24 +213,31 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 		isServer:          true,
 		subprotocol:       rw.subprotocol,
 		pd:                pd,
+		rsv:               extensions.rsv,
+		extensions:        extensions.sessions,
 		conn:              netConn,
 		config:            config,
 		br:                br,
 		continuationFrame: continuationFrame{},
 		fh:                frameHeader{},
-		handler:           c.eventHandler,
+		handler:           c.getEventHandler(subprotocol),
+		codec:             selectCodec(c.option.Codecs, subprotocol),
 		closed:            0,
 		writeQueue:        workerQueue{maxConcurrency: 1},
+		controlQueue:      workerQueue{maxConcurrency: 1},
 		readQueue:         make(channel, c.option.ParallelGolimit),
 		ctx:               r.Context(),
 	}
 	if pd.Enabled {
-		socket.deflater = c.deflaterPool.Select()
-		if c.option.PermessageDeflate.ServerContextTakeover {
-			socket.cpsWindow.initialize(config.cswPool, c.option.PermessageDeflate.ServerMaxWindowBits)
+		socket.deflater = c.deflaterPool.SelectWindow(pd.ServerMaxWindowBits)
+		if pd.AdaptiveEnabled {
+			socket.sampler = newCompressSampler(pd)
+		}
+		if pd.ServerContextTakeover {
+			socket.cpsWindow.initialize(config.cswPool, pd.ServerMaxWindowBits)
 		}
-		if c.option.PermessageDeflate.ClientContextTakeover {
-			socket.dpsWindow.initialize(config.dswPool, c.option.PermessageDeflate.ClientMaxWindowBits)
+		if pd.ClientContextTakeover {
+			socket.dpsWindow.initialize(config.dswPool, pd.ClientMaxWindowBits)
 		}
 	}
 	return socket, nil
@@ -228,6 +246,11 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 type Server struct {
 	upgrader *Upgrader
 	option   *ServerOption
+	reactor  *reactor
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
 
 	// OnError
 	OnError func(conn net.Conn, err error)
@@ -239,17 +262,24 @@ type Server struct {
 // NewServer 创建websocket服务器
 // create a websocket server
 func NewServer(eventHandler Event, option *ServerOption) *Server {
-	var c = &Server{upgrader: NewUpgrader(eventHandler, option)}
+	var c = &Server{upgrader: NewUpgrader(eventHandler, option), listeners: make(map[net.Listener]struct{})}
 	c.option = c.upgrader.option
 	c.OnError = func(conn net.Conn, err error) { c.option.Logger.Error("gws: " + err.Error()) }
 	c.OnRequest = func(conn net.Conn, br *bufio.Reader, r *http.Request) {
 		socket, err := c.GetUpgrader().UpgradeFromConn(conn, br, r)
 		if err != nil {
 			c.OnError(conn, err)
-		} else {
+		} else if c.reactor == nil || !c.reactor.add(socket) {
 			socket.ReadLoop()
 		}
 	}
+	if c.option.ReactorEnabled {
+		reactor, err := newReactor(c.option.ReactorLoops, c.option.ReactorWorkers)
+		if err != nil {
+			c.option.Logger.Error("gws: " + err.Error())
+		}
+		c.reactor = reactor
+	}
 	return c
 }
 
@@ -287,14 +317,34 @@ func (c *Server) RunTLS(addr string, certFile, keyFile string) error {
 	return c.RunListener(tls.NewListener(listener, config))
 }
 
-// RunListener 运行网络监听器
-// Running the network listener
+// RunListener 运行网络监听器, 直到监听器被关闭或者调用了Close
+// Running the network listener until it is closed or Close is called
 func (c *Server) RunListener(listener net.Listener) error {
-	defer listener.Close()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	c.listeners[listener] = struct{}{}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.listeners, listener)
+		c.mu.Unlock()
+		_ = listener.Close()
+	}()
 
 	for {
 		netConn, err := listener.Accept()
 		if err != nil {
+			if c.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			c.OnError(netConn, err)
 			continue
 		}
@@ -310,3 +360,36 @@ func (c *Server) RunListener(listener net.Listener) error {
 		}(netConn)
 	}
 }
+
+func (c *Server) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Close 关闭RunListener中的监听器并停止事件循环, 之后RunListener返回ErrServerClosed.
+// 已经建立的连接不受影响, 事件循环中的连接转为在各自的协程中读取.
+// Close the listeners of RunListener and stop the event loops, RunListener returns ErrServerClosed afterwards.
+// Established connections are not affected, connections in the event loops continue to be read in their own goroutines.
+func (c *Server) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	var listeners = c.listeners
+	c.listeners = make(map[net.Listener]struct{})
+	c.mu.Unlock()
+
+	var err error
+	for listener := range listeners {
+		if e := listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if c.reactor != nil {
+		c.reactor.close()
+	}
+	return err
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -434,6 +435,111 @@ func TestSubprotocol(t *testing.T) {
 	})
 }
 
+func TestSelectSubProtocol(t *testing.T) {
+	var as = assert.New(t)
+	var newRequest = func(subprotocols string) *http.Request {
+		var request = &http.Request{Header: http.Header{}, Method: http.MethodGet}
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		if subprotocols != "" {
+			request.Header.Set("Sec-WebSocket-Protocol", subprotocols)
+		}
+		return request
+	}
+
+	t.Run("hook", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			SubProtocols: []string{"chat"},
+			SelectSubProtocol: func(r *http.Request, offered []string) (string, error) {
+				switch r.URL.Query().Get("mode") {
+				case "none":
+					return "", nil
+				case "invalid":
+					return "v3", nil
+				case "deny":
+					return "", ErrUnauthorized
+				default:
+					return offered[len(offered)-1], nil
+				}
+			},
+		})
+		var upgrade = func(mode string) (*Conn, error) {
+			var request = newRequest("v1, v2")
+			request.URL, _ = url.Parse("/connect?mode=" + mode)
+			return upgrader.Upgrade(newHttpWriter(), request)
+		}
+
+		socket, err := upgrade("")
+		if as.NoError(err) {
+			as.Equal("v2", socket.SubProtocol())
+		}
+		socket, err = upgrade("none")
+		if as.NoError(err) {
+			as.Equal("", socket.SubProtocol())
+		}
+		_, err = upgrade("invalid")
+		as.ErrorIs(err, ErrSubprotocolNegotiation)
+		_, err = upgrade("deny")
+		as.ErrorIs(err, ErrUnauthorized)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{
+			SubProtocolHandlers: map[string]Event{"v1.json": new(BuiltinEventHandler)},
+		})
+		subprotocol, err := option.SelectSubProtocol(newRequest(""), []string{"v2.protobuf", "v1.json"})
+		as.NoError(err)
+		as.Equal("v1.json", subprotocol)
+		subprotocol, err = option.SelectSubProtocol(newRequest(""), []string{"v3"})
+		as.NoError(err)
+		as.Equal("", subprotocol)
+
+		option.SubProtocols = []string{"v2.protobuf"}
+		subprotocol, err = option.SelectSubProtocol(newRequest(""), []string{"v1.json", "v2.protobuf"})
+		as.NoError(err)
+		as.Equal("v2.protobuf", subprotocol)
+		_, err = option.SelectSubProtocol(newRequest(""), []string{"v1.json"})
+		as.ErrorIs(err, ErrSubprotocolNegotiation)
+	})
+
+	t.Run("route", func(t *testing.T) {
+		var addr = "127.0.0.1:" + nextPort()
+		var opened = make(chan string, 4)
+		var newHandler = func(name string) Event {
+			var handler = new(webSocketMocker)
+			handler.onOpen = func(socket *Conn) { opened <- name + ":" + socket.SubProtocol() }
+			return handler
+		}
+		var server = NewServer(newHandler("default"), &ServerOption{
+			SubProtocolHandlers: map[string]Event{
+				"v1.json":     newHandler("json"),
+				"v2.protobuf": newHandler("protobuf"),
+			},
+		})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		var dial = func(subprotocols string) {
+			var header = http.Header{}
+			if subprotocols != "" {
+				header.Set("Sec-WebSocket-Protocol", subprotocols)
+			}
+			client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr, RequestHeader: header})
+			if as.NoError(err) {
+				_ = client.NetConn().Close()
+			}
+		}
+		dial("v2.protobuf")
+		as.Equal("protobuf:v2.protobuf", <-opened)
+		dial("v3, v1.json")
+		as.Equal("json:v1.json", <-opened)
+		dial("")
+		as.Equal("default:", <-opened)
+	})
+}
+
 func TestResponseWriter_Write(t *testing.T) {
 	t.Run("", func(t *testing.T) {
 		conn, _ := net.Pipe()
@@ -0,0 +1,226 @@
+package gws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/marifcelik/gws/internal"
+)
+
+const (
+	// WebsockifyBinaryProtocol websockify的二进制子协议, 数据以二进制消息传输. 没有协商子协议时也使用二进制消息.
+	// The binary subprotocol of websockify, data is carried in binary messages. Binary messages are also used without a subprotocol.
+	WebsockifyBinaryProtocol = "binary"
+
+	// WebsockifyBase64Protocol websockify的base64子协议, 数据以base64编码的文本消息传输
+	// The base64 subprotocol of websockify, data is carried in base64 encoded text messages.
+	WebsockifyBase64Protocol = "base64"
+
+	// WebsockifyTargetKey 在Authorize中把目标地址(host:port)写入session的键, 优先于按路径配置的目标
+	// Session key under which Authorize stores the target address (host:port), it takes precedence over the targets configured by path.
+	WebsockifyTargetKey = "gws:websockify:target"
+
+	defaultWebsockifyDialTimeout = 5 * time.Second
+	defaultWebsockifyBufferSize  = 32 * 1024
+	websockifySessionKey         = "gws:websockify"
+)
+
+type WebsockifyOption struct {
+	// 按请求路径配置的TCP目标地址
+	// TCP target addresses by request path
+	Targets map[string]string
+
+	// 连接目标的超时时间, 默认为5秒
+	// Timeout of dialing the target, 5 seconds by default
+	DialTimeout time.Duration
+
+	// 自定义拨号, 默认使用net.Dialer
+	// Custom dialing, net.Dialer is used by default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 从TCP连接读取的缓冲区大小, 也是单条消息的长度上限, 默认为32KB
+	// Size of the buffer reading from the TCP connection, which is also the limit of a single message, 32KB by default
+	BufferSize int
+}
+
+func (c *WebsockifyOption) initialize() *WebsockifyOption {
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = defaultWebsockifyDialTimeout
+	}
+	if c.Dial == nil {
+		var dialer = &net.Dialer{}
+		c.Dial = dialer.DialContext
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultWebsockifyBufferSize
+	}
+	return c
+}
+
+// WebsockifyBridge WebSocket到TCP的桥接, 实现了http.Handler
+// 每个WebSocket连接在握手之后拨号一个TCP目标, 双向转发数据. 两个方向都是同步写入, 一侧写入缓慢时另一侧停止读取.
+// TCP连接正常结束时以1000关闭WebSocket, 出错时以1011关闭, 拨号失败时以1014关闭; WebSocket关闭时关闭TCP连接.
+// Bridge from WebSocket to TCP implementing http.Handler.
+// Every WebSocket connection dials a TCP target after the handshake and data is forwarded in both directions.
+// Writes are synchronous in both directions, so one side stops reading while the other side is slow.
+// The WebSocket is closed with 1000 when the TCP connection ends normally, with 1011 on errors and with 1014 when dialing fails;
+// the TCP connection is closed when the WebSocket is closed.
+type WebsockifyBridge struct {
+	upgrader *Upgrader
+}
+
+// NewWebsockifyBridge 创建桥接
+// 目标地址优先取Authorize写入session的WebsockifyTargetKey, 其次按请求路径匹配Targets, 都没有时拒绝握手.
+// 没有配置SubProtocols和SelectSubProtocol时, 按binary, base64的顺序协商子协议, 客户端都不支持时使用二进制消息.
+// 不要开启ParallelEnabled, 否则数据会乱序.
+// Create a bridge.
+// The target is WebsockifyTargetKey stored in the session by Authorize, or else Targets matched by the request path;
+// the handshake is rejected when there is neither.
+// Without SubProtocols and SelectSubProtocol, binary and base64 are negotiated in that order
+// and binary messages are used when the client supports neither.
+// Do not enable ParallelEnabled, otherwise data will be reordered.
+func NewWebsockifyBridge(option *WebsockifyOption, serverOption *ServerOption) *WebsockifyBridge {
+	if option == nil {
+		option = new(WebsockifyOption)
+	}
+	option.initialize()
+	if serverOption == nil {
+		serverOption = new(ServerOption)
+	}
+
+	var authorize = serverOption.Authorize
+	serverOption.Authorize = func(r *http.Request, session SessionStorage) bool {
+		if authorize != nil && !authorize(r, session) {
+			return false
+		}
+		if _, ok := session.Load(WebsockifyTargetKey); ok {
+			return true
+		}
+		if target, ok := option.Targets[r.URL.Path]; ok {
+			session.Store(WebsockifyTargetKey, target)
+			return true
+		}
+		return false
+	}
+
+	if len(serverOption.SubProtocols) == 0 && serverOption.SelectSubProtocol == nil {
+		serverOption.SelectSubProtocol = func(r *http.Request, offered []string) (string, error) {
+			for _, item := range []string{WebsockifyBinaryProtocol, WebsockifyBase64Protocol} {
+				if internal.InCollection(item, offered) {
+					return item, nil
+				}
+			}
+			return "", nil
+		}
+	}
+
+	var handler = &websockifyHandler{option: option}
+	return &WebsockifyBridge{upgrader: NewUpgrader(handler, serverOption)}
+}
+
+// Upgrader 获取升级器
+// Get the upgrader
+func (c *WebsockifyBridge) Upgrader() *Upgrader { return c.upgrader }
+
+func (c *WebsockifyBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	socket, err := c.upgrader.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	go socket.ReadLoop()
+}
+
+type websockifyHandler struct {
+	BuiltinEventHandler
+	option *WebsockifyOption
+}
+
+func (c *websockifyHandler) OnOpen(socket *Conn) {
+	target, _ := socket.Session().Load(WebsockifyTargetKey)
+	addr, _ := target.(string)
+
+	// 请求上下文在ServeHTTP返回之后就被取消了, 不能用于拨号
+	ctx, cancel := context.WithTimeout(context.Background(), c.option.DialTimeout)
+	defer cancel()
+	conn, err := c.option.Dial(ctx, "tcp", addr)
+	if err != nil {
+		socket.WriteClose(1014, []byte("dial target failed"))
+		return
+	}
+	socket.Session().Store(websockifySessionKey, conn)
+	go c.pump(socket, conn)
+}
+
+// 把TCP连接的数据转发到WebSocket
+func (c *websockifyHandler) pump(socket *Conn, conn net.Conn) {
+	var opcode = OpcodeBinary
+	var encoding = socket.SubProtocol() == WebsockifyBase64Protocol
+	if encoding {
+		opcode = OpcodeText
+	}
+
+	var buf = make([]byte, c.option.BufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			var payload = buf[:n]
+			if encoding {
+				payload = make([]byte, base64.StdEncoding.EncodedLen(n))
+				base64.StdEncoding.Encode(payload, buf[:n])
+			}
+			if socket.WriteMessage(opcode, payload) != nil {
+				_ = conn.Close()
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				socket.WriteClose(1000, nil)
+			} else {
+				socket.WriteClose(1011, []byte("target connection error"))
+			}
+			return
+		}
+	}
+}
+
+func (c *websockifyHandler) OnClose(socket *Conn, err error) {
+	if v, ok := socket.Session().Load(websockifySessionKey); ok {
+		_ = v.(net.Conn).Close()
+	}
+}
+
+func (c *websockifyHandler) OnMessage(socket *Conn, message *Message) {
+	defer message.Close()
+	v, ok := socket.Session().Load(websockifySessionKey)
+	if !ok {
+		return
+	}
+
+	var payload = message.Bytes()
+	if socket.SubProtocol() == WebsockifyBase64Protocol {
+		if message.Opcode != OpcodeText {
+			socket.WriteClose(1003, []byte("base64 requires text messages"))
+			return
+		}
+		var buf = make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(buf, payload)
+		if err != nil {
+			socket.WriteClose(1007, []byte("invalid base64 payload"))
+			return
+		}
+		payload = buf[:n]
+	} else if message.Opcode != OpcodeBinary {
+		socket.WriteClose(1003, []byte("binary requires binary messages"))
+		return
+	}
+
+	if _, err := v.(net.Conn).Write(payload); err != nil {
+		socket.WriteClose(1011, []byte("target connection error"))
+	}
+}
@@ -0,0 +1,190 @@
+package gws
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type websockifyClient struct {
+	socket   *Conn
+	messages chan *Message
+	closed   chan error
+}
+
+func newWebsockifyClient(addr string, subprotocol string) (*websockifyClient, error) {
+	var client = &websockifyClient{messages: make(chan *Message, 16), closed: make(chan error, 1)}
+	var handler = &webSocketMocker{
+		onMessage: func(socket *Conn, message *Message) { client.messages <- message },
+		onClose:   func(socket *Conn, err error) { client.closed <- err },
+	}
+	var header = http.Header{}
+	if subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	socket, _, err := NewClient(handler, &ClientOption{Addr: addr, RequestHeader: header})
+	if err != nil {
+		return nil, err
+	}
+	client.socket = socket
+	go socket.ReadLoop()
+	return client, nil
+}
+
+func (c *websockifyClient) closeCode() uint16 {
+	select {
+	case err := <-c.closed:
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.Code
+		}
+		return 0
+	case <-time.After(time.Second):
+		return 0
+	}
+}
+
+// 启动TCP目标, 每个连接交给serve处理
+func newWebsockifyTarget(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestWebsockifyBridge(t *testing.T) {
+	var as = assert.New(t)
+	var echo = newWebsockifyTarget(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	var hangup = make(chan error, 1)
+	var target = newWebsockifyTarget(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("bye"))
+		_ = conn.Close()
+	})
+	var watch = newWebsockifyTarget(t, func(conn net.Conn) {
+		_, err := io.ReadAll(conn)
+		hangup <- err
+	})
+
+	var bridge = NewWebsockifyBridge(&WebsockifyOption{
+		Targets: map[string]string{"/echo": echo, "/bye": target, "/watch": watch, "/down": "127.0.0.1:1"},
+	}, &ServerOption{
+		Authorize: func(r *http.Request, session SessionStorage) bool {
+			if addr := r.URL.Query().Get("target"); addr != "" {
+				session.Store(WebsockifyTargetKey, addr)
+			}
+			return r.URL.Query().Get("token") != "invalid"
+		},
+	})
+	var server = httptest.NewServer(bridge)
+	defer server.Close()
+	var addr = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("binary", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/echo", "binary, base64")
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(WebsockifyBinaryProtocol, client.socket.SubProtocol())
+		as.NoError(client.socket.WriteMessage(OpcodeBinary, []byte("hello")))
+		var message = <-client.messages
+		as.Equal(OpcodeBinary, message.Opcode)
+		as.Equal("hello", string(message.Bytes()))
+
+		// 二进制模式不接受文本消息
+		as.NoError(client.socket.WriteString("text"))
+		as.Equal(uint16(1003), client.closeCode())
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/echo", "base64")
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(WebsockifyBase64Protocol, client.socket.SubProtocol())
+		as.NoError(client.socket.WriteString(base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 255})))
+		var message = <-client.messages
+		as.Equal(OpcodeText, message.Opcode)
+		as.Equal(base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 255}), string(message.Bytes()))
+
+		as.NoError(client.socket.WriteString("!invalid"))
+		as.Equal(uint16(1007), client.closeCode())
+	})
+
+	t.Run("no subprotocol", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/echo", "")
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("", client.socket.SubProtocol())
+		as.NoError(client.socket.WriteMessage(OpcodeBinary, []byte("raw")))
+		as.Equal("raw", string((<-client.messages).Bytes()))
+	})
+
+	t.Run("target close", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/bye", "binary")
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("bye", string((<-client.messages).Bytes()))
+		as.Equal(uint16(1000), client.closeCode())
+	})
+
+	t.Run("client close", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/watch", "binary")
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.socket.WriteMessage(OpcodeBinary, []byte("data")))
+		client.socket.WriteClose(1000, nil)
+		select {
+		case err := <-hangup:
+			as.NoError(err)
+		case <-time.After(time.Second):
+			as.Fail("target connection is not closed")
+		}
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/down", "binary")
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(uint16(1014), client.closeCode())
+	})
+
+	t.Run("authorize", func(t *testing.T) {
+		client, err := newWebsockifyClient(addr+"/any?target="+echo, "binary")
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.socket.WriteMessage(OpcodeBinary, []byte("routed")))
+		as.Equal("routed", string((<-client.messages).Bytes()))
+
+		_, err = newWebsockifyClient(addr+"/echo?token=invalid", "binary")
+		as.Error(err)
+		_, err = newWebsockifyClient(addr+"/unknown", "binary")
+		as.Error(err)
+	})
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"math"
+	"net"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/marifcelik/gws/internal"
 )
@@ -44,7 +48,13 @@ func (c *Conn) WriteString(s string) error {
 // WriteMessage 写入文本/二进制消息, 文本消息应该使用UTF8编码
 // Write text/binary messages, text messages should be encoded in UTF8.
 func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
-	err := c.doWrite(opcode, internal.Bytes(payload))
+	return c.WriteMessageOpts(opcode, payload, WriteOptions{})
+}
+
+// WriteMessageOpts 类似WriteMessage, 可以单独控制这条消息的压缩策略
+// Similar to WriteMessage, but the compression of this message can be controlled separately.
+func (c *Conn) WriteMessageOpts(opcode Opcode, payload []byte, opts WriteOptions) error {
+	err := c.doWrite(opcode, internal.Bytes(payload), opts)
 	c.emitError(err)
 	return err
 }
@@ -53,25 +63,73 @@ func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
 // 异步非阻塞地将消息写入到任务队列, 收到回调后才允许回收payload内存
 // Asynchronously and non-blockingly write the message to the task queue, allowing the payload memory to be reclaimed only after a callback is received.
 func (c *Conn) WriteAsync(opcode Opcode, payload []byte, callback func(error)) {
-	c.writeQueue.Push(func() {
-		if err := c.WriteMessage(opcode, payload); callback != nil {
+	c.WriteAsyncOpts(opcode, payload, WriteOptions{}, callback)
+}
+
+// WriteAsyncOpts 类似WriteAsync, 可以单独控制这条消息的压缩策略和优先级
+// Similar to WriteAsync, but the compression and priority of this message can be controlled separately.
+func (c *Conn) WriteAsyncOpts(opcode Opcode, payload []byte, opts WriteOptions, callback func(error)) {
+	if c.config.WriteCoalesceEnabled && opcode.isDataFrame() {
+		c.pushWrite(opcode, opts.Priority, func() { c.writeBatch(opcode, internal.Bytes(payload), opts, callback) })
+		return
+	}
+	c.pushWrite(opcode, opts.Priority, func() {
+		if err := c.WriteMessageOpts(opcode, payload, opts); callback != nil {
 			callback(err)
 		}
 	})
 }
 
+// 按照优先级加入发送队列. Ping和Pong使用独立的队列, 可以插入到大消息的分片之间; 高优先级的数据排在普通数据之前.
+// 关闭帧之后不能再发送数据, 所以关闭帧和数据一起排队, 不能越过在它之前加入的数据.
+func (c *Conn) pushWrite(opcode Opcode, priority WritePriority, job asyncJob) {
+	switch {
+	case opcode == OpcodePing || opcode == OpcodePong:
+		c.controlQueue.Push(job)
+	case priority == PriorityHigh:
+		c.writeQueue.PushPriority(job)
+	default:
+		c.writeQueue.Push(job)
+	}
+}
+
 // Writev 类似WriteMessage, 区别是可以一次写入多个切片
 // Similar to WriteMessage, except that you can write multiple slices at once.
 func (c *Conn) Writev(opcode Opcode, payloads ...[]byte) error {
-	var err = c.doWrite(opcode, internal.Buffers(payloads))
+	var err error
+	if c.config.WriteCoalesceEnabled {
+		err = c.doWritev(opcode, internal.Buffers(payloads))
+	} else {
+		err = c.doWrite(opcode, internal.Buffers(payloads), WriteOptions{})
+	}
 	c.emitError(err)
 	return err
 }
 
+// 同步写入多个切片, 和合并写入的帧一起写出. 未压缩且不需要掩码时直接引用载荷.
+func (c *Conn) doWritev(opcode Opcode, payload internal.Buffers) error {
+	if c.shouldFragment(opcode, payload) {
+		return c.doWriteFragmented(opcode, payload, WriteOptions{})
+	}
+	c.mu.Lock()
+	var err = c.appendFrame(opcode, payload, WriteOptions{}, nil)
+	notify, flushErr := c.flushBatch()
+	c.mu.Unlock()
+	notify()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
 // WritevAsync 类似WriteAsync, 区别是可以一次写入多个切片
 // Similar to WriteAsync, except that you can write multiple slices at once.
 func (c *Conn) WritevAsync(opcode Opcode, payloads [][]byte, callback func(error)) {
-	c.writeQueue.Push(func() {
+	if c.config.WriteCoalesceEnabled && opcode.isDataFrame() {
+		c.pushWrite(opcode, PriorityNormal, func() { c.writeBatch(opcode, internal.Buffers(payloads), WriteOptions{}, callback) })
+		return
+	}
+	c.pushWrite(opcode, PriorityNormal, func() {
 		if err := c.Writev(opcode, payloads...); callback != nil {
 			callback(err)
 		}
@@ -88,47 +146,573 @@ func (c *Conn) Async(f func()) {
 }
 
 // 执行写入逻辑, 注意妥善维护压缩字典
-func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
+func (c *Conn) doWrite(opcode Opcode, payload internal.Payload, opts WriteOptions) error {
+	if !opcode.isDataFrame() {
+		return c.doWriteControl(opcode, payload)
+	}
+	if c.shouldFragment(opcode, payload) {
+		return c.doWriteFragmented(opcode, payload, opts)
+	}
+
 	c.mu.Lock()
+	c.waitFragments()
+	notify, err := c.flushBatch()
+	defer notify()
 	defer c.mu.Unlock()
 
-	if opcode != OpcodeCloseConnection && c.isClosed() {
+	if err != nil {
+		return err
+	}
+	if c.isClosed() {
 		return ErrConnClosed
 	}
+	// 拓展变换之前检查编码, 变换结果不再是文本
+	if err := c.checkPayload(opcode, payload); err != nil {
+		return err
+	}
+
+	opts.Compress = c.resolveCompressMode(opcode, payload.Len(), opts.Compress)
+	payload, rsv, err := c.encodeExtensions(opcode, payload, opts.Compress)
+	if err != nil {
+		return err
+	}
 
-	frame, err := c.genFrame(opcode, payload, false)
+	var n = payload.Len()
+	frame, err := c.encodeFrame(opcode, payload, opts, false)
 	if err != nil {
 		return err
 	}
+	frame.Bytes()[0] |= rsv
 
 	err = internal.WriteN(c.conn, frame.Bytes())
-	_, _ = payload.WriteTo(&c.cpsWindow)
+	// 只有压缩过的消息才会进入对端的解压字典
+	if c.isCompressible(opcode, n, opts.Compress) {
+		_, _ = payload.WriteTo(&c.cpsWindow)
+		if c.sampler != nil {
+			c.sampler.Record(opcode, n, framePayloadLength(frame.Bytes()))
+		}
+	}
 	binaryPool.Put(frame)
 	return err
 }
 
-// 帧生成
-func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, isBroadcast bool) (*bytes.Buffer, error) {
+// 写入控制帧. 控制帧先放入待写入列表, 正在分片写入时由分片写入者在两帧之间写出, 否则获取写锁之后自己写出.
+func (c *Conn) doWriteControl(opcode Opcode, payload internal.Payload) error {
+	var frame = &controlFrame{opcode: opcode, payload: payload, done: make(chan error, 1)}
+	if c.controls.push(frame) {
+		return <-frame.done
+	}
+
+	c.mu.Lock()
+	notify, err := c.flushBatch()
+	c.writeControls(err)
+	c.mu.Unlock()
+	notify()
+	return <-frame.done
+}
+
+// 写出全部待写入的控制帧, 调用者持有写锁. err不为空时直接以err结束.
+func (c *Conn) writeControls(err error) {
+	for _, frame := range c.controls.take() {
+		if err != nil {
+			frame.done <- err
+		} else {
+			frame.done <- c.writeControlFrame(frame.opcode, frame.payload)
+		}
+	}
+}
+
+func (c *Conn) writeControlFrame(opcode Opcode, payload internal.Payload) error {
+	if opcode != OpcodeCloseConnection && c.isClosed() {
+		return ErrConnClosed
+	}
+	frame, err := c.genFrame(opcode, payload, WriteOptions{}, false)
+	if err != nil {
+		return err
+	}
+	err = internal.WriteN(c.conn, frame.Bytes())
+	binaryPool.Put(frame)
+	return err
+}
+
+// 分片写入消息, sizes为每一帧的载荷长度.
+// 压缩之后的长度和sizes不再对应, 此时保持分片数量, 将压缩数据均分到各帧.
+func (c *Conn) writeFragments(opcode Opcode, payload []byte, sizes []int, opts WriteOptions) error {
+	if len(sizes) <= 1 {
+		return c.WriteMessageOpts(opcode, payload, opts)
+	}
+	var err = c.doWriteFragments(opcode, internal.Bytes(payload), sizes, opts)
+	c.emitError(err)
+	return err
+}
+
+func (c *Conn) doWriteFragments(opcode Opcode, payload internal.Payload, sizes []int, opts WriteOptions) error {
+	c.mu.Lock()
+	c.waitFragments()
+	notify, err := c.flushBatch()
+	defer notify()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if c.isClosed() {
+		return ErrConnClosed
+	}
 	if opcode == OpcodeText && !payload.CheckEncoding(c.config.CheckUtf8Enabled, uint8(opcode)) {
-		return nil, internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+		return internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+	}
+	if payload.Len() > c.config.WriteMaxPayloadSize {
+		return internal.CloseMessageTooLarge
+	}
+
+	opts.Compress = c.resolveCompressMode(opcode, payload.Len(), opts.Compress)
+	payload, rsv, err := c.encodeExtensions(opcode, payload, opts.Compress)
+	if err != nil {
+		return err
+	}
+
+	var n = payload.Len()
+	var compressed = c.isCompressible(opcode, n, opts.Compress)
+	var data = binaryPool.Get(n)
+	defer binaryPool.Put(data)
+	if compressed {
+		if err := c.deflater.Compress(payload, data, c.getCpsDict(false)); err != nil {
+			return err
+		}
+	} else {
+		_, _ = payload.WriteTo(data)
+	}
+
+	var contents = data.Bytes()
+	var sum = 0
+	for _, size := range sizes {
+		sum += size
+	}
+	if sum != len(contents) {
+		sizes = splitFragments(len(contents), len(sizes))
+	}
+
+	var frame = binaryPool.Get(len(contents) + len(sizes)*frameHeaderSize)
+	defer binaryPool.Put(frame)
+	for i, size := range sizes {
+		var header = frameHeader{}
+		var code = internal.SelectValue(i == 0, opcode, OpcodeContinuation)
+		headerLength, maskBytes := header.GenerateHeader(c.isServer, i == len(sizes)-1, compressed && i == 0, code, size)
+		if i == 0 {
+			header[0] |= rsv
+		}
+		var chunk = contents[:size]
+		contents = contents[size:]
+		if !c.isServer {
+			internal.MaskXOR(chunk, maskBytes)
+		}
+		frame.Write(header[:headerLength])
+		frame.Write(chunk)
+	}
+
+	err = internal.WriteN(c.conn, frame.Bytes())
+	if compressed {
+		_, _ = payload.WriteTo(&c.cpsWindow)
+		if c.sampler != nil {
+			c.sampler.Record(opcode, n, data.Len())
+		}
+	}
+	return err
+}
+
+// 载荷超过WriteFragmentSize的数据帧需要自动分片
+func (c *Conn) shouldFragment(opcode Opcode, payload internal.Payload) bool {
+	return c.config.WriteFragmentSize > 0 && opcode.isDataFrame() && payload.Len() > c.config.WriteFragmentSize
+}
+
+// 等待正在分片写入的消息写完, 调用者持有写锁. 数据帧不能插入到分片消息的中间.
+func (c *Conn) waitFragments() {
+	for c.fragmenting {
+		c.fragmentCond.Wait()
+	}
+}
+
+// 将大消息按照WriteFragmentSize拆分为多个帧写入, 每写完一帧写入一次等待中的控制帧.
+// 消息作为一个整体压缩, 然后拆分压缩后的数据.
+func (c *Conn) doWriteFragmented(opcode Opcode, payload internal.Payload, opts WriteOptions) error {
+	c.mu.Lock()
+	c.waitFragments()
+	notify, err := c.flushBatch()
+	if err == nil {
+		err = c.writeFragmented(opcode, payload, opts)
+	}
+	c.mu.Unlock()
+	notify()
+	return err
+}
+
+// 调用者持有写锁, 返回时仍然持有
+func (c *Conn) writeFragmented(opcode Opcode, payload internal.Payload, opts WriteOptions) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+	if err := c.checkPayload(opcode, payload); err != nil {
+		return err
+	}
+	opts.Compress = c.resolveCompressMode(opcode, payload.Len(), opts.Compress)
+	payload, rsv, err := c.encodeExtensions(opcode, payload, opts.Compress)
+	if err != nil {
+		return err
+	}
+
+	var n = payload.Len()
+	var compressed = c.isCompressible(opcode, n, opts.Compress)
+	var data = binaryPool.Get(n)
+	defer binaryPool.Put(data)
+	if compressed {
+		if err := c.deflater.Compress(payload, data, c.getCpsDict(false)); err != nil {
+			return err
+		}
+		// 其他数据帧要等待这条消息写完, 所以可以提前更新滑动窗口
+		_, _ = payload.WriteTo(&c.cpsWindow)
+		if c.sampler != nil {
+			c.sampler.Record(opcode, n, data.Len())
+		}
+	} else {
+		_, _ = payload.WriteTo(data)
+	}
+
+	c.fragmenting = true
+	c.controls.setActive(true)
+	if c.fragmentCond == nil {
+		c.fragmentCond = sync.NewCond(&c.mu)
+	}
+	defer func() {
+		c.fragmenting = false
+		c.fragmentCond.Broadcast()
+		// 写入期间加入的控制帧只等待分片写入者
+		c.controls.setActive(false)
+		c.writeControls(nil)
+	}()
+
+	var size = c.config.WriteFragmentSize
+	var frame = binaryPool.Get(size + frameHeaderSize)
+	defer binaryPool.Put(frame)
+	var contents = data.Bytes()
+	for i := 0; ; i++ {
+		var chunk = contents[:internal.Min(size, len(contents))]
+		contents = contents[len(chunk):]
+		var fin = len(contents) == 0
+		var header = frameHeader{}
+		var code = internal.SelectValue(i == 0, opcode, OpcodeContinuation)
+		headerLength, maskBytes := header.GenerateHeader(c.isServer, fin, compressed && i == 0, code, len(chunk))
+		if i == 0 {
+			header[0] |= rsv
+		}
+		frame.Reset()
+		frame.Write(header[:headerLength])
+		frame.Write(chunk)
+		if !c.isServer {
+			internal.MaskXOR(frame.Bytes()[headerLength:], maskBytes)
+		}
+		if err := internal.WriteN(c.conn, frame.Bytes()); err != nil || fin {
+			return err
+		}
+
+		// 在两帧之间写入等待中的控制帧. 关闭帧之后不能再写入数据.
+		c.writeControls(nil)
+		if c.isClosed() {
+			return ErrConnClosed
+		}
+	}
+}
+
+// 将n字节均分为count份
+func splitFragments(n int, count int) []int {
+	var sizes = make([]int, count)
+	for i := range sizes {
+		sizes[i] = n / count
+		if i < n%count {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// 等待写入的控制帧, 由自己的锁保护, 分片写入期间不需要写锁就能加入
+type controlSlot struct {
+	mu     sync.Mutex
+	active bool // 是否正在分片写入
+	frames []*controlFrame
+}
+
+type controlFrame struct {
+	opcode  Opcode
+	payload internal.Payload
+	done    chan error
+}
+
+// 加入控制帧, 返回是否正在分片写入
+func (c *controlSlot) push(frame *controlFrame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = append(c.frames, frame)
+	return c.active
+}
+
+func (c *controlSlot) take() []*controlFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var frames = c.frames
+	c.frames = nil
+	return frames
+}
+
+func (c *controlSlot) setActive(active bool) {
+	c.mu.Lock()
+	c.active = active
+	c.mu.Unlock()
+}
+
+// 合并写入的帧, 由写锁保护
+type writeBatch struct {
+	buffers   net.Buffers     // 待写入的切片
+	headers   []byte          // 直接引用载荷的帧的帧头
+	frames    []*bytes.Buffer // 写入之后归还到内存池
+	callbacks []func(error)   // 写入之后执行的回调
+	size      int             // 待写入的字节数
+	timer     *time.Timer     // 延迟写入的定时器
+	scheduled bool            // 是否已经安排了延迟写入
+}
+
+// 把消息加入合并写入的帧, 达到WriteFlushSize或者发送队列中没有更多消息时写入.
+// 设置了WriteFlushLatency时, 发送队列清空之后最多再等待这段时间.
+func (c *Conn) writeBatch(opcode Opcode, payload internal.Payload, opts WriteOptions, callback func(error)) {
+	// 大消息先写出已经合并的帧, 然后分片写入
+	if c.shouldFragment(opcode, payload) {
+		var err = c.doWriteFragmented(opcode, payload, opts)
+		c.emitError(err)
+		if callback != nil {
+			callback(err)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	c.commitBatch(c.appendFrame(opcode, payload, opts, callback), callback)
+}
+
+// 加入合并写入的帧之后调用, 调用者持有写锁, 返回时已经释放. 加入失败时直接执行回调.
+func (c *Conn) commitBatch(err error, callback func(error)) {
+	if err != nil {
+		c.mu.Unlock()
+		c.emitError(err)
+		if callback != nil {
+			callback(err)
+		}
+		return
+	}
+
+	var notify = func() {}
+	var idle = c.writeQueue.queued() == 0
+	if c.batch.size >= c.config.WriteFlushSize || (idle && c.config.WriteFlushLatency <= 0) {
+		notify, err = c.flushBatch()
+	} else if idle && !c.batch.scheduled {
+		c.batch.scheduled = true
+		if c.batch.timer == nil {
+			c.batch.timer = time.AfterFunc(c.config.WriteFlushLatency, c.flushLater)
+		} else {
+			c.batch.timer.Reset(c.config.WriteFlushLatency)
+		}
+	}
+	c.mu.Unlock()
+	c.emitError(err)
+	notify()
+}
+
+func (c *Conn) flushLater() {
+	c.mu.Lock()
+	c.batch.scheduled = false
+	notify, err := c.flushBatch()
+	c.mu.Unlock()
+	c.emitError(err)
+	notify()
+}
+
+// 生成帧并加入待写入的切片, 调用者持有写锁.
+// 未压缩且不需要掩码的载荷直接引用, 其他的帧和同步写入一样生成在缓冲区中.
+func (c *Conn) appendFrame(opcode Opcode, payload internal.Payload, opts WriteOptions, callback func(error)) error {
+	if opcode.isDataFrame() {
+		c.waitFragments()
+	}
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+	if err := c.checkPayload(opcode, payload); err != nil {
+		return err
+	}
+
+	opts.Compress = c.resolveCompressMode(opcode, payload.Len(), opts.Compress)
+	payload, rsv, err := c.encodeExtensions(opcode, payload, opts.Compress)
+	if err != nil {
+		return err
 	}
 
+	var b = &c.batch
 	var n = payload.Len()
+	var compressed = c.isCompressible(opcode, n, opts.Compress)
+
+	// 自定义拓展可能复用编码结果的内存, 不能直接引用
+	if c.isServer && !compressed && len(c.extensions) == 0 {
+		switch v := payload.(type) {
+		case internal.Bytes, internal.Buffers:
+			var header = frameHeader{}
+			headerLength, _ := header.GenerateHeader(true, true, false, opcode, n)
+			var m = len(b.headers)
+			b.headers = append(b.headers, header[:headerLength]...)
+			b.buffers = append(b.buffers, b.headers[m:m+headerLength:m+headerLength])
+			if p, ok := v.(internal.Bytes); ok {
+				b.buffers = append(b.buffers, p)
+			} else {
+				b.buffers = append(b.buffers, v.(internal.Buffers)...)
+			}
+			b.callbacks = append(b.callbacks, callback)
+			b.size += headerLength + n
+			return nil
+		}
+	}
+
+	frame, err := c.encodeFrame(opcode, payload, opts, false)
+	if err != nil {
+		return err
+	}
+	frame.Bytes()[0] |= rsv
+	b.frames = append(b.frames, frame)
+	b.buffers = append(b.buffers, frame.Bytes())
+	b.callbacks = append(b.callbacks, callback)
+	b.size += frame.Len()
+	if compressed {
+		_, _ = payload.WriteTo(&c.cpsWindow)
+		if c.sampler != nil {
+			c.sampler.Record(opcode, n, framePayloadLength(frame.Bytes()))
+		}
+	}
+	return nil
+}
+
+// 标准库只在这些连接上使用writev
+func isVectored(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
+
+// 写入合并的帧, 调用者持有写锁. 返回的函数执行回调, 需要在释放写锁之后调用.
+func (c *Conn) flushBatch() (func(), error) {
+	var b = &c.batch
+	if len(b.buffers) == 0 {
+		return func() {}, nil
+	}
+
+	var err error
+	if isVectored(c.conn) {
+		var buffers = b.buffers
+		_, err = buffers.WriteTo(c.conn)
+	} else {
+		// 其他连接上net.Buffers会逐个切片写入, TLS连接每个切片都会生成一条记录
+		var buf = binaryPool.Get(b.size)
+		for _, item := range b.buffers {
+			buf.Write(item)
+		}
+		err = internal.WriteN(c.conn, buf.Bytes())
+		binaryPool.Put(buf)
+	}
+	for i, frame := range b.frames {
+		binaryPool.Put(frame)
+		b.frames[i] = nil
+	}
+	for i := range b.buffers {
+		b.buffers[i] = nil
+	}
+	var callbacks = b.callbacks
+	b.buffers = b.buffers[:0]
+	b.frames = b.frames[:0]
+	b.headers = b.headers[:0]
+	b.callbacks = nil
+	b.size = 0
+
+	return func() {
+		for _, f := range callbacks {
+			if f != nil {
+				f(err)
+			}
+		}
+	}, err
+}
 
-	if n > c.config.WriteMaxPayloadSize {
-		return nil, internal.CloseMessageTooLarge
+// 开启自适应压缩时, 根据采样结果将Auto模式解析为确定的压缩策略
+func (c *Conn) resolveCompressMode(opcode Opcode, n int, mode CompressMode) CompressMode {
+	if c.sampler == nil || mode != CompressAuto || !c.isCompressible(opcode, n, mode) {
+		return mode
 	}
+	return internal.SelectValue(c.sampler.Allow(opcode), CompressAlways, CompressNever)
+}
+
+// 判断消息是否需要压缩
+func (c *Conn) isCompressible(opcode Opcode, n int, mode CompressMode) bool {
+	if !c.pd.Enabled || !opcode.isDataFrame() {
+		return false
+	}
+	switch mode {
+	case CompressNever:
+		return false
+	case CompressAlways:
+		return true
+	default:
+		return n >= c.pd.Threshold
+	}
+}
+
+// 检查消息的编码和长度
+func (c *Conn) checkPayload(opcode Opcode, payload internal.Payload) error {
+	if opcode == OpcodeText && !payload.CheckEncoding(c.config.CheckUtf8Enabled, uint8(opcode)) {
+		return internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+	}
+	if payload.Len() > c.config.WriteMaxPayloadSize {
+		return internal.CloseMessageTooLarge
+	}
+	return nil
+}
 
-	var buf = binaryPool.Get(n + frameHeaderSize)
-	buf.Write(framePadding[0:])
+// 帧生成
+func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, opts WriteOptions, isBroadcast bool) (*bytes.Buffer, error) {
+	if err := c.checkPayload(opcode, payload); err != nil {
+		return nil, err
+	}
+	return c.encodeFrame(opcode, payload, opts, isBroadcast)
+}
+
+// 生成帧, 调用者已经检查过载荷
+func (c *Conn) encodeFrame(opcode Opcode, payload internal.Payload, opts WriteOptions, isBroadcast bool) (*bytes.Buffer, error) {
+	var n = payload.Len()
 
-	if c.pd.Enabled && opcode.isDataFrame() && n >= c.pd.Threshold {
+	if c.isCompressible(opcode, n, opts.Compress) {
+		var buf = binaryPool.Get(n + frameHeaderSize)
+		buf.Write(framePadding[0:])
 		return c.compressData(buf, opcode, payload, isBroadcast)
 	}
 
+	var buf *bytes.Buffer
+	if p, ok := payload.(*encodedPayload); ok {
+		// 编解码器已经在预留了帧头的缓冲区中写入了内容
+		buf = p.take()
+	} else {
+		buf = binaryPool.Get(n + frameHeaderSize)
+		buf.Write(framePadding[0:])
+		_, _ = payload.WriteTo(buf)
+	}
+
 	var header = frameHeader{}
 	headerLength, maskBytes := header.GenerateHeader(c.isServer, true, false, opcode, n)
-	_, _ = payload.WriteTo(buf)
 	var contents = buf.Bytes()
 	if !c.isServer {
 		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
@@ -139,6 +723,23 @@ func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, isBroadcast boo
 	return buf, nil
 }
 
+// 帧的载荷长度, 不包括帧头
+func framePayloadLength(frame []byte) int {
+	var fh = frameHeader{}
+	copy(fh[:2], frame)
+	var headerLength = 2
+	switch fh.GetLengthCode() {
+	case 126:
+		headerLength += 2
+	case 127:
+		headerLength += 8
+	}
+	if fh.GetMask() {
+		headerLength += 4
+	}
+	return len(frame) - headerLength
+}
+
 func (c *Conn) compressData(buf *bytes.Buffer, opcode Opcode, payload internal.Payload, isBroadcast bool) (*bytes.Buffer, error) {
 	err := c.deflater.Compress(payload, buf, c.getCpsDict(isBroadcast))
 	if err != nil {
@@ -159,10 +760,20 @@ func (c *Conn) compressData(buf *bytes.Buffer, opcode Opcode, payload internal.P
 
 type (
 	Broadcaster struct {
-		opcode  Opcode
-		payload []byte
-		msgs    [2]*broadcastMessageWrapper
-		state   int64
+		opcode   Opcode
+		payload  []byte
+		opts     WriteOptions
+		mu       sync.Mutex
+		msgs     map[broadcastKey]*broadcastMessageWrapper
+		failures []BroadcastFailure
+		state    int64
+	}
+
+	// 广播帧的变体, 协商参数相同的连接共享同一帧
+	broadcastKey struct {
+		isServer   bool // 客户端的帧需要掩码
+		compressed bool // 是否压缩
+		windowBits int  // 压缩器的窗口大小, 帧不能引用超出对端窗口的内容
 	}
 
 	broadcastMessageWrapper struct {
@@ -170,60 +781,233 @@ type (
 		err   error
 		frame *bytes.Buffer
 	}
+
+	// BroadcastFailure 广播失败的连接和原因
+	// A connection the broadcast failed on, and the reason
+	BroadcastFailure struct {
+		Conn *Conn
+		Err  error
+	}
+
+	// BroadcastError 汇总广播失败的连接
+	// Aggregated connections the broadcast failed on
+	BroadcastError struct {
+		Failures []BroadcastFailure
+	}
 )
 
+func (c *BroadcastError) Error() string {
+	var msg = "gws: broadcast failed on " + strconv.Itoa(len(c.Failures)) + " connections"
+	if len(c.Failures) > 0 {
+		msg += ", first error: " + c.Failures[0].Err.Error()
+	}
+	return msg
+}
+
 // NewBroadcaster 创建广播器
 // 相比循环调用WriteAsync, Broadcaster只会压缩一次消息, 可以节省大量CPU开销.
 // Instead of calling WriteAsync in a loop, Broadcaster compresses the message only once, saving a lot of CPU overhead.
 func NewBroadcaster(opcode Opcode, payload []byte) *Broadcaster {
+	return NewBroadcasterOpts(opcode, payload, WriteOptions{})
+}
+
+// NewBroadcasterOpts 类似NewBroadcaster, 可以单独控制这条消息的压缩策略
+// Similar to NewBroadcaster, but the compression of this message can be controlled separately.
+func NewBroadcasterOpts(opcode Opcode, payload []byte, opts WriteOptions) *Broadcaster {
 	c := &Broadcaster{
 		opcode:  opcode,
 		payload: payload,
-		msgs:    [2]*broadcastMessageWrapper{{}, {}},
+		opts:    opts,
+		msgs:    make(map[broadcastKey]*broadcastMessageWrapper, 2),
 		state:   int64(math.MaxInt32),
 	}
 	return c
 }
 
-func (c *Broadcaster) writeFrame(socket *Conn, frame *bytes.Buffer) error {
+// 按照连接协商的参数获取帧, 每个变体只生成一次
+func (c *Broadcaster) variant(socket *Conn) (*broadcastMessageWrapper, broadcastKey) {
+	var key = broadcastKey{isServer: socket.isServer}
+	if socket.isCompressible(c.opcode, len(c.payload), c.opts.Compress) {
+		key.compressed = true
+		key.windowBits = internal.SelectValue(socket.isServer, socket.pd.ServerMaxWindowBits, socket.pd.ClientMaxWindowBits)
+	}
+
+	c.mu.Lock()
+	msg, ok := c.msgs[key]
+	if !ok {
+		msg = new(broadcastMessageWrapper)
+		c.msgs[key] = msg
+	}
+	c.mu.Unlock()
+
+	msg.once.Do(func() {
+		msg.frame, msg.err = socket.genFrame(c.opcode, internal.Bytes(c.payload), c.opts, true)
+	})
+	return msg, key
+}
+
+func (c *Broadcaster) writeFrame(socket *Conn, msg *broadcastMessageWrapper, key broadcastKey) error {
 	if socket.isClosed() {
 		return ErrConnClosed
 	}
 	socket.mu.Lock()
-	var err = internal.WriteN(socket.conn, frame.Bytes())
-	socket.cpsWindow.Write(c.payload)
+	if c.opcode.isDataFrame() {
+		socket.waitFragments()
+	}
+	notify, err := socket.flushBatch()
+	if err == nil {
+		err = internal.WriteN(socket.conn, msg.frame.Bytes())
+		if key.compressed {
+			socket.cpsWindow.Write(c.payload)
+		}
+	}
 	socket.mu.Unlock()
+	notify()
 	return err
 }
 
+// 开启合并写入时, 直接引用共享的帧, 写入之后执行回调
+func (c *Broadcaster) appendFrame(socket *Conn, msg *broadcastMessageWrapper, key broadcastKey, callback func(error)) {
+	socket.mu.Lock()
+	if c.opcode.isDataFrame() {
+		socket.waitFragments()
+	}
+	if socket.isClosed() {
+		socket.commitBatch(ErrConnClosed, callback)
+		return
+	}
+	var b = &socket.batch
+	b.buffers = append(b.buffers, msg.frame.Bytes())
+	b.callbacks = append(b.callbacks, callback)
+	b.size += msg.frame.Len()
+	if key.compressed {
+		socket.cpsWindow.Write(c.payload)
+	}
+	socket.commitBatch(nil, callback)
+}
+
+// 记录失败的连接
+func (c *Broadcaster) record(socket *Conn, err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	c.failures = append(c.failures, BroadcastFailure{Conn: socket, Err: err})
+	c.mu.Unlock()
+}
+
+func (c *Broadcaster) release() {
+	if atomic.AddInt64(&c.state, -1) == 0 {
+		c.doClose()
+	}
+}
+
 // Broadcast 广播
-// 向客户端发送广播消息
-// Send a broadcast message to a client.
+// 向客户端发送广播消息. 写入是异步的, 失败的连接通过Err汇总.
+// Send a broadcast message to a client. The write is asynchronous, failed connections are aggregated by Err.
 func (c *Broadcaster) Broadcast(socket *Conn) error {
-	var idx = internal.SelectValue(socket.pd.Enabled, 1, 0)
-	var msg = c.msgs[idx]
+	// 自定义拓展可能是有状态的, 不能共享同一帧
+	if len(socket.extensions) > 0 {
+		socket.WriteAsyncOpts(c.opcode, c.payload, c.opts, func(err error) { c.record(socket, err) })
+		return nil
+	}
 
-	msg.once.Do(func() {
-		msg.frame, msg.err = socket.genFrame(c.opcode, internal.Bytes(c.payload), true)
-	})
+	var msg, key = c.variant(socket)
 	if msg.err != nil {
 		return msg.err
 	}
 
 	atomic.AddInt64(&c.state, 1)
+	var callback = func(err error) {
+		c.record(socket, err)
+		c.release()
+	}
 	socket.writeQueue.Push(func() {
-		var err = c.writeFrame(socket, msg.frame)
-		socket.emitError(err)
-		if atomic.AddInt64(&c.state, -1) == 0 {
-			c.doClose()
+		if socket.config.WriteCoalesceEnabled {
+			c.appendFrame(socket, msg, key, callback)
+			return
 		}
+		var err = c.writeFrame(socket, msg, key)
+		socket.emitError(err)
+		callback(err)
 	})
 	return nil
 }
 
+// BroadcastAll 向多个连接广播并等待写入完成.
+// 连接被分成若干组, 每组在一个协程中依次同步写入, 协程数量不超过GOMAXPROCS. 写入失败的连接汇总在*BroadcastError中.
+// 同一组中阻塞的连接会延迟后面的连接, 建议设置写超时.
+// Broadcast to multiple connections and wait for the writes to complete.
+// Connections are split into shards and each shard is written synchronously in one goroutine,
+// there are at most GOMAXPROCS goroutines. Failed connections are aggregated in a *BroadcastError.
+// A blocking connection delays the following ones in its shard, setting write deadlines is recommended.
+func (c *Broadcaster) BroadcastAll(conns []*Conn) error {
+	if len(conns) == 0 {
+		return nil
+	}
+	var shards = internal.Min((len(conns)+defaultBroadcastShardSize-1)/defaultBroadcastShardSize, runtime.GOMAXPROCS(0))
+	var size = (len(conns) + shards - 1) / shards
+	var result = &BroadcastError{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	atomic.AddInt64(&c.state, 1)
+	defer c.release()
+	for i := 0; i < len(conns); i += size {
+		wg.Add(1)
+		go func(shard []*Conn) {
+			defer wg.Done()
+			for _, socket := range shard {
+				if err := c.writeTo(socket); err != nil {
+					mu.Lock()
+					result.Failures = append(result.Failures, BroadcastFailure{Conn: socket, Err: err})
+					mu.Unlock()
+				}
+			}
+		}(conns[i:internal.Min(i+size, len(conns))])
+	}
+	wg.Wait()
+
+	if len(result.Failures) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	c.failures = append(c.failures, result.Failures...)
+	c.mu.Unlock()
+	return result
+}
+
+// 同步写入一个连接
+func (c *Broadcaster) writeTo(socket *Conn) error {
+	if len(socket.extensions) > 0 {
+		return socket.WriteMessageOpts(c.opcode, c.payload, c.opts)
+	}
+	var msg, key = c.variant(socket)
+	if msg.err != nil {
+		return msg.err
+	}
+	var err = c.writeFrame(socket, msg, key)
+	socket.emitError(err)
+	return err
+}
+
+// Err 汇总Broadcast和BroadcastAll中写入失败的连接, 没有失败时返回nil. 异步写入的失败在写入完成之后才会出现.
+// Aggregated connections that failed in Broadcast and BroadcastAll, nil if there is none.
+// Failures of asynchronous writes appear after the writes complete.
+func (c *Broadcaster) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.failures) == 0 {
+		return nil
+	}
+	return &BroadcastError{Failures: append([]BroadcastFailure(nil), c.failures...)}
+}
+
 func (c *Broadcaster) doClose() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, item := range c.msgs {
-		if item != nil {
+		if item.frame != nil {
 			binaryPool.Put(item.frame)
 		}
 	}
@@ -7,7 +7,9 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -509,3 +511,502 @@ func TestConn_Async(t *testing.T) {
 	wg.Wait()
 	assert.True(t, internal.IsSameSlice(arr1, arr2))
 }
+
+func TestConn_WriteMessageOpts(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("never / always", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 512}}
+		var clientOption = &ClientOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 512}}
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+
+		var results = make(chan bool, 4)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			results <- message.compressed
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteMessageOpts(OpcodeText, internal.AlphabetNumeric.Generate(1024), WriteOptions{Compress: CompressNever}))
+		as.NoError(server.WriteMessageOpts(OpcodeText, internal.AlphabetNumeric.Generate(8), WriteOptions{Compress: CompressAlways}))
+		as.NoError(server.WriteMessageOpts(OpcodeText, internal.AlphabetNumeric.Generate(8), WriteOptions{}))
+		as.NoError(server.WriteMessageOpts(OpcodeText, internal.AlphabetNumeric.Generate(1024), WriteOptions{}))
+		wg.Wait()
+		as.Equal(false, <-results)
+		as.Equal(true, <-results)
+		as.Equal(false, <-results)
+		as.Equal(true, <-results)
+	})
+
+	t.Run("compression disabled", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.False(message.compressed)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		server.WriteAsyncOpts(OpcodeText, internal.AlphabetNumeric.Generate(8), WriteOptions{Compress: CompressAlways}, func(err error) {
+			as.NoError(err)
+		})
+		wg.Wait()
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var serverHandler = new(webSocketMocker)
+		var received = make(chan string, 8)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received <- message.Data.String()
+		}
+		var server = NewServer(serverHandler, &ServerOption{PermessageDeflate: PermessageDeflate{
+			Enabled:               true,
+			ServerContextTakeover: true,
+			ClientContextTakeover: true,
+		}})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr: "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{
+				Enabled:               true,
+				ServerContextTakeover: true,
+				ClientContextTakeover: true,
+			},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+
+		var messages = []string{"hello", "hello, world!", "hello, gws!", "hello, world!"}
+		for i, item := range messages {
+			var mode = internal.SelectValue(i%2 == 1, CompressNever, CompressAuto)
+			as.NoError(client.WriteMessageOpts(OpcodeText, []byte(item), WriteOptions{Compress: mode}))
+		}
+		as.Equal("hellohello, gws!", string(client.cpsWindow.dict))
+		for _, item := range messages {
+			as.Equal(item, <-received)
+		}
+	})
+
+	t.Run("broadcast", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+		var clientOption = &ClientOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.False(message.compressed)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var broadcaster = NewBroadcasterOpts(OpcodeText, internal.AlphabetNumeric.Generate(1024), WriteOptions{Compress: CompressNever})
+		as.NoError(broadcaster.Broadcast(server))
+		wg.Wait()
+		as.NoError(broadcaster.Close())
+	})
+}
+
+func TestConn_WriteCoalesce(t *testing.T) {
+	var pd = PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		Threshold:             64,
+	}
+
+	var newPair = func(serverOption *ServerOption, clientOption *ClientOption) (server, client *Conn, received chan *Message) {
+		received = make(chan *Message, 1024)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message }}
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+		server, client = newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		if serverOption.PermessageDeflate.Enabled {
+			client.dpsWindow.initialize(nil, server.pd.ServerMaxWindowBits)
+			client.cpsWindow.initialize(nil, server.pd.ClientMaxWindowBits)
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		return
+	}
+
+	t.Run("compression", func(t *testing.T) {
+		var as = assert.New(t)
+		var server, _, received = newPair(&ServerOption{PermessageDeflate: pd, WriteCoalesceEnabled: true}, &ClientOption{PermessageDeflate: pd})
+
+		// 压缩和不压缩的消息交错, 同步写入和合并写入交替进行, 压缩上下文保持一致
+		var expected []string
+		for i := 0; i < 200; i++ {
+			var item = string(internal.AlphabetNumeric.Generate(i%3*50 + 1))
+			expected = append(expected, item)
+			if i%10 == 9 {
+				as.NoError(server.WriteString(item))
+			} else {
+				server.WriteAsync(OpcodeText, []byte(item), nil)
+			}
+		}
+		var results = map[string]int{}
+		for range expected {
+			select {
+			case message := <-received:
+				results[message.Data.String()]++
+			case <-time.After(time.Second):
+				as.Fail("message is not received")
+				return
+			}
+		}
+		for _, item := range expected {
+			results[item]--
+		}
+		for _, n := range results {
+			as.Equal(0, n)
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		var as = assert.New(t)
+		var server, _, received = newPair(&ServerOption{
+			WriteCoalesceEnabled: true,
+			WriteFlushLatency:    100 * time.Millisecond,
+			WriteFlushSize:       1024,
+		}, nil)
+
+		var done = make(chan error, 4)
+		for _, item := range []string{"a", "b", "c"} {
+			server.WriteAsync(OpcodeText, []byte(item), func(err error) { done <- err })
+		}
+		select {
+		case <-received:
+			as.Fail("message is flushed before the latency")
+		case <-done:
+			as.Fail("callback runs before the message is written")
+		case <-time.After(50 * time.Millisecond):
+		}
+		for _, item := range []string{"a", "b", "c"} {
+			as.Equal(item, (<-received).Data.String())
+			as.NoError(<-done)
+		}
+
+		// 达到WriteFlushSize时立即写入
+		server.WriteAsync(OpcodeBinary, make([]byte, 2048), func(err error) { done <- err })
+		select {
+		case message := <-received:
+			as.Equal(2048, message.Data.Len())
+			as.NoError(<-done)
+		case <-time.After(50 * time.Millisecond):
+			as.Fail("message is not flushed at WriteFlushSize")
+		}
+	})
+
+	t.Run("wrapped conn", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan *Message, 8)
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message }}
+		for _, coalesce := range []bool{true, false} {
+			server, client := newPeer(new(webSocketMocker), &ServerOption{
+				WriteCoalesceEnabled: coalesce,
+				WriteFlushLatency:    50 * time.Millisecond,
+			}, clientHandler, nil)
+			var conn = &countingConn{Conn: server.conn}
+			server.conn = conn
+			go client.ReadLoop()
+
+			// 不支持writev的连接上, 合并的帧和多个切片都只写入一次
+			as.NoError(server.Writev(OpcodeText, []byte("he"), []byte("llo")))
+			as.Equal("hello", (<-received).Data.String())
+			as.Equal(int64(1), atomic.LoadInt64(&conn.writes))
+			if coalesce {
+				for _, item := range []string{"a", "b", "c"} {
+					server.WriteAsync(OpcodeText, []byte(item), nil)
+				}
+				for _, item := range []string{"a", "b", "c"} {
+					as.Equal(item, (<-received).Data.String())
+				}
+				as.Equal(int64(2), atomic.LoadInt64(&conn.writes))
+			}
+		}
+	})
+
+	t.Run("flush before sync write", func(t *testing.T) {
+		var as = assert.New(t)
+		var server, _, received = newPair(&ServerOption{WriteCoalesceEnabled: true, WriteFlushLatency: time.Second}, nil)
+		server.WriteAsync(OpcodeText, []byte("async"), nil)
+		time.Sleep(20 * time.Millisecond)
+		as.NoError(server.Writev(OpcodeText, []byte("sy"), []byte("nc")))
+		as.Equal("async", (<-received).Data.String())
+		as.Equal("sync", (<-received).Data.String())
+	})
+
+	t.Run("client", func(t *testing.T) {
+		var as = assert.New(t)
+		var _, client, received = newPair(&ServerOption{PermessageDeflate: pd}, &ClientOption{PermessageDeflate: pd, WriteCoalesceEnabled: true})
+		var wg = &sync.WaitGroup{}
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			client.WritevAsync(OpcodeBinary, [][]byte{[]byte("hello, "), []byte(strings.Repeat("world", i))}, func(err error) {
+				as.NoError(err)
+				wg.Done()
+			})
+		}
+		wg.Wait()
+		for i := 0; i < 100; i++ {
+			as.Equal("hello, "+strings.Repeat("world", i), (<-received).Data.String())
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var as = assert.New(t)
+		var server, _, _ = newPair(&ServerOption{WriteCoalesceEnabled: true, CheckUtf8Enabled: true}, nil)
+		var done = make(chan error, 2)
+		server.WriteAsync(OpcodeText, []byte{0xff}, func(err error) { done <- err })
+		as.Error(<-done)
+		server.WriteAsync(OpcodeText, []byte("closed"), func(err error) { done <- err })
+		as.ErrorIs(<-done, ErrConnClosed)
+	})
+}
+
+func TestBroadcaster_Variants(t *testing.T) {
+	var newSocket = func(pd PermessageDeflate, coalesce bool, received chan string) *Conn {
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message.Data.String() }}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{PermessageDeflate: pd, WriteCoalesceEnabled: coalesce}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		return server
+	}
+	var payload = strings.Repeat("hello, gws! ", 100)
+
+	t.Run("window bits", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan string, 8)
+		var sockets = []*Conn{
+			newSocket(PermessageDeflate{Enabled: true, ServerMaxWindowBits: 9, Threshold: 1}, false, received),
+			newSocket(PermessageDeflate{Enabled: true, ServerMaxWindowBits: 15, Threshold: 1}, false, received),
+			newSocket(PermessageDeflate{Enabled: true, ServerMaxWindowBits: 15, Threshold: 1}, true, received),
+			newSocket(PermessageDeflate{}, false, received),
+		}
+		var broadcaster = NewBroadcaster(OpcodeText, []byte(payload))
+		for _, socket := range sockets {
+			as.NoError(broadcaster.Broadcast(socket))
+		}
+		for range sockets {
+			as.Equal(payload, <-received)
+		}
+		as.NoError(broadcaster.Close())
+		as.NoError(broadcaster.Err())
+
+		// 窗口大小不同的连接不共享压缩帧
+		as.Equal(3, len(broadcaster.msgs))
+		as.Contains(broadcaster.msgs, broadcastKey{isServer: true, compressed: true, windowBits: 9})
+		as.Contains(broadcaster.msgs, broadcastKey{isServer: true, compressed: true, windowBits: 15})
+		as.Contains(broadcaster.msgs, broadcastKey{isServer: true})
+	})
+
+	t.Run("broadcast all", func(t *testing.T) {
+		var as = assert.New(t)
+		var count = 600
+		var received = make(chan string, count)
+		var sockets = make([]*Conn, 0, count)
+		var closed = map[*Conn]bool{}
+		for i := 0; i < count; i++ {
+			var pd = PermessageDeflate{Enabled: i%2 == 0, Threshold: 1}
+			var socket = newSocket(pd, i%3 == 0, received)
+			if i%100 == 0 {
+				socket.WriteClose(1000, nil)
+				closed[socket] = true
+			}
+			sockets = append(sockets, socket)
+		}
+
+		var broadcaster = NewBroadcaster(OpcodeText, []byte(payload))
+		var err = broadcaster.BroadcastAll(sockets)
+		var broadcastErr *BroadcastError
+		if as.True(errors.As(err, &broadcastErr)) {
+			as.Equal(len(closed), len(broadcastErr.Failures))
+			for _, item := range broadcastErr.Failures {
+				as.True(closed[item.Conn])
+				as.ErrorIs(item.Err, ErrConnClosed)
+			}
+		}
+		for i := 0; i < count-len(closed); i++ {
+			as.Equal(payload, <-received)
+		}
+		as.Equal(err.Error(), broadcaster.Err().Error())
+		as.NoError(broadcaster.Close())
+	})
+
+	t.Run("async failure", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan string, 2)
+		var socket = newSocket(PermessageDeflate{}, true, received)
+		var broadcaster = NewBroadcaster(OpcodeText, []byte(payload))
+		as.NoError(broadcaster.Broadcast(socket))
+		as.Equal(payload, <-received)
+
+		socket.WriteClose(1000, nil)
+		as.NoError(broadcaster.Broadcast(socket))
+		as.Eventually(func() bool { return broadcaster.Err() != nil }, time.Second, 5*time.Millisecond)
+		var broadcastErr *BroadcastError
+		if as.True(errors.As(broadcaster.Err(), &broadcastErr)) {
+			as.Equal(1, len(broadcastErr.Failures))
+			as.Equal(socket, broadcastErr.Failures[0].Conn)
+		}
+		as.NoError(broadcaster.Close())
+	})
+}
+
+func TestConn_WritePriority(t *testing.T) {
+	var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+
+	t.Run("fragment", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan *Message, 4)
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message }}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{WriteFragmentSize: 1024, PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var payload = internal.AlphabetNumeric.Generate(10 * 1024)
+		as.NoError(server.WriteMessageOpts(OpcodeBinary, payload, WriteOptions{Compress: CompressNever}))
+		var message = <-received
+		as.Equal(payload, message.Bytes())
+		as.Equal(10, len(message.fragments))
+
+		// 压缩之后再分片
+		as.NoError(server.WriteMessageOpts(OpcodeText, payload, WriteOptions{Compress: CompressAlways}))
+		message = <-received
+		as.Equal(payload, message.Bytes())
+		as.True(len(message.fragments) > 1)
+
+		// 不超过WriteFragmentSize的消息不分片
+		as.NoError(server.WriteString("hello"))
+		message = <-received
+		as.Equal("hello", message.Data.String())
+		as.Nil(message.fragments)
+	})
+
+	t.Run("fragment coalesced", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan *Message, 4)
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message }}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{WriteFragmentSize: 1024, WriteCoalesceEnabled: true}, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 合并写入时, 大消息同样分片, 并且排在之前合并的消息之后
+		var payload = internal.AlphabetNumeric.Generate(10 * 1024)
+		var done = make(chan error, 2)
+		server.WriteAsync(OpcodeText, []byte("small"), func(err error) { done <- err })
+		server.WritevAsync(OpcodeBinary, [][]byte{payload[:4096], payload[4096:]}, func(err error) { done <- err })
+		as.NoError(<-done)
+		as.NoError(<-done)
+		as.NoError(server.Writev(OpcodeBinary, payload[:4096], payload[4096:]))
+		as.Equal("small", (<-received).Data.String())
+		for i := 0; i < 2; i++ {
+			var message = <-received
+			as.Equal(payload, message.Bytes())
+			as.Equal(10, len(message.fragments))
+		}
+	})
+
+	t.Run("preempt", func(t *testing.T) {
+		var as = assert.New(t)
+		var pinged = make(chan bool, 2)
+		var received = make(chan *Message, 1)
+		var clientHandler = &webSocketMocker{
+			// 在分片消息的中间收到Ping
+			onPing:    func(socket *Conn, payload []byte) { pinged <- socket.continuationFrame.initialized },
+			onMessage: func(socket *Conn, message *Message) { received <- message },
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{WriteFragmentSize: 512}, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var payload = internal.AlphabetNumeric.Generate(8 * 1024 * 1024)
+		var done = make(chan error, 1)
+		server.WriteAsync(OpcodeBinary, payload, func(err error) { done <- err })
+		as.Eventually(func() bool {
+			server.controls.mu.Lock()
+			defer server.controls.mu.Unlock()
+			return server.controls.active
+		}, time.Second, 100*time.Microsecond)
+		server.WriteAsync(OpcodePing, []byte("ping"), nil)
+		as.True(<-pinged)
+
+		// 同步写入的控制帧也由分片写入者在两帧之间写出
+		as.NoError(server.WritePing([]byte("sync")))
+		as.True(<-pinged)
+		as.NoError(<-done)
+		as.Equal(len(payload), (<-received).Data.Len())
+	})
+
+	t.Run("lanes", func(t *testing.T) {
+		var as = assert.New(t)
+		var conn = &Conn{writeQueue: workerQueue{maxConcurrency: 1}, controlQueue: workerQueue{maxConcurrency: 1}}
+		var results = make(chan string, 8)
+		var block = make(chan struct{})
+		conn.pushWrite(OpcodeText, PriorityNormal, func() { <-block; results <- "bulk-0" })
+		conn.pushWrite(OpcodeText, PriorityNormal, func() { results <- "bulk-1" })
+		conn.pushWrite(OpcodeText, PriorityHigh, func() { results <- "high" })
+
+		// Ping和Pong不在数据的队列中排队, 关闭帧不能越过之前的数据
+		conn.pushWrite(OpcodeCloseConnection, PriorityNormal, func() { results <- "close" })
+		conn.pushWrite(OpcodePong, PriorityNormal, func() { results <- "pong" })
+		as.Equal("pong", <-results)
+		close(block)
+		as.Equal("bulk-0", <-results)
+		as.Equal("high", <-results)
+		as.Equal("bulk-1", <-results)
+		as.Equal("close", <-results)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		var as = assert.New(t)
+		var received = make(chan *Message, 8)
+		var clientHandler = &webSocketMocker{onMessage: func(socket *Conn, message *Message) { received <- message }}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{WriteFragmentSize: 256, WriteCoalesceEnabled: true}, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 其他数据帧不会插入到分片消息中间
+		var payload = internal.AlphabetNumeric.Generate(256 * 1024)
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		go func() { as.NoError(server.WriteMessage(OpcodeBinary, payload)); wg.Done() }()
+		go func() { as.NoError(server.WriteString("sync")); wg.Done() }()
+		server.WriteAsync(OpcodeText, []byte("async"), func(err error) { as.NoError(err); wg.Done() })
+		wg.Wait()
+
+		var results = map[string]bool{}
+		for i := 0; i < 3; i++ {
+			var message = <-received
+			results[internal.SelectValue(message.Data.Len() > 16, "big", message.Data.String())] = true
+		}
+		as.Equal(map[string]bool{"big": true, "sync": true, "async": true}, results)
+	})
+}
+
+// 统计写入次数的连接
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
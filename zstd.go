@@ -0,0 +1,205 @@
+package gws
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"runtime"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/marifcelik/gws/internal"
+)
+
+const (
+	permessageZstd       = "permessage-zstd"
+	zstdDictionaryID     = "dict_id"
+	zstdDictionaryMagic  = 0xEC30A437
+	defaultZstdLevel     = 1
+	zstdSessionBufferCap = 256 * 1024
+)
+
+// PermessageZstd 基于zstd的压缩拓展配置
+// 这是一个非标准拓展, 使用RSV1, 与permessage-deflate互斥; 对端没有请求时会回退到permessage-deflate.
+// 不支持上下文接管, 每条消息单独压缩, 可以配合预置字典提高小消息的压缩率.
+// 字典无效时, NewServer和NewUpgrader会panic, NewClient返回错误.
+// Zstd based compression extension.
+// It's non-standard, owns RSV1 and is exclusive with permessage-deflate, falling back to it when the peer doesn't offer zstd.
+// There is no context takeover, every message is compressed on its own, use a preset dictionary to compress small messages.
+// With an invalid dictionary NewServer and NewUpgrader panic, NewClient returns the error.
+type PermessageZstd struct {
+	// 是否开启压缩
+	// Whether to turn on compression
+	Enabled bool
+
+	// 压缩级别, 与zstd命令行的级别一致, 默认为1
+	// Compress level, the same as the zstd command line, default 1.
+	Level int
+
+	// 压缩阈值, 长度小于阈值的消息不会被压缩
+	// Compression threshold, messages below the threshold will not be compressed.
+	Threshold int
+
+	// 预置字典, 需要通过带外的方式分发, 两端必须完全一致.
+	// 可以是`zstd --train`生成的字典, 也可以是任意的样本内容.
+	// Preset dictionary distributed out-of-band, it must be identical on both ends.
+	// Either a dictionary produced by `zstd --train` or arbitrary sample content.
+	Dictionary []byte
+}
+
+// 字典ID, 用于握手时确认两端的字典一致
+func (c *PermessageZstd) dictionaryID() uint32 {
+	if len(c.Dictionary) == 0 {
+		return 0
+	}
+	if len(c.Dictionary) >= 8 && binary.LittleEndian.Uint32(c.Dictionary[:4]) == zstdDictionaryMagic {
+		return binary.LittleEndian.Uint32(c.Dictionary[4:8])
+	}
+	return internal.SelectValue(crc32.ChecksumIEEE(c.Dictionary) == 0, 1, crc32.ChecksumIEEE(c.Dictionary))
+}
+
+func (c *PermessageZstd) setDefault() {
+	if c.Level <= 0 {
+		c.Level = defaultZstdLevel
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = defaultCompressThreshold
+	}
+}
+
+// zstdExtension 编码器和解码器都是并发安全的.
+// 服务端所有连接共享同一个实例, 两者内部各有GOMAXPROCS个实例, EncodeAll和DecodeAll可以并行执行;
+// 客户端每次握手单独创建并发度为1的实例, 属于协商成功的连接, 连接关闭时释放.
+type zstdExtension struct {
+	option    PermessageZstd
+	dictID    uint32
+	shared    bool // 是否由所有连接共享
+	confirmed bool // 客户端握手是否协商成功
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+func newZstdExtension(option PermessageZstd, readLimit int, shared bool) (*zstdExtension, error) {
+	var c = &zstdExtension{option: option, dictID: option.dictionaryID(), shared: shared}
+	var concurrency = internal.SelectValue(shared, runtime.GOMAXPROCS(0), 1)
+	var encoderOptions = []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(option.Level)),
+		zstd.WithEncoderConcurrency(concurrency),
+		zstd.WithEncoderCRC(false),
+	}
+	var decoderOptions = []zstd.DOption{
+		zstd.WithDecoderConcurrency(concurrency),
+		zstd.WithDecoderMaxMemory(uint64(readLimit)),
+	}
+	if c.dictID != 0 {
+		if binary.LittleEndian.Uint32(option.Dictionary[:4]) == zstdDictionaryMagic {
+			encoderOptions = append(encoderOptions, zstd.WithEncoderDict(option.Dictionary))
+			decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(option.Dictionary))
+		} else {
+			encoderOptions = append(encoderOptions, zstd.WithEncoderDictRaw(c.dictID, option.Dictionary))
+			decoderOptions = append(decoderOptions, zstd.WithDecoderDictRaw(c.dictID, option.Dictionary))
+		}
+	}
+
+	var err error
+	if c.encoder, err = zstd.NewWriter(nil, encoderOptions...); err != nil {
+		return nil, err
+	}
+	if c.decoder, err = zstd.NewReader(nil, decoderOptions...); err != nil {
+		_ = c.encoder.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 释放编码器和解码器, 共享的实例不会被释放
+func (c *zstdExtension) close() {
+	if c.shared {
+		return
+	}
+	_ = c.encoder.Close()
+	c.decoder.Close()
+}
+
+func (c *zstdExtension) Name() string { return permessageZstd }
+
+func (c *zstdExtension) RSV() uint8 { return RSV1 }
+
+func (c *zstdExtension) Offer() ExtensionParams {
+	var params = ExtensionParams{Name: permessageZstd}
+	if c.dictID != 0 {
+		params = params.With(zstdDictionaryID, strconv.FormatUint(uint64(c.dictID), 10))
+	}
+	return params
+}
+
+// 字典必须一致
+func (c *zstdExtension) checkDictionary(params ExtensionParams) error {
+	var expected = internal.SelectValue(c.dictID == 0, "", strconv.FormatUint(uint64(c.dictID), 10))
+	if v, _ := params.Get(zstdDictionaryID); v != expected {
+		return ErrCompressionNegotiation
+	}
+	return nil
+}
+
+func (c *zstdExtension) Accept(offer ExtensionParams) (ExtensionParams, ExtensionSession, error) {
+	if err := c.checkDictionary(offer); err != nil {
+		return ExtensionParams{}, nil, err
+	}
+	return c.Offer(), &zstdSession{ext: c}, nil
+}
+
+func (c *zstdExtension) Confirm(response ExtensionParams) (ExtensionSession, error) {
+	if err := c.checkDictionary(response); err != nil {
+		return nil, err
+	}
+	c.confirmed = true
+	return &zstdSession{ext: c}, nil
+}
+
+// zstdSession 复用压缩和解压的缓冲区, 连接会在下次调用前拷贝结果
+type zstdSession struct {
+	ext    *zstdExtension
+	encBuf []byte
+	decBuf []byte
+}
+
+func (c *zstdSession) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	return c.EncodeMode(opcode, payload, CompressAuto)
+}
+
+// EncodeMode 与permessage-deflate一致: CompressNever不压缩, CompressAlways忽略压缩阈值
+func (c *zstdSession) EncodeMode(opcode Opcode, payload []byte, mode CompressMode) ([]byte, bool, error) {
+	switch mode {
+	case CompressNever:
+		return payload, false, nil
+	case CompressAuto:
+		if len(payload) < c.ext.option.Threshold {
+			return payload, false, nil
+		}
+	}
+	c.encBuf = c.ext.encoder.EncodeAll(payload, c.encBuf[:0])
+	var result = c.encBuf
+	if cap(c.encBuf) > zstdSessionBufferCap {
+		c.encBuf = nil
+	}
+	return result, true, nil
+}
+
+// 连接关闭时释放客户端独占的编码器和解码器
+func (c *zstdSession) release() { c.ext.close() }
+
+func (c *zstdSession) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if !rsv {
+		return payload, nil
+	}
+	result, err := c.ext.decoder.DecodeAll(payload, c.decBuf[:0])
+	if err != nil {
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, internal.CloseMessageTooLarge
+		}
+		return nil, err
+	}
+	c.decBuf = internal.SelectValue(cap(result) > zstdSessionBufferCap, nil, result)
+	return result, nil
+}
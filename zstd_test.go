@@ -0,0 +1,205 @@
+package gws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/marifcelik/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermessageZstd(t *testing.T) {
+	var as = assert.New(t)
+	var dictionary = bytes.Repeat([]byte(`{"jsonrpc":"2.0","method":"subscribe","params":{"channel":"ticker"}}`), 4)
+
+	var echo = func(zstdOption PermessageZstd) string {
+		var addr = ":" + nextPort()
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		var server = NewServer(serverHandler, &ServerOption{
+			CheckUtf8Enabled:  true,
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			PermessageZstd:    zstdOption,
+		})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+		return addr
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		var addr = echo(PermessageZstd{Enabled: true, Threshold: 1, Dictionary: dictionary})
+		var received = make(chan *Message, 4)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+		client, resp, err := NewClient(clientHandler, &ClientOption{
+			Addr:              "ws://localhost" + addr,
+			CheckUtf8Enabled:  true,
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			PermessageZstd:    PermessageZstd{Enabled: true, Threshold: 1, Dictionary: dictionary},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		var params = ParseExtensions(resp.Header.Get(internal.SecWebSocketExtensions.Key))
+		as.Equal(1, len(params))
+		as.Equal(permessageZstd, params[0].Name)
+		as.False(client.pd.Enabled)
+		as.Equal(RSV1, client.getRSV())
+		go client.ReadLoop()
+
+		var payload = []byte(`{"jsonrpc":"2.0","method":"subscribe","params":{"channel":"orders"}}`)
+		as.NoError(client.WriteMessage(OpcodeText, payload))
+		var msg = <-received
+		as.Equal(string(payload), msg.Data.String())
+		as.Equal(RSV1, msg.rsv)
+
+		var large = internal.AlphabetNumeric.Generate(512 * 1024)
+		as.NoError(client.WriteMessage(OpcodeBinary, large))
+		as.Equal(large, (<-received).Bytes())
+	})
+
+	t.Run("fallback to deflate", func(t *testing.T) {
+		var addr = echo(PermessageZstd{})
+		client, resp, err := NewClient(new(webSocketMocker), &ClientOption{
+			Addr:              "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			PermessageZstd:    PermessageZstd{Enabled: true},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		var params = ParseExtensions(resp.Header.Get(internal.SecWebSocketExtensions.Key))
+		as.Equal(1, len(params))
+		as.Equal("permessage-deflate", params[0].Name)
+		as.True(client.pd.Enabled)
+		_ = client.NetConn().Close()
+	})
+
+	t.Run("dictionary mismatch", func(t *testing.T) {
+		var addr = echo(PermessageZstd{Enabled: true, Dictionary: dictionary})
+		client, resp, err := NewClient(new(webSocketMocker), &ClientOption{
+			Addr:              "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			PermessageZstd:    PermessageZstd{Enabled: true, Dictionary: []byte("another dictionary")},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		var params = ParseExtensions(resp.Header.Get(internal.SecWebSocketExtensions.Key))
+		as.Equal(1, len(params))
+		as.True(client.pd.Enabled)
+		_ = client.NetConn().Close()
+	})
+
+	t.Run("session", func(t *testing.T) {
+		var option = PermessageZstd{Enabled: true, Dictionary: dictionary}
+		option.setDefault()
+		ext, err := newZstdExtension(option, 1024, true)
+		if !as.NoError(err) {
+			return
+		}
+		_, session, err := ext.Accept(ext.Offer())
+		as.NoError(err)
+
+		var small = []byte("ping")
+		result, compressed, _ := session.Encode(OpcodeText, small)
+		as.False(compressed)
+		as.Equal(small, result)
+
+		var payload = bytes.Repeat([]byte("hello"), 200)
+		result, compressed, _ = session.Encode(OpcodeText, payload)
+		as.True(compressed)
+		as.Less(len(result), len(payload))
+		decoded, err := session.Decode(OpcodeText, true, append([]byte{}, result...))
+		as.NoError(err)
+		as.Equal(payload, decoded)
+
+		result, _, _ = session.Encode(OpcodeText, bytes.Repeat([]byte("hello"), 1024))
+		_, err = session.Decode(OpcodeText, true, append([]byte{}, result...))
+		as.ErrorIs(err, internal.CloseMessageTooLarge)
+
+		_, _, err = ext.Accept(ExtensionParams{Name: permessageZstd})
+		as.ErrorIs(err, ErrCompressionNegotiation)
+	})
+
+	t.Run("compress mode", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var received = make(chan uint8, 8)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- message.rsv }
+		var server = NewServer(serverHandler, &ServerOption{PermessageZstd: PermessageZstd{Enabled: true, Threshold: 64}})
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		client, _, err := NewClient(new(webSocketMocker), &ClientOption{
+			Addr:           "ws://localhost" + addr,
+			PermessageZstd: PermessageZstd{Enabled: true, Threshold: 64},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+
+		// 与permessage-deflate一致, 单条消息的压缩策略优先于压缩阈值
+		var large = bytes.Repeat([]byte("hello"), 100)
+		var small = []byte("hello")
+		var cases = []struct {
+			payload []byte
+			mode    CompressMode
+			rsv     uint8
+		}{
+			{large, CompressAuto, RSV1},
+			{large, CompressNever, 0},
+			{small, CompressAuto, 0},
+			{small, CompressAlways, RSV1},
+		}
+		for _, item := range cases {
+			as.NoError(client.WriteMessageOpts(OpcodeBinary, item.payload, WriteOptions{Compress: item.mode}))
+			as.Equal(item.rsv, <-received)
+		}
+		client.WriteAsyncOpts(OpcodeBinary, large, WriteOptions{Compress: CompressNever}, nil)
+		as.Equal(uint8(0), <-received)
+		_ = client.NetConn().Close()
+	})
+
+	t.Run("client release", func(t *testing.T) {
+		var addr = echo(PermessageZstd{Enabled: true})
+		var closed = make(chan struct{})
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) { close(closed) }
+		client, _, err := NewClient(clientHandler, &ClientOption{
+			Addr:           "ws://localhost" + addr,
+			PermessageZstd: PermessageZstd{Enabled: true},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+
+		// 客户端的编解码器属于连接, 关闭之后释放
+		var ext = client.extensions[0].session.(*zstdSession).ext
+		as.False(ext.shared)
+		_, err = ext.decoder.DecodeAll(nil, nil)
+		as.NoError(err)
+		client.WriteClose(1000, nil)
+		<-closed
+		_, err = ext.decoder.DecodeAll(nil, nil)
+		as.ErrorIs(err, zstd.ErrDecoderClosed)
+	})
+
+	t.Run("invalid dictionary", func(t *testing.T) {
+		var dict = make([]byte, 8)
+		binary.LittleEndian.PutUint32(dict, zstdDictionaryMagic)
+		binary.LittleEndian.PutUint32(dict[4:], 1)
+		as.Panics(func() {
+			NewUpgrader(new(webSocketMocker), &ServerOption{PermessageZstd: PermessageZstd{Enabled: true, Dictionary: dict}})
+		})
+		_, _, err := NewClient(new(webSocketMocker), &ClientOption{PermessageZstd: PermessageZstd{Enabled: true, Dictionary: dict}})
+		as.Error(err)
+	})
+}